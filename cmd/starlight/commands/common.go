@@ -9,12 +9,12 @@ import (
 )
 
 func GetClient() (*rpc.Client, error) {
-	iden, err := GetIdentity()
+	id, err := GetId()
 	if err != nil {
 		return nil, err
 	}
 
-	address := local.GetAddress(iden.Id)
+	address := local.GetAddress(id)
 	return local.Dial(address)
 }
 
@@ -23,7 +23,33 @@ func GetConfig() (*config.Config, error) {
 	return config.Get(path)
 }
 
+// GetIdentity loads the local identity asking for the passphrase if the
+// identity is encrypted.
 func GetIdentity() (*node.Identity, error) {
 	path := config.GetConfigDirPath()
-	return node.LoadLocalIdentity(path)
+	passphrase, err := getIdentityPassphrase(path)
+	if err != nil {
+		return nil, err
+	}
+	return node.LoadLocalIdentityWithPassphrase(path, passphrase)
+}
+
+// GetId loads the id of the local identity which doesn't require the
+// passphrase.
+func GetId() (node.ID, error) {
+	path := config.GetConfigDirPath()
+	return node.LoadLocalId(path)
+}
+
+// getIdentityPassphrase returns the passphrase if the identity stored in the
+// directory is encrypted.
+func getIdentityPassphrase(directory string) ([]byte, error) {
+	encrypted, err := node.IsLocalIdentityEncrypted(directory)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return nil, nil
+	}
+	return GetPassphrase()
 }
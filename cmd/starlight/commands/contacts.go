@@ -0,0 +1,232 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/config"
+	"github.com/boreq/starlight/core/contacts"
+	"github.com/boreq/starlight/irc"
+	"github.com/boreq/starlight/irc/humanizer"
+	"github.com/boreq/starlight/local/backend"
+	"github.com/boreq/starlight/network/node"
+	"github.com/pkg/errors"
+)
+
+var contactsCmd = guinea.Command{
+	Run: runContacts,
+	Subcommands: map[string]*guinea.Command{
+		"verify":      &contactsVerifyCmd,
+		"remove":      &contactsRemoveCmd,
+		"fingerprint": &contactsFingerprintCmd,
+	},
+	ShortDescription: "manages verified contacts",
+	Description: `
+Anybody can pick any nick so a nick doesn't prove that a node belongs to your
+colleague. Compare the fingerprint of their id displayed by the fingerprint
+command with the fingerprint displayed on their machine, for example in person
+or during a call, and mark the id as verified using the verify command.
+
+You can vouch for the verified contacts. The ids of the contacts you vouch for
+are published in the DHT in a trust list signed with your key. Other users who
+verified your id will see the contacts you vouch for as trusted, the nodes
+trusted by those contacts are trusted at a lower level and so on.
+
+The trust levels are displayed in the hosts of the users on IRC and by the
+WHOIS command. The verified contacts are marked as 'verified', the nodes
+trusted by them as 'trusted1' and so on. The fingerprint of an id is the part
+of the host displayed on IRC which precedes the trust level.
+
+This command lists the verified contacts.`,
+}
+
+func runContacts(c guinea.Context) error {
+	list, err := contacts.Load(config.GetConfigDirPath())
+	if err != nil {
+		return err
+	}
+	for _, contact := range list {
+		fmt.Printf("%s %q verified on %s", contact.Id, contact.Name, contact.Verified.Format(time.RFC3339))
+		if contact.Vouch {
+			fmt.Print(" vouched")
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+var contactsVerifyCmd = guinea.Command{
+	Options: []guinea.Option{
+		{
+			Name:        "n",
+			Type:        guinea.String,
+			Description: "Name of the contact",
+		},
+		{
+			Name:        "vouch",
+			Type:        guinea.Bool,
+			Description: "Publish a trust list which includes this contact",
+		},
+	},
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Multiple:    false,
+			Description: "id of the contact",
+		},
+	},
+	Run:              runContactsVerify,
+	ShortDescription: "marks an id as verified",
+	Description: `
+Marks an id as verified after its fingerprint was compared using the
+fingerprint command. Verifying an id which is already a contact replaces its
+name and the '-vouch' setting.`,
+}
+
+func runContactsVerify(c guinea.Context) error {
+	id, err := node.NewId(c.Arguments[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid id")
+	}
+	if !node.ValidateId(id) {
+		return errors.New("invalid id")
+	}
+	if localId, err := GetId(); err == nil && node.CompareId(id, localId) {
+		return errors.New("you can't verify your own id")
+	}
+	list, err := contacts.Load(config.GetConfigDirPath())
+	if err != nil {
+		return err
+	}
+
+	contact := contacts.Contact{
+		Id:       id,
+		Name:     c.Options["n"].Str(),
+		Verified: time.Now(),
+		Vouch:    c.Options["vouch"].Bool(),
+	}
+	list = removeContact(list, id)
+	list = append(list, contact)
+
+	fingerprint, err := getFingerprint(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified %s with fingerprint %s\n", id, fingerprint)
+	return saveContacts(list)
+}
+
+var contactsRemoveCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Multiple:    false,
+			Description: "id of the contact",
+		},
+	},
+	Run:              runContactsRemove,
+	ShortDescription: "removes a contact",
+	Description: `
+Removes a contact. If you vouched for the contact an updated trust list is
+published.`,
+}
+
+func runContactsRemove(c guinea.Context) error {
+	id, err := node.NewId(c.Arguments[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid id")
+	}
+	list, err := contacts.Load(config.GetConfigDirPath())
+	if err != nil {
+		return err
+	}
+	updated := removeContact(list, id)
+	if len(updated) == len(list) {
+		return errors.New("contact not found")
+	}
+	return saveContacts(updated)
+}
+
+var contactsFingerprintCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Optional:    true,
+			Multiple:    false,
+			Description: "id of the node, defaults to your id",
+		},
+	},
+	Run:              runContactsFingerprint,
+	ShortDescription: "displays the fingerprint of an id",
+	Description: `
+Displays the fingerprint of an id which is easier to compare than the id
+itself. Ask your contact to display the fingerprint of their id and confirm
+that it matches the fingerprint of the id you are verifying.`,
+}
+
+func runContactsFingerprint(c guinea.Context) error {
+	var id node.ID
+	var err error
+	if len(c.Arguments) > 0 {
+		id, err = node.NewId(c.Arguments[0])
+		if err != nil {
+			return errors.Wrap(err, "invalid id")
+		}
+	} else {
+		id, err = GetId()
+		if err != nil {
+			return err
+		}
+	}
+	fingerprint, err := getFingerprint(id)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fingerprint)
+	return nil
+}
+
+// getFingerprint returns the host displayed on IRC without the trust levels.
+func getFingerprint(id node.ID) (string, error) {
+	dictionary, err := irc.LoadDictionary()
+	if err != nil {
+		return "", err
+	}
+	host, err := humanizer.NewHostFunc(dictionary)
+	if err != nil {
+		return "", err
+	}
+	return host(id)
+}
+
+func removeContact(list []contacts.Contact, id node.ID) []contacts.Contact {
+	var rv []contacts.Contact
+	for _, contact := range list {
+		if !node.CompareId(contact.Id, id) {
+			rv = append(rv, contact)
+		}
+	}
+	return rv
+}
+
+// saveContacts saves the contacts and passes them to the daemon if it is
+// running.
+func saveContacts(list []contacts.Contact) error {
+	if err := contacts.Save(config.GetConfigDirPath(), list); err != nil {
+		return errors.Wrap(err, "could not save the contacts")
+	}
+
+	client, err := GetClient()
+	if err != nil {
+		fmt.Println("the contacts will be loaded when the daemon starts")
+		return nil
+	}
+	args := &backend.SetContactsArgs{Contacts: list}
+	if err := client.Call("Backend.SetContacts", args, &struct{}{}); err != nil {
+		fmt.Printf("the trust list will be published later: %s\n", err)
+		return nil
+	}
+	fmt.Println("the contacts were updated")
+	return nil
+}
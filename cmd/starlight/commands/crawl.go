@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/local/backend"
+	"github.com/pkg/errors"
+)
+
+var crawlCmd = guinea.Command{
+	Options: []guinea.Option{
+		{
+			Name:        "format",
+			Type:        guinea.String,
+			Default:     "json",
+			Description: "Output format: json or dot",
+		},
+		{
+			Name:        "timeout",
+			Type:        guinea.Int,
+			Default:     300,
+			Description: "Crawl timeout in seconds",
+		},
+	},
+	Run:              runCrawl,
+	ShortDescription: "maps the network",
+	Description: `
+Walks the DHT starting from the local routing table and displays all nodes that
+could be found together with the addresses advertised for them, their
+reachability and the versions they reported. The output can be printed as JSON
+or in the Graphviz dot format.`,
+}
+
+func runCrawl(c guinea.Context) error {
+	format := c.Options["format"].Str()
+	if format != "json" && format != "dot" {
+		return errors.Errorf("unknown format %s", format)
+	}
+
+	client, err := GetClient()
+	if err != nil {
+		return err
+	}
+
+	args := &backend.CrawlArgs{Timeout: c.Options["timeout"].Int()}
+	var nodes []backend.CrawlNode
+	if err := client.Call("Backend.Crawl", args, &nodes); err != nil {
+		return err
+	}
+
+	if format == "dot" {
+		printDot(nodes)
+		return nil
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(nodes)
+}
+
+func printDot(nodes []backend.CrawlNode) {
+	fmt.Println("digraph starlight {")
+	for _, n := range nodes {
+		style := "solid"
+		if !n.Reachable {
+			style = "dashed"
+		}
+		fmt.Printf("\t\"%s\" [label=\"%.8s\\n%s\", style=%s];\n", n.Id, n.Id, n.Version, style)
+	}
+	for _, n := range nodes {
+		for _, neighbour := range n.Neighbours {
+			fmt.Printf("\t\"%s\" -> \"%s\";\n", n.Id, neighbour)
+		}
+	}
+	fmt.Println("}")
+}
@@ -1,14 +1,19 @@
 package commands
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/config"
 	"github.com/boreq/starlight/core"
+	"github.com/boreq/starlight/core/contacts"
 	"github.com/boreq/starlight/core/dht"
 	"github.com/boreq/starlight/irc"
 	"github.com/boreq/starlight/local"
 	"github.com/boreq/starlight/network"
+	"github.com/boreq/starlight/network/node"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -16,6 +21,11 @@ import (
 var daemonCmd = guinea.Command{
 	Run:              daemon,
 	ShortDescription: "runs a daemon",
+	Description: `
+Runs a daemon. If your identity is encrypted you will be prompted for the
+passphrase unless it is provided using the STARLIGHT_PASSPHRASE environment
+variable or stored in a file specified using the STARLIGHT_PASSPHRASE_FILE
+environment variable.`,
 }
 
 func daemon(c guinea.Context) error {
@@ -32,10 +42,30 @@ func daemon(c guinea.Context) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var idleTimeout time.Duration
+	if conf.IdleTimeout != "" {
+		idleTimeout, err = time.ParseDuration(conf.IdleTimeout)
+		if err != nil {
+			return errors.Wrap(err, "invalid idle timeout")
+		}
+	}
+
 	// Connect to the wired
-	net := network.New(ctx, *iden, conf.ListenAddress)
+	netConf := network.Config{
+		ListenAddresses:     conf.ListenAddresses,
+		AdvertisedAddresses: conf.AdvertisedAddresses,
+		ProxyAddress:        conf.ProxyAddress,
+		LocalDiscovery:      conf.LocalDiscovery,
+		LowWatermark:        conf.LowWatermark,
+		HighWatermark:       conf.HighWatermark,
+		IdleTimeout:         idleTimeout,
+	}
+	net, err := network.New(ctx, *iden, netConf)
+	if err != nil {
+		return errors.Wrap(err, "could not create the network")
+	}
 	dht := dht.New(ctx, net, *iden)
-	core := core.NewCore(ctx, *iden, conf, dht)
+	core := core.NewCore(ctx, *iden, conf, net, dht)
 
 	err = net.Listen()
 	if err != nil {
@@ -47,6 +77,42 @@ func daemon(c guinea.Context) error {
 		return err
 	}
 
+	// Publish the revocations issued using the identity revoke command.
+	revocations, err := node.LoadLocalRevocations(config.GetConfigDirPath())
+	if err != nil {
+		return errors.Wrap(err, "could not load the revocations")
+	}
+	for _, r := range revocations {
+		// Failed revocations are republished during the bootstrap.
+		if err := dht.PutRevocation(ctx, r); err != nil {
+			fmt.Fprintf(os.Stderr, "could not publish a revocation: %s\n", err)
+		}
+	}
+
+	// Publish the device list created using the identity master command.
+	deviceList, err := node.LoadLocalDeviceList(config.GetConfigDirPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not load the device list")
+	}
+	if deviceList != nil {
+		// A failed publication is repeated during the bootstrap.
+		if err := core.SetDeviceList(ctx, deviceList); err != nil {
+			fmt.Fprintf(os.Stderr, "could not set the device list: %s\n", err)
+		}
+	}
+
+	// Load the contacts verified using the contacts command.
+	verified, err := contacts.Load(config.GetConfigDirPath())
+	if err != nil {
+		return errors.Wrap(err, "could not load the contacts")
+	}
+	if len(verified) > 0 {
+		// A failed publication is repeated during the bootstrap.
+		if err := core.SetContacts(ctx, verified); err != nil {
+			fmt.Fprintf(os.Stderr, "could not set the contacts: %s\n", err)
+		}
+	}
+
 	// Run the local API server
 	address := local.GetAddress(iden.Id)
 	err = os.Remove(address)
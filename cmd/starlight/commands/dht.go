@@ -0,0 +1,171 @@
+package commands
+
+import (
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/local/backend"
+)
+
+var dhtCmd = guinea.Command{
+	Run: func(c guinea.Context) error {
+		return guinea.ErrInvalidParms
+	},
+	Subcommands: map[string]*guinea.Command{
+		"table":   &dhtTableCmd,
+		"lookup":  &dhtLookupCmd,
+		"get-key": &dhtGetKeyCmd,
+		"channel": &dhtChannelCmd,
+	},
+	ShortDescription: "inspects the DHT",
+	Description: `
+Displays the state of the DHT of the running daemon and performs DHT
+procedures. Useful when debugging routing problems.`,
+}
+
+var dhtTableCmd = guinea.Command{
+	Run:              runDhtTable,
+	ShortDescription: "dumps the routing table",
+	Description: `
+Displays the contents of all buckets and their replacement caches together with
+the time which elapsed since each node was last seen.`,
+}
+
+func runDhtTable(c guinea.Context) error {
+	client, err := GetClient()
+	if err != nil {
+		return err
+	}
+
+	var buckets []backend.DhtBucket
+	if err := client.Call("Backend.DhtTable", &struct{}{}, &buckets); err != nil {
+		return err
+	}
+
+	for i, bucket := range buckets {
+		lastLookup := "never"
+		if bucket.LastLookup != nil {
+			lastLookup = formatAge(*bucket.LastLookup)
+		}
+		fmt.Printf("bucket %d (last lookup: %s)\n", i, lastLookup)
+		printDhtEntries("entry", bucket.Entries)
+		printDhtEntries("cache", bucket.Cache)
+	}
+	return nil
+}
+
+func printDhtEntries(kind string, entries []backend.DhtEntry) {
+	for _, entry := range entries {
+		stale := ""
+		if entry.Stale {
+			stale = " stale"
+		}
+		fmt.Printf("  %s %s %s %s%s\n", kind, entry.Id, strings.Join(entry.Addresses, ","), formatAge(entry.LastSeen), stale)
+	}
+}
+
+func formatAge(t time.Time) string {
+	return fmt.Sprintf("%s ago", time.Since(t).Truncate(time.Second))
+}
+
+var dhtLookupCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Multiple:    false,
+			Description: "id to look up",
+		},
+	},
+	Run:              runDhtLookup,
+	ShortDescription: "performs a node lookup",
+	Description: `
+Performs the node lookup procedure and displays each node which responded
+together with the hop at which it was found and the query latency.`,
+}
+
+func runDhtLookup(c guinea.Context) error {
+	client, err := GetClient()
+	if err != nil {
+		return err
+	}
+
+	args := &backend.DhtLookupArgs{NodeId: c.Arguments[0]}
+	var hops []backend.DhtHop
+	if err := client.Call("Backend.DhtLookup", args, &hops); err != nil {
+		return err
+	}
+
+	for _, hop := range hops {
+		fmt.Printf("hop %d %s %s %fms\n", hop.Hop, hop.Id, strings.Join(hop.Addresses, ","), hop.Latency*1000)
+	}
+	return nil
+}
+
+var dhtGetKeyCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Multiple:    false,
+			Description: "node whose key should be retrieved",
+		},
+	},
+	Run:              runDhtGetKey,
+	ShortDescription: "retrieves a public key",
+	Description: `
+Retrieves the public key of a node from the DHT and displays it.`,
+}
+
+func runDhtGetKey(c guinea.Context) error {
+	client, err := GetClient()
+	if err != nil {
+		return err
+	}
+
+	args := &backend.DhtGetKeyArgs{NodeId: c.Arguments[0]}
+	var key []byte
+	if err := client.Call("Backend.DhtGetKey", args, &key); err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: key,
+	}
+	return pem.Encode(os.Stdout, block)
+}
+
+var dhtChannelCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "name",
+			Multiple:    false,
+			Description: "channel name",
+		},
+	},
+	Run:              runDhtChannel,
+	ShortDescription: "lists channel members",
+	Description: `
+Retrieves the list of nodes which joined a channel from the DHT.`,
+}
+
+func runDhtChannel(c guinea.Context) error {
+	client, err := GetClient()
+	if err != nil {
+		return err
+	}
+
+	args := &backend.DhtChannelArgs{Name: c.Arguments[0]}
+	var ids []string
+	if err := client.Call("Backend.DhtChannel", args, &ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
@@ -2,21 +2,360 @@ package commands
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+
 	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/config"
+	"github.com/boreq/starlight/local/backend"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/utils"
+	"github.com/pkg/errors"
 )
 
 var identityCmd = guinea.Command{
-	Run:              runIdentity,
+	Run: runIdentity,
+	Subcommands: map[string]*guinea.Command{
+		"migrate": &identityMigrateCmd,
+		"passwd":  &identityPasswdCmd,
+		"export":  &identityExportCmd,
+		"import":  &identityImportCmd,
+		"revoke":  &identityRevokeCmd,
+		"master":  &identityMasterCmd,
+	},
 	ShortDescription: "displays local identity",
 	Description: `
-Displays your identity.`,
+Displays your identity and the difficulty of the crypto puzzle solved by your
+id.`,
 }
 
 func runIdentity(c guinea.Context) error {
+	id, err := GetId()
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	fmt.Printf("difficulty %d\n", node.IdDifficulty(id))
+
+	m, err := node.LoadLocalMigration(config.GetConfigDirPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	oldId, err := m.OldId()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated from %s on %s\n", oldId, m.Timestamp)
+	return nil
+}
+
+var identityMigrateCmd = guinea.Command{
+	Run:              runIdentityMigrate,
+	ShortDescription: "migrates to an Ed25519 identity",
+	Description: `
+Replaces an RSA identity with a new Ed25519 identity. Ed25519 keys are smaller
+and much faster to use. The old identity is kept in a separate file and a
+migration statement signed with both keys, which links the old id to the new
+id, is saved next to it.
+
+Nodes running versions which don't support Ed25519 keys will not be able to
+connect to your node after the migration. Your id will also change, which
+means that other users have to learn the new one, the migration statement can
+be used to prove that both ids belong to you.`,
+}
+
+func runIdentityMigrate(c guinea.Context) error {
+	passphrase, err := getIdentityPassphrase(config.GetConfigDirPath())
+	if err != nil {
+		return err
+	}
+	m, err := node.MigrateLocalIdentity(config.GetConfigDirPath(), passphrase)
+	if err != nil {
+		return err
+	}
+	oldId, err := m.OldId()
+	if err != nil {
+		return err
+	}
+	newId, err := m.NewId()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated from %s to %s\n", oldId, newId)
+	return nil
+}
+
+var identityPasswdCmd = guinea.Command{
+	Run:              runIdentityPasswd,
+	ShortDescription: "changes the passphrase of the identity",
+	Description: `
+Encrypts your identity with a new passphrase. Leave the new passphrase empty to
+store the identity unencrypted.
+
+The daemon prompts for the passphrase of an encrypted identity when it starts.
+The passphrase can also be provided using the STARLIGHT_PASSPHRASE environment
+variable or stored in a file specified using the STARLIGHT_PASSPHRASE_FILE
+environment variable.`,
+}
+
+func runIdentityPasswd(c guinea.Context) error {
+	iden, err := GetIdentity()
+	if err != nil {
+		return err
+	}
+	passphrase, err := GetNewPassphrase(true)
+	if err != nil {
+		return err
+	}
+	return node.SaveLocalIdentityWithPassphrase(iden, config.GetConfigDirPath(), passphrase)
+}
+
+const (
+	bundleFormatPem  = "pem"
+	bundleFormatText = "text"
+)
+
+var identityExportCmd = guinea.Command{
+	Options: []guinea.Option{
+		{
+			Name:        "format",
+			Type:        guinea.String,
+			Default:     bundleFormatPem,
+			Description: fmt.Sprintf("Format of the bundle, %s or %s (default %s)", bundleFormatPem, bundleFormatText, bundleFormatPem),
+		},
+		{
+			Name:        "o",
+			Type:        guinea.String,
+			Description: "Write the bundle to a file instead of the standard output",
+		},
+	},
+	Run:              runIdentityExport,
+	ShortDescription: "exports the identity",
+	Description: `
+Exports your identity as a bundle encrypted with a new passphrase which can be
+used to back up the identity or move it to a different machine using the import
+command. The bundle can be stored as a PEM file or as text which can be written
+down or stored in a QR code. The bundle is decoded and decrypted after being
+created to verify it.`,
+}
+
+func runIdentityExport(c guinea.Context) error {
+	format := c.Options["format"].Str()
+	if format != bundleFormatPem && format != bundleFormatText {
+		return errors.Errorf("invalid format %s", format)
+	}
+
 	iden, err := GetIdentity()
 	if err != nil {
 		return err
 	}
-	fmt.Println(iden.Id)
+	fmt.Fprintln(os.Stderr, "Choose the passphrase used to encrypt the bundle.")
+	passphrase, err := GetNewPassphrase(false)
+	if err != nil {
+		return err
+	}
+	bundle, err := node.NewBundle(iden, passphrase)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch format {
+	case bundleFormatPem:
+		data = bundle.PEM()
+	case bundleFormatText:
+		text, err := bundle.Text()
+		if err != nil {
+			return err
+		}
+		data = []byte(text + "\n")
+	}
+
+	// Verify the bundle.
+	verified, err := node.NewBundleFromBytes(data)
+	if err != nil {
+		return errors.Wrap(err, "verification failed")
+	}
+	verifiedIden, err := verified.Open(passphrase)
+	if err != nil {
+		return errors.Wrap(err, "verification failed")
+	}
+	if !node.CompareId(verifiedIden.Id, iden.Id) {
+		return errors.Errorf("verification failed: invalid id %s", verifiedIden.Id)
+	}
+
+	if filename := c.Options["o"].Str(); filename != "" {
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			return err
+		}
+	} else {
+		os.Stdout.Write(data)
+	}
+	fmt.Fprintf(os.Stderr, "exported and verified %s\n", verifiedIden.Id)
+	return nil
+}
+
+var identityImportCmd = guinea.Command{
+	Options: []guinea.Option{
+		{
+			Name:        "f",
+			Type:        guinea.Bool,
+			Description: "Overwrite the existing identity",
+		},
+	},
+	Arguments: []guinea.Argument{
+		{
+			Name:        "file",
+			Multiple:    false,
+			Description: "file containing a bundle created by the export command",
+		},
+	},
+	Run:              runIdentityImport,
+	ShortDescription: "imports an identity",
+	Description: `
+Replaces your identity with an identity exported using the export command. The
+imported identity is stored encrypted with the passphrase of the bundle, use the
+passwd command to change it. The imported identity is loaded after being saved
+to verify it and its id is displayed.
+
+To move an identity to a new machine run the init command first and then import
+the identity using the '-f' option.`,
+}
+
+func runIdentityImport(c guinea.Context) error {
+	data, err := ioutil.ReadFile(c.Arguments[0])
+	if err != nil {
+		return err
+	}
+	bundle, err := node.NewBundleFromBytes(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Enter the passphrase of the bundle of %s.\n", bundle.Id())
+	passphrase, err := GetPassphrase()
+	if err != nil {
+		return err
+	}
+	iden, err := bundle.Open(passphrase)
+	if err != nil {
+		return err
+	}
+
+	directory := config.GetConfigDirPath()
+	if !c.Options["f"].Bool() {
+		if _, err := node.LoadLocalId(directory); !os.IsNotExist(err) {
+			return errors.New("identity already exists, use '-f' to overwrite")
+		}
+	}
+	utils.EnsureDirExists(directory)
+	if err := node.SaveLocalIdentityWithPassphrase(iden, directory, passphrase); err != nil {
+		return err
+	}
+
+	// Verify the saved identity.
+	imported, err := node.LoadLocalIdentityWithPassphrase(directory, passphrase)
+	if err != nil {
+		return errors.Wrap(err, "verification failed")
+	}
+	if !node.CompareId(imported.Id, bundle.Id()) {
+		return errors.Errorf("verification failed: invalid id %s", imported.Id)
+	}
+	fmt.Printf("imported %s\n", imported.Id)
+	return nil
+}
+
+var identityRevokeCmd = guinea.Command{
+	Options: []guinea.Option{
+		{
+			Name:        "successor",
+			Type:        guinea.String,
+			Description: "Id of the identity which replaces the revoked identity",
+		},
+		{
+			Name:        "i",
+			Type:        guinea.String,
+			Description: "Revoke the identity stored in the specified file instead of your identity",
+		},
+	},
+	Run:              runIdentityRevoke,
+	ShortDescription: "revokes an identity",
+	Description: `
+Tells other nodes to stop trusting an identity, for example because its private
+key was compromised. A signed revocation is stored in the DHT next to the
+public key of the identity. Other nodes will reject the messages signed with the
+revoked key and mark the revoked identity on IRC.
+
+The revocation is saved in the config directory and published by the daemon
+every time it starts. If the daemon is running the revocation is published
+immediately.
+
+A revocation can name a successor. As anybody who knows the revoked key can
+issue a revocation, other users should confirm the successor with you. To revoke
+an identity replaced using the migrate command use the '-i' option to revoke
+the old identity and name the current identity as the successor.`,
+}
+
+func runIdentityRevoke(c guinea.Context) error {
+	iden, err := loadIdentityToRevoke(c.Options["i"].Str())
+	if err != nil {
+		return err
+	}
+
+	var successor node.ID
+	if s := c.Options["successor"].Str(); s != "" {
+		successor, err = node.NewId(s)
+		if err != nil {
+			return errors.Wrap(err, "invalid successor")
+		}
+	}
+
+	r, err := node.NewRevocation(iden, successor)
+	if err != nil {
+		return err
+	}
+	if err := node.SaveLocalRevocation(r, config.GetConfigDirPath()); err != nil {
+		return errors.Wrap(err, "could not save the revocation")
+	}
+	fmt.Printf("revoked %s\n", iden.Id)
+
+	data, err := r.Bytes()
+	if err != nil {
+		return err
+	}
+	client, err := GetClient()
+	if err != nil {
+		fmt.Println("the revocation will be published when the daemon starts")
+		return nil
+	}
+	args := &backend.DhtPutRevocationArgs{Revocation: data}
+	if err := client.Call("Backend.DhtPutRevocation", args, &struct{}{}); err != nil {
+		fmt.Printf("the revocation will be published later: %s\n", err)
+		return nil
+	}
+	fmt.Println("the revocation was published")
 	return nil
 }
+
+// loadIdentityToRevoke loads your identity or the identity stored in the
+// specified file asking for the passphrase if the identity is encrypted.
+func loadIdentityToRevoke(filename string) (*node.Identity, error) {
+	if filename == "" {
+		return GetIdentity()
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	iden, err := node.LoadIdentity(data)
+	if errors.Cause(err) != node.ErrPassphraseRequired {
+		return iden, err
+	}
+	passphrase, err := GetPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return node.LoadIdentityWithPassphrase(data, passphrase)
+}
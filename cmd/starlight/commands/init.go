@@ -1,14 +1,20 @@
 package commands
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/boreq/guinea"
 	"github.com/boreq/starlight/config"
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/irc"
+	"github.com/boreq/starlight/irc/humanizer"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/utils"
+	"github.com/pkg/errors"
 )
 
 const defaultKeypairBits = 4096
@@ -20,18 +26,64 @@ var initCmd = guinea.Command{
 			Type:        guinea.Bool,
 			Description: "Overwrite existing config",
 		},
+		{
+			Name:        "t",
+			Type:        guinea.String,
+			Default:     crypto.Ed25519.String(),
+			Description: fmt.Sprintf("Type of the generated key, %s or %s (default %s)", crypto.Ed25519, crypto.RSA, crypto.Ed25519),
+		},
 		{
 			Name:        "b",
 			Type:        guinea.Int,
 			Default:     defaultKeypairBits,
 			Description: fmt.Sprintf("Number of bits in the generated RSA key (default %d)", defaultKeypairBits),
 		},
+		{
+			Name:        "e",
+			Type:        guinea.Bool,
+			Description: "Encrypt the generated key with a passphrase",
+		},
+		{
+			Name:        "d",
+			Type:        guinea.Int,
+			Default:     node.MinIdDifficulty,
+			Description: fmt.Sprintf("Number of zero bits at the beginning of the generated id (default %d)", node.MinIdDifficulty),
+		},
+		{
+			Name:        "vanity-id",
+			Type:        guinea.String,
+			Description: "Generate an id starting with the specified hex digits",
+		},
+		{
+			Name:        "vanity-host",
+			Type:        guinea.String,
+			Description: "Generate an id whose host displayed on IRC starts with the specified text",
+		},
+		{
+			Name:        "w",
+			Type:        guinea.Int,
+			Default:     runtime.NumCPU(),
+			Description: fmt.Sprintf("Number of keys generated in parallel (default %d)", runtime.NumCPU()),
+		},
 	},
 	Run:              runInit,
 	ShortDescription: "initializes configuration",
 	Description: `
 Creates a new config file with default configuration values and generates a new
-keypair.`,
+keypair. Use '-e' to encrypt the keypair with a passphrase which will have to
+be provided when the daemon starts.
+
+The id of a node is the hash of its public key which has to start with a
+number of zero bits. Keys are generated until a matching id is found. Use '-d'
+to generate an id with more zero bits, each additional bit doubles the time
+needed to generate the id which proves that more work was put into creating
+your identity. The difficulty of an id is displayed by the identity command.
+
+Use '-vanity-id' or '-vanity-host' to generate an id whose hex representation
+or host displayed on IRC starts with the specified text. The ids always start
+with zero bits so the hex prefixes have to start with zeros. Each additional
+character significantly increases the time needed to generate the id, the
+progress is displayed while the keys are generated.`,
 }
 
 func runInit(c guinea.Context) error {
@@ -42,23 +94,138 @@ func runInit(c guinea.Context) error {
 		}
 	}
 
+	// Validate the identity options before creating the config.
+	keyType, err := crypto.ParseKeyType(c.Options["t"].Str())
+	if err != nil {
+		return err
+	}
+	options := node.GenerateOptions{
+		KeyType:    keyType,
+		Bits:       c.Options["b"].Int(),
+		Difficulty: c.Options["d"].Int(),
+		Workers:    c.Options["w"].Int(),
+	}
+	options.Match, err = getVanityMatcher(c.Options["vanity-id"].Str(), c.Options["vanity-host"].Str(), options.Difficulty)
+	if err != nil {
+		return err
+	}
+
 	// Generate default config.
 	utils.EnsureDirExists(config.GetConfigDirPath())
 	conf := config.Default()
-	err := conf.Save(config.GetConfigPath())
+	err = conf.Save(config.GetConfigPath())
 	if err != nil {
 		return err
 	}
 
+	var passphrase []byte
+	if c.Options["e"].Bool() {
+		passphrase, err = GetNewPassphrase(true)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Generate new identity.
-	bits := c.Options["b"].Int()
-	iden, err := node.GenerateIdentity(bits)
+	start := time.Now()
+	options.Progress = func(attempts uint64) {
+		rate := float64(attempts) / time.Since(start).Seconds()
+		fmt.Fprintf(os.Stderr, "\rgenerated %d keys, %.0f keys/s", attempts, rate)
+	}
+	iden, err := node.GenerateIdentityWithOptions(options)
+	fmt.Fprintln(os.Stderr)
 	if err != nil {
 		return err
 	}
-	if err := node.SaveLocalIdentity(iden, config.GetConfigDirPath()); err != nil {
+	fmt.Printf("generated %s with difficulty %d\n", iden.Id, node.IdDifficulty(iden.Id))
+	if err := node.SaveLocalIdentityWithPassphrase(iden, config.GetConfigDirPath(), passphrase); err != nil {
 		return err
 	}
 
 	return err
 }
+
+// getVanityMatcher returns a function which accepts the ids matching the
+// vanity prefixes or nil if no prefixes were specified.
+func getVanityMatcher(idPrefix, hostPrefix string, difficulty int) (func(id node.ID) bool, error) {
+	var matchers []func(id node.ID) bool
+	if idPrefix != "" {
+		matcher, err := node.NewHexIdMatcher(strings.ToLower(idPrefix), difficulty)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid vanity id")
+		}
+		matchers = append(matchers, matcher)
+	}
+	if hostPrefix != "" {
+		dictionary, err := irc.LoadDictionary()
+		if err != nil {
+			return nil, err
+		}
+		host, err := humanizer.NewHostFunc(dictionary)
+		if err != nil {
+			return nil, err
+		}
+		hostPrefix = strings.ToLower(hostPrefix)
+		words, err := firstHostWords(host, difficulty)
+		if err != nil {
+			return nil, err
+		}
+		if !canStartHost(words, hostPrefix) {
+			return nil, errors.Errorf("invalid vanity host: ids start with %d zero bits, the prefix can't be matched", difficulty)
+		}
+		matchers = append(matchers, func(id node.ID) bool {
+			h, err := host(id)
+			return err == nil && strings.HasPrefix(h, hostPrefix)
+		})
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+	return func(id node.ID) bool {
+		for _, matcher := range matchers {
+			if !matcher(id) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// firstHostWords returns the words which can appear first in the hosts of the
+// ids generated with the given difficulty. The ids start with 'difficulty'
+// zero bits which limits the possible first words. The first word is assumed
+// to be determined by the first two bytes of an id.
+func firstHostWords(host func(id node.ID) (string, error), difficulty int) (map[string]bool, error) {
+	freeBits := 16 - difficulty
+	if freeBits < 0 {
+		freeBits = 0
+	}
+	words := make(map[string]bool)
+	for v := 0; v < 1<<uint(freeBits); v++ {
+		id := make(node.ID, crypto.KeyDigestLength)
+		id[0] = byte(v >> 8)
+		id[1] = byte(v)
+		h, err := host(id)
+		if err != nil {
+			return nil, err
+		}
+		words[strings.SplitN(h, ".", 2)[0]] = true
+	}
+	return words, nil
+}
+
+// canStartHost returns true if a host starting with one of the words can
+// match the prefix. A prefix without a delimiter can end in the middle of the
+// first word.
+func canStartHost(words map[string]bool, prefix string) bool {
+	parts := strings.SplitN(prefix, ".", 2)
+	if len(parts) > 1 {
+		return words[parts[0]]
+	}
+	for word := range words {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	return false
+}
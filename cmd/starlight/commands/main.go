@@ -1,7 +1,10 @@
 package commands
 
 import (
+	"fmt"
+
 	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/utils/version"
 )
 
 var MainCmd = guinea.Command{
@@ -14,6 +17,7 @@ var MainCmd = guinea.Command{
 	},
 	Run: func(c guinea.Context) error {
 		if c.Options["version"].Bool() {
+			fmt.Println(version.Version)
 			return nil
 		}
 		return guinea.ErrInvalidParms
@@ -23,6 +27,9 @@ var MainCmd = guinea.Command{
 		"init":     &initCmd,
 		"identity": &identityCmd,
 		"ping":     &pingCmd,
+		"dht":      &dhtCmd,
+		"crawl":    &crawlCmd,
+		"contacts": &contactsCmd,
 	},
 	ShortDescription: "distributed chat network",
 	Description: `Starlight is a distributed chat network inspired by the functionality of the
@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boreq/guinea"
+	"github.com/boreq/starlight/config"
+	"github.com/boreq/starlight/local/backend"
+	"github.com/boreq/starlight/network/node"
+	"github.com/pkg/errors"
+)
+
+var identityMasterCmd = guinea.Command{
+	Run: runIdentityMaster,
+	Subcommands: map[string]*guinea.Command{
+		"init":   &identityMasterInitCmd,
+		"add":    &identityMasterAddCmd,
+		"remove": &identityMasterRemoveCmd,
+	},
+	ShortDescription: "displays the master identity and its devices",
+	Description: `
+A master identity lets you use starlight on multiple devices, for example on
+your laptop and desktop, while other users see you as a single person. The
+master identity signs a device list containing the ids of your devices. The
+device list is stored in the DHT and attached to the messages sent by your
+devices. Private messages sent to the master id are delivered to all your
+devices and the messages sent by your devices are displayed as sent by the
+master id.
+
+Create the master identity on one of your devices using the init command and
+add the ids of your other devices using the add command. The device list is
+stored in the devices.pem file in the config directory, copy it to the config
+directory of every device after changing it. The master identity is stored in
+the master.pem file which is needed only to change the device list and can be
+kept offline.
+
+This command displays the master id and the ids of the devices.`,
+}
+
+func runIdentityMaster(c guinea.Context) error {
+	l, err := node.LoadLocalDeviceList(config.GetConfigDirPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("no device list, use the init command to create a master identity")
+		}
+		return err
+	}
+	masterId, err := l.MasterId()
+	if err != nil {
+		return err
+	}
+	fmt.Println(masterId)
+	for _, id := range l.Devices {
+		fmt.Printf("device %s\n", id)
+	}
+	fmt.Printf("updated on %s\n", l.Timestamp)
+	return nil
+}
+
+var identityMasterInitCmd = guinea.Command{
+	Run:              runIdentityMasterInit,
+	ShortDescription: "creates a master identity",
+	Description: `
+Creates a master identity and a device list containing only this device. You
+will be asked for the passphrase used to encrypt the master identity.`,
+}
+
+func runIdentityMasterInit(c guinea.Context) error {
+	directory := config.GetConfigDirPath()
+	if _, err := node.LoadLocalMasterIdentity(directory, nil); !os.IsNotExist(err) {
+		return errors.New("master identity already exists")
+	}
+	id, err := GetId()
+	if err != nil {
+		return err
+	}
+
+	master, err := node.GenerateEd25519Identity()
+	if err != nil {
+		return errors.Wrap(err, "could not generate the master identity")
+	}
+	fmt.Fprintln(os.Stderr, "Choose the passphrase used to encrypt the master identity.")
+	passphrase, err := GetNewPassphrase(true)
+	if err != nil {
+		return err
+	}
+	l, err := node.NewDeviceList(master, []node.ID{id})
+	if err != nil {
+		return err
+	}
+	if err := node.SaveLocalMasterIdentity(master, directory, passphrase); err != nil {
+		return errors.Wrap(err, "could not save the master identity")
+	}
+	fmt.Printf("created %s\n", master.Id)
+	return saveDeviceList(l)
+}
+
+var identityMasterAddCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Multiple:    false,
+			Description: "id of the device",
+		},
+	},
+	Run:              runIdentityMasterAdd,
+	ShortDescription: "adds a device to the device list",
+	Description: `
+Adds a device to the device list. Run the identity command on the added device
+to display its id and copy the updated devices.pem file to its config
+directory.`,
+}
+
+func runIdentityMasterAdd(c guinea.Context) error {
+	return updateDeviceList(c.Arguments[0], func(devices []node.ID, id node.ID) ([]node.ID, error) {
+		for _, device := range devices {
+			if node.CompareId(device, id) {
+				return nil, errors.New("device is already on the list")
+			}
+		}
+		return append(devices, id), nil
+	})
+}
+
+var identityMasterRemoveCmd = guinea.Command{
+	Arguments: []guinea.Argument{
+		{
+			Name:        "id",
+			Multiple:    false,
+			Description: "id of the device",
+		},
+	},
+	Run:              runIdentityMasterRemove,
+	ShortDescription: "removes a device from the device list",
+	Description: `
+Removes a device from the device list, for example after the device was lost.
+Other nodes stop displaying the messages sent by the removed device as sent by
+the master identity once they receive the updated list. If the key of the
+device could have been compromised revoke it as well.`,
+}
+
+func runIdentityMasterRemove(c guinea.Context) error {
+	return updateDeviceList(c.Arguments[0], func(devices []node.ID, id node.ID) ([]node.ID, error) {
+		var rv []node.ID
+		for _, device := range devices {
+			if !node.CompareId(device, id) {
+				rv = append(rv, device)
+			}
+		}
+		if len(rv) == len(devices) {
+			return nil, errors.New("device is not on the list")
+		}
+		return rv, nil
+	})
+}
+
+// updateDeviceList replaces the local device list with a new list signed with
+// the master identity containing the devices returned by the update function.
+func updateDeviceList(deviceId string, update func(devices []node.ID, id node.ID) ([]node.ID, error)) error {
+	id, err := node.NewId(deviceId)
+	if err != nil {
+		return errors.Wrap(err, "invalid device id")
+	}
+	directory := config.GetConfigDirPath()
+	l, err := node.LoadLocalDeviceList(directory)
+	if err != nil {
+		return errors.Wrap(err, "could not load the device list")
+	}
+	master, err := loadMasterIdentity(directory)
+	if err != nil {
+		return errors.Wrap(err, "could not load the master identity")
+	}
+	devices, err := update(append([]node.ID(nil), l.Devices...), id)
+	if err != nil {
+		return err
+	}
+	updated, err := l.Update(master, devices)
+	if err != nil {
+		return err
+	}
+	return saveDeviceList(updated)
+}
+
+// loadMasterIdentity loads the master identity asking for the passphrase if
+// it is encrypted.
+func loadMasterIdentity(directory string) (*node.Identity, error) {
+	master, err := node.LoadLocalMasterIdentity(directory, nil)
+	if errors.Cause(err) != node.ErrPassphraseRequired {
+		return master, err
+	}
+	fmt.Fprintln(os.Stderr, "Enter the passphrase of the master identity.")
+	passphrase, err := GetPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return node.LoadLocalMasterIdentity(directory, passphrase)
+}
+
+// saveDeviceList saves the device list and publishes it if the daemon is
+// running and this device is on the list.
+func saveDeviceList(l *node.DeviceList) error {
+	if err := node.SaveLocalDeviceList(l, config.GetConfigDirPath()); err != nil {
+		return errors.Wrap(err, "could not save the device list")
+	}
+	fmt.Println("the device list was saved, copy devices.pem to your other devices")
+
+	id, err := GetId()
+	if err != nil || !l.Contains(id) {
+		return nil
+	}
+	data, err := l.Bytes()
+	if err != nil {
+		return err
+	}
+	client, err := GetClient()
+	if err != nil {
+		fmt.Println("the device list will be published when the daemon starts")
+		return nil
+	}
+	args := &backend.SetDeviceListArgs{DeviceList: data}
+	if err := client.Call("Backend.SetDeviceList", args, &struct{}{}); err != nil {
+		fmt.Printf("the device list will be published later: %s\n", err)
+		return nil
+	}
+	fmt.Println("the device list was published")
+	return nil
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// The environment variables which can be used to provide the passphrase used
+// to decrypt the identity instead of typing it in.
+const (
+	passphraseEnv     = "STARLIGHT_PASSPHRASE"
+	passphraseFileEnv = "STARLIGHT_PASSPHRASE_FILE"
+)
+
+// GetPassphrase returns the passphrase used to decrypt the identity. The
+// passphrase is read from the STARLIGHT_PASSPHRASE environment variable, from
+// the file specified in the STARLIGHT_PASSPHRASE_FILE environment variable or,
+// if neither of them is set, the user is prompted for it.
+func GetPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if filename := os.Getenv(passphraseFileEnv); filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read the passphrase file")
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	return promptPassphrase("Passphrase: ")
+}
+
+// GetNewPassphrase prompts the user for a new passphrase twice. If the
+// passphrase is optional an empty passphrase is returned if the user doesn't
+// want to encrypt the identity.
+func GetNewPassphrase(optional bool) ([]byte, error) {
+	prompt := "New passphrase: "
+	if optional {
+		prompt = "New passphrase (empty for none): "
+	}
+	passphrase, err := promptPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if !optional && len(passphrase) == 0 {
+		return nil, errors.New("passphrase can't be empty")
+	}
+	confirmation, err := promptPassphrase("Repeat the new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirmation) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.Errorf("passphrase required, set %s or %s", passphraseEnv, passphraseFileEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the passphrase")
+	}
+	return passphrase, nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 
+	"github.com/boreq/starlight/network/address"
 	"github.com/boreq/starlight/network/node"
 	"github.com/shibukawa/configdir"
 )
@@ -19,10 +20,16 @@ const dataSubdirectoryName = "starlight"
 
 // This part of the config structure is saved in the config file in JSON format.
 type savedConfig struct {
-	ListenAddress     string
-	IRCGatewayAddress string
-	BootstrapNodes    []node.NodeInfo
-	NickServerAddress string
+	ListenAddresses     []string
+	AdvertisedAddresses []string
+	ProxyAddress        string
+	IRCGatewayAddress   string
+	BootstrapNodes      []node.NodeInfo
+	LocalDiscovery      bool
+	LowWatermark        int
+	HighWatermark       int
+	IdleTimeout         string
+	NickServerAddress   string
 }
 
 // Full config struct.
@@ -38,7 +45,21 @@ func (conf *Config) Load(path string) error {
 	if os.IsNotExist(err) {
 		return nil
 	}
-	return json.Unmarshal(content, conf)
+	if err := json.Unmarshal(content, conf); err != nil {
+		return err
+	}
+
+	// Older config files contain a single listen address.
+	var legacy struct {
+		ListenAddress string
+	}
+	if err := json.Unmarshal(content, &legacy); err != nil {
+		return err
+	}
+	if legacy.ListenAddress != "" {
+		conf.ListenAddresses = []string{legacy.ListenAddress}
+	}
+	return nil
 }
 
 // Save saves this struct into the specified config file.
@@ -81,15 +102,20 @@ func GetConfigPath() string {
 
 func getDefaultBootstrap() []node.NodeInfo {
 	def := map[string]string{
-		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": "address:1836",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": "/dns/address/tcp/1836",
 	}
 
 	var rw []node.NodeInfo
-	for id, address := range def {
+	for id, addr := range def {
 		nodeId, err := node.NewId(id)
-		if err == nil {
-			rw = append(rw, node.NodeInfo{Id: nodeId, Address: address})
+		if err != nil {
+			continue
+		}
+		a, err := address.Parse(addr)
+		if err != nil {
+			continue
 		}
+		rw = append(rw, node.NodeInfo{Id: nodeId, Addresses: []address.Address{a}})
 	}
 	return rw
 }
@@ -98,9 +124,12 @@ func getDefaultBootstrap() []node.NodeInfo {
 func Default() *Config {
 	conf := &Config{
 		savedConfig{
-			ListenAddress:     ":1836",
+			ListenAddresses:   []string{"/ip6/::/tcp/1836", "/ip6/::/udp/1836/quic"},
 			IRCGatewayAddress: "127.0.0.1:6667",
 			BootstrapNodes:    getDefaultBootstrap(),
+			LowWatermark:      64,
+			HighWatermark:     128,
+			IdleTimeout:       "10m",
 			NickServerAddress: "https://example.com",
 		},
 	}
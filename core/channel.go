@@ -66,6 +66,21 @@ func (n *core) ListChannels() []string {
 	return rv
 }
 
+// isChannelMember returns true if the node is a member of one of the channels
+// the local node is in. The connections with the channel members are
+// protected since they are used to propagate the channel messages.
+func (n *core) isChannelMember(id node.ID) bool {
+	n.channelsMutex.Lock()
+	defer n.channelsMutex.Unlock()
+
+	for _, ch := range n.channels {
+		if ch.Users.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
 // inChannel returns true if the local node is already in the channel.
 func (n *core) inChannel(name string) bool {
 	id := channel.CreateId(name)
@@ -48,6 +48,19 @@ func (b *Buckets) Insert(id node.ID, t time.Time) error {
 	return nil
 }
 
+// Contains returns true if the node is stored in the buckets.
+func (b *Buckets) Contains(id node.ID) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	i, err := b.bucketIndex(id)
+	if err != nil || i >= len(b.buckets) {
+		return false
+	}
+	b.buckets[i].Cleanup()
+	return b.buckets[i].Contains(id)
+}
+
 // Get picks i random nodes from each bucket and returns all of them. That means
 // that the total number of the returned nodes will be <= len(b.self) * 8 * i.
 func (b *Buckets) Get(i int) []node.ID {
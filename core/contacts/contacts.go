@@ -0,0 +1,81 @@
+// Package contacts stores the ids verified by the user and computes the trust
+// levels of other nodes using the trust lists published in the DHT.
+package contacts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/boreq/starlight/network/node"
+	"github.com/pkg/errors"
+)
+
+// Contact is a node whose id was verified by the user, for example by
+// comparing its fingerprint in person.
+type Contact struct {
+	Id       node.ID
+	Name     string
+	Verified time.Time
+
+	// Vouch is true if the contact is included in the trust list of the
+	// local node which is published in the DHT.
+	Vouch bool
+}
+
+const contactsFilename = "contacts.json"
+
+// Load loads the contacts stored in the specified directory. No contacts and
+// no error are returned if the file doesn't exist.
+func Load(directory string) ([]Contact, error) {
+	data, err := ioutil.ReadFile(path.Join(directory, contactsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var contacts []Contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, errors.Wrap(err, "invalid contacts file")
+	}
+	for _, contact := range contacts {
+		if !node.ValidateId(contact.Id) {
+			return nil, errors.Errorf("invalid contact id %s", contact.Id)
+		}
+	}
+	return contacts, nil
+}
+
+// Save saves the contacts in the specified directory.
+func Save(directory string, contacts []Contact) error {
+	data, err := json.MarshalIndent(contacts, "", "	")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(directory, contactsFilename), data, 0600)
+}
+
+// Find returns the contact with the given id.
+func Find(contacts []Contact, id node.ID) (Contact, bool) {
+	for _, contact := range contacts {
+		if node.CompareId(contact.Id, id) {
+			return contact, true
+		}
+	}
+	return Contact{}, false
+}
+
+// NewTrustList creates the trust list of the local node containing the
+// contacts which the user vouches for.
+func NewTrustList(iden *node.Identity, contacts []Contact) (*node.TrustList, error) {
+	var trusted []node.ID
+	for _, contact := range contacts {
+		if contact.Vouch {
+			trusted = append(trusted, contact.Id)
+		}
+	}
+	return node.NewTrustList(iden, trusted)
+}
@@ -0,0 +1,115 @@
+package contacts
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/network/node"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func generateIdentities(t *testing.T, n int) []*node.Identity {
+	var rv []*node.Identity
+	for i := 0; i < n; i++ {
+		iden, err := node.GenerateEd25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv = append(rv, iden)
+	}
+	return rv
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	list, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Fatal("Contacts returned")
+	}
+
+	idens := generateIdentities(t, 2)
+	list = []Contact{
+		{Id: idens[0].Id, Name: "a", Verified: time.Unix(1000, 0), Vouch: true},
+		{Id: idens[1].Id, Name: "b", Verified: time.Unix(2000, 0)},
+	}
+	if err := Save(dir, list); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(list) {
+		t.Fatalf("Invalid number of contacts %d", len(loaded))
+	}
+	for i := range list {
+		if !node.CompareId(loaded[i].Id, list[i].Id) {
+			t.Errorf("Invalid id %s", loaded[i].Id)
+		}
+		if loaded[i].Name != list[i].Name || loaded[i].Vouch != list[i].Vouch {
+			t.Errorf("Invalid contact %+v", loaded[i])
+		}
+		if !loaded[i].Verified.Equal(list[i].Verified) {
+			t.Errorf("Invalid verification time %s", loaded[i].Verified)
+		}
+	}
+}
+
+func TestComputeLevels(t *testing.T) {
+	// 0 is verified, 0 trusts 1, 1 trusts 2, 2 trusts 3.
+	idens := generateIdentities(t, 4)
+	lists := make(map[string]*node.TrustList)
+	for i := 0; i < len(idens)-1; i++ {
+		l, err := NewTrustList(idens[i], []Contact{{Id: idens[i+1].Id, Vouch: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lists[idens[i].Id.String()] = l
+	}
+	get := func(ctx context.Context, id node.ID) (*node.TrustList, error) {
+		if l, ok := lists[id.String()]; ok {
+			return l, nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	levels := ComputeLevels(context.Background(), []Contact{{Id: idens[0].Id}}, get)
+	for i, iden := range idens {
+		level, ok := levels.Get(iden.Id)
+		if Level(i) > MaxLevel {
+			if ok {
+				t.Errorf("Node %d is trusted at level %d", i, level)
+			}
+			continue
+		}
+		if !ok || level != Level(i) {
+			t.Errorf("Node %d has level %d, %t", i, level, ok)
+		}
+	}
+}
+
+func TestNewTrustList(t *testing.T) {
+	idens := generateIdentities(t, 3)
+	list := []Contact{
+		{Id: idens[1].Id, Vouch: true},
+		{Id: idens[2].Id},
+	}
+	l, err := NewTrustList(idens[0], list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Contains(idens[1].Id) || l.Contains(idens[2].Id) {
+		t.Fatal("Only the vouched contacts should be trusted")
+	}
+}
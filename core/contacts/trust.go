@@ -0,0 +1,108 @@
+package contacts
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+// Level is the number of trust lists which link the user to a node. The
+// contacts verified by the user have the level Verified, the nodes trusted by
+// them have the level 1 and so on.
+type Level int
+
+// Verified is the level of the contacts verified by the user.
+const Verified Level = 0
+
+// MaxLevel is the highest computed trust level. The trust between the users
+// is not really transitive so the nodes which are too far away are not
+// considered to be trusted.
+const MaxLevel Level = 2
+
+// concurrentLookups limits the number of trust lists retrieved in parallel.
+const concurrentLookups = 10
+
+func (l Level) String() string {
+	if l == Verified {
+		return "verified"
+	}
+	return fmt.Sprintf("trusted%d", l)
+}
+
+// Levels maps the ids to their trust levels.
+type Levels map[string]Level
+
+// Get returns the trust level of the node with the given id.
+func (l Levels) Get(id node.ID) (Level, bool) {
+	level, ok := l[id.String()]
+	return level, ok
+}
+
+// TrustListGetter returns the trust list of a node.
+type TrustListGetter func(ctx context.Context, id node.ID) (*node.TrustList, error)
+
+// NewLevels returns the trust levels of the contacts without retrieving any
+// trust lists.
+func NewLevels(contacts []Contact) Levels {
+	levels := make(Levels)
+	for _, contact := range contacts {
+		levels[contact.Id.String()] = Verified
+	}
+	return levels
+}
+
+// ComputeLevels computes the trust levels by following the trust lists
+// starting from the contacts. Each node is assigned the lowest level at which
+// it was found. The nodes whose trust lists couldn't be retrieved, for example
+// because their keys were revoked, are skipped.
+func ComputeLevels(ctx context.Context, contacts []Contact, get TrustListGetter) Levels {
+	levels := NewLevels(contacts)
+	var frontier []node.ID
+	for _, contact := range contacts {
+		frontier = append(frontier, contact.Id)
+	}
+
+	for level := Verified + 1; level <= MaxLevel && len(frontier) > 0; level++ {
+		var next []node.ID
+		for _, l := range getTrustLists(ctx, frontier, get) {
+			for _, id := range l.Trusted {
+				if _, ok := levels[id.String()]; !ok {
+					levels[id.String()] = level
+					next = append(next, id)
+				}
+			}
+		}
+		frontier = next
+	}
+	return levels
+}
+
+// getTrustLists retrieves the trust lists of the nodes in parallel. The
+// lists are returned in the order of the ids.
+func getTrustLists(ctx context.Context, ids []node.ID, get TrustListGetter) []*node.TrustList {
+	lists := make([]*node.TrustList, len(ids))
+	semaphore := make(chan struct{}, concurrentLookups)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id node.ID) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if l, err := get(ctx, id); err == nil {
+				lists[i] = l
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	var rv []*node.TrustList
+	for _, l := range lists {
+		if l != nil {
+			rv = append(rv, l)
+		}
+	}
+	return rv
+}
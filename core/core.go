@@ -3,8 +3,10 @@ package core
 import (
 	"github.com/boreq/starlight/config"
 	"github.com/boreq/starlight/core/channel"
+	"github.com/boreq/starlight/core/contacts"
 	"github.com/boreq/starlight/core/dht"
 	"github.com/boreq/starlight/core/msgregister"
+	"github.com/boreq/starlight/network"
 	"github.com/boreq/starlight/network/dispatcher"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/protocol/message"
@@ -16,7 +18,7 @@ import (
 
 var log = utils.GetLogger("core")
 
-func NewCore(ctx context.Context, ident node.Identity, config *config.Config, dht dht.DHT) Core {
+func NewCore(ctx context.Context, ident node.Identity, config *config.Config, net network.Network, dht dht.DHT) Core {
 	rv := &core{
 		config:      config,
 		ident:       ident,
@@ -24,8 +26,12 @@ func NewCore(ctx context.Context, ident node.Identity, config *config.Config, dh
 		disp:        dispatcher.New(ctx),
 		dht:         dht,
 		ctx:         ctx,
+
+		deviceListLookups: make(map[string]bool),
 	}
+	net.Protect(rv.isChannelMember)
 	go rv.listenToDht()
+	go rv.refreshTrustLoop()
 	return rv
 }
 
@@ -38,6 +44,16 @@ type core struct {
 	disp          dispatcher.Dispatcher
 	dht           dht.DHT
 	ctx           context.Context
+
+	deviceList        *message.DeviceList
+	deviceListLookups map[string]bool
+	deviceListMutex   sync.Mutex
+
+	contacts        []contacts.Contact
+	contactsVersion int
+	trustLevels     contacts.Levels
+	trustPublished  bool
+	contactsMutex   sync.Mutex
 }
 
 func (n *core) Identity() node.Identity {
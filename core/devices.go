@@ -0,0 +1,136 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"golang.org/x/net/context"
+)
+
+// How long the device lists of the master identities whose devices sent the
+// received messages are looked up for.
+const deviceListLookupTimeout = 30 * time.Second
+
+func (n *core) SetDeviceList(ctx context.Context, l *node.DeviceList) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	if !l.Contains(n.ident.Id) {
+		return errors.New("local node is not one of the devices")
+	}
+	msg, err := l.Message()
+	if err != nil {
+		return err
+	}
+
+	n.deviceListMutex.Lock()
+	n.deviceList = msg
+	n.deviceListMutex.Unlock()
+
+	return n.dht.PutDeviceList(ctx, l)
+}
+
+// getDeviceList returns the device list which is attached to the sent
+// messages or nil if it wasn't set.
+func (n *core) getDeviceList() *message.DeviceList {
+	n.deviceListMutex.Lock()
+	defer n.deviceListMutex.Unlock()
+	return n.deviceList
+}
+
+// getMasterId returns the id of the master identity of the node which sent
+// a message if the attached device list proves that the node is one of its
+// devices. Otherwise the id of the node is returned. The newest known device
+// list is used in place of the attached one so that the removed devices can't
+// speak for the master identity. Only the locally known device lists are used
+// so that the messages aren't delayed by the lookups, a list which isn't known
+// yet is looked up in the background.
+func (n *core) getMasterId(id node.ID, listMsg *message.DeviceList) node.ID {
+	if listMsg == nil {
+		return id
+	}
+	l, err := node.NewDeviceListFromMessage(listMsg)
+	if err != nil {
+		log.Debugf("invalid device list attached by %s: %s", id, err)
+		return id
+	}
+	masterId, err := l.MasterId()
+	if err != nil {
+		return id
+	}
+	if _, ok := n.dht.Revoked(masterId); ok {
+		return id
+	}
+	if newest, ok := n.dht.DeviceList(masterId); !ok {
+		go n.lookupDeviceList(masterId)
+	} else if newest.Timestamp.After(l.Timestamp) {
+		l = newest
+	}
+	if !l.Contains(id) {
+		return id
+	}
+	return masterId
+}
+
+// lookupDeviceList looks up the newest device list of a master identity. Only
+// one lookup of the list of each master identity runs at a time.
+func (n *core) lookupDeviceList(masterId node.ID) {
+	key := masterId.String()
+	n.deviceListMutex.Lock()
+	if n.deviceListLookups[key] {
+		n.deviceListMutex.Unlock()
+		return
+	}
+	n.deviceListLookups[key] = true
+	n.deviceListMutex.Unlock()
+
+	defer func() {
+		n.deviceListMutex.Lock()
+		delete(n.deviceListLookups, key)
+		n.deviceListMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(n.ctx, deviceListLookupTimeout)
+	defer cancel()
+	if _, err := n.dht.GetDeviceList(ctx, masterId); err != nil {
+		log.Debugf("device list lookup of %s failed: %s", masterId, err)
+	}
+}
+
+// sendToDevices sends a private message to all devices of a master identity
+// except the local node. It fails only if none of the devices received the
+// message.
+func (n *core) sendToDevices(ctx context.Context, l *node.DeviceList, text string) error {
+	var devices []node.ID
+	for _, id := range l.Devices {
+		if !node.CompareId(id, n.ident.Id) {
+			devices = append(devices, id)
+		}
+	}
+	if len(devices) == 0 {
+		return errors.New("master identity has no other devices")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(devices))
+	for _, id := range devices {
+		wg.Add(1)
+		go func(id node.ID) {
+			defer wg.Done()
+			if err := n.sendMessage(ctx, id, text); err != nil {
+				log.Debugf("sending to device %s failed: %s", id, err)
+				errs <- err
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+
+	if len(errs) == len(devices) {
+		return <-errs
+	}
+	return nil
+}
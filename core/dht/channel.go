@@ -3,12 +3,13 @@ package dht
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"github.com/boreq/starlight/core/channel"
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/protocol/message"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"time"
 )
@@ -21,30 +22,14 @@ func (d *dht) PutChannel(ctx context.Context, id []byte) error {
 	}
 
 	// Locate the closest nodes.
-	nodeResults, err := d.findNode(ctx, id, false)
+	nodes, err := d.findClosest(ctx, id)
 	if err != nil {
 		return err
 	}
 
 	// Send 'k' store RPCs. We don't have to wait for this to finish so
 	// a goroutine with the DHT's context is used instead of blocking.
-	go func() {
-		counter := 0
-		for _, nodes := range nodeResults {
-			for _, nodeInfo := range nodes {
-				peer, err := d.netDial(nodeInfo)
-				if err == nil {
-					err := peer.SendWithContext(d.ctx, msg)
-					if err == nil {
-						counter++
-						if counter > paramK {
-							return
-						}
-					}
-				}
-			}
-		}
-	}()
+	go d.sendToAll(nodes, msg)
 	return nil
 }
 
@@ -73,93 +58,57 @@ func (d *dht) GetChannel(ctx context.Context, id []byte) ([]node.ID, error) {
 func (d *dht) getChannel(ctx context.Context, id []byte) ([]*message.StoreChannel, error) {
 	log.Debugf("getChannel %x", id)
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	result := make(chan []*message.StoreChannel)
-	sendResult := func(r []*message.StoreChannel) {
-		select {
-		case result <- r:
-			return
-		case <-ctx.Done():
-			return
-		}
+	// Run the lookup procedure and collect the memberships returned by all
+	// queried nodes.
+	results, err := d.lookup(ctx, id, d.queryFindChannel)
+	if err != nil {
+		return nil, err
 	}
 
-	findNodeDone := make(chan int)
-
-	// Process incoming messages.
-	go func() {
-		c, cancel := d.net.Subscribe()
-		defer cancel()
-
-		var results []*message.StoreChannel
-
-		// Used to timeout when no relevant new messages received for 2
-		// seconds.
-		var first bool = true
-		t := time.NewTimer(time.Second)
-		t.Stop()
-
-		// Used to timeout when 5 seconds passed from first relevant
-		// message.
-		ctxTimeout := context.Background()
-
-		for {
-
-			select {
-			case msg := <-c:
-				switch pMsg := msg.Message.(type) {
-				case *message.StoreChannel:
-					if bytes.Equal(pMsg.GetChannelId(), id) {
-						log.Debugf("getChannel %x new result", id)
-						results = append(results, pMsg)
-						t.Reset(2 * time.Second)
-						if first {
-							ctxTimeout, _ = context.WithTimeout(ctx, 5*time.Second)
-							first = false
-						}
-					}
-				}
-			case <-findNodeDone:
-				log.Debugf("getChannel %x findNodeDone", id)
-				t.Reset(2 * time.Second)
-			case <-t.C:
-				log.Debugf("getChannel %x sendResults - t", id)
-				sendResult(results)
-				return
-			case <-ctxTimeout.Done():
-				log.Debugf("getChannel %x sendResults - ctxTimeout", id)
-				sendResult(results)
-				return
-			case <-ctx.Done():
-				return
+	var rv []*message.StoreChannel
+	for result := range results {
+		for _, value := range result.Values {
+			if storeMsg, ok := value.(*message.StoreChannel); ok {
+				log.Debugf("getChannel %x new result", id)
+				rv = append(rv, storeMsg)
 			}
 		}
-	}()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
 
-	// Run the lookup procedure.
-	go func() {
-		msgFactory := func(id node.ID) proto.Message {
-			rv := &message.FindChannel{
-				ChannelId: id,
-			}
-			return rv
+// queryFindChannel sends a FindChannel message and awaits a ChannelMembers
+// message. Invalid memberships are discarded.
+func (d *dht) queryFindChannel(ctx context.Context, p network.Peer, id node.ID) (queryResponse, error) {
+	msg := &message.FindChannel{
+		ChannelId: id,
+	}
+	response, err := p.Request(ctx, msg)
+	if err != nil {
+		return queryResponse{}, err
+	}
+	membersMsg, ok := response.(*message.ChannelMembers)
+	if !ok {
+		return queryResponse{}, errors.Errorf("unexpected response %T", response)
+	}
+	rv := toQueryResponse(membersMsg)
+	var values []proto.Message
+	for _, value := range rv.Values {
+		storeMsg := value.(*message.StoreChannel)
+		if !bytes.Equal(storeMsg.GetChannelId(), id) {
+			continue
 		}
-		d.lookup(ctx, id, msgFactory, false)
-		select {
-		case findNodeDone <- 0:
-		case <-ctx.Done():
+		if err := d.validateStoreChannelMessage(ctx, storeMsg); err != nil {
+			log.Debugf("queryFindChannel invalid membership: %s", err)
+			continue
 		}
-	}()
-
-	// Await results.
-	select {
-	case results := <-result:
-		return results, nil
-	case <-ctx.Done():
-		return nil, errors.New("key not found")
+		values = append(values, storeMsg)
 	}
+	rv.Values = values
+	return rv, nil
 }
 
 // handlePutChannelMsg processes an incoming StoreChannel message.
@@ -187,7 +136,7 @@ func (d *dht) handleStoreChannelMsg(ctx context.Context, sender node.NodeInfo, m
 }
 
 // handlePutChannelMsg processes an incoming StoreChannel message.
-func (d *dht) handleFindChannelMsg(ctx context.Context, sender node.NodeInfo, msg *message.FindChannel) error {
+func (d *dht) handleFindChannelMsg(ctx context.Context, sender node.NodeInfo, requestId uint64, msg *message.FindChannel) error {
 	id := msg.GetChannelId()
 	if !channel.ValidateId(id) {
 		return errors.New("invalid id")
@@ -195,21 +144,12 @@ func (d *dht) handleFindChannelMsg(ctx context.Context, sender node.NodeInfo, ms
 
 	go d.disp.Dispatch(sender, msg)
 
-	peer, err := d.Dial(ctx, sender.Id)
-	if err != nil {
-		return err
+	// Send known channel members and closer nodes.
+	response := &message.ChannelMembers{
+		Members: d.channelStore.Get(id),
+		Nodes:   d.createNodesMessage(id).GetNodes(),
 	}
-
-	// Send known channel members.
-	msgs := d.channelStore.Get(id)
-	for _, storeMsg := range msgs {
-		peer.SendWithContext(d.ctx, storeMsg)
-	}
-
-	// Send closer nodes.
-	response := d.createNodesMessage(id)
-	peer.SendWithContext(d.ctx, response)
-	return nil
+	return d.respond(ctx, sender, requestId, response)
 }
 
 // CreateStoreChannelMessage creates a StoreChannel message which can be sent
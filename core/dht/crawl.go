@@ -0,0 +1,182 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/boreq/starlight/core/dht/kbuckets"
+	"github.com/boreq/starlight/network"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/utils/version"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// crawlConcurrency limits the number of nodes which are queried at the same
+// time during the crawl.
+const crawlConcurrency = 10
+
+// crawlQueriesPerNode specifies how many FindNode queries are sent to each
+// node during the crawl. Each query targets a different bucket of the queried
+// node starting with the most distant one in order to retrieve as many
+// entries of its routing table as possible.
+const crawlQueriesPerNode = 8
+
+// CrawledNode describes a single node discovered during the crawl.
+type CrawledNode struct {
+	Id node.ID
+
+	// Addresses advertised for this node by other nodes.
+	Addresses []address.Address
+
+	// Reachable is true if it was possible to connect to this node.
+	Reachable bool
+
+	// Address under which the node was reached.
+	Address address.Address
+
+	// Version reported by the node during the handshake.
+	Version string
+
+	// Neighbours contains the nodes returned by this node in response to
+	// the FindNode queries.
+	Neighbours []node.ID
+}
+
+// Crawl walks the entire DHT by sending FindNode queries to every node that
+// it can find starting with the nodes present in the local routing table. The
+// local node is included in the returned list. The crawl ends when there are
+// no more nodes to query or the context is closed, in which case the nodes
+// discovered so far are returned together with the error.
+func (d *dht) Crawl(ctx context.Context) ([]CrawledNode, error) {
+	c := &crawl{
+		d:     d,
+		nodes: make(map[string]*CrawledNode),
+		sem:   make(chan struct{}, crawlConcurrency),
+	}
+
+	// Local node.
+	self := &CrawledNode{
+		Id:        d.self.Id,
+		Reachable: true,
+		Version:   version.Version,
+	}
+	c.nodes[d.self.Id.String()] = self
+	c.order = append(c.order, self)
+
+	// Seed the crawl with the routing table.
+	var nodes []node.NodeInfo
+	for _, bucket := range d.rt.Dump() {
+		for _, entry := range bucket.Entries {
+			nodes = append(nodes, entry.Node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("buckets returned zero nodes")
+	}
+	c.discovered(ctx, self, nodes)
+
+	c.wg.Wait()
+
+	var rv []CrawledNode
+	c.mutex.Lock()
+	for _, crawledNode := range c.order {
+		rv = append(rv, *crawledNode)
+	}
+	c.mutex.Unlock()
+	return rv, ctx.Err()
+}
+
+// crawl holds the state of a single crawl.
+type crawl struct {
+	d     *dht
+	nodes map[string]*CrawledNode
+	order []*CrawledNode
+	mutex sync.Mutex
+	sem   chan struct{}
+	wg    sync.WaitGroup
+}
+
+// discovered records the nodes returned by a node and starts querying the
+// ones which weren't seen before.
+func (c *crawl) discovered(ctx context.Context, sender *CrawledNode, nodes []node.NodeInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, nd := range nodes {
+		if !containsId(sender.Neighbours, nd.Id) {
+			sender.Neighbours = append(sender.Neighbours, nd.Id)
+		}
+
+		crawledNode, ok := c.nodes[nd.Id.String()]
+		if !ok {
+			crawledNode = &CrawledNode{Id: nd.Id}
+			c.nodes[nd.Id.String()] = crawledNode
+			c.order = append(c.order, crawledNode)
+
+			c.wg.Add(1)
+			go func(nd node.NodeInfo) {
+				defer c.wg.Done()
+				c.visit(ctx, nd)
+			}(nd)
+		}
+		for _, addr := range nd.Addresses {
+			if !address.Contains(crawledNode.Addresses, addr) {
+				crawledNode.Addresses = append(crawledNode.Addresses, addr)
+			}
+		}
+	}
+}
+
+// visit dials the node and queries it. The addresses are dialed one by one in
+// order to record which one was used to reach the node.
+func (c *crawl) visit(ctx context.Context, nd node.NodeInfo) {
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		return
+	}
+
+	var p network.Peer
+	var reachedAddress address.Address
+	for _, addr := range nd.Addresses {
+		var err error
+		p, err = c.d.net.Dial(ctx, node.NodeInfo{Id: nd.Id, Addresses: []address.Address{addr}})
+		if err == nil {
+			reachedAddress = addr
+			break
+		}
+		log.Debugf("crawl: %s unreachable on %s: %s", nd.Id, addr, err)
+	}
+	if p == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	crawledNode := c.nodes[nd.Id.String()]
+	crawledNode.Reachable = true
+	crawledNode.Address = reachedAddress
+	crawledNode.Version = p.Version()
+	c.mutex.Unlock()
+
+	for i := 0; i < crawlQueriesPerNode && i < len(nd.Id)*8; i++ {
+		qCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+		response, err := c.d.queryFindNode(qCtx, p, kbuckets.RandomId(nd.Id, i))
+		cancel()
+		if err != nil {
+			log.Debugf("crawl: query to %s failed: %s", nd.Id, err)
+			return
+		}
+		c.discovered(ctx, crawledNode, response.Nodes)
+	}
+}
+
+func containsId(ids []node.ID, id node.ID) bool {
+	for _, i := range ids {
+		if node.CompareId(i, id) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/core/dht/kbuckets"
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func crawlTestId(b byte) node.ID {
+	id := make(node.ID, crypto.KeyDigestLength)
+	id[0] = b
+	return id
+}
+
+func crawlTestInfo(b byte) node.NodeInfo {
+	return node.NodeInfo{
+		Id:        crawlTestId(b),
+		Addresses: []address.Address{testAddress(fmt.Sprintf("10.0.0.%d", b))},
+	}
+}
+
+// crawlTestNetwork is an in-memory network in which every node responds to
+// the FindNode queries with a fixed list of neighbours.
+type crawlTestNetwork struct {
+	network.Network
+	neighbours map[string][]node.NodeInfo
+	dials      map[string]int
+	mutex      sync.Mutex
+}
+
+func (n *crawlTestNetwork) Dial(ctx context.Context, nd node.NodeInfo) (network.Peer, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.dials[nd.Id.String()]++
+	neighbours, ok := n.neighbours[nd.Id.String()]
+	if !ok {
+		return nil, errors.New("unreachable")
+	}
+	return &crawlTestPeer{id: nd.Id, neighbours: neighbours}, nil
+}
+
+type crawlTestPeer struct {
+	network.Peer
+	id         node.ID
+	neighbours []node.NodeInfo
+}
+
+func (p *crawlTestPeer) Id() node.ID {
+	return p.id
+}
+
+func (p *crawlTestPeer) Version() string {
+	return "test"
+}
+
+func (p *crawlTestPeer) Request(ctx context.Context, msg proto.Message) (proto.Message, error) {
+	if _, ok := msg.(*message.FindNode); !ok {
+		return nil, errors.Errorf("unexpected request %T", msg)
+	}
+	response := &message.Nodes{}
+	for _, nd := range p.neighbours {
+		response.Nodes = append(response.Nodes, nd.Message())
+	}
+	return response, nil
+}
+
+// TestCrawl makes sure that the crawl terminates once every node was visited,
+// that every node is dialed and reported only once even though the nodes
+// return each other and the local node and that the unreachable nodes are
+// reported as well.
+func TestCrawl(t *testing.T) {
+	self := crawlTestInfo(0)
+	net := &crawlTestNetwork{
+		neighbours: map[string][]node.NodeInfo{
+			crawlTestId(1).String(): {self, crawlTestInfo(2), crawlTestInfo(3)},
+			crawlTestId(2).String(): {crawlTestInfo(1), crawlTestInfo(3), crawlTestInfo(4)},
+			crawlTestId(3).String(): {crawlTestInfo(1), crawlTestInfo(2)},
+		},
+		dials: make(map[string]int),
+	}
+	d := &dht{
+		net:  net,
+		rt:   kbuckets.New(self.Id, paramK, time.Hour),
+		self: node.Identity{Id: self.Id},
+	}
+	d.rt.Update(crawlTestId(1), crawlTestInfo(1).Addresses)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	nodes, err := d.Crawl(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 5 {
+		t.Fatalf("Invalid number of nodes %d", len(nodes))
+	}
+	for i, crawledNode := range nodes {
+		for _, other := range nodes[:i] {
+			if node.CompareId(crawledNode.Id, other.Id) {
+				t.Fatalf("Node %s reported twice", crawledNode.Id)
+			}
+		}
+		reachable := crawledNode.Id[0] != 4
+		if crawledNode.Reachable != reachable {
+			t.Fatalf("Node %s reachable %t", crawledNode.Id, crawledNode.Reachable)
+		}
+		if i > 0 && len(crawledNode.Addresses) != 1 {
+			t.Fatalf("Node %s has addresses %s", crawledNode.Id, crawledNode.Addresses)
+		}
+	}
+	if !node.CompareId(nodes[0].Id, self.Id) {
+		t.Fatal("Local node should be first")
+	}
+
+	for _, b := range []byte{1, 2, 3, 4} {
+		if dials := net.dials[crawlTestId(b).String()]; dials != 1 {
+			t.Fatalf("Node %d dialed %d times", b, dials)
+		}
+	}
+	if net.dials[self.Id.String()] != 0 {
+		t.Fatal("Local node was dialed")
+	}
+}
@@ -58,6 +58,15 @@ func (d *Datastore) Get(key []byte) (interface{}, error) {
 	}
 }
 
+// Len returns the number of entries which weren't removed yet.
+func (d *Datastore) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.cleanup()
+	return len(d.items)
+}
+
 // cleanup removes the stale data.
 func (d *Datastore) cleanup() {
 	n := time.Now()
@@ -72,3 +72,14 @@ func TestTimeout(t *testing.T) {
 		t.Fatal("Get should not fail")
 	}
 }
+
+func TestLen(t *testing.T) {
+	d := New(time.Second)
+
+	d.Store([]byte{0}, nil)
+	d.Store([]byte{1}, nil)
+	d.Store([]byte{1}, nil)
+	if l := d.Len(); l != 2 {
+		t.Fatal("Invalid length", l)
+	}
+}
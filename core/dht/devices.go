@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ErrNoDeviceList is returned by GetDeviceList if the id doesn't belong to
+// a master identity.
+var ErrNoDeviceList = errors.New("device list not found")
+
+// newDeviceListStore creates a store for the device lists. A newer device list
+// replaces the older lists.
+func newDeviceListStore() *recordStore {
+	s := newRecordStore("device list", pubKeyStoreTimeout)
+	s.fromMessage = func(msg *message.StorePubKey) (interface{}, node.ID, error) {
+		if msg.GetDeviceList() == nil {
+			return nil, nil, nil
+		}
+		l, err := node.NewDeviceListFromMessage(msg.GetDeviceList())
+		if err != nil {
+			return nil, nil, err
+		}
+		id, err := l.MasterId()
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, id, nil
+	}
+	s.toMessage = func(record interface{}) (*message.StorePubKey, error) {
+		return storePubKeyWithDeviceList(record.(*node.DeviceList))
+	}
+	s.keep = func(stored, record interface{}) bool {
+		return stored.(*node.DeviceList).Timestamp.After(record.(*node.DeviceList).Timestamp)
+	}
+	return s
+}
+
+func (d *dht) PutDeviceList(ctx context.Context, l *node.DeviceList) error {
+	if err := l.Validate(); err != nil {
+		return errors.Wrap(err, "invalid device list")
+	}
+	id, err := l.MasterId()
+	if err != nil {
+		return err
+	}
+	log.Debugf("PutDeviceList %s", id)
+
+	d.deviceLists.put(id, l)
+	d.deviceListsMutex.Lock()
+	d.issuedDeviceList = l
+	d.deviceListsMutex.Unlock()
+
+	return d.publishRecord(ctx, d.deviceLists, id, l)
+}
+
+// republishDeviceList republishes the device list passed to PutDeviceList.
+func (d *dht) republishDeviceList(ctx context.Context) {
+	d.deviceListsMutex.Lock()
+	l := d.issuedDeviceList
+	d.deviceListsMutex.Unlock()
+
+	if l == nil {
+		return
+	}
+	id, err := l.MasterId()
+	if err != nil {
+		return
+	}
+	if err := d.publishRecord(ctx, d.deviceLists, id, l); err != nil {
+		log.Debugf("republishing device list of %s failed: %s", id, err)
+	}
+}
+
+func (d *dht) GetDeviceList(ctx context.Context, id node.ID) (*node.DeviceList, error) {
+	log.Debugf("GetDeviceList %s", id)
+
+	if _, ok := d.Revoked(id); ok {
+		return nil, ErrRevoked
+	}
+
+	// The master identities don't connect to the network so the nodes
+	// which we are communicating with are not master identities.
+	if _, err := d.net.FindActive(id); err == nil {
+		return nil, ErrNoDeviceList
+	}
+
+	if l, ok := d.DeviceList(id); ok {
+		log.Debugf("GetDeviceList %s had locally", id)
+		return l, nil
+	}
+	record, err := d.lookupRecord(ctx, d.deviceLists, id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrNoDeviceList
+	}
+	return record.(*node.DeviceList), nil
+}
+
+func (d *dht) DeviceList(id node.ID) (*node.DeviceList, bool) {
+	record, ok := d.deviceLists.get(id)
+	if !ok {
+		return nil, false
+	}
+	return record.(*node.DeviceList), true
+}
+
+// storePubKeyWithDeviceList creates a StorePubKey message containing the
+// master key and the device list.
+func storePubKeyWithDeviceList(l *node.DeviceList) (*message.StorePubKey, error) {
+	listMsg, err := l.Message()
+	if err != nil {
+		return nil, err
+	}
+	return &message.StorePubKey{
+		Key:        listMsg.GetMasterKey(),
+		DeviceList: listMsg,
+	}, nil
+}
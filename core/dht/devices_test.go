@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/boreq/starlight/network/node"
+)
+
+func TestStoreDeviceList(t *testing.T) {
+	master, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older, err := node.NewDeviceList(master, []node.ID{device.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := older.Update(master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dht{deviceLists: newDeviceListStore()}
+	if _, ok := d.DeviceList(master.Id); ok {
+		t.Fatal("Device list found")
+	}
+
+	// The newest list is kept.
+	d.deviceLists.put(master.Id, newer)
+	if l := d.deviceLists.put(master.Id, older); l != newer {
+		t.Fatal("Newer list should be kept")
+	}
+	l, ok := d.DeviceList(master.Id)
+	if !ok || l.Contains(device.Id) {
+		t.Fatal("Newer list should be stored")
+	}
+}
+
+func TestDeviceListFromMessage(t *testing.T) {
+	master, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := node.NewDeviceList(master, []node.ID{device.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := storePubKeyWithDeviceList(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubKeyFromMessage(master.Id, msg); err != nil {
+		t.Fatal(err)
+	}
+	s := newDeviceListStore()
+	loaded, err := s.extract(master.Id, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || !loaded.(*node.DeviceList).Contains(device.Id) {
+		t.Fatal("Device list not returned")
+	}
+	if _, err := s.extract(device.Id, msg); err == nil {
+		t.Fatal("Device list of a different node was accepted")
+	}
+
+	msg.DeviceList.DeviceIds = nil
+	if _, err := s.extract(master.Id, msg); err == nil {
+		t.Fatal("Modified device list was accepted")
+	}
+}
@@ -10,9 +10,11 @@ import (
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/protocol/message"
 	"github.com/boreq/starlight/utils"
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -35,9 +37,26 @@ const SigningHash = crypto.SHA256
 // Stored public keys will be removed after this time passes.
 const pubKeyStoreTimeout = 2 * time.Hour
 
+// Stored revocations will be removed after this time passes. The revocations
+// are republished by the nodes which issued them during the bootstrap
+// procedure.
+const revocationStoreTimeout = 7 * 24 * time.Hour
+
+// The ids which don't belong to master identities are remembered for this
+// long in order to avoid repeating the lookups of their device lists.
+const noDeviceListTimeout = 10 * time.Minute
+
 // How often the bootstrap procedure should run.
 const bootstrapInterval = 1 * time.Hour
 
+// How often the nodes discovered on the local network are inserted into the
+// buckets.
+const localNodesInterval = 30 * time.Second
+
+// How long to wait for the nodes on the local network to announce themselves
+// if the bootstrap nodes are unreachable.
+const localBootstrapTimeout = 10 * time.Second
+
 // How often should a bucket be refreshed if no lookup procedure was performed
 // on the nodes falling within its range.
 const refreshbucketsAfter = 1 * time.Hour
@@ -53,7 +72,16 @@ func New(ctx context.Context, net network.Network, ident node.Identity) DHT {
 		disp:         dispatcher.New(ctx),
 		pubKeysStore: datastore.New(pubKeyStoreTimeout),
 		channelStore: channelstore.New(maxStoreChannelMessageAge),
+
+		revocations:       newRevocationStore(),
+		issuedRevocations: make(map[string]*node.Revocation),
+
+		deviceLists:   newDeviceListStore(),
+		noDeviceLists: datastore.New(noDeviceListTimeout),
+
+		trustLists: newTrustListStore(),
 	}
+	net.Protect(rv.isNeighbour)
 	go rv.listenToNetwork()
 	return rv
 }
@@ -66,6 +94,33 @@ type dht struct {
 	disp         dispatcher.Dispatcher
 	pubKeysStore *datastore.Datastore
 	channelStore *channelstore.Channelstore
+	refresh      refreshProgress
+	metrics      lookupMetrics
+
+	revocations       *recordStore
+	issuedRevocations map[string]*node.Revocation
+	revocationsMutex  sync.Mutex
+
+	deviceLists      *recordStore
+	noDeviceLists    *datastore.Datastore
+	issuedDeviceList *node.DeviceList
+	deviceListsMutex sync.Mutex
+
+	trustLists      *recordStore
+	issuedTrustList *node.TrustList
+	trustListsMutex sync.Mutex
+}
+
+// isNeighbour returns true if the node is one of the closest nodes to the
+// local node found in the routing table. The connections with the neighbours
+// are protected since they are the most likely to be queried by other nodes.
+func (d *dht) isNeighbour(id node.ID) bool {
+	for _, nodeInfo := range d.rt.GetClosest(d.self.Id, paramK) {
+		if node.CompareId(nodeInfo.Id, id) {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *dht) Subscribe() (chan dispatcher.IncomingMessage, dispatcher.CancelFunc) {
@@ -88,17 +143,26 @@ func (d *dht) listenToNetwork() {
 func (d *dht) Init(nodes []node.NodeInfo) error {
 	// Init the DHT - insert all defined bootstrap nodes into the buckets.
 	for _, nodeInfo := range nodes {
-		d.rt.Update(nodeInfo.Id, nodeInfo.Address)
+		d.rt.Update(nodeInfo.Id, nodeInfo.Addresses)
 	}
 
-	// Init the DHT - refresh the more distant buckets.
-	// TODO
-
-	// Init the DHT - run FindNode on local node's id.
-	_, err := d.findNode(d.ctx, d.self.Id, false)
+	// Init the DHT - run FindNode on local node's id in order to locate
+	// the closest neighbours. If the bootstrap nodes are unreachable use
+	// the nodes discovered on the local network instead.
+	closest, err := d.findClosest(d.ctx, d.self.Id)
+	if (err != nil || len(closest) == 0) && d.waitForLocalNodes(d.ctx, localBootstrapTimeout) {
+		log.Print("bootstrap nodes unreachable, using the nodes on the local network")
+		_, err = d.findClosest(d.ctx, d.self.Id)
+	}
 	if err != nil {
 		return errors.Wrap(err, "findNode on local id failed")
 	}
+	go d.runLocalNodes(d.ctx, localNodesInterval)
+
+	// Init the DHT - refresh the buckets which are further away than the
+	// closest neighbour. This populates the routing table instead of
+	// waiting for the regular refresh.
+	go d.initialRefresh(d.ctx)
 
 	// Init the DHT - run the bootstrap once before returning and then
 	// continue in a loop.
@@ -124,14 +188,63 @@ func (d *dht) runBootstrap(ctx context.Context, interval time.Duration) {
 	}
 }
 
+// runLocalNodes periodically inserts the nodes discovered on the local network
+// into the buckets.
+func (d *dht) runLocalNodes(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.addLocalNodes()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addLocalNodes inserts the nodes discovered on the local network into the
+// buckets.
+func (d *dht) addLocalNodes() {
+	nodes, _ := d.net.LocalNodes()
+	for _, nodeInfo := range nodes {
+		d.rt.Update(nodeInfo.Id, nodeInfo.Addresses)
+	}
+}
+
+// waitForLocalNodes waits until the nodes on the local network are discovered
+// and inserts them into the buckets. Returns false if the local discovery is
+// disabled or no nodes were discovered in time.
+func (d *dht) waitForLocalNodes(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		nodes, err := d.net.LocalNodes()
+		if err != nil {
+			return false
+		}
+		if len(nodes) > 0 {
+			for _, nodeInfo := range nodes {
+				d.rt.Update(nodeInfo.Id, nodeInfo.Addresses)
+			}
+			return true
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
 func (d *dht) bootstrap(ctx context.Context) error {
 	log.Debug("bootstrap")
 
 	// Refresh buckets.
 	ids := d.rt.GetForRefresh()
 	for _, id := range ids {
-		log.Debugf("bootstrap findNode %s", id)
-		go d.findNode(ctx, id, false)
+		log.Debugf("bootstrap findClosest %s", id)
+		go d.findClosest(ctx, id)
 	}
 
 	// Republish local node's public key.
@@ -140,40 +253,43 @@ func (d *dht) bootstrap(ctx context.Context) error {
 		return err
 	}
 
+	// Republish the revocations issued by the local node.
+	go d.republishRevocations(ctx)
+
+	// Republish the device list of the master identity of the local node.
+	go d.republishDeviceList(ctx)
+
+	// Republish the trust list of the local node.
+	go d.republishTrustList(ctx)
+
 	return nil
 }
 
 func (d *dht) handleMessage(ctx context.Context, msg dispatcher.IncomingMessage) error {
-	d.rt.Update(msg.Sender.Id, msg.Sender.Address)
+	d.rt.Update(msg.Sender.Id, msg.Sender.Addresses)
 
 	switch pMsg := msg.Message.(type) {
 
 	case *message.Ping:
-		peer, err := d.Dial(ctx, msg.Sender.Id)
-		if err == nil {
-			random := pMsg.GetRandom()
-			response := &message.Pong{Random: &random}
-			peer.Send(response)
-		}
+		random := pMsg.GetRandom()
+		response := &message.Pong{Random: &random}
+		d.respond(ctx, msg.Sender, msg.RequestId, response)
 
 	case *message.FindNode:
 		response := d.createNodesMessage(pMsg.GetId())
-		peer, err := d.Dial(ctx, msg.Sender.Id)
-		if err == nil {
-			peer.Send(response)
-		}
+		d.respond(ctx, msg.Sender, msg.RequestId, response)
 
 	case *message.StorePubKey:
 		d.handleStorePubKeyMsg(ctx, msg.Sender, pMsg)
 
 	case *message.FindPubKey:
-		d.handleFindPubKeyMsg(ctx, msg.Sender, pMsg)
+		d.handleFindPubKeyMsg(ctx, msg.Sender, msg.RequestId, pMsg)
 
 	case *message.StoreChannel:
 		d.handleStoreChannelMsg(ctx, msg.Sender, pMsg)
 
 	case *message.FindChannel:
-		d.handleFindChannelMsg(ctx, msg.Sender, pMsg)
+		d.handleFindChannelMsg(ctx, msg.Sender, msg.RequestId, pMsg)
 
 	case *message.PrivateMessage:
 		go d.disp.Dispatch(msg.Sender, pMsg)
@@ -194,29 +310,22 @@ func (d *dht) Dial(ctx context.Context, id node.ID) (network.Peer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return d.netDial(nd)
+	return d.netDial(ctx, nd)
 }
 
 // netDial wraps net.Dial in order to remove a node from the buckets if it fails
-// to respond or returns a different error.
-func (d *dht) netDial(nd node.NodeInfo) (network.Peer, error) {
-	p, err := d.net.Dial(nd)
-	if err != nil {
-		d.rt.Unresponsive(nd.Id, nd.Address)
+// to respond or returns a different error. The node is kept if the dial was
+// interrupted by the context.
+func (d *dht) netDial(ctx context.Context, nd node.NodeInfo) (network.Peer, error) {
+	p, err := d.net.Dial(ctx, nd)
+	if err != nil && ctx.Err() == nil {
+		for _, addr := range nd.Addresses {
+			d.rt.Unresponsive(nd.Id, addr)
+		}
 	}
 	return p, err
 }
 
-// netCheckOnline wraps net.CheckOnline in order to remove a node from the
-// buckets if it fails to respond or returns a different error.
-func (d *dht) netCheckOnline(ctx context.Context, nd node.NodeInfo) error {
-	err := d.net.CheckOnline(ctx, nd)
-	if err != nil {
-		d.rt.Unresponsive(nd.Id, nd.Address)
-	}
-	return err
-}
-
 func (d *dht) Ping(ctx context.Context, id node.ID) (*time.Duration, error) {
 	ctx, cancel := context.WithTimeout(d.ctx, 5*time.Second)
 	defer cancel()
@@ -226,46 +335,45 @@ func (d *dht) Ping(ctx context.Context, id node.ID) (*time.Duration, error) {
 		return nil, err
 	}
 
-	result := make(chan *message.Pong)
-
 	random := rand.Uint32()
-	go func() {
-		defer close(result)
-		c, cancel := d.net.Subscribe()
-		defer cancel()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-c:
-				if node.CompareId(msg.Sender.Id, id) {
-					pMsg, ok := msg.Message.(*message.Pong)
-					if ok && pMsg.GetRandom() == random {
-						select {
-						case <-ctx.Done():
-							return
-						case result <- pMsg:
-						}
-					}
-				}
-			}
-		}
-	}()
-
+	start := time.Now()
 	msg := &message.Ping{Random: &random}
-	err = peer.SendWithContext(ctx, msg)
+	response, err := peer.Request(ctx, msg)
 	if err != nil {
 		return nil, err
 	}
-	start := time.Now()
+	if pMsg, ok := response.(*message.Pong); !ok || pMsg.GetRandom() != random {
+		return nil, errors.New("invalid response")
+	}
+	duration := time.Since(start)
+	return &duration, nil
+}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-result:
-		duration := time.Since(start)
-		return &duration, nil
+// respond sends a response to a request received from a node.
+func (d *dht) respond(ctx context.Context, sender node.NodeInfo, requestId uint64, msg proto.Message) error {
+	peer, err := d.Dial(ctx, sender.Id)
+	if err != nil {
+		return err
+	}
+	return peer.Respond(ctx, requestId, msg)
+}
+
+// sendToAll sends a message to up to 'k' nodes. The DHT's context is used
+// so this function can be run in a goroutine after the calling procedure
+// returns.
+func (d *dht) sendToAll(nodes []node.NodeInfo, msg proto.Message) {
+	counter := 0
+	for _, nodeInfo := range nodes {
+		peer, err := d.netDial(d.ctx, nodeInfo)
+		if err == nil {
+			err := peer.SendWithContext(d.ctx, msg)
+			if err == nil {
+				counter++
+				if counter >= paramK {
+					return
+				}
+			}
+		}
 	}
 }
 
@@ -275,11 +383,7 @@ func (d *dht) createNodesMessage(id node.ID) *message.Nodes {
 	nodes := d.rt.GetClosest(id, paramK)
 	msg := &message.Nodes{}
 	for i := 0; i < len(nodes); i++ {
-		ndInfo := &message.Nodes_NodeInfo{
-			Id:      nodes[i].Id,
-			Address: &nodes[i].Address,
-		}
-		msg.Nodes = append(msg.Nodes, ndInfo)
+		msg.Nodes = append(msg.Nodes, nodes[i].Message())
 	}
 	return msg
 }
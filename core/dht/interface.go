@@ -4,6 +4,7 @@
 package dht
 
 import (
+	"github.com/boreq/starlight/core/dht/kbuckets"
 	"github.com/boreq/starlight/crypto"
 	"github.com/boreq/starlight/network"
 	"github.com/boreq/starlight/network/dispatcher"
@@ -38,6 +39,36 @@ type DHT interface {
 	// PutPubKey stores the public key of the specified node.
 	PutPubKey(ctx context.Context, id node.ID, key crypto.PublicKey) error
 
+	// PutRevocation stores the revocation of a key next to that key. The
+	// revocation is republished periodically. GetPubKey returns
+	// ErrRevoked for the revoked keys.
+	PutRevocation(ctx context.Context, r *node.Revocation) error
+
+	// Revoked returns the revocation of the key of the specified node if
+	// it is known. Unlike GetPubKey it doesn't perform a lookup.
+	Revoked(id node.ID) (*node.Revocation, bool)
+
+	// PutDeviceList stores the device list next to the master key. The
+	// list is republished periodically.
+	PutDeviceList(ctx context.Context, l *node.DeviceList) error
+
+	// GetDeviceList returns the newest device list of the specified
+	// master identity. ErrNoDeviceList is returned if the id isn't a master
+	// identity.
+	GetDeviceList(ctx context.Context, id node.ID) (*node.DeviceList, error)
+
+	// DeviceList returns the device list of the specified master identity
+	// if it is known. Unlike GetDeviceList it doesn't perform a lookup.
+	DeviceList(id node.ID) (*node.DeviceList, bool)
+
+	// PutTrustList stores the trust list of the local node next to its
+	// key. The list is republished periodically.
+	PutTrustList(ctx context.Context, l *node.TrustList) error
+
+	// GetTrustList returns the newest trust list of the specified node.
+	// ErrNoTrustList is returned if the node didn't publish a trust list.
+	GetTrustList(ctx context.Context, id node.ID) (*node.TrustList, error)
+
 	// GetChannel returns a list of nodes which have joined a channel.
 	GetChannel(ctx context.Context, id []byte) ([]node.ID, error)
 
@@ -45,4 +76,28 @@ type DHT interface {
 	// specifed channel. Other nodes can recover this information to know
 	// which nodes should receive messages related to that channel.
 	PutChannel(ctx context.Context, id []byte) error
+
+	// RefreshProgress returns the progress of the initial bucket refresh
+	// which is started by Init.
+	RefreshProgress() RefreshProgress
+
+	// BucketStats returns statistics describing how full the buckets of
+	// the routing table are.
+	BucketStats() []kbuckets.BucketStats
+
+	// RoutingTable returns the contents of the buckets and their
+	// replacement caches.
+	RoutingTable() []kbuckets.BucketDump
+
+	// Lookup performs the node lookup procedure for the given id. Each
+	// node which responds to a FindNode query is sent over the returned
+	// channel which is closed when the procedure ends.
+	Lookup(ctx context.Context, id node.ID) (<-chan LookupResult, error)
+
+	// Crawl walks the DHT and returns all nodes which could be found.
+	Crawl(ctx context.Context) ([]CrawledNode, error)
+
+	// LookupMetrics returns metrics describing the hop counts and
+	// latencies of the performed lookup procedures.
+	LookupMetrics() LookupMetrics
 }
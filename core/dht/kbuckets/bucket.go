@@ -3,13 +3,109 @@ package kbuckets
 import (
 	"container/list"
 	"errors"
-	"github.com/boreq/starlight/network/node"
+	"sort"
 	"time"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
 )
 
+// maxAddresses limits the number of addresses stored for a single node. The
+// addresses with the lowest rank are forgotten first.
+const maxAddresses = 8
+
 type bucketEntry struct {
-	Node  node.NodeInfo
-	Stale bool
+	Id        node.ID
+	Addresses []*addressEntry
+	LastSeen  time.Time
+}
+
+// addressEntry tracks a single address of a node.
+type addressEntry struct {
+	Address  address.Address
+	LastSeen time.Time
+
+	// Failures is the number of failed attempts to contact the node under
+	// this address since it was last seen.
+	Failures int
+}
+
+// Stale returns true if all addresses of the node are unresponsive.
+func (en *bucketEntry) Stale() bool {
+	for _, a := range en.Addresses {
+		if a.Failures == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Node returns the node info with the addresses ordered by their rank.
+func (en *bucketEntry) Node() node.NodeInfo {
+	rv := node.NodeInfo{Id: en.Id}
+	for _, a := range en.Addresses {
+		rv.Addresses = append(rv.Addresses, a.Address)
+	}
+	return rv
+}
+
+// update marks the addresses as seen, inserts the ones which weren't known
+// before and ranks them again.
+func (en *bucketEntry) update(addresses []address.Address, lastSeen time.Time) {
+	en.LastSeen = lastSeen
+	for _, addr := range addresses {
+		if a := en.find(addr); a != nil {
+			a.LastSeen = lastSeen
+			a.Failures = 0
+		} else {
+			en.Addresses = append(en.Addresses, &addressEntry{Address: addr, LastSeen: lastSeen})
+		}
+	}
+	en.rank()
+	if len(en.Addresses) > maxAddresses {
+		en.Addresses = en.Addresses[:maxAddresses]
+	}
+}
+
+// rank sorts the addresses placing the ones which failed the least number of
+// times first, then the most recently seen ones, then the ones with the widest
+// scope.
+func (en *bucketEntry) rank() {
+	sort.SliceStable(en.Addresses, func(i, j int) bool {
+		a, b := en.Addresses[i], en.Addresses[j]
+		if a.Failures != b.Failures {
+			return a.Failures < b.Failures
+		}
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+		return a.Address.Scope() > b.Address.Scope()
+	})
+}
+
+func (en *bucketEntry) find(addr address.Address) *addressEntry {
+	for _, a := range en.Addresses {
+		if a.Address == addr {
+			return a
+		}
+	}
+	return nil
+}
+
+func (en *bucketEntry) dump() Entry {
+	rv := Entry{
+		Node:     en.Node(),
+		Stale:    en.Stale(),
+		LastSeen: en.LastSeen,
+	}
+	for _, a := range en.Addresses {
+		rv.Addresses = append(rv.Addresses, AddressEntry{
+			Address:  a.Address,
+			LastSeen: a.LastSeen,
+			Failures: a.Failures,
+		})
+	}
+	return rv
 }
 
 type bucket struct {
@@ -32,35 +128,74 @@ func (b *bucket) Contains(id node.ID) bool {
 	return b.find(id) != nil
 }
 
+// StaleLen returns the number of entries marked as unresponsive.
+func (b *bucket) StaleLen() int {
+	n := 0
+	for el := b.entries.Front(); el != nil; el = el.Next() {
+		if el.Value.(*bucketEntry).Stale() {
+			n++
+		}
+	}
+	return n
+}
+
 // Entries returns a slice with all entries in this bucket.
 func (b *bucket) Entries() []node.NodeInfo {
 	rw := make([]node.NodeInfo, b.Len())
 	i := 0
 	for el := b.entries.Front(); el != nil; el = el.Next() {
-		rw[i] = el.Value.(*bucketEntry).Node
+		rw[i] = el.Value.(*bucketEntry).Node()
 		i++
 	}
 	return rw
 }
 
-// Update adds a new entry at the front of the bucket or updates the address of
-// an already existing entry and moves it to front of the bucket.
-func (b *bucket) Update(id node.ID, address string) {
-	el := b.find(id)
+// Dump returns a copy of all entries in this bucket.
+func (b *bucket) Dump() []Entry {
+	var rw []Entry
+	for el := b.entries.Front(); el != nil; el = el.Next() {
+		rw = append(rw, el.Value.(*bucketEntry).dump())
+	}
+	return rw
+}
+
+// Update adds a new entry at the front of the bucket or updates the addresses
+// of an already existing entry and moves it to front of the bucket.
+func (b *bucket) Update(id node.ID, addresses []address.Address) {
+	en := b.get(id)
+	if en == nil {
+		en = &bucketEntry{Id: id}
+	}
+	en.update(addresses, time.Now())
+	b.insert(en)
+}
+
+// insert inserts an entry at the front of the bucket replacing an entry with
+// the same id if it exists.
+func (b *bucket) insert(en *bucketEntry) {
+	el := b.find(en.Id)
 	if el != nil {
 		b.entries.Remove(el)
 	}
-	en := &bucketEntry{node.NodeInfo{Id: id, Address: address}, false}
 	b.entries.PushFront(en)
 }
 
-// Unresponsive marks an entry as unresponsive.
-func (b *bucket) Unresponsive(id node.ID, address string) {
-	el := b.find(id)
-	if el != nil {
-		en := el.Value.(*bucketEntry)
-		if en.Node.Address == address {
-			en.Stale = true
+// get returns the entry with the given id or nil if it doesn't exist.
+func (b *bucket) get(id node.ID) *bucketEntry {
+	if el := b.find(id); el != nil {
+		return el.Value.(*bucketEntry)
+	}
+	return nil
+}
+
+// Unresponsive records a failed attempt to contact a node under the given
+// address. The entry is considered to be stale once all of its addresses are
+// unresponsive.
+func (b *bucket) Unresponsive(id node.ID, addr address.Address) {
+	if en := b.get(id); en != nil {
+		if a := en.find(addr); a != nil {
+			a.Failures++
+			en.rank()
 		}
 	}
 }
@@ -74,42 +209,40 @@ func (b *bucket) TryReplaceLast(c *bucket) error {
 		return errors.New("the bucket is empty")
 	}
 	entry := el.Value.(*bucketEntry)
-	if !entry.Stale {
+	if !entry.Stale() {
 		return errors.New("the last entry is not stale")
 	}
-	nd, err := c.DropFirst()
+	en, err := c.DropFirst()
 	if err != nil {
 		return err
 	}
 	b.DropLast()
-	b.Update(nd.Id, nd.Address)
+	b.insert(en)
 	return nil
 }
 
 // DropLast removes the last entry from the bucket and returns it.
-func (b *bucket) DropLast() (*node.NodeInfo, error) {
+func (b *bucket) DropLast() (*bucketEntry, error) {
 	el := b.entries.Back()
 	if el == nil {
 		return nil, errors.New("bucket is empty")
 	}
-	entry := b.entries.Remove(el).(*bucketEntry).Node
-	return &entry, nil
+	return b.entries.Remove(el).(*bucketEntry), nil
 }
 
 // DropFirst removes the first entry from the bucket and returns it.
-func (b *bucket) DropFirst() (*node.NodeInfo, error) {
+func (b *bucket) DropFirst() (*bucketEntry, error) {
 	el := b.entries.Front()
 	if el == nil {
 		return nil, errors.New("bucket is empty")
 	}
-	entry := b.entries.Remove(el).(*bucketEntry).Node
-	return &entry, nil
+	return b.entries.Remove(el).(*bucketEntry), nil
 }
 
 // Find returns a list element which stores an entry with the given id.
 func (b *bucket) find(id node.ID) *list.Element {
 	for el := b.entries.Front(); el != nil; el = el.Next() {
-		en := el.Value.(*bucketEntry).Node
+		en := el.Value.(*bucketEntry)
 		if node.CompareId(en.Id, id) {
 			return el
 		}
@@ -1,12 +1,28 @@
 package kbuckets
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/boreq/starlight/network/address"
+)
+
+func testAddress(host string) address.Address {
+	return address.Address{Transport: address.TCP, Host: host, Port: 1836}
+}
+
+func testAddresses(hosts ...string) []address.Address {
+	var rv []address.Address
+	for _, host := range hosts {
+		rv = append(rv, testAddress(host))
+	}
+	return rv
+}
 
 // TestBucket ensures that the most basic functionality is in order by inserting
 // a single <id, addr> pair into the bucket.
 func TestBucket(t *testing.T) {
 	id := []byte{0}
-	addr := "addr"
+	addr := testAddresses("addr")
 
 	b := &bucket{}
 	if b.Len() != 0 {
@@ -28,11 +44,11 @@ func TestBucket(t *testing.T) {
 // TestTryReplace tests the replacement cache mechanism.
 func TestTryReplace(t *testing.T) {
 	b := &bucket{}
-	b.Update([]byte{0}, "addr0")
-	b.Update([]byte{1}, "addr1")
+	b.Update([]byte{0}, testAddresses("addr0"))
+	b.Update([]byte{1}, testAddresses("addr1"))
 
 	c := &bucket{}
-	c.Update([]byte{2}, "addr2")
+	c.Update([]byte{2}, testAddresses("addr2"))
 
 	// Fail, the entry in the bucket is not stale.
 	err := b.TryReplaceLast(c)
@@ -44,7 +60,7 @@ func TestTryReplace(t *testing.T) {
 	}
 
 	// Succeed after marking the entry as stale.
-	b.Unresponsive([]byte{0}, "addr0")
+	b.Unresponsive([]byte{0}, testAddress("addr0"))
 	err = b.TryReplaceLast(c)
 	if err != nil {
 		t.Fatal("The entry is stale, this should succeed, error:", err)
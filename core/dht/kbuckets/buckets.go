@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/boreq/starlight/network/address"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/utils"
 )
@@ -52,25 +53,85 @@ func (b *buckets) GetForRefresh() []node.ID {
 	now := time.Now()
 	for i, bu := range b.buckets {
 		if bu.LastLookup == nil || (*bu.LastLookup).Add(b.refreshAfter).Before(now) {
-			r := randomId(b.self, i)
+			r := RandomId(b.self, i)
 			rv = append(rv, r)
 		}
 	}
 	return rv
 }
 
+// GetForInitialRefresh returns random ids falling within the ranges of all
+// buckets which are further away than the closest neighbour of the local node.
+// Performing lookups on those ids after joining the network populates the
+// buckets which would otherwise remain empty until the regular refresh.
 func (b *buckets) GetForInitialRefresh() []node.ID {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	closest := -1
+	for _, bu := range b.buckets {
+		for _, entry := range bu.Entries() {
+			if node.CompareId(entry.Id, b.self) {
+				continue
+			}
+			dis, err := node.Distance(b.self, entry.Id)
+			if err != nil {
+				continue
+			}
+			if zeros := utils.ZerosLen(dis); zeros > closest {
+				closest = zeros
+			}
+		}
+	}
+
 	var rv []node.ID
+	for i := 0; i < closest; i++ {
+		rv = append(rv, RandomId(b.self, i))
+	}
 	return rv
 }
 
-func (b *buckets) Update(id node.ID, address string) {
+func (b *buckets) Stats() []BucketStats {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.update(id, address)
+
+	var rv []BucketStats
+	for i, bu := range b.buckets {
+		stats := BucketStats{
+			Capacity: b.k,
+			Entries:  bu.Len(),
+			Stale:    bu.StaleLen(),
+			Cached:   b.cache[i].Len(),
+		}
+		if bu.LastLookup != nil {
+			t := *bu.LastLookup
+			stats.LastLookup = &t
+		}
+		rv = append(rv, stats)
+	}
+	return rv
 }
 
-func (b *buckets) Unresponsive(id node.ID, address string) {
+func (b *buckets) Dump() []BucketDump {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var rv []BucketDump
+	for i, bu := range b.buckets {
+		dump := BucketDump{
+			Entries: bu.Dump(),
+			Cache:   b.cache[i].Dump(),
+		}
+		if bu.LastLookup != nil {
+			t := *bu.LastLookup
+			dump.LastLookup = &t
+		}
+		rv = append(rv, dump)
+	}
+	return rv
+}
+
+func (b *buckets) Update(id node.ID, addresses []address.Address) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -79,19 +140,40 @@ func (b *buckets) Unresponsive(id node.ID, address string) {
 		return
 	}
 
-	b.buckets[i].Unresponsive(id, address)
-	b.buckets[i].TryReplaceLast(b.cache[i])
+	en := b.buckets[i].get(id)
+	if en == nil {
+		en = b.cache[i].get(id)
+	}
+	if en == nil {
+		en = &bucketEntry{Id: id}
+	}
+	en.update(addresses, time.Now())
+	b.insert(en)
 }
 
-func (b *buckets) update(id node.ID, address string) {
+func (b *buckets) Unresponsive(id node.ID, addr address.Address) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
 	i, err := b.bucketIndex(id)
 	if err != nil {
 		return
 	}
 
+	b.buckets[i].Unresponsive(id, addr)
+	b.buckets[i].TryReplaceLast(b.cache[i])
+}
+
+// insert places an entry in the appropriate bucket or replacement cache.
+func (b *buckets) insert(en *bucketEntry) {
+	i, err := b.bucketIndex(en.Id)
+	if err != nil {
+		return
+	}
+
 	// If not full just insert.
-	if b.buckets[i].Len() < b.k || b.buckets[i].Contains(id) {
-		b.buckets[i].Update(id, address)
+	if b.buckets[i].Len() < b.k || b.buckets[i].Contains(en.Id) {
+		b.buckets[i].insert(en)
 	} else {
 		// Only the last bucket can be split and can we add more buckets?
 		if i == len(b.buckets)-1 && len(b.buckets) < len(b.self)*8 {
@@ -111,13 +193,13 @@ func (b *buckets) update(id node.ID, address string) {
 				if err != nil {
 					break
 				}
-				b.update(entry.Id, entry.Address)
+				b.insert(entry)
 			}
 			// Try insert new.
-			b.update(id, address)
+			b.insert(en)
 		} else {
 			// We can't split, drop last and insert.
-			b.cache[i].Update(id, address)
+			b.cache[i].insert(en)
 			if b.cache[i].Len() > b.k {
 				b.cache[i].DropLast()
 			}
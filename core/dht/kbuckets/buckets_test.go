@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"testing"
 	"time"
+
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/utils"
 )
 
 func TestBuckets(t *testing.T) {
@@ -12,18 +15,18 @@ func TestBuckets(t *testing.T) {
 
 	buckets := New(selfId, 2, 1*time.Minute)
 
-	buckets.Update([]byte{0x8}, "addr1")
-	buckets.Update([]byte{0xc}, "addr2")
-	buckets.Update([]byte{0xe}, "addr3")
+	buckets.Update([]byte{0x8}, testAddresses("addr1"))
+	buckets.Update([]byte{0xc}, testAddresses("addr2"))
+	buckets.Update([]byte{0xe}, testAddresses("addr3"))
 
 	fmt.Println("Add more distant ones")
-	buckets.Update([]byte{0xf0}, "add")
+	buckets.Update([]byte{0xf0}, testAddresses("add"))
 
 	fmt.Println("Update")
-	buckets.Update([]byte{0xe}, "addrnew")
+	buckets.Update([]byte{0xe}, testAddresses("addrnew"))
 
 	for _, entry := range buckets.GetClosest(selfId, 2) {
-		fmt.Printf("%x %s\n", entry.Id, entry.Address)
+		fmt.Printf("%x %s\n", entry.Id, entry.Addresses)
 	}
 }
 
@@ -38,8 +41,8 @@ func TestReplace(t *testing.T) {
 	}
 
 	// Insert two entries into the first bucket.
-	b.Update([]byte{allOnes}, "addr1")
-	b.Update([]byte{allOnes - 1}, "addr2")
+	b.Update([]byte{allOnes}, testAddresses("addr1"))
+	b.Update([]byte{allOnes - 1}, testAddresses("addr2"))
 	if len(b.buckets) != 1 || b.buckets[0].Len() != 2 {
 		t.Fatal("Invalid bucket len 1")
 	}
@@ -48,7 +51,7 @@ func TestReplace(t *testing.T) {
 	}
 
 	// Overflow the first bucket and split it.
-	b.Update([]byte{allOnes - 2}, "addr3")
+	b.Update([]byte{allOnes - 2}, testAddresses("addr3"))
 	if len(b.buckets) != 2 || b.buckets[0].Len() != 2 {
 		t.Fatal("Invalid bucket len 2")
 	}
@@ -57,9 +60,9 @@ func TestReplace(t *testing.T) {
 	}
 
 	// Mark the last entry as stale.
-	b.Unresponsive([]byte{allOnes}, "addr1")
-	b.Unresponsive([]byte{allOnes - 1}, "addr2")
-	b.Unresponsive([]byte{allOnes - 2}, "addr3")
+	b.Unresponsive([]byte{allOnes}, testAddress("addr1"))
+	b.Unresponsive([]byte{allOnes - 1}, testAddress("addr2"))
+	b.Unresponsive([]byte{allOnes - 2}, testAddress("addr3"))
 
 	// Since the entry is marked as stale it should be replaced.
 	if len(b.buckets) != 2 || !bytes.Equal(b.buckets[0].Entries()[0].Id, []byte{allOnes - 2}) {
@@ -69,3 +72,130 @@ func TestReplace(t *testing.T) {
 		t.Fatal("Invalid cache len 3")
 	}
 }
+
+// TestGetForInitialRefresh checks that the ids returned for the initial
+// refresh fall within the ranges of all buckets further away than the closest
+// neighbour.
+func TestGetForInitialRefresh(t *testing.T) {
+	selfId := []byte{0x0, 0x0}
+
+	buckets := New(selfId, 2, 1*time.Minute)
+	if ids := buckets.GetForInitialRefresh(); len(ids) != 0 {
+		t.Fatal("Empty buckets should not be refreshed", len(ids))
+	}
+
+	buckets.Update([]byte{0x80, 0x0}, testAddresses("addr1"))
+	buckets.Update([]byte{0x04, 0x0}, testAddresses("addr2"))
+
+	ids := buckets.GetForInitialRefresh()
+	if len(ids) != 5 {
+		t.Fatal("Invalid number of ids", len(ids))
+	}
+	for i, id := range ids {
+		dis, err := node.Distance(selfId, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if utils.ZerosLen(dis) != i {
+			t.Fatal("Invalid prefix len", utils.ZerosLen(dis), i)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	selfId := []byte{0x0}
+
+	buckets := New(selfId, 2, 1*time.Minute)
+	buckets.Update([]byte{0x8}, testAddresses("addr1"))
+	buckets.Update([]byte{0x9}, testAddresses("addr2"))
+	buckets.Unresponsive([]byte{0x9}, testAddress("addr2"))
+	buckets.PerformedLookup([]byte{0x8})
+
+	stats := buckets.Stats()
+	if len(stats) != 1 {
+		t.Fatal("Invalid number of buckets", len(stats))
+	}
+	if stats[0].Capacity != 2 || stats[0].Entries != 2 || stats[0].Stale != 1 || stats[0].Cached != 0 {
+		t.Fatalf("Invalid stats %#v", stats[0])
+	}
+	if stats[0].LastLookup == nil {
+		t.Fatal("Last lookup should be set")
+	}
+}
+
+func TestDump(t *testing.T) {
+	selfId := []byte{0x0}
+
+	buckets := New(selfId, 1, 1*time.Minute)
+	buckets.Update([]byte{0x80}, testAddresses("addr1"))
+	buckets.Update([]byte{0x40}, testAddresses("addr2"))
+	buckets.Update([]byte{0xc0}, testAddresses("addr3"))
+
+	dump := buckets.Dump()
+	if len(dump) != 2 {
+		t.Fatal("Invalid number of buckets", len(dump))
+	}
+	if len(dump[0].Entries) != 1 || !bytes.Equal(dump[0].Entries[0].Node.Id, []byte{0x80}) {
+		t.Fatalf("Invalid entries %#v", dump[0].Entries)
+	}
+	if len(dump[0].Cache) != 1 || !bytes.Equal(dump[0].Cache[0].Node.Id, []byte{0xc0}) {
+		t.Fatalf("Invalid cache %#v", dump[0].Cache)
+	}
+	if len(dump[1].Entries) != 1 || !bytes.Equal(dump[1].Entries[0].Node.Id, []byte{0x40}) {
+		t.Fatalf("Invalid entries %#v", dump[1].Entries)
+	}
+	for _, bu := range dump {
+		for _, entry := range append(bu.Entries, bu.Cache...) {
+			if entry.LastSeen.IsZero() {
+				t.Fatal("Last seen should be set")
+			}
+		}
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	selfId := []byte{0x0}
+	id := []byte{0x8}
+
+	buckets := New(selfId, 2, 1*time.Minute)
+	buckets.Update(id, testAddresses("addr1", "addr2"))
+
+	get := func() Entry {
+		dump := buckets.Dump()
+		if len(dump) != 1 || len(dump[0].Entries) != 1 {
+			t.Fatalf("Invalid dump %#v", dump)
+		}
+		return dump[0].Entries[0]
+	}
+
+	// The unresponsive address should be ranked lower.
+	buckets.Unresponsive(id, testAddress("addr1"))
+	entry := get()
+	if entry.Stale {
+		t.Fatal("Entry should not be stale")
+	}
+	if entry.Node.Addresses[0] != testAddress("addr2") || entry.Addresses[1].Failures != 1 {
+		t.Fatalf("Invalid addresses %#v", entry.Addresses)
+	}
+
+	// The entry is stale once all addresses are unresponsive.
+	buckets.Unresponsive(id, testAddress("addr2"))
+	if entry := get(); !entry.Stale {
+		t.Fatal("Entry should be stale")
+	}
+
+	// Seeing the node again resets the failures.
+	buckets.Update(id, testAddresses("addr1"))
+	entry = get()
+	if entry.Stale || entry.Node.Addresses[0] != testAddress("addr1") {
+		t.Fatalf("Invalid entry %#v", entry)
+	}
+
+	// The number of addresses is limited.
+	for i := 0; i < 2*maxAddresses; i++ {
+		buckets.Update(id, testAddresses(fmt.Sprintf("new%d", i)))
+	}
+	if entry := get(); len(entry.Addresses) != maxAddresses {
+		t.Fatal("Invalid number of addresses", len(entry.Addresses))
+	}
+}
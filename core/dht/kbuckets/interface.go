@@ -1,14 +1,86 @@
 package kbuckets
 
 import (
+	"time"
+
+	"github.com/boreq/starlight/network/address"
 	"github.com/boreq/starlight/network/node"
 )
 
 type RoutingTable interface {
-	Update(id node.ID, address string)
-	Unresponsive(id node.ID, address string)
+	// Update records that the node was seen under the given addresses.
+	Update(id node.ID, addresses []address.Address)
+
+	// Unresponsive records a failed attempt to contact the node under the
+	// given address.
+	Unresponsive(id node.ID, addr address.Address)
+
 	GetClosest(id node.ID, a int) []node.NodeInfo
 	PerformedLookup(id node.ID)
 	GetForRefresh() []node.ID
 	GetForInitialRefresh() []node.ID
+	Stats() []BucketStats
+	Dump() []BucketDump
+}
+
+// BucketDump contains the entries of a single bucket of the routing table and
+// of its replacement cache.
+type BucketDump struct {
+	// Entries stored in the bucket, most recently seen first.
+	Entries []Entry
+
+	// Cache contains the entries stored in the replacement cache of the
+	// bucket, most recently seen first.
+	Cache []Entry
+
+	// LastLookup is the time of the last lookup performed on an id falling
+	// within the range of the bucket or nil if no lookup was performed.
+	LastLookup *time.Time
+}
+
+// Entry is a single node stored in the routing table.
+type Entry struct {
+	Node node.NodeInfo
+
+	// Stale is true if all addresses of the node are unresponsive.
+	Stale bool
+
+	// LastSeen is the time when the node was last seen.
+	LastSeen time.Time
+
+	// Addresses of the node, best ranked first.
+	Addresses []AddressEntry
+}
+
+// AddressEntry is a single address of a node stored in the routing table.
+type AddressEntry struct {
+	Address address.Address
+
+	// LastSeen is the time when the node was last seen under this address.
+	LastSeen time.Time
+
+	// Failures is the number of failed attempts to contact the node under
+	// this address since it was last seen.
+	Failures int
+}
+
+// BucketStats describes how full a single bucket of the routing table is.
+type BucketStats struct {
+	// Capacity is the max number of entries in the bucket.
+	Capacity int
+
+	// Entries is the number of entries in the bucket.
+	Entries int
+
+	// Stale is the number of entries in the bucket which were marked as
+	// unresponsive.
+	Stale int
+
+	// Cached is the number of entries in the replacement cache of the
+	// bucket.
+	Cached int
+
+	// LastLookup is the time of the last lookup performed on an id falling
+	// within the range of the bucket or nil if no lookup was performed.
+	LastLookup *time.Time
 }
@@ -1,13 +1,20 @@
 package kbuckets
 
 import (
+	"math/rand"
+
 	"github.com/boreq/starlight/network/node"
 )
 
-// randomId creates a random id which has the same length as the provided id
+// RandomId creates a random id which has the same length as the provided id
 // and in which prefixLen starting bits are identical as in the provided id.
-func randomId(self node.ID, prefixLen int) node.ID {
+// The bit which comes after the prefix is always different than in the
+// provided id so that the distance between the ids has exactly prefixLen
+// leading zero bits.
+func RandomId(self node.ID, prefixLen int) node.ID {
 	rv := make([]byte, len(self))
+	rand.Read(rv)
+
 	// Copy the first bits.
 outer:
 	for i := 0; i < len(rv); i++ {
@@ -22,9 +29,9 @@ outer:
 		}
 	}
 
-	// Flip the bit that comes after them.
+	// Set the bit that comes after them to the opposite value.
 	mask := byte(1) << byte(7-prefixLen%8)
 	i := prefixLen / 8
-	rv[i] = rv[i] ^ mask
+	rv[i] = (rv[i] & ^mask) | (^self[i] & mask)
 	return rv
 }
@@ -13,7 +13,7 @@ func TestRandomId(t *testing.T) {
 	// Since this really is random there is a chance that the result is
 	// correct by accident.
 	for i := 0; i < 100; i++ {
-		rand := randomId(self, prefixLen)
+		rand := RandomId(self, prefixLen)
 		dis, err := node.Distance(self, rand)
 		if err != nil {
 			t.Fatal(err)
@@ -1,11 +1,12 @@
 package dht
 
 import (
-	"errors"
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/protocol/message"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -20,30 +21,14 @@ func (d *dht) PutPubKey(ctx context.Context, id node.ID, key crypto.PublicKey) e
 	msg := &message.StorePubKey{Key: keyBytes}
 
 	// Locate the closest nodes.
-	nodeResults, err := d.findNode(ctx, id, false)
+	nodes, err := d.findClosest(ctx, id)
 	if err != nil {
 		return err
 	}
 
 	// Send 'k' store RPCs. We don't have to wait for this to finish so
 	// a goroutine with the DHT's context is used instead of blocking.
-	go func() {
-		counter := 0
-		for _, nodes := range nodeResults {
-			for _, nodeInfo := range nodes {
-				peer, err := d.netDial(nodeInfo)
-				if err == nil {
-					err := peer.SendWithContext(d.ctx, msg)
-					if err == nil {
-						counter++
-						if counter > paramK {
-							return
-						}
-					}
-				}
-			}
-		}
-	}()
+	go d.sendToAll(nodes, msg)
 
 	return nil
 }
@@ -51,6 +36,10 @@ func (d *dht) PutPubKey(ctx context.Context, id node.ID, key crypto.PublicKey) e
 func (d *dht) GetPubKey(ctx context.Context, id node.ID) (crypto.PublicKey, error) {
 	log.Debugf("GetPubKey %s", id)
 
+	if _, ok := d.Revoked(id); ok {
+		return nil, ErrRevoked
+	}
+
 	// Try to find the key locally and if it isn't found perform a key
 	// lookup procedure.
 	key, err := d.getPubKeyLocally(id)
@@ -81,6 +70,11 @@ func (d *dht) getPubKeyLocally(id node.ID) (crypto.PublicKey, error) {
 		}
 	}
 
+	// Check the device lists which contain the master keys.
+	if l, ok := d.DeviceList(id); ok {
+		return l.MasterKey, nil
+	}
+
 	// Check if it is our key.
 	if node.CompareId(id, d.self.Id) {
 		return d.self.PubKey, nil
@@ -97,59 +91,113 @@ func (d *dht) getPubKey(ctx context.Context, id node.ID) (crypto.PublicKey, erro
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	result := make(chan crypto.PublicKey)
-
-	// Process incoming messages.
-	go func() {
-		c, cancel := d.net.Subscribe()
-		defer cancel()
-
-		for {
-			select {
-			case msg := <-c:
-				switch pMsg := msg.Message.(type) {
-				case *message.StorePubKey:
-					// TODO inefficient
-					pubKey, err := crypto.NewPublicKey(pMsg.GetKey())
-					if err == nil {
-						keyKey, err := pubKey.Hash()
-						if err == nil && node.CompareId(keyKey, id) {
-							select {
-							case result <- pubKey:
-								return
-							case <-ctx.Done():
-								return
-							}
-						}
-					}
-				}
-			case <-ctx.Done():
-				return
+	results, err := d.lookup(ctx, id, d.queryFindPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return d.pubKeyFromResults(id, results)
+}
+
+// pubKeyFromResults processes the responses of all nodes queried during the
+// lookup before accepting the key as the closest nodes may know about
+// a revocation of the key even if other nodes return the key. A revocation
+// returned by any node is stored and the lookup is stopped. Otherwise the
+// device lists and the trust lists are stored together with the key.
+func (d *dht) pubKeyFromResults(id node.ID, results <-chan LookupResult) (crypto.PublicKey, error) {
+	var key crypto.PublicKey
+	for result := range results {
+		for _, value := range result.Values {
+			storeMsg, ok := value.(*message.StorePubKey)
+			if !ok {
+				continue
+			}
+			msgKey, err := pubKeyFromMessage(id, storeMsg)
+			if err != nil {
+				log.Debugf("getPubKey %s invalid key: %s", id, err)
+				continue
+			}
+			r, err := d.revocations.extract(id, storeMsg)
+			if err != nil {
+				log.Debugf("getPubKey %s invalid revocation: %s", id, err)
+				continue
 			}
+			if r != nil {
+				d.revocations.put(id, r)
+				return nil, ErrRevoked
+			}
+			l, err := d.deviceLists.extract(id, storeMsg)
+			if err != nil {
+				log.Debugf("getPubKey %s invalid device list: %s", id, err)
+				continue
+			}
+			if l != nil {
+				d.deviceLists.put(id, l)
+			}
+			t, err := d.trustLists.extract(id, storeMsg)
+			if err != nil {
+				log.Debugf("getPubKey %s invalid trust list: %s", id, err)
+				continue
+			}
+			if t != nil {
+				d.trustLists.put(id, t)
+			}
+			key = msgKey
 		}
-	}()
+	}
+	if key == nil {
+		return nil, errors.New("key not found")
+	}
+	// Store locally before returning in order to cache the data.
+	d.pubKeysStore.Store(id, key)
+	return key, nil
+}
 
-	// Run the lookup procedure.
-	msgFactory := func(id node.ID) proto.Message {
-		rv := &message.FindPubKey{
-			Id: id,
+// queryFindPubKey sends a FindPubKey message and awaits either a StorePubKey
+// message containing the key or a Nodes message.
+func (d *dht) queryFindPubKey(ctx context.Context, p network.Peer, id node.ID) (queryResponse, error) {
+	msg := &message.FindPubKey{
+		Id: id,
+	}
+	response, err := p.Request(ctx, msg)
+	if err != nil {
+		return queryResponse{}, err
+	}
+	switch pMsg := response.(type) {
+	case *message.Nodes:
+	case *message.StorePubKey:
+		if _, err := pubKeyFromMessage(id, pMsg); err != nil {
+			return queryResponse{}, errors.Wrap(err, "invalid key")
 		}
-		return rv
+		if _, err := d.revocations.extract(id, pMsg); err != nil {
+			return queryResponse{}, errors.Wrap(err, "invalid revocation")
+		}
+		if _, err := d.deviceLists.extract(id, pMsg); err != nil {
+			return queryResponse{}, errors.Wrap(err, "invalid device list")
+		}
+		if _, err := d.trustLists.extract(id, pMsg); err != nil {
+			return queryResponse{}, errors.Wrap(err, "invalid trust list")
+		}
+	default:
+		return queryResponse{}, errors.Errorf("unexpected response %T", response)
 	}
-	go d.lookup(ctx, id, msgFactory, false)
+	return toQueryResponse(response), nil
+}
 
-	// Await results.
-	select {
-	case key := <-result:
-		// Store locally before returning in order to cache the data.
-		keyKey, err := key.Hash()
-		if err == nil {
-			d.pubKeysStore.Store(keyKey, key)
-		}
-		return key, nil
-	case <-ctx.Done():
-		return nil, errors.New("key not found")
+// pubKeyFromMessage extracts a public key from a StorePubKey message and
+// confirms that it belongs to the node with the given id.
+func pubKeyFromMessage(id node.ID, msg *message.StorePubKey) (crypto.PublicKey, error) {
+	pubKey, err := crypto.NewPublicKey(msg.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	keyKey, err := pubKey.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if !node.CompareId(keyKey, id) {
+		return nil, errors.New("key belongs to a different node")
 	}
+	return pubKey, nil
 }
 
 // handleStorePubKeyMsg processes an incoming StorePubKey message.
@@ -157,6 +205,23 @@ func (d *dht) handleStorePubKeyMsg(ctx context.Context, sender node.NodeInfo, ms
 	pubKey, err := crypto.NewPublicKey(msg.GetKey())
 	if err == nil {
 		keyKey, err := pubKey.Hash()
+		// Revocations are signed with the revoked keys so they can be
+		// sent by any node.
+		if err == nil && msg.GetRevocation() != nil {
+			return d.storeReceivedRecord(d.revocations, keyKey, msg)
+		}
+		// Device lists are signed with the master keys which never
+		// connect to the network so they can be sent by any node.
+		if err == nil && msg.GetDeviceList() != nil {
+			return d.storeReceivedRecord(d.deviceLists, keyKey, msg)
+		}
+		// Trust lists are signed with the keys so they can be stored
+		// by any node.
+		if err == nil && msg.GetTrustList() != nil {
+			if err := d.storeReceivedRecord(d.trustLists, keyKey, msg); err != nil {
+				return err
+			}
+		}
 		// A call to node.CompareId below doesn't allow other nodes to
 		// republish the data as there is no need to clutter the network
 		// with stale data.
@@ -169,7 +234,7 @@ func (d *dht) handleStorePubKeyMsg(ctx context.Context, sender node.NodeInfo, ms
 }
 
 // handleFindPubKeyMsg processes an incoming FindPubKey message.
-func (d *dht) handleFindPubKeyMsg(ctx context.Context, sender node.NodeInfo, msg *message.FindPubKey) error {
+func (d *dht) handleFindPubKeyMsg(ctx context.Context, sender node.NodeInfo, requestId uint64, msg *message.FindPubKey) error {
 	// Sanity.
 	id := msg.GetId()
 	if !node.ValidateId(id) {
@@ -177,13 +242,33 @@ func (d *dht) handleFindPubKeyMsg(ctx context.Context, sender node.NodeInfo, msg
 	}
 
 	var response proto.Message = nil
-	key, err := d.getPubKeyLocally(id)
-	if err == nil {
+	if r, ok := d.Revoked(id); ok {
+		log.Debug("FindPubKey response sending the revocation")
+		if storeMsg, err := storePubKeyWithRevocation(r); err == nil {
+			response = storeMsg
+		}
+	} else if l, ok := d.DeviceList(id); ok {
+		log.Debug("FindPubKey response sending the device list")
+		if storeMsg, err := storePubKeyWithDeviceList(l); err == nil {
+			response = storeMsg
+		}
+	} else if key, err := d.getPubKeyLocally(id); err == nil {
 		log.Debug("FindPubKey response sending the key directly")
 		if keyBytes, err := key.Bytes(); err == nil {
-			response = &message.StorePubKey{
+			storeMsg := &message.StorePubKey{
 				Key: keyBytes,
 			}
+			if l, ok := d.getTrustListLocally(id); ok {
+				storeMsg.TrustList, _ = l.Message()
+			}
+			response = storeMsg
+		}
+	} else if l, ok := d.getTrustListLocally(id); ok {
+		// The trust lists are stored by the closest nodes even if the
+		// key was sent by a different node.
+		log.Debug("FindPubKey response sending the trust list")
+		if storeMsg, err := storePubKeyWithTrustList(l); err == nil {
+			response = storeMsg
 		}
 	} else {
 		log.Debug("FindPubKey response sending the closest nodes")
@@ -191,14 +276,7 @@ func (d *dht) handleFindPubKeyMsg(ctx context.Context, sender node.NodeInfo, msg
 	}
 
 	if response != nil {
-		peer, err := d.Dial(ctx, sender.Id)
-		if err != nil {
-			return err
-		}
-		err = peer.Send(response)
-		if err != nil {
-			return err
-		}
+		return d.respond(ctx, sender, requestId, response)
 	}
 	return nil
 }
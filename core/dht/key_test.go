@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/boreq/starlight/core/dht/datastore"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+)
+
+func newTestKeyDht() *dht {
+	return &dht{
+		pubKeysStore: datastore.New(pubKeyStoreTimeout),
+		revocations:  newRevocationStore(),
+		deviceLists:  newDeviceListStore(),
+		trustLists:   newTrustListStore(),
+	}
+}
+
+// testResults returns the results of a lookup during which each node
+// returned one of the messages.
+func testResults(msgs ...proto.Message) <-chan LookupResult {
+	results := make(chan LookupResult, len(msgs))
+	for _, msg := range msgs {
+		results <- LookupResult{Values: []proto.Message{msg}}
+	}
+	close(results)
+	return results
+}
+
+func TestPubKeyFromResults(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := iden.PubKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestKeyDht()
+	if _, err := d.pubKeyFromResults(iden.Id, testResults(&message.Nodes{})); err == nil {
+		t.Fatal("Key should not be found")
+	}
+	key, err := d.pubKeyFromResults(iden.Id, testResults(&message.StorePubKey{Key: keyBytes}, &message.Nodes{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.pubKeysStore.Get(iden.Id); err != nil || key == nil {
+		t.Fatal("Key should be stored")
+	}
+}
+
+// TestPubKeyFromResultsRevoked checks if a revocation returned by any node
+// is taken into account even if other nodes return the key.
+func TestPubKeyFromResultsRevoked(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := iden.PubKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocationMsg, err := storePubKeyWithRevocation(newTestRevocation(t, iden, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestKeyDht()
+	results := testResults(&message.StorePubKey{Key: keyBytes}, &message.Nodes{}, revocationMsg)
+	if _, err := d.pubKeyFromResults(iden.Id, results); err != ErrRevoked {
+		t.Fatalf("Invalid error %v", err)
+	}
+	if _, ok := d.Revoked(iden.Id); !ok {
+		t.Fatal("Revocation should be stored")
+	}
+	if _, err := d.pubKeysStore.Get(iden.Id); err == nil {
+		t.Fatal("Revoked key should not be stored")
+	}
+}
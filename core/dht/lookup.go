@@ -0,0 +1,394 @@
+package dht
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/network"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/boreq/starlight/utils"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// queryTimeout specifies how much time a single node has to respond to
+// a query sent during the lookup procedure. The time needed to dial the node
+// is included.
+const queryTimeout = 5 * time.Second
+
+// queryResponse is a response received from a node queried during the lookup
+// procedure.
+type queryResponse struct {
+	// Nodes returned by the queried node which are closer to the searched
+	// id.
+	Nodes []node.NodeInfo
+
+	// Values returned by the queried node, for example public keys or
+	// channel memberships.
+	Values []proto.Message
+}
+
+// queryFunc sends a query related to the searched id to a peer and awaits the
+// response. Different functions are used to send different messages during
+// the lookup procedure, for example FindPubKey is used instead of FindNode
+// during a key lookup.
+type queryFunc func(ctx context.Context, p network.Peer, id node.ID) (queryResponse, error)
+
+// LookupResult is produced by the lookup procedure every time a queried node
+// responds.
+type LookupResult struct {
+	// Node which responded.
+	Node node.NodeInfo
+
+	// Hop is the number of nodes which had to be queried in order to
+	// learn about this node. Nodes taken from the local buckets are one
+	// hop away.
+	Hop int
+
+	// Latency is the time which elapsed between dialing the node and
+	// receiving its response.
+	Latency time.Duration
+
+	// Values returned by the node.
+	Values []proto.Message
+}
+
+// lookup starts an iterative procedure which attempts to locate k closest
+// nodes to a given key (node id). The procedure is performed over d disjoint
+// paths. Every path keeps up to 'a' queries in flight and each query has to be
+// answered within queryTimeout. Results are sent using the returned channel as
+// soon as the queried nodes respond and the channel is closed when the
+// procedure ends. Cancelling the context terminates the procedure early.
+func (d *dht) lookup(ctx context.Context, id node.ID, query queryFunc) (<-chan LookupResult, error) {
+	var log = log.GetLogger("lookup id=%s", id)
+	log.Debug("starting")
+
+	// Register that the lookup was performed to avoid refreshing the bucket
+	// that this node falls into during the bootstrap procedure.
+	d.rt.PerformedLookup(id)
+
+	// Initial nodes from kbuckets. Take more than 'a' since some of them
+	// may be offline. There is really no real reason why 'k' nodes are
+	// picked here - that number is simply significantly larger than 'a'.
+	nodes := d.rt.GetClosest(id, paramK)
+	if len(nodes) == 0 {
+		return nil, errors.New("buckets returned zero nodes")
+	}
+
+	// Split the returned nodes into 'd' paths randomly in order to perform
+	// a lookup over d disjoint paths.
+	l := &lookupProcedure{
+		d:     d,
+		id:    id,
+		query: query,
+		log:   log,
+	}
+	for i := 0; i < paramD; i++ {
+		l.paths = append(l.paths, newResultsList(id))
+	}
+	for i := range nodes {
+		j := rand.Intn(i + 1)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	for i := range nodes {
+		l.paths[i%paramD].Add(d.self.Id, 1, &nodes[i])
+	}
+
+	// Start the disjoint lookup procedure for each path.
+	results := make(chan LookupResult)
+	wg := &sync.WaitGroup{}
+	for i := range l.paths {
+		if len(l.paths[i].Get(1)) > 0 {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				l.runPath(ctx, i, results)
+			}(i)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		d.metrics.lookupFinished(l.maxHop())
+		log.Debug("finished")
+		close(results)
+	}()
+
+	return results, nil
+}
+
+// lookupProcedure holds the state of a single lookup procedure.
+type lookupProcedure struct {
+	d          *dht
+	id         node.ID
+	query      queryFunc
+	log        utils.Logger
+	paths      []*resultsList
+	pathsMutex sync.Mutex
+	hop        int
+	hopMutex   sync.Mutex
+}
+
+// queryResult is passed from the goroutines sending queries to the path which
+// started them.
+type queryResult struct {
+	nodeData *nodeData
+	address  address.Address
+	response queryResponse
+	latency  time.Duration
+	err      error
+}
+
+// runPath performs the lookup over a single disjoint path until all k closest
+// nodes in the path are processed or the context is closed.
+func (l *lookupProcedure) runPath(ctx context.Context, pathI int, results chan<- LookupResult) {
+	path := l.paths[pathI]
+
+	// The channel is buffered so that the goroutines sending queries never
+	// block even if this function already returned.
+	queryResults := make(chan queryResult, paramA)
+	inFlight := make(map[string]bool)
+
+	for {
+		// Send new queries.
+		for _, nData := range path.Get(paramK) {
+			if len(inFlight) >= paramA {
+				break
+			}
+			key := nData.Id.String()
+			if inFlight[key] || nData.IsProcessed() {
+				continue
+			}
+			addrData, err := nData.GetUnprocessedAddress()
+			if err != nil {
+				continue
+			}
+			if err := nData.MarkAddressProcessed(addrData.Address); err != nil {
+				l.log.Debugf("error marking address as processed: %s", err)
+			}
+			inFlight[key] = true
+			go l.send(ctx, nData, addrData.Address, queryResults)
+		}
+
+		// Nothing left to query and nothing to wait for.
+		if len(inFlight) == 0 {
+			return
+		}
+
+		// Await results.
+		select {
+		case result := <-queryResults:
+			delete(inFlight, result.nodeData.Id.String())
+			if result.err != nil {
+				l.log.Debugf("query to %s failed: %s", result.nodeData.Id, result.err)
+				continue
+			}
+			if err := result.nodeData.MarkAddressValid(result.address); err != nil {
+				l.log.Debugf("error marking address as valid: %s", err)
+			}
+			l.addNodes(pathI, result)
+
+			r := LookupResult{
+				Node:    node.NodeInfo{Id: result.nodeData.Id, Addresses: []address.Address{result.address}},
+				Hop:     result.nodeData.Hop,
+				Latency: result.latency,
+				Values:  result.response.Values,
+			}
+			select {
+			case results <- r:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send dials a node and sends a query to it.
+func (l *lookupProcedure) send(ctx context.Context, nData *nodeData, addr address.Address, c chan<- queryResult) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	start := time.Now()
+	result := queryResult{
+		nodeData: nData,
+		address:  addr,
+	}
+
+	ndInfo := node.NodeInfo{Id: nData.Id, Addresses: []address.Address{addr}}
+	l.log.Debugf("attempting to contact %s on %s", ndInfo.Id, addr)
+	p, err := l.d.netDial(ctx, ndInfo)
+	if err != nil {
+		result.err = errors.Wrap(err, "dial failed")
+	} else {
+		result.response, result.err = l.query(ctx, p, l.id)
+		if result.err == nil {
+			// Responses are not passed to the message handler so
+			// the buckets have to be updated here.
+			l.d.rt.Update(ndInfo.Id, ndInfo.Addresses)
+		}
+	}
+	result.latency = time.Since(start)
+
+	l.d.metrics.queryFinished(result.latency, result.err)
+	l.hopMutex.Lock()
+	if result.err == nil && nData.Hop > l.hop {
+		l.hop = nData.Hop
+	}
+	l.hopMutex.Unlock()
+	c <- result
+}
+
+// addNodes inserts the nodes returned by a queried node into a path. A node
+// which is already present in a different path is skipped to keep the paths
+// disjoint.
+func (l *lookupProcedure) addNodes(pathI int, result queryResult) {
+	l.pathsMutex.Lock()
+	defer l.pathsMutex.Unlock()
+
+	for i := range result.response.Nodes {
+		ndInfo := &result.response.Nodes[i]
+		if node.CompareId(ndInfo.Id, l.d.self.Id) {
+			continue
+		}
+		if l.isInOtherPaths(ndInfo.Id, pathI) {
+			continue
+		}
+		err := l.paths[pathI].Add(result.nodeData.Id, result.nodeData.Hop+1, ndInfo)
+		l.log.Debugf("adding a node %s - %s, err %v", ndInfo.Id, ndInfo.Addresses, err)
+	}
+}
+
+func (l *lookupProcedure) isInOtherPaths(id node.ID, pathI int) bool {
+	for i, path := range l.paths {
+		if i != pathI && path.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxHop returns the highest hop of a node which responded during this lookup.
+func (l *lookupProcedure) maxHop() int {
+	l.hopMutex.Lock()
+	defer l.hopMutex.Unlock()
+	return l.hop
+}
+
+// toQueryResponse converts the response received from a node into
+// a queryResponse.
+func toQueryResponse(response proto.Message) queryResponse {
+	rv := queryResponse{}
+	switch pMsg := response.(type) {
+	case *message.Nodes:
+		rv.Nodes = toNodeInfo(pMsg.GetNodes())
+	case *message.ChannelMembers:
+		rv.Nodes = toNodeInfo(pMsg.GetNodes())
+		for _, member := range pMsg.GetMembers() {
+			rv.Values = append(rv.Values, member)
+		}
+	default:
+		rv.Values = append(rv.Values, response)
+	}
+	return rv
+}
+
+// toNodeInfo converts the nodes received from other nodes. Invalid addresses
+// and nodes without valid addresses are skipped.
+func toNodeInfo(nodes []*message.Nodes_NodeInfo) []node.NodeInfo {
+	var rv []node.NodeInfo
+	for _, nd := range nodes {
+		ndInfo := node.NewNodeInfoFromMessage(nd)
+		if len(ndInfo.Addresses) > 0 {
+			rv = append(rv, ndInfo)
+		}
+	}
+	return rv
+}
+
+// sortByDistance sorts the nodes by their distance to the given id.
+func sortByDistance(id node.ID, nodes []node.NodeInfo) {
+	sort.Slice(nodes, func(i, j int) bool {
+		iDis, _ := node.Distance(id, nodes[i].Id)
+		jDis, _ := node.Distance(id, nodes[j].Id)
+		cmp, _ := utils.Compare(iDis, jDis)
+		return cmp < 0
+	})
+}
+
+// LookupMetrics describes the lookup procedures performed by the DHT.
+type LookupMetrics struct {
+	// Lookups is the number of finished lookup procedures.
+	Lookups int
+
+	// Queries is the number of queries sent to other nodes.
+	Queries int
+
+	// FailedQueries is the number of queries which failed or timed out.
+	FailedQueries int
+
+	// AverageHops is the average number of hops needed to reach the most
+	// distant node which responded during a lookup.
+	AverageHops float64
+
+	// MaxHops is the highest number of hops needed to reach a node which
+	// responded during a lookup.
+	MaxHops int
+
+	// AverageLatency is the average latency of successful queries.
+	AverageLatency time.Duration
+
+	// MaxLatency is the highest latency of a successful query.
+	MaxLatency time.Duration
+}
+
+type lookupMetrics struct {
+	metrics      LookupMetrics
+	totalHops    int
+	totalLatency time.Duration
+	mutex        sync.Mutex
+}
+
+func (m *lookupMetrics) lookupFinished(hops int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.metrics.Lookups++
+	m.totalHops += hops
+	m.metrics.AverageHops = float64(m.totalHops) / float64(m.metrics.Lookups)
+	if hops > m.metrics.MaxHops {
+		m.metrics.MaxHops = hops
+	}
+}
+
+func (m *lookupMetrics) queryFinished(latency time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.metrics.Queries++
+	if err != nil {
+		m.metrics.FailedQueries++
+		return
+	}
+	m.totalLatency += latency
+	m.metrics.AverageLatency = m.totalLatency / time.Duration(m.metrics.Queries-m.metrics.FailedQueries)
+	if latency > m.metrics.MaxLatency {
+		m.metrics.MaxLatency = latency
+	}
+}
+
+func (m *lookupMetrics) get() LookupMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.metrics
+}
+
+func (d *dht) LookupMetrics() LookupMetrics {
+	return d.metrics.get()
+}
@@ -2,14 +2,14 @@ package dht
 
 import (
 	"container/list"
-	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/boreq/starlight/network"
+	"github.com/boreq/starlight/network/address"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/protocol/message"
 	"github.com/boreq/starlight/utils"
-	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -19,12 +19,6 @@ import (
 // an error although it can still return a list of useful nodes.
 const findNodeTimeout = 20 * time.Second
 
-// findNodeLoopInterval specifies an interval between batches of find node
-// messages sent out by a find node procedure. The procedure iteratively sends
-// out new find node messages and waits for the responses for an amount of time
-// specified by the findNodeLoopInterval between iterations.
-const findNodeLoopInterval = 500 * time.Millisecond
-
 func (d *dht) FindNode(ctx context.Context, id node.ID) (node.NodeInfo, error) {
 	ctx, cancel := context.WithTimeout(ctx, findNodeTimeout)
 	defer cancel()
@@ -32,283 +26,68 @@ func (d *dht) FindNode(ctx context.Context, id node.ID) (node.NodeInfo, error) {
 	var log = log.GetLogger("FindNode id=%s", id)
 	log.Debug("starting")
 
-	// Run the lookup procedure
-	nodesLists, err := d.findNode(ctx, id, true)
+	// Run the lookup procedure and stop it the moment the right node
+	// responds.
+	results, err := d.lookup(ctx, id, d.queryFindNode)
 	if err != nil {
 		return node.NodeInfo{}, err
 	}
-
-	// Print the results for debug purposes
-	log.Debugf("got %d result lists", len(nodesLists))
-	for i, nodes := range nodesLists {
-		for _, node := range nodes {
-			log.Debug("nodelist %d: %#v", i, node)
-		}
-	}
-
-	// Check if the procedure managed to locate the right node
-	for _, nodes := range nodesLists {
-		if len(nodes) > 0 && node.CompareId(nodes[0].Id, id) {
-			return nodes[0], nil
+	for result := range results {
+		log.Debugf("result: %s - %s", result.Node.Id, result.Node.Addresses)
+		if node.CompareId(result.Node.Id, id) {
+			return result.Node, nil
 		}
 	}
 	return node.NodeInfo{}, errors.New("node not found")
 }
 
-// messageFactory is used to send different messages during the node lookup
-// procedure - for example FindPubKey is used instead of FindNode during a key
-// lookup, so the calling function has to provide a way of generating that
-// message instead of the default one. The provided node ID is the id of the
-// searched node.
-type messageFactory func(id node.ID) proto.Message
-
-// findNode performs a standard node lookup procedure using the FindNode
-// message.
-func (d *dht) findNode(ctx context.Context, id node.ID, breakOnResult bool) ([][]node.NodeInfo, error) {
-	msgFactory := func(id node.ID) proto.Message {
-		rv := &message.FindNode{
-			Id: id,
-		}
-		return rv
-	}
-	return d.lookup(ctx, id, msgFactory, breakOnResult)
+func (d *dht) Lookup(ctx context.Context, id node.ID) (<-chan LookupResult, error) {
+	return d.lookup(ctx, id, d.queryFindNode)
 }
 
-// lookup attempts to locate k closest nodes to a given key (node id). The
-// procedure is performed over disjoint paths. If breakOnResult is set this
-// function will return results the moment a node that we are looking for is
-// found in any of the lists (and it is possible to communicate with it).
-func (d *dht) lookup(ctx context.Context, id node.ID, msgFac messageFactory, breakOnResult bool) ([][]node.NodeInfo, error) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	var log = log.GetLogger("lookup id=%s", id)
-	log.Debug("starting")
-
-	// Register that the lookup was performed to avoid refreshing the bucket
-	// that this node falls into during the bootstrap procedure.
-	d.rt.PerformedLookup(id) // TODO move this somewhere else in this code?
-
-	// Initial nodes from kbuckets. Take more than 'a' since some of them
-	// may be offline. There is really no real reason why 'k' nodes are
-	// picked here - that number is simply significantly larger than 'a'.
-	nodes := d.rt.GetClosest(id, paramK)
-	if len(nodes) == 0 {
-		return nil, errors.New("buckets returned zero nodes")
-	}
-
-	for _, node := range nodes {
-		log.Debugf("nodes %s - %s", node.Id, node.Address)
+// findClosest performs a standard node lookup procedure using the FindNode
+// message and returns up to 'k' closest nodes which responded.
+func (d *dht) findClosest(ctx context.Context, id node.ID) ([]node.NodeInfo, error) {
+	results, err := d.lookup(ctx, id, d.queryFindNode)
+	if err != nil {
+		return nil, err
 	}
 
-	// Split the returned nodes into 'd' buckets randomly in order to perform
-	// a lookup over d disjoint paths.
-	var buckets []*resultsList
-	for i := 0; i < paramD; i++ {
-		buckets = append(buckets, newResultsList(id))
-	}
-	for i := range nodes {
-		j := rand.Intn(i + 1)
-		nodes[i], nodes[j] = nodes[j], nodes[i]
+	var rv []node.NodeInfo
+	for result := range results {
+		rv = append(rv, result.Node)
 	}
-	for i := range nodes {
-		buckets[i%paramD].Add(d.self.Id, &nodes[i])
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	for i, bucket := range buckets {
-		for _, node := range bucket.Get(paramK) {
-			log.Debugf("bucket %d contains node %s", i, node.Id)
-		}
-	}
-
-	// Start the disjoint lookup procedure for each bucket.
-	resultC := make(chan []node.NodeInfo, len(buckets))
-	bucketsMutex := &sync.Mutex{}
-
-	startedLookups := 0
-	for i := range buckets {
-		if len(buckets[i].Get(1)) > 0 {
-			startedLookups++
-			go d.lookupDisjointPath(ctx, buckets, bucketsMutex, i, id, msgFac, breakOnResult, resultC)
-		}
-	}
-
-	// Gather results from all disjoint lookup procedures.
-	var results [][]node.NodeInfo
-	responses := 0
-	for {
-		select {
-		case result := <-resultC:
-			responses++
-			results = append(results, result)
-			// If we are supposed to breakOnResult and the node has
-			// been found return immidiately.
-			if breakOnResult {
-				if len(result) > 0 && node.CompareId(result[0].Id, id) {
-					return results, nil
-				}
-			}
-			if responses >= startedLookups {
-				return results, nil
-			}
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+	sortByDistance(id, rv)
+	if len(rv) > paramK {
+		rv = rv[:paramK]
 	}
+	return rv, nil
 }
 
-func isInOtherBuckets(id node.ID, bucketI int, buckets []*resultsList) bool {
-	for i, bucket := range buckets {
-		if i != bucketI {
-			if bucket.Contains(id) {
-				return true
-			}
-		}
+// queryFindNode sends a FindNode message and awaits a Nodes message.
+func (d *dht) queryFindNode(ctx context.Context, p network.Peer, id node.ID) (queryResponse, error) {
+	msg := &message.FindNode{
+		Id: id,
 	}
-	return false
-}
-
-func (d *dht) lookupDisjointPath(ctx context.Context, buckets []*resultsList, bucketsMutex *sync.Mutex, bucketI int, id node.ID, msgFac messageFactory, breakOnResult bool, resultC chan<- []node.NodeInfo) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	var log = log.GetLogger("lookupDisjointPath id=%s bucket=%d", id, bucketI)
-	log.Debug("starting")
-
-	results := buckets[bucketI]
-
-	// Handle incoming Nodes messages.
-	go func() {
-		c, cancel := d.net.Subscribe()
-		defer cancel()
-		for {
-			select {
-			case msg := <-c:
-				switch pMsg := msg.Message.(type) {
-				case *message.Nodes:
-					// When a Nodes message is received add
-					// every single node to the list of
-					// results.
-					if results.WasQueried(msg.Sender.Id) {
-						for _, nd := range pMsg.Nodes {
-							ndInfo := &node.NodeInfo{Id: nd.GetId(), Address: nd.GetAddress()}
-							log.Debugf("received a response %s - %s", ndInfo.Id, ndInfo.Address)
-							if !node.CompareId(ndInfo.Id, d.self.Id) {
-								bucketsMutex.Lock()
-								if !isInOtherBuckets(ndInfo.Id, bucketI, buckets) {
-									err := results.Add(msg.Sender.Id, ndInfo)
-									log.Debugf("adding a node to buckets %s, err %s", ndInfo.Id, err)
-								}
-								bucketsMutex.Unlock()
-							}
-						}
-					}
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	var prevAllProcessed = false
-	for {
-		counterSent := 0
-		counterIter := 0
-		allProcessed := true
-
-		// Send new FindNode messages.
-		for i, nData := range results.Get(paramK) {
-			counterIter = i
-
-			// Stop after sending 'a' messages and await results.
-			if counterSent >= paramA {
-				break
-			}
-
-			// Stop if an address for this entry has been found or
-			// it hasn't been found but no more addresses are
-			// known.
-			if nData.IsProcessed() {
-				continue
-			}
-
-			allProcessed = false
-			address, err := nData.GetUnprocessedAddress()
-			if err != nil {
-				continue
-			}
-			if err := nData.MarkAddressProcessed(address.Address); err != nil {
-				log.Debugf("error marking address as processed: %s", err)
-			}
-
-			ndInfo := node.NodeInfo{Id: nData.Id, Address: address.Address}
-
-			log.Debugf("attempting to contact %s", ndInfo.Id)
-
-			// Send the lookup message to the node.
-			p, err := d.netDial(ndInfo)
-			if err == nil {
-				if breakOnResult {
-					if node.CompareId(p.Id(), id) {
-						nData.MarkAddressValid(address.Address)
-						resultC <- results.Results()
-						return
-					}
-				}
-				counterSent++
-				msg := msgFac(id)
-				log.Debugf("send to %s", ndInfo.Id)
-				go p.SendWithContext(ctx, msg)
-			} else {
-				log.Debugf("netDial err %s", err)
-			}
-
-			// Check if this node is reachable using this address.
-			go func(nData *nodeData) {
-				err = d.netCheckOnline(ctx, ndInfo)
-				if err == nil {
-					log.Debugf("findNode mark address valid %s", address.Address)
-					if err := nData.MarkAddressValid(address.Address); err != nil {
-						log.Debugf("error marking address as valid: %s", err)
-					}
-				}
-			}(nData)
-		}
-
-		// Already processed all k closest nodes.
-		if counterIter >= paramK && allProcessed {
-			log.Debug("findNode counterIter and allProcessed")
-			resultC <- results.Results()
-			return
-		}
-
-		// No new results, everything we have has been processed so
-		// is no point in waiting for more.
-		if prevAllProcessed && allProcessed {
-			log.Debug("findNode prevAllProcessed and allProcessed")
-			resultC <- results.Results()
-			return
-		}
-		prevAllProcessed = allProcessed
-
-		// Await results.
-		// TODO: move this before two previous if statements?
-		log.Debug("findNode waiting")
-		select {
-		case <-ctx.Done():
-			resultC <- results.Results()
-			return
-		case <-time.After(findNodeLoopInterval):
-		}
+	response, err := p.Request(ctx, msg)
+	if err != nil {
+		return queryResponse{}, err
 	}
+	if _, ok := response.(*message.Nodes); !ok {
+		return queryResponse{}, errors.Errorf("unexpected response %T", response)
+	}
+	return toQueryResponse(response), nil
 }
 
 // addressData stores one of the addresses returned by the nodes during
 // the lookup procedure. It is normally linked to a node id by being stored
 // in a nodeData structure.
 type addressData struct {
-	// Network address in the format used by the net package.
-	Address string
+	Address address.Address
 
 	// Sources is a list of nodes that sent this address.
 	Sources []node.ID
@@ -327,18 +106,19 @@ type nodeData struct {
 	Id        node.ID
 	addresses []*addressData
 	Distance  []byte
+	Hop       int
 	lock      sync.Mutex
 }
 
 // Insert inserts a new address into the address register. If an address
 // already exists it appends the id of the sender to the list of address
 // sources.
-func (nd *nodeData) Insert(sender node.ID, address string) error {
+func (nd *nodeData) Insert(sender node.ID, addr address.Address) error {
 	nd.lock.Lock()
 	defer nd.lock.Unlock()
 
 	for _, addrData := range nd.addresses {
-		if addrData.Address == address {
+		if addrData.Address == addr {
 			for _, id := range addrData.Sources {
 				if node.CompareId(sender, id) {
 					return nil
@@ -349,7 +129,7 @@ func (nd *nodeData) Insert(sender node.ID, address string) error {
 		}
 	}
 	ad := &addressData{
-		Address:   address,
+		Address:   addr,
 		Sources:   []node.ID{sender},
 		Processed: false,
 		Valid:     false,
@@ -360,24 +140,26 @@ func (nd *nodeData) Insert(sender node.ID, address string) error {
 
 // GetUnprocessedAddress returns an unprocessed address with the highest
 // amount of sources (an address that the lookup procedure hasn't checked yet).
+// If several addresses have the same amount of sources the one with the widest
+// scope is preferred.
 func (nd *nodeData) GetUnprocessedAddress() (addressData, error) {
 	nd.lock.Lock()
 	defer nd.lock.Unlock()
 
-	maxSources := 0
-	i := 0
-	for j, addressData := range nd.addresses {
-		l := len(addressData.Sources)
-		if !addressData.Processed && l > maxSources {
-			maxSources = l
-			i = j
+	var best *addressData
+	for _, addrData := range nd.addresses {
+		if addrData.Processed {
+			continue
+		}
+		if best == nil || len(addrData.Sources) > len(best.Sources) ||
+			(len(addrData.Sources) == len(best.Sources) && addrData.Address.Scope() > best.Address.Scope()) {
+			best = addrData
 		}
 	}
-	if maxSources > 0 {
-		return *nd.addresses[i], nil
-	} else {
+	if best == nil {
 		return addressData{}, errors.New("Not found")
 	}
+	return *best, nil
 }
 
 // GetValidAddress returns a confirmed, valid address for this node.
@@ -397,20 +179,6 @@ func (nd *nodeData) getValidAddress() (addressData, error) {
 	return addressData{}, errors.New("Not found")
 }
 
-// WasQueried returns true if a message was sent to this node during this
-// lookup procedure.
-func (nd *nodeData) WasQueried() bool {
-	nd.lock.Lock()
-	defer nd.lock.Unlock()
-
-	for _, addressData := range nd.addresses {
-		if addressData.Processed {
-			return true
-		}
-	}
-	return false
-}
-
 // IsProcessed returns true if the address for this node has been found or
 // it hasn't been found but there are no more addresses to query.
 func (nd *nodeData) IsProcessed() bool {
@@ -431,12 +199,12 @@ func (nd *nodeData) IsProcessed() bool {
 
 // MarkAddressProcessed marks an address processed. Address can't be returned
 // using a pointer and marked as processed directly due to race conditions.
-func (nd *nodeData) MarkAddressProcessed(address string) error {
+func (nd *nodeData) MarkAddressProcessed(addr address.Address) error {
 	nd.lock.Lock()
 	defer nd.lock.Unlock()
 
 	for _, addressData := range nd.addresses {
-		if addressData.Address == address {
+		if addressData.Address == addr {
 			addressData.Processed = true
 			return nil
 		}
@@ -446,12 +214,12 @@ func (nd *nodeData) MarkAddressProcessed(address string) error {
 
 // MarkAddressValid marks an address as valid. Address can't be returned
 // using a pointer and marked as processed directly due to race conditions.
-func (nd *nodeData) MarkAddressValid(address string) error {
+func (nd *nodeData) MarkAddressValid(addr address.Address) error {
 	nd.lock.Lock()
 	defer nd.lock.Unlock()
 
 	for _, addressData := range nd.addresses {
-		if addressData.Address == address {
+		if addressData.Address == addr {
 			addressData.Valid = true
 			return nil
 		}
@@ -475,30 +243,13 @@ type resultsList struct {
 	lock sync.Mutex
 }
 
-// Result returns a list of confirmed nodes resulting from the lookup.
-func (l *resultsList) Results() []node.NodeInfo {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-
-	var rv []node.NodeInfo
-	for elem := l.list.Front(); elem != nil; elem = elem.Next() {
-		entry := elem.Value.(*nodeData)
-		addr, err := entry.GetValidAddress()
-		if err != nil {
-			continue
-		}
-		info := node.NodeInfo{Id: entry.Id, Address: addr.Address}
-		rv = append(rv, info)
-	}
-	return rv
-}
-
 // Add is used to insert lookup results as they arrive. The list of results is
 // kept sorted by the distance to the searched id, so the closest node to the
 // searched id is always located at the beginning of the list. Errors basically
 // mean that the sender node id or the node id nested in the NodeInfo struct
-// is simply invalid.
-func (l *resultsList) Add(sender node.ID, nd *node.NodeInfo) error {
+// is simply invalid. Hop is the number of hops needed to learn about this node,
+// the lowest known value is retained.
+func (l *resultsList) Add(sender node.ID, hop int, nd *node.NodeInfo) error {
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
@@ -510,8 +261,11 @@ func (l *resultsList) Add(sender node.ID, nd *node.NodeInfo) error {
 	newEntry := &nodeData{
 		Id:       nd.Id,
 		Distance: distance,
+		Hop:      hop,
+	}
+	for _, addr := range nd.Addresses {
+		newEntry.Insert(sender, addr)
 	}
-	newEntry.Insert(sender, nd.Address)
 
 	// Find an element with a distance bigger or equal to the new one.
 	var elem *list.Element = nil
@@ -525,12 +279,20 @@ func (l *resultsList) Add(sender node.ID, nd *node.NodeInfo) error {
 		// The entry already exists so we are just going to add a new
 		// address to it.
 		if res == 0 {
-			return entry.Insert(sender, nd.Address)
+			if hop < entry.Hop {
+				entry.Hop = hop
+			}
+			for _, addr := range nd.Addresses {
+				if err := entry.Insert(sender, addr); err != nil {
+					return err
+				}
+			}
+			return nil
 		}
 
 		// An entry which is further away exists, so we are going to
 		// insert a new entry before it.
-		if res > 0 {
+		if res < 0 {
 			l.list.InsertBefore(newEntry, elem)
 			return nil
 		}
@@ -549,33 +311,13 @@ func (l *resultsList) Get(k int) []*nodeData {
 	defer l.lock.Unlock()
 
 	var rv []*nodeData
-	i := 0
-	for elem := l.list.Front(); elem != nil; elem = elem.Next() {
+	for elem := l.list.Front(); elem != nil && len(rv) < k; elem = elem.Next() {
 		entry := elem.Value.(*nodeData)
 		rv = append(rv, entry)
-		i++
-		if i > k {
-			break
-		}
 	}
 	return rv
 }
 
-// WasQueried is used to check if a message was sent to a node during this
-// lookup procedure.
-func (l *resultsList) WasQueried(id node.ID) bool {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-
-	for elem := l.list.Front(); elem != nil; elem = elem.Next() {
-		entry := elem.Value.(*nodeData)
-		if node.CompareId(entry.Id, id) {
-			return entry.WasQueried()
-		}
-	}
-	return false
-}
-
 // Contains is used to check if this results list contains a node.
 func (l *resultsList) Contains(id node.ID) bool {
 	l.lock.Lock()
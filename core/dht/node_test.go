@@ -1,6 +1,15 @@
 package dht
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+)
+
+func testAddress(host string) address.Address {
+	return address.Address{Transport: address.TCP, Host: host, Port: 1836}
+}
 
 // TestGetUnprocessedAddress makes sure that GetUnprocessedAddress returns
 // the address with the highest amount of votes and doesn't return processed
@@ -9,17 +18,17 @@ func TestGetUnprocessedAddress(t *testing.T) {
 	id := []byte{0}
 	nd := &nodeData{Id: id}
 
-	err := nd.Insert([]byte{1}, "addr1")
+	err := nd.Insert([]byte{1}, testAddress("addr1"))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = nd.Insert([]byte{1}, "addr2")
+	err = nd.Insert([]byte{1}, testAddress("addr2"))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = nd.Insert([]byte{2}, "addr2")
+	err = nd.Insert([]byte{2}, testAddress("addr2"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,7 +37,7 @@ func TestGetUnprocessedAddress(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if data1.Address != "addr2" {
+	if data1.Address != testAddress("addr2") {
 		t.Fatal("addr2 had more votes")
 	}
 
@@ -45,3 +54,33 @@ func TestGetUnprocessedAddress(t *testing.T) {
 	}
 
 }
+
+// TestResultsList makes sure that the results are sorted by distance, that the
+// lowest hop is retained and that Get respects the limit.
+func TestResultsList(t *testing.T) {
+	l := newResultsList([]byte{0})
+
+	if err := l.Add([]byte{9}, 2, &node.NodeInfo{Id: []byte{4}, Addresses: []address.Address{testAddress("addr4")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add([]byte{9}, 1, &node.NodeInfo{Id: []byte{1}, Addresses: []address.Address{testAddress("addr1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add([]byte{8}, 1, &node.NodeInfo{Id: []byte{4}, Addresses: []address.Address{testAddress("addr4")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := l.Get(10)
+	if len(entries) != 2 {
+		t.Fatal("Invalid number of entries", len(entries))
+	}
+	if !node.CompareId(entries[0].Id, []byte{1}) || !node.CompareId(entries[1].Id, []byte{4}) {
+		t.Fatal("Entries are not sorted")
+	}
+	if entries[1].Hop != 1 {
+		t.Fatal("The lowest hop should be retained", entries[1].Hop)
+	}
+	if len(l.Get(1)) != 1 {
+		t.Fatal("Get should respect the limit")
+	}
+}
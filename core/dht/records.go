@@ -0,0 +1,211 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/core/dht/datastore"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/boreq/starlight/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxReceivedRecords limits the number of records of each kind which are
+// stored on behalf of other nodes.
+const maxReceivedRecords = 10000
+
+// recordStore stores one kind of the signed records, such as the revocations,
+// which are sent in the StorePubKey messages next to the key which signed
+// them. The records are stored by the nodes closest to the id of that key.
+type recordStore struct {
+	name  string
+	store *datastore.Datastore
+	mutex sync.Mutex
+
+	// fromMessage extracts a valid record and the id of the node which
+	// signed it from a message. A nil record is returned if the message
+	// doesn't contain a record.
+	fromMessage func(msg *message.StorePubKey) (interface{}, node.ID, error)
+
+	// toMessage creates a StorePubKey message containing the record.
+	toMessage func(record interface{}) (*message.StorePubKey, error)
+
+	// keep returns true if the stored record shouldn't be replaced with
+	// the new record.
+	keep func(stored, record interface{}) bool
+}
+
+func newRecordStore(name string, timeout time.Duration) *recordStore {
+	return &recordStore{
+		name:  name,
+		store: datastore.New(timeout),
+	}
+}
+
+// get returns the record of the node with the given id.
+func (s *recordStore) get(id node.ID) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, err := s.store.Get(id)
+	if err != nil {
+		return nil, false
+	}
+	return record, true
+}
+
+// put stores the record of the node with the given id unless the stored record
+// should be kept. The stored record is returned.
+func (s *recordStore) put(id node.ID, record interface{}) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.putLocked(id, record)
+}
+
+// putReceived stores a record received from another node unless too many
+// records are already stored. Returns false if the record wasn't stored.
+func (s *recordStore) putReceived(id node.ID, record interface{}) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.store.Get(id); err != nil && s.store.Len() >= maxReceivedRecords {
+		return false
+	}
+	s.putLocked(id, record)
+	return true
+}
+
+func (s *recordStore) putLocked(id node.ID, record interface{}) interface{} {
+	if stored, err := s.store.Get(id); err == nil && s.keep(stored, record) {
+		// Refresh the stored record.
+		record = stored
+	}
+	log.Debugf("Storing %s of %s", s.name, id)
+	s.store.Store(id, record)
+	return record
+}
+
+// extract extracts a record from a StorePubKey message and confirms that it
+// was signed by the node with the given id. Nil is returned if the message
+// doesn't contain a record.
+func (s *recordStore) extract(id node.ID, msg *message.StorePubKey) (interface{}, error) {
+	record, signerId, err := s.fromMessage(msg)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	if !node.CompareId(signerId, id) {
+		return nil, errors.Errorf("%s belongs to a different node", s.name)
+	}
+	return record, nil
+}
+
+// publishRecord sends the record of the node with the given id to the nodes
+// closest to that id.
+func (d *dht) publishRecord(ctx context.Context, s *recordStore, id node.ID, record interface{}) error {
+	msg, err := s.toMessage(record)
+	if err != nil {
+		return err
+	}
+
+	// Locate the closest nodes.
+	nodes, err := d.findClosest(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// Send 'k' store RPCs. We don't have to wait for this to finish so
+	// a goroutine with the DHT's context is used instead of blocking.
+	go d.sendToAll(nodes, msg)
+	return nil
+}
+
+// lookupRecord attempts to find the record of the node with the given id by
+// performing a full lookup procedure. The lookup continues until one of the
+// nodes returns the record or a revocation of the key of the node. The found
+// record is stored. Nil is returned if the record wasn't found.
+func (d *dht) lookupRecord(ctx context.Context, s *recordStore, id node.ID) (interface{}, error) {
+	log.Debugf("lookupRecord %s of %s", s.name, id)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results, err := d.lookup(ctx, id, d.queryFindPubKey)
+	if err != nil {
+		return nil, err
+	}
+	for result := range results {
+		for _, value := range result.Values {
+			storeMsg, ok := value.(*message.StorePubKey)
+			if !ok {
+				continue
+			}
+			r, err := d.revocations.extract(id, storeMsg)
+			if err != nil {
+				log.Debugf("lookupRecord %s invalid revocation: %s", id, err)
+				continue
+			}
+			if r != nil {
+				d.revocations.put(id, r)
+				return nil, ErrRevoked
+			}
+			record, err := s.extract(id, storeMsg)
+			if err != nil {
+				log.Debugf("lookupRecord %s invalid %s: %s", id, s.name, err)
+				continue
+			}
+			if record != nil {
+				return s.put(id, record), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// storeReceivedRecord stores a record sent by another node in a StorePubKey
+// message if the local node is one of the nodes which should store the
+// records of the node with the given id. Returns an error if the message
+// contains an invalid record.
+func (d *dht) storeReceivedRecord(s *recordStore, id node.ID, msg *message.StorePubKey) error {
+	record, err := s.extract(id, msg)
+	if err != nil {
+		log.Debugf("Invalid %s of %s: %s", s.name, id, err)
+		return err
+	}
+	if record == nil {
+		return nil
+	}
+	if !d.isAmongClosest(id) {
+		log.Debugf("Not storing %s of %s: not among the closest nodes", s.name, id)
+		return nil
+	}
+	if !s.putReceived(id, record) {
+		log.Debugf("Not storing %s of %s: too many records", s.name, id)
+	}
+	return nil
+}
+
+// isAmongClosest returns true if the local node is one of the 'k' nodes
+// closest to the id out of the nodes present in the routing table.
+func (d *dht) isAmongClosest(id node.ID) bool {
+	nodes := d.rt.GetClosest(id, paramK)
+	if len(nodes) < paramK {
+		return true
+	}
+	selfDistance, err := node.Distance(id, d.self.Id)
+	if err != nil {
+		return false
+	}
+	for _, nd := range nodes {
+		distance, err := node.Distance(id, nd.Id)
+		if err != nil {
+			continue
+		}
+		if cmp, err := utils.Compare(selfDistance, distance); err == nil && cmp < 0 {
+			return true
+		}
+	}
+	return false
+}
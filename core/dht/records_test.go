@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/core/dht/kbuckets"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+)
+
+// TestStoreReceivedRecord makes sure that the records sent by other nodes are
+// stored only by the nodes closest to the id of the node which signed them.
+func TestStoreReceivedRecord(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := storePubKeyWithRevocation(newTestRevocation(t, iden, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The local node is the most distant node possible.
+	self := make(node.ID, len(iden.Id))
+	for i := range self {
+		self[i] = ^iden.Id[i]
+	}
+	d := &dht{
+		rt:          kbuckets.New(self, paramK, time.Hour),
+		self:        node.Identity{Id: self},
+		revocations: newRevocationStore(),
+	}
+
+	// Only the local node is known.
+	if err := d.storeReceivedRecord(d.revocations, iden.Id, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Revoked(iden.Id); !ok {
+		t.Fatal("Revocation should be stored")
+	}
+
+	// 'k' closer nodes are known.
+	d.revocations = newRevocationStore()
+	for i := 0; i < paramK; i++ {
+		id := append(node.ID{}, iden.Id...)
+		id[len(id)-1] ^= byte(i + 1)
+		d.rt.Update(id, []address.Address{testAddress("10.0.0.1")})
+	}
+	if err := d.storeReceivedRecord(d.revocations, iden.Id, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Revoked(iden.Id); ok {
+		t.Fatal("Revocation should not be stored")
+	}
+
+	// Invalid records are rejected.
+	msg.Revocation.Timestamp = nil
+	if err := d.storeReceivedRecord(d.revocations, iden.Id, msg); err == nil {
+		t.Fatal("Invalid revocation was accepted")
+	}
+}
@@ -0,0 +1,103 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/boreq/starlight/core/dht/kbuckets"
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+// initialRefreshConcurrency limits the number of lookups which are performed
+// at the same time during the initial bucket refresh.
+const initialRefreshConcurrency = paramA
+
+// RefreshProgress describes the progress of the initial bucket refresh which
+// is performed after the DHT is initialized.
+type RefreshProgress struct {
+	// Started is true if the initial refresh has been started.
+	Started bool
+
+	// Done is true if all lookups have been performed.
+	Done bool
+
+	// Total is the number of lookups which have to be performed.
+	Total int
+
+	// Completed is the number of lookups which have been performed
+	// successfully.
+	Completed int
+
+	// Failed is the number of lookups which returned an error.
+	Failed int
+}
+
+type refreshProgress struct {
+	progress RefreshProgress
+	mutex    sync.Mutex
+}
+
+func (r *refreshProgress) start(total int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.progress = RefreshProgress{Started: true, Total: total, Done: total == 0}
+}
+
+func (r *refreshProgress) finished(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		r.progress.Failed++
+	} else {
+		r.progress.Completed++
+	}
+	r.progress.Done = r.progress.Completed+r.progress.Failed >= r.progress.Total
+}
+
+func (r *refreshProgress) get() RefreshProgress {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.progress
+}
+
+func (d *dht) RefreshProgress() RefreshProgress {
+	return d.refresh.get()
+}
+
+func (d *dht) BucketStats() []kbuckets.BucketStats {
+	return d.rt.Stats()
+}
+
+func (d *dht) RoutingTable() []kbuckets.BucketDump {
+	return d.rt.Dump()
+}
+
+// initialRefresh performs lookups on random ids falling within the ranges of
+// the buckets which are further away than the closest neighbour of the local
+// node. This function blocks until all lookups are performed.
+func (d *dht) initialRefresh(ctx context.Context) {
+	ids := d.rt.GetForInitialRefresh()
+	d.refresh.start(len(ids))
+	log.Debugf("initial refresh of %d buckets", len(ids))
+
+	sem := make(chan struct{}, initialRefreshConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(id node.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			_, err := d.findClosest(ctx, id)
+			if err != nil {
+				log.Debugf("initial refresh findClosest %s failed: %s", id, err)
+			}
+			d.refresh.finished(err)
+		}(id)
+	}
+	wg.Wait()
+}
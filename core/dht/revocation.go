@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ErrRevoked is returned by GetPubKey if the key of a node was revoked.
+var ErrRevoked = errors.New("key was revoked")
+
+// newRevocationStore creates a store for the revocations. As a compromised key
+// can be used to name a different successor, a revocation without a successor
+// always replaces a revocation with a successor and otherwise the first
+// received revocation is kept.
+func newRevocationStore() *recordStore {
+	s := newRecordStore("revocation", revocationStoreTimeout)
+	s.fromMessage = func(msg *message.StorePubKey) (interface{}, node.ID, error) {
+		if msg.GetRevocation() == nil {
+			return nil, nil, nil
+		}
+		r, err := node.NewRevocationFromMessage(msg.GetRevocation())
+		if err != nil {
+			return nil, nil, err
+		}
+		id, err := r.Id()
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, id, nil
+	}
+	s.toMessage = func(record interface{}) (*message.StorePubKey, error) {
+		return storePubKeyWithRevocation(record.(*node.Revocation))
+	}
+	s.keep = func(stored, record interface{}) bool {
+		return stored.(*node.Revocation).Successor == nil || record.(*node.Revocation).Successor != nil
+	}
+	return s
+}
+
+func (d *dht) PutRevocation(ctx context.Context, r *node.Revocation) error {
+	if err := r.Validate(); err != nil {
+		return errors.Wrap(err, "invalid revocation")
+	}
+	id, err := r.Id()
+	if err != nil {
+		return err
+	}
+	log.Debugf("PutRevocation %s", id)
+
+	d.revocations.put(id, r)
+	d.revocationsMutex.Lock()
+	d.issuedRevocations[id.String()] = r
+	d.revocationsMutex.Unlock()
+
+	return d.publishRecord(ctx, d.revocations, id, r)
+}
+
+// republishRevocations republishes the revocations passed to PutRevocation.
+func (d *dht) republishRevocations(ctx context.Context) {
+	d.revocationsMutex.Lock()
+	var revocations []*node.Revocation
+	for _, r := range d.issuedRevocations {
+		revocations = append(revocations, r)
+	}
+	d.revocationsMutex.Unlock()
+
+	for _, r := range revocations {
+		id, err := r.Id()
+		if err != nil {
+			continue
+		}
+		if err := d.publishRecord(ctx, d.revocations, id, r); err != nil {
+			log.Debugf("republishing revocation of %s failed: %s", id, err)
+		}
+	}
+}
+
+func (d *dht) Revoked(id node.ID) (*node.Revocation, bool) {
+	record, ok := d.revocations.get(id)
+	if !ok {
+		return nil, false
+	}
+	return record.(*node.Revocation), true
+}
+
+// storePubKeyWithRevocation creates a StorePubKey message containing the
+// revoked key and its revocation.
+func storePubKeyWithRevocation(r *node.Revocation) (*message.StorePubKey, error) {
+	revocationMsg, err := r.Message()
+	if err != nil {
+		return nil, err
+	}
+	return &message.StorePubKey{
+		Key:        revocationMsg.GetKey(),
+		Revocation: revocationMsg,
+	}, nil
+}
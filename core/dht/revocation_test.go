@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+func newTestRevocation(t *testing.T, iden *node.Identity, successor node.ID) *node.Revocation {
+	r, err := node.NewRevocation(iden, successor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestStoreRevocation(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	successorA, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	successorB, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dht{revocations: newRevocationStore()}
+	if _, ok := d.Revoked(iden.Id); ok {
+		t.Fatal("Node is revoked")
+	}
+
+	// The first revocation naming a successor is kept.
+	d.revocations.put(iden.Id, newTestRevocation(t, iden, successorA.Id))
+	d.revocations.put(iden.Id, newTestRevocation(t, iden, successorB.Id))
+	r, ok := d.Revoked(iden.Id)
+	if !ok || !node.CompareId(r.Successor, successorA.Id) {
+		t.Fatal("First revocation should be kept")
+	}
+
+	// A revocation without a successor replaces it.
+	d.revocations.put(iden.Id, newTestRevocation(t, iden, nil))
+	d.revocations.put(iden.Id, newTestRevocation(t, iden, successorB.Id))
+	r, ok = d.Revoked(iden.Id)
+	if !ok || r.Successor != nil {
+		t.Fatal("Revocation without a successor should be kept")
+	}
+
+	if _, err := d.GetPubKey(context.Background(), iden.Id); err != ErrRevoked {
+		t.Fatalf("Invalid error %v", err)
+	}
+}
+
+func TestRevocationFromMessage(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := storePubKeyWithRevocation(newTestRevocation(t, iden, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubKeyFromMessage(iden.Id, msg); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRevocationStore().extract(iden.Id, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		t.Fatal("Revocation not returned")
+	}
+	if _, err := newRevocationStore().extract(other.Id, msg); err == nil {
+		t.Fatal("Revocation of a different node was accepted")
+	}
+
+	msg.Revocation.Timestamp = nil
+	if _, err := newRevocationStore().extract(iden.Id, msg); err == nil {
+		t.Fatal("Modified revocation was accepted")
+	}
+}
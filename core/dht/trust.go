@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ErrNoTrustList is returned by GetTrustList if the node didn't publish a trust
+// list.
+var ErrNoTrustList = errors.New("trust list not found")
+
+// newTrustListStore creates a store for the trust lists. A newer trust list
+// replaces the older lists.
+func newTrustListStore() *recordStore {
+	s := newRecordStore("trust list", pubKeyStoreTimeout)
+	s.fromMessage = func(msg *message.StorePubKey) (interface{}, node.ID, error) {
+		if msg.GetTrustList() == nil {
+			return nil, nil, nil
+		}
+		l, err := node.NewTrustListFromMessage(msg.GetTrustList())
+		if err != nil {
+			return nil, nil, err
+		}
+		id, err := l.Id()
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, id, nil
+	}
+	s.toMessage = func(record interface{}) (*message.StorePubKey, error) {
+		return storePubKeyWithTrustList(record.(*node.TrustList))
+	}
+	s.keep = func(stored, record interface{}) bool {
+		return stored.(*node.TrustList).Timestamp.After(record.(*node.TrustList).Timestamp)
+	}
+	return s
+}
+
+func (d *dht) PutTrustList(ctx context.Context, l *node.TrustList) error {
+	if err := l.Validate(); err != nil {
+		return errors.Wrap(err, "invalid trust list")
+	}
+	id, err := l.Id()
+	if err != nil {
+		return err
+	}
+	if !node.CompareId(id, d.self.Id) {
+		return errors.New("trust list wasn't signed by the local node")
+	}
+	log.Debugf("PutTrustList %s", id)
+
+	d.trustLists.put(id, l)
+	d.trustListsMutex.Lock()
+	d.issuedTrustList = l
+	d.trustListsMutex.Unlock()
+
+	return d.publishRecord(ctx, d.trustLists, id, l)
+}
+
+// republishTrustList republishes the trust list passed to PutTrustList.
+func (d *dht) republishTrustList(ctx context.Context) {
+	d.trustListsMutex.Lock()
+	l := d.issuedTrustList
+	d.trustListsMutex.Unlock()
+
+	if l == nil {
+		return
+	}
+	if err := d.publishRecord(ctx, d.trustLists, d.self.Id, l); err != nil {
+		log.Debugf("republishing trust list failed: %s", err)
+	}
+}
+
+func (d *dht) GetTrustList(ctx context.Context, id node.ID) (*node.TrustList, error) {
+	log.Debugf("GetTrustList %s", id)
+
+	if _, ok := d.Revoked(id); ok {
+		return nil, ErrRevoked
+	}
+
+	if l, ok := d.getTrustListLocally(id); ok {
+		log.Debugf("GetTrustList %s had locally", id)
+		return l, nil
+	}
+	record, err := d.lookupRecord(ctx, d.trustLists, id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrNoTrustList
+	}
+	return record.(*node.TrustList), nil
+}
+
+func (d *dht) getTrustListLocally(id node.ID) (*node.TrustList, bool) {
+	record, ok := d.trustLists.get(id)
+	if !ok {
+		return nil, false
+	}
+	return record.(*node.TrustList), true
+}
+
+// storePubKeyWithTrustList creates a StorePubKey message containing the key
+// and the trust list.
+func storePubKeyWithTrustList(l *node.TrustList) (*message.StorePubKey, error) {
+	listMsg, err := l.Message()
+	if err != nil {
+		return nil, err
+	}
+	return &message.StorePubKey{
+		Key:       listMsg.GetKey(),
+		TrustList: listMsg,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/boreq/starlight/network/node"
+)
+
+func TestStoreTrustList(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older, err := node.NewTrustList(iden, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := older.Update(iden, []node.ID{trusted.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dht{trustLists: newTrustListStore()}
+	if _, ok := d.getTrustListLocally(iden.Id); ok {
+		t.Fatal("Trust list found")
+	}
+
+	// The newest list is kept.
+	d.trustLists.put(iden.Id, newer)
+	if l := d.trustLists.put(iden.Id, older); l != newer {
+		t.Fatal("Newer list should be kept")
+	}
+	l, ok := d.getTrustListLocally(iden.Id)
+	if !ok || !l.Contains(trusted.Id) {
+		t.Fatal("Newer list should be stored")
+	}
+}
+
+func TestTrustListFromMessage(t *testing.T) {
+	iden, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := node.GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := node.NewTrustList(iden, []node.ID{trusted.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := storePubKeyWithTrustList(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubKeyFromMessage(iden.Id, msg); err != nil {
+		t.Fatal(err)
+	}
+	s := newTrustListStore()
+	loaded, err := s.extract(iden.Id, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || !loaded.(*node.TrustList).Contains(trusted.Id) {
+		t.Fatal("Trust list not returned")
+	}
+	if _, err := s.extract(trusted.Id, msg); err == nil {
+		t.Fatal("Trust list of a different node was accepted")
+	}
+
+	msg.TrustList.TrustedIds = nil
+	if _, err := s.extract(iden.Id, msg); err == nil {
+		t.Fatal("Modified trust list was accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"github.com/boreq/starlight/core/contacts"
 	"github.com/boreq/starlight/core/dht"
 	"github.com/boreq/starlight/network/dispatcher"
 	"github.com/boreq/starlight/network/node"
@@ -25,7 +26,8 @@ type Core interface {
 	// provided to the the JoinChannel method.
 	Subscribe() (chan dispatcher.IncomingMessage, dispatcher.CancelFunc)
 
-	// SendMessage sends a private text message to a node.
+	// SendMessage sends a private text message to a node. If the id
+	// belongs to a master identity the message is sent to all its devices.
 	SendMessage(ctx context.Context, to node.ID, text string) error
 
 	// SendChannelMessage sends a text message to a specified channel.
@@ -41,4 +43,21 @@ type Core interface {
 
 	// ListChannels returns a list of currently joined channels.
 	ListChannels() []string
+
+	// SetDeviceList publishes the device list of the master identity of
+	// the local node and attaches it to the sent messages. The messages
+	// sent by the devices are dispatched with their NodeId replaced with
+	// the id of the master identity.
+	SetDeviceList(ctx context.Context, l *node.DeviceList) error
+
+	// SetContacts replaces the contacts verified by the user and publishes
+	// the trust list containing the contacts which the user vouches for.
+	SetContacts(ctx context.Context, c []contacts.Contact) error
+
+	// Contacts returns the contacts passed to SetContacts.
+	Contacts() []contacts.Contact
+
+	// TrustLevel returns the trust level of the specified node computed
+	// using the contacts and the trust lists published by other nodes.
+	TrustLevel(id node.ID) (contacts.Level, bool)
 }
@@ -58,10 +58,11 @@ func (n *core) handleChannelMessageMsg(msg *message.ChannelMessage, sender node.
 		return
 	}
 
-	// Dispatch.
+	// Dispatch. The messages sent by the devices are displayed as sent
+	// by their master identity.
 	dMsg := &message.ChannelMessage{
 		ChannelId: []byte(ch.Name),
-		NodeId:    msg.NodeId,
+		NodeId:    n.getMasterId(msg.GetNodeId(), msg.GetDeviceList()),
 		Timestamp: msg.Timestamp,
 		Text:      msg.Text,
 		Signature: msg.Signature,
@@ -90,8 +91,15 @@ func (n *core) handlePrivateMessageMsg(msg *message.PrivateMessage, sender node.
 		return
 	}
 
-	// Dispatch.
-	n.disp.Dispatch(sender, msg)
+	// Dispatch. The messages sent by the devices are displayed as sent
+	// by their master identity.
+	dMsg := &message.PrivateMessage{
+		TargetId: msg.TargetId,
+		NodeId:   n.getMasterId(msg.GetNodeId(), msg.GetDeviceList()),
+		Text:     msg.Text,
+		Nonce:    msg.Nonce,
+	}
+	n.disp.Dispatch(sender, dMsg)
 }
 
 func (n *core) SendChannelMessage(ctx context.Context, channelName string, text string) error {
@@ -128,6 +136,24 @@ func (n *core) SendMessage(ctx context.Context, id node.ID, text string) error {
 		return errors.New("message is too long")
 	}
 
+	// Send the message to all devices of a known master identity. The
+	// master identities don't connect to the network so the device list
+	// is looked up only if the node can't be reached directly.
+	if l, ok := n.dht.DeviceList(id); ok {
+		return n.sendToDevices(ctx, l, text)
+	}
+	err := n.sendMessage(ctx, id, text)
+	if err == nil {
+		return nil
+	}
+	if l, lErr := n.dht.GetDeviceList(ctx, id); lErr == nil {
+		return n.sendToDevices(ctx, l, text)
+	}
+	return err
+}
+
+// sendMessage sends a private message to a single node.
+func (n *core) sendMessage(ctx context.Context, id node.ID, text string) error {
 	p, err := n.dht.Dial(ctx, id)
 	if err != nil {
 		return err
@@ -146,11 +172,12 @@ func (n *core) createChannelMessage(channelId []byte, text string) (*message.Cha
 	var nonce uint64
 	timestamp := time.Now().UTC().Unix()
 	msg := &message.ChannelMessage{
-		ChannelId: channelId,
-		NodeId:    n.ident.Id,
-		Timestamp: &timestamp,
-		Text:      &text,
-		Nonce:     &nonce,
+		ChannelId:  channelId,
+		NodeId:     n.ident.Id,
+		Timestamp:  &timestamp,
+		Text:       &text,
+		Nonce:      &nonce,
+		DeviceList: n.getDeviceList(),
 	}
 
 	// Solve the puzzle.
@@ -178,10 +205,11 @@ func (n *core) createPrivateMessage(target node.ID, text string) (*message.Priva
 	// Create the message.
 	var nonce uint64
 	msg := &message.PrivateMessage{
-		TargetId: target,
-		NodeId:   n.ident.Id,
-		Text:     &text,
-		Nonce:    &nonce,
+		TargetId:   target,
+		NodeId:     n.ident.Id,
+		Text:       &text,
+		Nonce:      &nonce,
+		DeviceList: n.getDeviceList(),
 	}
 
 	// Solve the puzzle.
@@ -249,7 +277,9 @@ func (n *core) validateChannelMessage(ctx context.Context, msg *message.ChannelM
 		return err
 	}
 
-	// Signature.
+	// Signature. GetPubKey fails if the key was revoked, a revoked key
+	// may be known to an attacker so the messages signed with it are
+	// rejected regardless of their timestamps.
 	key, err := n.dht.GetPubKey(ctx, msg.GetNodeId())
 	if err != nil {
 		return err
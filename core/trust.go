@@ -0,0 +1,92 @@
+package core
+
+import (
+	"time"
+
+	"github.com/boreq/starlight/core/contacts"
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+// trustRefreshInterval specifies how often the trust levels are recomputed
+// as the trust lists published by other nodes change.
+const trustRefreshInterval = 30 * time.Minute
+
+// trustRefreshTimeout limits the time spent retrieving the trust lists.
+const trustRefreshTimeout = 5 * time.Minute
+
+func (n *core) SetContacts(ctx context.Context, c []contacts.Contact) error {
+	n.contactsMutex.Lock()
+	n.contacts = c
+	n.contactsVersion++
+	n.trustLevels = contacts.NewLevels(c)
+	publish := n.trustPublished
+	n.contactsMutex.Unlock()
+
+	go n.refreshTrust()
+
+	// An empty trust list is published only to replace a previously
+	// published list.
+	for _, contact := range c {
+		publish = publish || contact.Vouch
+	}
+	if !publish {
+		return nil
+	}
+	l, err := contacts.NewTrustList(&n.ident, c)
+	if err != nil {
+		return err
+	}
+	n.contactsMutex.Lock()
+	n.trustPublished = true
+	n.contactsMutex.Unlock()
+	return n.dht.PutTrustList(ctx, l)
+}
+
+func (n *core) Contacts() []contacts.Contact {
+	n.contactsMutex.Lock()
+	defer n.contactsMutex.Unlock()
+	return n.contacts
+}
+
+func (n *core) TrustLevel(id node.ID) (contacts.Level, bool) {
+	n.contactsMutex.Lock()
+	defer n.contactsMutex.Unlock()
+	return n.trustLevels.Get(id)
+}
+
+// refreshTrustLoop periodically recomputes the trust levels.
+func (n *core) refreshTrustLoop() {
+	for {
+		select {
+		case <-time.After(trustRefreshInterval):
+			n.refreshTrust()
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshTrust recomputes the trust levels by retrieving the trust lists from
+// the DHT.
+func (n *core) refreshTrust() {
+	n.contactsMutex.Lock()
+	c := n.contacts
+	version := n.contactsVersion
+	n.contactsMutex.Unlock()
+	if len(c) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, trustRefreshTimeout)
+	defer cancel()
+	levels := contacts.ComputeLevels(ctx, c, n.dht.GetTrustList)
+	log.Debugf("computed trust levels of %d nodes", len(levels))
+
+	n.contactsMutex.Lock()
+	defer n.contactsMutex.Unlock()
+	// Ignore the result if the contacts were changed in the meantime.
+	if n.contactsVersion == version {
+		n.trustLevels = levels
+	}
+}
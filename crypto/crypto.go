@@ -3,11 +3,57 @@ package crypto
 import (
 	"crypto"
 	"crypto/rand"
+	"errors"
+)
+
+// KeyType identifies the algorithm of a key.
+type KeyType int
+
+const (
+	RSA KeyType = iota
+	Ed25519
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case RSA:
+		return "rsa"
+	case Ed25519:
+		return "ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseKeyType returns a key type based on the name returned by its String
+// method.
+func ParseKeyType(name string) (KeyType, error) {
+	for _, t := range []KeyType{RSA, Ed25519} {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return 0, errors.New("invalid key type")
+}
+
+// The serialized keys other than the RSA keys start with a byte which
+// identifies their type. RSA keys are serialized as DER structures which
+// always start with derSequence so that the ids of the existing nodes don't
+// change.
+const (
+	derSequence = 0x30
+	tagEd25519  = 0xed
 )
 
 type Key interface {
+	// Bytes returns the serialized key which identifies its type.
 	Bytes() ([]byte, error)
+
+	// Hash returns the digest of the serialized key, see KeyDigest.
 	Hash() ([]byte, error)
+
+	// Type returns the type of the key.
+	Type() KeyType
 }
 
 type PrivateKey interface {
@@ -38,10 +84,11 @@ type EphemeralKey interface {
 }
 
 // Must be variables or there will be a problem with using those in the protobuf
-// structs.
+// structs. The AEAD ciphers are preferred, the CBC based ciphers are kept only
+// to be able to communicate with the nodes which don't support them.
 var SupportedCurves = "P224,P256,P384,P521"
 var SupportedHashes = "SHA256,SHA512"
-var SupportedCiphers = "AES-256,AES-128"
+var SupportedCiphers = "CHACHA20-POLY1305,AES-256-GCM,AES-128-GCM,AES-256,AES-128"
 
 // GenerateNonce fills a provided slice with random bytes.
 func GenerateNonce(nonce []byte) error {
@@ -24,3 +24,21 @@ func TestGetHash(t *testing.T) {
 		}
 	}
 }
+
+func TestGetCipher(t *testing.T) {
+	data := strings.Split(SupportedCiphers, ",")
+	for _, name := range data {
+		_, k, err := StretchKey([]byte("secret"), []byte("salt"), "SHA256", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsAEAD(name) {
+			_, err = GetAEAD(name, k.CipherKey)
+		} else {
+			_, err = GetCipher(name, k.CipherKey)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
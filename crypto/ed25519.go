@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+)
+
+// Implements PrivateKey.
+type ed25519PrivateKey struct {
+	key ed25519.PrivateKey
+}
+
+// Bytes returns the seed of the key prefixed with the key type.
+func (k ed25519PrivateKey) Bytes() ([]byte, error) {
+	return append([]byte{tagEd25519}, k.key.Seed()...), nil
+}
+
+func (k ed25519PrivateKey) Hash() ([]byte, error) {
+	return KeyDigest(k)
+}
+
+func (k ed25519PrivateKey) Type() KeyType {
+	return Ed25519
+}
+
+func (k ed25519PrivateKey) PublicKey() PublicKey {
+	return ed25519PublicKey{k.key.Public().(ed25519.PublicKey)}
+}
+
+// Sign signs the data. The hash is ignored as Ed25519 hashes the data
+// internally.
+func (k ed25519PrivateKey) Sign(data []byte, hash crypto.Hash) ([]byte, error) {
+	return ed25519.Sign(k.key, data), nil
+}
+
+func newEd25519PrivateKey(seed []byte) (PrivateKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid length of the Ed25519 private key")
+	}
+	return ed25519PrivateKey{ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Implements PublicKey.
+type ed25519PublicKey struct {
+	key ed25519.PublicKey
+}
+
+// Bytes returns the key prefixed with the key type.
+func (k ed25519PublicKey) Bytes() ([]byte, error) {
+	return append([]byte{tagEd25519}, k.key...), nil
+}
+
+func (k ed25519PublicKey) Hash() ([]byte, error) {
+	return KeyDigest(k)
+}
+
+func (k ed25519PublicKey) Type() KeyType {
+	return Ed25519
+}
+
+// Validate validates the signature. The hash is ignored as Ed25519 hashes
+// the data internally.
+func (k ed25519PublicKey) Validate(data, signature []byte, hash crypto.Hash) error {
+	if !ed25519.Verify(k.key, data, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func newEd25519PublicKey(data []byte) (PublicKey, error) {
+	if len(data) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid length of the Ed25519 public key")
+	}
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	copy(key, data)
+	return ed25519PublicKey{key}, nil
+}
+
+// GenerateEd25519Keypair generates an Ed25519 keypair.
+func GenerateEd25519Keypair() (PrivateKey, PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ed25519PrivateKey{priv}, ed25519PublicKey{pub}, nil
+}
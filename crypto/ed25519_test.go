@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+)
+
+func TestEd25519Sign(t *testing.T) {
+	priv, pub, err := GenerateEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("data")
+	sig, err := priv.Sign(data, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Validate(data, sig, crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Validate([]byte("other"), sig, crypto.SHA256); err == nil {
+		t.Fatal("Invalid signature was accepted")
+	}
+}
+
+func TestEd25519Bytes(t *testing.T) {
+	priv, pub, err := GenerateEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv.Type() != Ed25519 || pub.Type() != Ed25519 {
+		t.Fatal("Invalid key type")
+	}
+
+	privBytes, err := priv.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privBytes[0] != tagEd25519 {
+		t.Fatal("Private key is not tagged")
+	}
+	loadedPriv, err := NewPrivateKey(privBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubBytes, err := pub.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubBytes[0] != tagEd25519 {
+		t.Fatal("Public key is not tagged")
+	}
+	loadedPub, err := NewPublicKey(pubBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h1, err := loadedPriv.PublicKey().Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := loadedPub.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3, err := pub.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h1, h3) || !bytes.Equal(h2, h3) {
+		t.Fatal("Hashes differ")
+	}
+}
+
+func TestEd25519InvalidLength(t *testing.T) {
+	if _, err := NewPublicKey([]byte{tagEd25519, 1, 2, 3}); err == nil {
+		t.Fatal("Invalid public key was accepted")
+	}
+	if _, err := NewPrivateKey([]byte{tagEd25519, 1, 2, 3}); err == nil {
+		t.Fatal("Invalid private key was accepted")
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	for _, keyType := range []KeyType{RSA, Ed25519} {
+		parsed, err := ParseKeyType(keyType.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != keyType {
+			t.Fatalf("Invalid key type %s", parsed)
+		}
+	}
+	if _, err := ParseKeyType("dsa"); err == nil {
+		t.Fatal("Invalid key type was accepted")
+	}
+}
@@ -21,7 +21,9 @@ var keyDigestHash = crypto.SHA256
 // function.
 var KeyDigestLength = keyDigestHash.Size()
 
-// KeyDigest calculates a SHA256 checksum of a key.
+// KeyDigest calculates a SHA256 checksum of a key. As the serialized keys are
+// prefixed with their type the keys of different types never have the same
+// digest.
 func KeyDigest(key Key) ([]byte, error) {
 	b, err := key.Bytes()
 	if err != nil {
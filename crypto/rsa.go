@@ -21,6 +21,10 @@ func (k rsaPrivateKey) Hash() ([]byte, error) {
 	return KeyDigest(k)
 }
 
+func (k rsaPrivateKey) Type() KeyType {
+	return RSA
+}
+
 func (k rsaPrivateKey) PublicKey() PublicKey {
 	return rsaPublicKey{&k.key.PublicKey}
 }
@@ -32,6 +36,9 @@ func (k rsaPrivateKey) Sign(data []byte, hash crypto.Hash) ([]byte, error) {
 
 // NewPrivateKey creates a key from the output of PrivateKey.Bytes method.
 func NewPrivateKey(data []byte) (PrivateKey, error) {
+	if len(data) > 0 && data[0] == tagEd25519 {
+		return newEd25519PrivateKey(data[1:])
+	}
 	key, err := x509.ParsePKCS1PrivateKey(data)
 	if err != nil {
 		return nil, err
@@ -52,6 +59,10 @@ func (k rsaPublicKey) Hash() ([]byte, error) {
 	return KeyDigest(k)
 }
 
+func (k rsaPublicKey) Type() KeyType {
+	return RSA
+}
+
 func (k rsaPublicKey) Validate(data, signature []byte, hash crypto.Hash) error {
 	hashed := Digest(hash.New(), data)
 	return rsa.VerifyPKCS1v15(k.key, hash, hashed, signature)
@@ -59,6 +70,12 @@ func (k rsaPublicKey) Validate(data, signature []byte, hash crypto.Hash) error {
 
 // NewPublicKey creates a key from the output of PublicKey.Bytes method.
 func NewPublicKey(data []byte) (PublicKey, error) {
+	if len(data) > 0 && data[0] == tagEd25519 {
+		return newEd25519PublicKey(data[1:])
+	}
+	if len(data) == 0 || data[0] != derSequence {
+		return nil, errors.New("unknown key type")
+	}
 	decodedKey, err := x509.ParsePKIXPublicKey(data)
 	if err != nil {
 		return nil, err
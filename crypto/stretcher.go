@@ -3,6 +3,7 @@ package crypto
 import (
 	"crypto/aes"
 	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -15,13 +16,19 @@ type StretchedKeys struct {
 // Looks like mac key size is arbitrary.
 const macKeySize = 30
 
+// gcmNonceSize is the standard nonce size used with GCM.
+const gcmNonceSize = 12
+
 // StretchedKey creates two new keypairs from the shared secret.
 func StretchKey(secret, salt []byte, hashName, cipherName string) (a, b StretchedKeys, err error) {
 	// We want to generate 2 * (IV, mac key, cipher key) so we need to know
 	// the total number of bytes we need.
 
-	// IV length is equal to cipher block size.
+	// IV length is equal to cipher block size. AEAD ciphers use the IV to
+	// derive the nonces so its length is equal to the nonce size, they also
+	// don't need a mac key.
 	var keySize, blockSize int
+	macSize := macKeySize
 	switch cipherName {
 	case "AES-256":
 		keySize = 32
@@ -29,6 +36,18 @@ func StretchKey(secret, salt []byte, hashName, cipherName string) (a, b Stretche
 	case "AES-128":
 		keySize = 16
 		blockSize = aes.BlockSize
+	case "CHACHA20-POLY1305":
+		keySize = chacha20poly1305.KeySize
+		blockSize = chacha20poly1305.NonceSize
+		macSize = 0
+	case "AES-256-GCM":
+		keySize = 32
+		blockSize = gcmNonceSize
+		macSize = 0
+	case "AES-128-GCM":
+		keySize = 16
+		blockSize = gcmNonceSize
+		macSize = 0
 	default:
 		err = errors.New("invalid cipher name")
 		return
@@ -40,18 +59,18 @@ func StretchKey(secret, salt []byte, hashName, cipherName string) (a, b Stretche
 		return
 	}
 
-	totalSize := 2 * (keySize + blockSize + macKeySize)
+	totalSize := 2 * (keySize + blockSize + macSize)
 	key := pbkdf2.Key(secret, salt, 4096, totalSize, h.New)
 
 	keyA := key[:totalSize/2]
 	a.IV = keyA[:blockSize]
-	a.MacKey = keyA[blockSize : blockSize+macKeySize]
-	a.CipherKey = keyA[blockSize+macKeySize:]
+	a.MacKey = keyA[blockSize : blockSize+macSize]
+	a.CipherKey = keyA[blockSize+macSize:]
 
 	keyB := key[totalSize/2:]
 	b.IV = keyB[:blockSize]
-	b.MacKey = keyB[blockSize : blockSize+macKeySize]
-	b.CipherKey = keyB[blockSize+macKeySize:]
+	b.MacKey = keyB[blockSize : blockSize+macSize]
+	b.CipherKey = keyB[blockSize+macSize:]
 
 	return
 }
@@ -4,6 +4,8 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // GetCipher returns a block cipher based on the given name.
@@ -23,3 +25,33 @@ func GetCipher(name string, key []byte) (cipher.Block, error) {
 		return nil, errors.New("invalid cipher name")
 	}
 }
+
+// IsAEAD returns true if the cipher with the given name provides
+// authenticated encryption and should be obtained using GetAEAD.
+func IsAEAD(name string) bool {
+	switch name {
+	case "CHACHA20-POLY1305", "AES-256-GCM", "AES-128-GCM":
+		return true
+	default:
+		return false
+	}
+}
+
+// GetAEAD returns an authenticated encryption cipher based on the given name.
+func GetAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case "CHACHA20-POLY1305":
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, errors.New("key for CHACHA20-POLY1305 must be 32 bytes long")
+		}
+		return chacha20poly1305.New(key)
+	case "AES-256-GCM", "AES-128-GCM":
+		block, err := GetCipher(name[:len(name)-len("-GCM")], key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, errors.New("invalid AEAD cipher name")
+	}
+}
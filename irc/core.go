@@ -29,7 +29,7 @@ func (s *Server) handleMessage(ctx context.Context, msg dispatcher.IncomingMessa
 	switch pMsg := msg.Message.(type) {
 
 	case *message.PrivateMessage:
-		s.handlePrivateMessage(ctx, msg.Sender.Id, pMsg)
+		s.handlePrivateMessage(ctx, pMsg)
 
 	case *message.ChannelMessage:
 		s.handleChannelMessage(ctx, msg.Sender.Id, pMsg)
@@ -39,11 +39,11 @@ func (s *Server) handleMessage(ctx context.Context, msg dispatcher.IncomingMessa
 
 // handlePrivateMessage handles incoming private messages which are received
 // directly from the other nodes.
-func (s *Server) handlePrivateMessage(ctx context.Context, sender node.ID, msg *message.PrivateMessage) {
+func (s *Server) handlePrivateMessage(ctx context.Context, msg *message.PrivateMessage) {
 	s.usersMutex.Lock()
 	defer s.usersMutex.Unlock()
 
-	prefix, err := s.getPrefix(sender)
+	prefix, err := s.getPrefix(msg.GetNodeId())
 	if err != nil {
 		log.Debugf("error getting a prefix: %s", err)
 		return
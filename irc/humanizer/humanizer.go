@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/boreq/friendlyhash"
+	"github.com/boreq/starlight/core/contacts"
 	"github.com/boreq/starlight/crypto"
 	"github.com/boreq/starlight/irc/nickserver"
 	"github.com/boreq/starlight/network/node"
@@ -15,12 +16,22 @@ import (
 )
 
 const delimiter = "."
+
+// revokedHost is appended to the hosts of the nodes whose keys were revoked.
+const revokedHost = "revoked"
 const nickCacheTimeout = 60 * time.Minute
 const retryNickUpdateEvery = 1 * time.Minute
 
 var log = utils.GetLogger("humanizer")
 
-func New(ctx context.Context, iden node.Identity, nickServerUrl string, dictionary []string) (*Humanizer, error) {
+// RevocationChecker returns the revocation of the key of the node if it is
+// known.
+type RevocationChecker func(id node.ID) (*node.Revocation, bool)
+
+// TrustChecker returns the trust level of the node if it is trusted.
+type TrustChecker func(id node.ID) (contacts.Level, bool)
+
+func New(ctx context.Context, iden node.Identity, nickServerUrl string, dictionary []string, revoked RevocationChecker, trust TrustChecker) (*Humanizer, error) {
 	friendlyHash, err := friendlyhash.New(dictionary, crypto.KeyDigestLength)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create friendlyhash")
@@ -35,6 +46,8 @@ func New(ctx context.Context, iden node.Identity, nickServerUrl string, dictiona
 		friendlyHash: friendlyHash,
 		nickServer:   nickServer,
 		nicks:        newNickCacheWithTimeout(nickCacheTimeout),
+		revoked:      revoked,
+		trust:        trust,
 		ctx:          ctx,
 	}
 	return rv, nil
@@ -43,6 +56,8 @@ func New(ctx context.Context, iden node.Identity, nickServerUrl string, dictiona
 type Humanizer struct {
 	friendlyHash *friendlyhash.FriendlyHash
 	nickServer   *nickserver.NickServerClient
+	revoked      RevocationChecker
+	trust        TrustChecker
 
 	ctx       context.Context
 	nick      string
@@ -77,15 +92,53 @@ func (h *Humanizer) updateNick(ctx context.Context) {
 	}
 }
 
+// HumanizeHost returns the host of the node. The trust levels of the trusted
+// nodes are appended to their hosts and the hosts of the nodes whose keys were
+// revoked are marked.
 func (h *Humanizer) HumanizeHost(id node.ID) (string, error) {
-	words, err := h.friendlyHash.Humanize(id)
+	host, err := humanizeHost(h.friendlyHash, id)
+	if err != nil {
+		return "", err
+	}
+	if level, ok := h.trust(id); ok {
+		host += delimiter + level.String()
+	}
+	if _, ok := h.revoked(id); ok {
+		host += delimiter + revokedHost
+	}
+	return host, nil
+}
+
+// NewHostFunc returns a function which converts the ids to the hosts in the
+// same way as HumanizeHost but without the trust levels and without marking the
+// revoked ids. It can be used without running the daemon, for example to
+// generate an id with a vanity host or to display the fingerprint of an id.
+func NewHostFunc(dictionary []string) (func(id node.ID) (string, error), error) {
+	friendlyHash, err := friendlyhash.New(dictionary, crypto.KeyDigestLength)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create friendlyhash")
+	}
+	return func(id node.ID) (string, error) {
+		return humanizeHost(friendlyHash, id)
+	}, nil
+}
+
+func humanizeHost(friendlyHash *friendlyhash.FriendlyHash, id node.ID) (string, error) {
+	words, err := friendlyHash.Humanize(id)
 	if err != nil {
 		return "", errors.Wrap(err, "could not humanize")
 	}
 	return strings.Join(words, delimiter), nil
 }
 
+// HumanizeNick returns the nick of the node. The nicks of the nodes whose keys
+// were revoked are not used as they could have been claimed by an attacker
+// who compromised the key.
 func (h *Humanizer) HumanizeNick(id node.ID) (string, error) {
+	if _, ok := h.revoked(id); ok {
+		return id.String(), nil
+	}
+
 	h.nicksMutex.Lock()
 	defer h.nicksMutex.Unlock()
 
@@ -122,7 +175,23 @@ func (h *Humanizer) getNick(id node.ID) (string, error) {
 	return nick, nil
 }
 
+// DehumanizeNick returns the id of the node using the nick. An error is
+// returned if the key of the node was revoked.
 func (h *Humanizer) DehumanizeNick(nick string) (node.ID, error) {
+	id, err := h.dehumanizeNick(nick)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := h.revoked(id); ok {
+		if r.Successor != nil {
+			return nil, errors.Errorf("key of %s was revoked, it named %s as its successor", id, r.Successor)
+		}
+		return nil, errors.Errorf("key of %s was revoked", id)
+	}
+	return id, nil
+}
+
+func (h *Humanizer) dehumanizeNick(nick string) (node.ID, error) {
 	h.nicksMutex.Lock()
 	defer h.nicksMutex.Unlock()
 
@@ -29,12 +29,12 @@ var log = utils.GetLogger("irc")
 // NewServer creates a new IRC server which interfaces with the provided core
 // instance.
 func NewServer(ctx context.Context, core core.Core, nickServerAddress string) (*Server, error) {
-	dictionary, err := loadDictionary()
+	dictionary, err := LoadDictionary()
 	if err != nil {
 		return nil, errors.Wrap(err, "could not load the dictionary")
 	}
 
-	humanizer, err := humanizer.New(ctx, core.Identity(), nickServerAddress, dictionary)
+	humanizer, err := humanizer.New(ctx, core.Identity(), nickServerAddress, dictionary, core.Dht().Revoked, core.TrustLevel)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create the humanizer")
 	}
@@ -46,9 +46,9 @@ func NewServer(ctx context.Context, core core.Core, nickServerAddress string) (*
 	return rv, nil
 }
 
-// loadDictionary loads the list of words used by the humanizer for encoding
+// LoadDictionary loads the list of words used by the humanizer for encoding
 // hashes.
-func loadDictionary() ([]string, error) {
+func LoadDictionary() ([]string, error) {
 	statikFS, err := fs.New()
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create statikFS")
@@ -156,7 +156,7 @@ func (s *Server) runLoop(ctx context.Context, user *User) {
 		case "PART":
 			s.handlerPart(ctx, user, msg)
 		case "WHOIS":
-			s.handlerPart(ctx, user, msg)
+			s.handlerWhois(ctx, user, msg)
 		}
 	}
 }
@@ -327,6 +327,45 @@ func (s *Server) handlerPart(ctx context.Context, user *User, msg *protocol.Mess
 	}
 }
 
+func (s *Server) handlerWhois(ctx context.Context, user *User, msg *protocol.Message) {
+	if len(msg.Params) < 1 {
+		err := s.makeServerReply(protocol.ERR_NONICKNAMEGIVEN,
+			[]string{"No nickname given"},
+		)
+		user.Send(ctx, err)
+		return
+	}
+
+	// The first parameter is an optional server name.
+	nick := msg.Params[len(msg.Params)-1]
+	id, err := s.humanizer.DehumanizeNick(nick)
+	if err != nil {
+		reply := s.makeServerReply(protocol.ERR_NOSUCHNICK,
+			[]string{nick, "No such nick"},
+		)
+		user.Send(ctx, reply)
+		return
+	}
+	host, err := s.humanizer.HumanizeHost(id)
+	if err != nil {
+		user.Send(ctx, s.makeGlobalErrorMessage(err))
+		return
+	}
+
+	whoisUser := s.makeServerReply(protocol.RPL_WHOISUSER,
+		[]string{nick, "~user", host, "*", s.describeTrust(id)},
+	)
+	user.Send(ctx, whoisUser)
+	whoisServer := s.makeServerReply(protocol.RPL_WHOISSERVER,
+		[]string{nick, "starlight", id.String()},
+	)
+	user.Send(ctx, whoisServer)
+	end := s.makeServerReply(protocol.RPL_ENDOFWHOIS,
+		[]string{nick, "End of WHOIS list"},
+	)
+	user.Send(ctx, end)
+}
+
 // sendWelcome sends the RPL_WELCOME message to the specified user.
 func (s *Server) sendWelcome(ctx context.Context, user *User) {
 	welcome := s.makeServerReply(protocol.RPL_WELCOME,
@@ -351,7 +390,10 @@ Supported functionality:
     3. PRIVMSG
         The PRIVMSG can be used to send messages directly to other Starlight
         nodes as well as to send messages in the Starlight channels which were
-        previously joined using the JOIN command.`
+        previously joined using the JOIN command.
+    4. WHOIS
+        The WHOIS command displays the id of a Starlight node and tells you if
+        it was verified by you or is trusted by your contacts.`
 
 	motdStart := s.makeServerReply(protocol.RPL_MOTDSTART,
 		[]string{"- Message of the day -"},
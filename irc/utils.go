@@ -3,6 +3,7 @@ package irc
 import (
 	"fmt"
 
+	"github.com/boreq/starlight/core/contacts"
 	"github.com/boreq/starlight/irc/protocol"
 	"github.com/boreq/starlight/network/node"
 	"github.com/pkg/errors"
@@ -81,6 +82,25 @@ func (s *Server) getPrefix(id node.ID) (string, error) {
 	return createPrefix(nick, "user", host), nil
 }
 
+// describeTrust describes the trust level of the node.
+func (s *Server) describeTrust(id node.ID) string {
+	if node.CompareId(id, s.core.Identity().Id) {
+		return "your node"
+	}
+	if contact, ok := contacts.Find(s.core.Contacts(), id); ok && contact.Name != "" {
+		return fmt.Sprintf("verified contact %s", contact.Name)
+	}
+	level, ok := s.core.TrustLevel(id)
+	switch {
+	case !ok:
+		return "not verified"
+	case level == contacts.Verified:
+		return "verified contact"
+	default:
+		return fmt.Sprintf("trusted by your contacts at level %d", level)
+	}
+}
+
 func createPrefix(nick, user, host string) string {
 	return fmt.Sprintf("%s!~%s@%s", nick, user, host)
 }
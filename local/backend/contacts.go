@@ -0,0 +1,19 @@
+package backend
+
+import (
+	"github.com/boreq/starlight/core/contacts"
+	"golang.org/x/net/context"
+)
+
+type SetContactsArgs struct {
+	Contacts []contacts.Contact
+}
+
+// SetContacts is a RPC used by the contacts CLI commands. It replaces the
+// contacts used to compute the trust levels and publishes the trust list.
+func (b *Backend) SetContacts(args *SetContactsArgs, reply *struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	return b.core.SetContacts(ctx, args.Contacts)
+}
@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type CrawlArgs struct {
+	// Timeout in seconds.
+	Timeout int
+}
+
+type CrawlNode struct {
+	Id         string   `json:"id"`
+	Addresses  []string `json:"addresses"`
+	Reachable  bool     `json:"reachable"`
+	Address    string   `json:"address,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Neighbours []string `json:"neighbours"`
+}
+
+// Crawl is a RPC used by the crawl CLI command. If the timeout is reached the
+// nodes discovered so far are returned.
+func (b *Backend) Crawl(args *CrawlArgs, nodes *[]CrawlNode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(args.Timeout)*time.Second)
+	defer cancel()
+
+	crawled, err := b.core.Dht().Crawl(ctx)
+	if err != nil && err != context.DeadlineExceeded {
+		return err
+	}
+
+	for _, crawledNode := range crawled {
+		n := CrawlNode{
+			Id:        crawledNode.Id.String(),
+			Reachable: crawledNode.Reachable,
+			Version:   crawledNode.Version,
+		}
+		for _, addr := range crawledNode.Addresses {
+			n.Addresses = append(n.Addresses, addr.String())
+		}
+		if crawledNode.Reachable {
+			n.Address = crawledNode.Address.String()
+		}
+		for _, id := range crawledNode.Neighbours {
+			n.Neighbours = append(n.Neighbours, id.String())
+		}
+		*nodes = append(*nodes, n)
+	}
+	return nil
+}
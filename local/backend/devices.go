@@ -0,0 +1,24 @@
+package backend
+
+import (
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+type SetDeviceListArgs struct {
+	DeviceList []byte
+}
+
+// SetDeviceList is a RPC used by the identity master CLI commands. It
+// publishes the device list and attaches it to the sent messages.
+func (b *Backend) SetDeviceList(args *SetDeviceListArgs, reply *struct{}) error {
+	l, err := node.NewDeviceListFromBytes(args.DeviceList)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	return b.core.SetDeviceList(ctx, l)
+}
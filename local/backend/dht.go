@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/boreq/starlight/core/channel"
+	"github.com/boreq/starlight/core/dht/kbuckets"
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+// dhtTimeout limits the duration of the DHT procedures started by the RPCs.
+const dhtTimeout = 60 * time.Second
+
+type DhtEntry struct {
+	Id        string
+	Addresses []string
+	Stale     bool
+	LastSeen  time.Time
+}
+
+type DhtBucket struct {
+	Entries    []DhtEntry
+	Cache      []DhtEntry
+	LastLookup *time.Time
+}
+
+// DhtTable is a RPC used by the dht table CLI command.
+func (b *Backend) DhtTable(args *struct{}, buckets *[]DhtBucket) error {
+	for _, dump := range b.core.Dht().RoutingTable() {
+		bu := DhtBucket{
+			LastLookup: dump.LastLookup,
+		}
+		for _, entry := range dump.Entries {
+			bu.Entries = append(bu.Entries, toDhtEntry(entry))
+		}
+		for _, entry := range dump.Cache {
+			bu.Cache = append(bu.Cache, toDhtEntry(entry))
+		}
+		*buckets = append(*buckets, bu)
+	}
+	return nil
+}
+
+func toDhtEntry(entry kbuckets.Entry) DhtEntry {
+	rv := DhtEntry{
+		Id:       entry.Node.Id.String(),
+		Stale:    entry.Stale,
+		LastSeen: entry.LastSeen,
+	}
+	for _, addr := range entry.Node.Addresses {
+		rv.Addresses = append(rv.Addresses, addr.String())
+	}
+	return rv
+}
+
+type DhtLookupArgs struct {
+	NodeId string
+}
+
+type DhtHop struct {
+	Id        string
+	Addresses []string
+	Hop       int
+	Latency   float64
+}
+
+// DhtLookup is a RPC used by the dht lookup CLI command. It returns every node
+// which responded during the lookup procedure in the order in which they
+// responded.
+func (b *Backend) DhtLookup(args *DhtLookupArgs, hops *[]DhtHop) error {
+	id, err := node.NewId(args.NodeId)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	results, err := b.core.Dht().Lookup(ctx, id)
+	if err != nil {
+		return err
+	}
+	for result := range results {
+		hop := DhtHop{
+			Id:      result.Node.Id.String(),
+			Hop:     result.Hop,
+			Latency: result.Latency.Seconds(),
+		}
+		for _, addr := range result.Node.Addresses {
+			hop.Addresses = append(hop.Addresses, addr.String())
+		}
+		*hops = append(*hops, hop)
+	}
+	return ctx.Err()
+}
+
+type DhtGetKeyArgs struct {
+	NodeId string
+}
+
+// DhtGetKey is a RPC used by the dht get-key CLI command.
+func (b *Backend) DhtGetKey(args *DhtGetKeyArgs, key *[]byte) error {
+	id, err := node.NewId(args.NodeId)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	pubKey, err := b.core.Dht().GetPubKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	*key, err = pubKey.Bytes()
+	return err
+}
+
+type DhtChannelArgs struct {
+	Name string
+}
+
+// DhtChannel is a RPC used by the dht channel CLI command. It returns the ids
+// of the nodes which joined the channel.
+func (b *Backend) DhtChannel(args *DhtChannelArgs, ids *[]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	members, err := b.core.Dht().GetChannel(ctx, channel.CreateId(args.Name))
+	if err != nil {
+		return err
+	}
+	for _, id := range members {
+		*ids = append(*ids, id.String())
+	}
+	return nil
+}
+
+type DhtPutRevocationArgs struct {
+	Revocation []byte
+}
+
+// DhtPutRevocation is a RPC used by the identity revoke CLI command. It
+// publishes the revocation in the DHT.
+func (b *Backend) DhtPutRevocation(args *DhtPutRevocationArgs, reply *struct{}) error {
+	r, err := node.NewRevocationFromBytes(args.Revocation)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhtTimeout)
+	defer cancel()
+
+	return b.core.Dht().PutRevocation(ctx, r)
+}
@@ -0,0 +1,322 @@
+// Package address handles the network addresses of the nodes. Addresses are
+// written in a format inspired by multiaddr which specifies the type of the
+// host, the host itself, the network, the port and optionally the protocol
+// used on top of that network, for example:
+//
+//	/ip4/1.2.3.4/tcp/1836
+//	/ip6/2001:db8::1/udp/1836/quic
+//	/dns/example.com/tcp/443/wss
+//
+// Nodes which can't accept incoming connections are reachable through relays.
+// Addresses of such nodes consist of the address of the relay followed by the
+// id of the relay, for example:
+//
+//	/ip4/1.2.3.4/tcp/1836/circuit/0012ab...
+//
+// For compatibility addresses in the formats "host:port" and
+// "transport://host:port" are also accepted by Parse. Addresses without
+// a transport are treated as TCP addresses.
+package address
+
+import (
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Supported transports.
+const (
+	TCP  = "tcp"
+	QUIC = "quic"
+	WS   = "ws"
+	WSS  = "wss"
+)
+
+// networks maps the transports to the networks used by them as defined by
+// the net package.
+var networks = map[string]string{
+	TCP:  "tcp",
+	QUIC: "udp",
+	WS:   "tcp",
+	WSS:  "tcp",
+}
+
+// Host types used in the multiaddr format.
+const (
+	hostIP4 = "ip4"
+	hostIP6 = "ip6"
+	hostDNS = "dns"
+)
+
+const urlSeparator = "://"
+
+// circuit separates the address of a relay from its id.
+const circuit = "circuit"
+
+// Address is a structured network address of a node. Addresses can be
+// compared using the == operator.
+type Address struct {
+	// Transport is one of the supported transports, for example TCP.
+	Transport string
+
+	// Host is an IP address or a DNS name.
+	Host string
+
+	// Port is a TCP or UDP port depending on the transport.
+	Port int
+
+	// Relay is a hex encoded id of the relay node if this address points
+	// to a relay which forwards the connections to the node. In that case
+	// the remaining fields describe the address of the relay.
+	Relay string
+}
+
+// New creates an address from a transport and an address in the format
+// used by the net package. An empty host is treated as an unspecified
+// address.
+func New(transport, hostPort string) (Address, error) {
+	if _, ok := networks[transport]; !ok {
+		return Address{}, errors.Errorf("unsupported transport %s", transport)
+	}
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return Address{}, errors.Wrap(err, "invalid host and port")
+	}
+	if host == "" {
+		host = net.IPv6unspecified.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	port, err := parsePort(portString)
+	if err != nil {
+		return Address{}, err
+	}
+	return Address{Transport: transport, Host: host, Port: port}, nil
+}
+
+// Parse parses an address in the multiaddr format or in one of the formats
+// supported for compatibility.
+func Parse(s string) (Address, error) {
+	if strings.HasPrefix(s, "/") {
+		return parseMultiaddr(s)
+	}
+	if i := strings.Index(s, urlSeparator); i >= 0 {
+		return New(s[:i], s[i+len(urlSeparator):])
+	}
+	return New(TCP, s)
+}
+
+func parseMultiaddr(s string) (Address, error) {
+	parts := strings.Split(s[1:], "/")
+	relay := ""
+	if len(parts) > 2 && parts[len(parts)-2] == circuit {
+		relay = parts[len(parts)-1]
+		if _, err := hex.DecodeString(relay); err != nil || relay == "" {
+			return Address{}, errors.Errorf("invalid relay id %s", relay)
+		}
+		parts = parts[:len(parts)-2]
+	}
+	if len(parts) != 4 && len(parts) != 5 {
+		return Address{}, errors.Errorf("invalid number of parts in %s", s)
+	}
+
+	// Host.
+	rv := Address{Host: parts[1]}
+	ip := net.ParseIP(rv.Host)
+	if ip != nil {
+		rv.Host = ip.String()
+	}
+	switch parts[0] {
+	case hostIP4:
+		if ip == nil || ip.To4() == nil {
+			return Address{}, errors.Errorf("invalid IPv4 address %s", rv.Host)
+		}
+	case hostIP6:
+		if ip == nil || ip.To4() != nil {
+			return Address{}, errors.Errorf("invalid IPv6 address %s", rv.Host)
+		}
+	case hostDNS:
+		if rv.Host == "" || ip != nil {
+			return Address{}, errors.Errorf("invalid DNS name %s", rv.Host)
+		}
+	default:
+		return Address{}, errors.Errorf("unsupported host type %s", parts[0])
+	}
+
+	// Port.
+	port, err := parsePort(parts[3])
+	if err != nil {
+		return Address{}, err
+	}
+	rv.Port = port
+
+	// Transport.
+	network := parts[2]
+	rv.Transport = network
+	if len(parts) == 5 {
+		rv.Transport = parts[4]
+	}
+	if n, ok := networks[rv.Transport]; !ok || n != network {
+		return Address{}, errors.Errorf("unsupported transport %s over %s", rv.Transport, network)
+	}
+	rv.Relay = relay
+	return rv, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, errors.Errorf("invalid port %s", s)
+	}
+	return port, nil
+}
+
+// ParseList parses a list of addresses.
+func ParseList(list []string) ([]Address, error) {
+	var rv []Address
+	for _, s := range list {
+		a, err := Parse(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid address %s", s)
+		}
+		rv = append(rv, a)
+	}
+	return rv, nil
+}
+
+// Network returns the name of the network used by the transport of this
+// address as defined by the net package, for example "udp".
+func (a Address) Network() string {
+	return networks[a.Transport]
+}
+
+// HostPort returns the host and the port in the format used by the net
+// package.
+func (a Address) HostPort() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// IP returns the IP address of the host or nil if the host is a DNS name.
+func (a Address) IP() net.IP {
+	return net.ParseIP(a.Host)
+}
+
+// IsUnspecified returns true if the host is an unspecified IP address, for
+// example 0.0.0.0. Such addresses are used for listening on all interfaces.
+func (a Address) IsUnspecified() bool {
+	ip := a.IP()
+	return ip != nil && ip.IsUnspecified()
+}
+
+// IsRelay returns true if this address points to a relay.
+func (a Address) IsRelay() bool {
+	return a.Relay != ""
+}
+
+// RelayAddress returns the address of the relay.
+func (a Address) RelayAddress() Address {
+	a.Relay = ""
+	return a
+}
+
+// WithRelay returns an address which points to the given relay available
+// under this address.
+func (a Address) WithRelay(relay string) Address {
+	a.Relay = relay
+	return a
+}
+
+// WithHost returns a copy of this address with a different host.
+func (a Address) WithHost(host string) Address {
+	a.Host = host
+	return a
+}
+
+// String returns the address in the multiaddr format.
+func (a Address) String() string {
+	hostType := hostDNS
+	if ip := a.IP(); ip != nil {
+		hostType = hostIP6
+		if ip.To4() != nil {
+			hostType = hostIP4
+		}
+	}
+	parts := []string{"", hostType, a.Host, a.Network(), strconv.Itoa(a.Port)}
+	if a.Transport != a.Network() {
+		parts = append(parts, a.Transport)
+	}
+	if a.IsRelay() {
+		parts = append(parts, circuit, a.Relay)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (a Address) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Address) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Scope describes how widely an address is reachable. Higher values are
+// better.
+type Scope int
+
+const (
+	ScopeUnspecified Scope = iota
+	ScopeLoopback
+	ScopePrivate
+	ScopeGlobal
+)
+
+// Scope returns the scope of the address. DNS names are treated as globally
+// reachable.
+func (a Address) Scope() Scope {
+	ip := a.IP()
+	switch {
+	case ip == nil:
+		return ScopeGlobal
+	case ip.IsUnspecified():
+		return ScopeUnspecified
+	case ip.IsLoopback():
+		return ScopeLoopback
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		return ScopePrivate
+	default:
+		return ScopeGlobal
+	}
+}
+
+// Sort sorts the addresses placing the most widely reachable ones first. The
+// order of the addresses with the same scope is preserved. Relay addresses are
+// placed after the direct addresses.
+func Sort(addresses []Address) {
+	sort.SliceStable(addresses, func(i, j int) bool {
+		a, b := addresses[i], addresses[j]
+		if a.IsRelay() != b.IsRelay() {
+			return !a.IsRelay()
+		}
+		return a.Scope() > b.Scope()
+	})
+}
+
+// Contains returns true if the list contains the given address.
+func Contains(addresses []Address, a Address) bool {
+	for _, b := range addresses {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package address
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		s        string
+		expected Address
+	}{
+		{"/ip4/1.2.3.4/tcp/1836", Address{Transport: TCP, Host: "1.2.3.4", Port: 1836}},
+		{"/ip6/2001:db8::1/udp/1836/quic", Address{Transport: QUIC, Host: "2001:db8::1", Port: 1836}},
+		{"/ip6/::/tcp/1836", Address{Transport: TCP, Host: "::", Port: 1836}},
+		{"/dns/example.com/tcp/443/wss", Address{Transport: WSS, Host: "example.com", Port: 443}},
+		{"1.2.3.4:1836", Address{Transport: TCP, Host: "1.2.3.4", Port: 1836}},
+		{"tcp://1.2.3.4:1836", Address{Transport: TCP, Host: "1.2.3.4", Port: 1836}},
+		{"quic://[::1]:1836", Address{Transport: QUIC, Host: "::1", Port: 1836}},
+		{"quic://:1836", Address{Transport: QUIC, Host: "::", Port: 1836}},
+		{"ws://example.com:80", Address{Transport: WS, Host: "example.com", Port: 80}},
+		{"wss://example.com:443", Address{Transport: WSS, Host: "example.com", Port: 443}},
+		{"/ip4/1.2.3.4/tcp/1836/ws/circuit/0a0b", Address{Transport: WS, Host: "1.2.3.4", Port: 1836, Relay: "0a0b"}},
+	}
+
+	for _, testCase := range testCases {
+		a, err := Parse(testCase.s)
+		if err != nil {
+			t.Fatal(testCase.s, err)
+		}
+		if a != testCase.expected {
+			t.Fatalf("Invalid address parsed from %s: %#v", testCase.s, a)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"1.2.3.4",
+		"udp://1.2.3.4:1836",
+		"quic://1.2.3.4",
+		"/ip4/1.2.3.4/tcp",
+		"/ip4/::1/tcp/1836",
+		"/ip6/1.2.3.4/tcp/1836",
+		"/dns/1.2.3.4/tcp/1836",
+		"/ip4/1.2.3.4/tcp/1836/quic",
+		"/ip4/1.2.3.4/udp/1836",
+		"/ip4/1.2.3.4/tcp/70000",
+		"/ip4/1.2.3.4/tcp/1836/circuit/xyz",
+		"/ip4/1.2.3.4/tcp/1836/circuit/",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Fatal("Address should be invalid", s)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, s := range []string{
+		"/ip4/1.2.3.4/tcp/1836",
+		"/ip6/2001:db8::1/udp/1836/quic",
+		"/dns/example.com/tcp/443/wss",
+		"/ip4/1.2.3.4/udp/1836/quic/circuit/0a0b",
+	} {
+		a, err := Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.String() != s {
+			t.Fatal("Invalid string", a.String())
+		}
+	}
+
+	a, err := Parse("[2001:db8::1]:1836")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Network() != "tcp" || a.HostPort() != "[2001:db8::1]:1836" {
+		t.Fatal("Invalid parts")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	a := Address{Transport: QUIC, Host: "1.2.3.4", Port: 1836}
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"/ip4/1.2.3.4/udp/1836/quic"` {
+		t.Fatal("Invalid JSON", string(data))
+	}
+	var decoded Address
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != a {
+		t.Fatalf("Invalid decoded address %#v", decoded)
+	}
+}
+
+func TestSort(t *testing.T) {
+	addresses := []Address{
+		{Transport: TCP, Host: "5.6.7.8", Port: 1836, Relay: "0a0b"},
+		{Transport: TCP, Host: "::", Port: 1836},
+		{Transport: TCP, Host: "127.0.0.1", Port: 1836},
+		{Transport: TCP, Host: "192.168.1.1", Port: 1836},
+		{Transport: TCP, Host: "1.2.3.4", Port: 1836},
+		{Transport: TCP, Host: "example.com", Port: 1836},
+	}
+	Sort(addresses)
+	expected := []string{"1.2.3.4", "example.com", "192.168.1.1", "127.0.0.1", "::", "5.6.7.8"}
+	for i, host := range expected {
+		if addresses[i].Host != host {
+			t.Fatalf("Invalid order %v", addresses)
+		}
+	}
+}
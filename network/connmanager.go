@@ -0,0 +1,241 @@
+package network
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/network/peer"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// connManagerInterval specifies how often the connection manager checks the
+// connections.
+const connManagerInterval = 30 * time.Second
+
+// keepaliveInterval specifies after how much time without receiving anything
+// from a node the node is pinged.
+const keepaliveInterval = 1 * time.Minute
+
+// keepaliveTimeout specifies how much time a node has to respond to a
+// keepalive ping before the connection with it is closed.
+const keepaliveTimeout = 20 * time.Second
+
+func newConnManager(n *network, low, high int, idleTimeout time.Duration) *connManager {
+	return &connManager{
+		n:                n,
+		low:              low,
+		high:             high,
+		idleTimeout:      idleTimeout,
+		keepaliveTimeout: keepaliveTimeout,
+		lastActive:       make(map[string]time.Time),
+		lastReceived:     make(map[string]time.Time),
+	}
+}
+
+// connManager limits the number of connected nodes, closes idle connections
+// and detects dead connections using keepalive pings. The connections with the
+// nodes reported by the protectors are never pruned or closed due to
+// inactivity.
+type connManager struct {
+	n           *network
+	low         int
+	high        int
+	idleTimeout time.Duration
+	protectors  []Protector
+
+	// keepaliveTimeout specifies how long to wait for a response to
+	// a keepalive ping, see keepaliveTimeout.
+	keepaliveTimeout time.Duration
+
+	// lastActive contains the time at which a message other than
+	// a keepalive was last received from a node.
+	lastActive map[string]time.Time
+
+	// lastReceived contains the time at which anything was last received
+	// from a node.
+	lastReceived map[string]time.Time
+
+	mutex sync.Mutex
+}
+
+// run periodically checks the connections.
+func (m *connManager) run() {
+	for {
+		select {
+		case <-time.After(connManagerInterval):
+			m.check()
+		case <-m.n.ctx.Done():
+			return
+		}
+	}
+}
+
+// protect registers a protector.
+func (m *connManager) protect(p Protector) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.protectors = append(m.protectors, p)
+}
+
+// connected records that a stream with the node was established.
+func (m *connManager) connected(id node.ID) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.lastActive[id.String()] = now
+	m.lastReceived[id.String()] = now
+}
+
+// received records that a message was received from the node.
+func (m *connManager) received(id node.ID, msg proto.Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	m.lastReceived[id.String()] = now
+	if !isKeepalive(msg) {
+		m.lastActive[id.String()] = now
+	}
+}
+
+// isKeepalive returns true if the message doesn't indicate that the
+// connection is in use.
+func isKeepalive(msg proto.Message) bool {
+	switch msg.(type) {
+	case *message.Ping, *message.Pong:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *connManager) isProtected(id node.ID) bool {
+	m.mutex.Lock()
+	protectors := make([]Protector, len(m.protectors))
+	copy(protectors, m.protectors)
+	m.mutex.Unlock()
+
+	for _, protector := range protectors {
+		if protector(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// check closes the idle connections, pings the nodes from which nothing was
+// received recently and prunes the connections if there are too many of them.
+func (m *connManager) check() {
+	peers := m.openPeers()
+	now := time.Now()
+
+	m.mutex.Lock()
+	lastActive := make(map[string]time.Time)
+	lastReceived := make(map[string]time.Time)
+	for _, p := range peers {
+		key := p.Id().String()
+		lastActive[key] = m.lastActive[key]
+		lastReceived[key] = m.lastReceived[key]
+	}
+	// Forget the disconnected nodes.
+	m.lastActive = lastActive
+	m.lastReceived = lastReceived
+	m.mutex.Unlock()
+
+	for _, p := range peers {
+		key := p.Id().String()
+		if m.idleTimeout > 0 && now.Sub(lastActive[key]) > m.idleTimeout && !m.isProtected(p.Id()) {
+			log.Debugf("connmanager: closing idle connection with %s", p.Id())
+			p.Close()
+			continue
+		}
+		if now.Sub(lastReceived[key]) > keepaliveInterval {
+			go m.keepalive(p)
+		}
+	}
+
+	m.trim()
+}
+
+// keepalive pings the node and closes the connection if nothing is received
+// from the node before the timeout. The ping is sent as a regular message as
+// all nodes respond to it, also the ones which don't support the requests.
+func (m *connManager) keepalive(p peer.Peer) {
+	sent := time.Now()
+
+	ctx, cancel := context.WithTimeout(m.n.ctx, m.keepaliveTimeout)
+	defer cancel()
+
+	random := rand.Uint32()
+	if err := p.SendWithContext(ctx, &message.Ping{Random: &random}); err != nil {
+		log.Debugf("connmanager: could not send a keepalive to %s, closing: %s", p.Id(), err)
+		p.Close()
+		return
+	}
+
+	<-ctx.Done()
+	if m.n.ctx.Err() != nil {
+		return
+	}
+	if !m.receivedSince(p.Id(), sent) {
+		log.Debugf("connmanager: %s didn't respond to a keepalive, closing", p.Id())
+		p.Close()
+	}
+}
+
+// receivedSince returns true if anything was received from the node after
+// the given time.
+func (m *connManager) receivedSince(id node.ID, t time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return !m.lastReceived[id.String()].Before(t)
+}
+
+// trim closes the least recently active connections with the unprotected
+// nodes if the number of connected nodes exceeds the high watermark until it
+// falls to the low watermark.
+func (m *connManager) trim() {
+	if m.high <= 0 {
+		return
+	}
+	peers := m.openPeers()
+	if len(peers) <= m.high {
+		return
+	}
+
+	var candidates []peer.Peer
+	for _, p := range peers {
+		if !m.isProtected(p.Id()) {
+			candidates = append(candidates, p)
+		}
+	}
+
+	m.mutex.Lock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return m.lastActive[candidates[i].Id().String()].Before(m.lastActive[candidates[j].Id().String()])
+	})
+	m.mutex.Unlock()
+
+	excess := len(peers) - m.low
+	for i := 0; i < excess && i < len(candidates); i++ {
+		log.Debugf("connmanager: pruning connection with %s", candidates[i].Id())
+		candidates[i].Close()
+	}
+}
+
+func (m *connManager) openPeers() []peer.Peer {
+	m.n.peersMutex.Lock()
+	defer m.n.peersMutex.Unlock()
+
+	var rv []peer.Peer
+	for _, p := range m.n.peers {
+		if !p.Closed() {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
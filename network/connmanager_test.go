@@ -0,0 +1,119 @@
+package network
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/network/peer"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// testConnPeer implements the methods of a peer used by the connection
+// manager.
+type testConnPeer struct {
+	peer.Peer
+	id         node.ID
+	m          *connManager
+	responsive bool
+	closed     bool
+	mutex      sync.Mutex
+}
+
+func (p *testConnPeer) Id() node.ID {
+	return p.id
+}
+
+func (p *testConnPeer) Closed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+func (p *testConnPeer) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+}
+
+// SendWithContext responds to the pings if the peer is responsive.
+func (p *testConnPeer) SendWithContext(ctx context.Context, msg proto.Message) error {
+	if _, ok := msg.(*message.Ping); ok && p.responsive {
+		go p.m.received(p.id, &message.Pong{})
+	}
+	return nil
+}
+
+func newTestConnManager(low, high int, idleTimeout time.Duration, ids ...byte) (*connManager, []*testConnPeer) {
+	n := &network{ctx: context.Background()}
+	m := newConnManager(n, low, high, idleTimeout)
+	var peers []*testConnPeer
+	for i, id := range ids {
+		p := &testConnPeer{id: node.ID{id}, m: m, responsive: true}
+		n.peers = append(n.peers, p)
+		peers = append(peers, p)
+		m.connected(p.id)
+		m.lastActive[p.id.String()] = time.Now().Add(time.Duration(i) * time.Second)
+	}
+	return m, peers
+}
+
+func TestConnManagerTrim(t *testing.T) {
+	m, peers := newTestConnManager(2, 3, 0, 1, 2, 3, 4, 5)
+	m.protect(func(id node.ID) bool {
+		return node.CompareId(id, node.ID{1})
+	})
+
+	m.trim()
+
+	// The protected node and the most recently active node remain.
+	for i, closed := range []bool{false, true, true, true, false} {
+		if peers[i].Closed() != closed {
+			t.Fatalf("Invalid state of peer %d", i)
+		}
+	}
+}
+
+func TestConnManagerTrimBelowHighWatermark(t *testing.T) {
+	m, peers := newTestConnManager(1, 3, 0, 1, 2, 3)
+	m.trim()
+	for i, p := range peers {
+		if p.Closed() {
+			t.Fatalf("Peer %d should not be closed", i)
+		}
+	}
+}
+
+func TestConnManagerIdle(t *testing.T) {
+	m, peers := newTestConnManager(0, 0, time.Minute, 1, 2, 3)
+	m.protect(func(id node.ID) bool {
+		return node.CompareId(id, node.ID{2})
+	})
+	m.lastActive[node.ID{1}.String()] = time.Now().Add(-2 * time.Minute)
+	m.lastActive[node.ID{2}.String()] = time.Now().Add(-2 * time.Minute)
+
+	// Keepalives don't count as activity.
+	m.received(node.ID{1}, &message.Ping{})
+
+	m.check()
+	for i, closed := range []bool{true, false, false} {
+		if peers[i].Closed() != closed {
+			t.Fatalf("Invalid state of peer %d", i)
+		}
+	}
+}
+
+func TestConnManagerKeepalive(t *testing.T) {
+	m, peers := newTestConnManager(0, 0, 0, 1, 2)
+	m.keepaliveTimeout = 100 * time.Millisecond
+	peers[1].responsive = false
+
+	m.keepalive(peers[0])
+	m.keepalive(peers[1])
+	if peers[0].Closed() || !peers[1].Closed() {
+		t.Fatal("Only the unresponsive peer should be closed")
+	}
+}
@@ -0,0 +1,249 @@
+// Package discovery implements the discovery of the nodes on the local
+// network. The nodes periodically announce their ids and addresses to a UDP
+// multicast group and listen for the announcements of other nodes. This lets
+// the nodes connected to the same network find each other even if they can't
+// reach the bootstrap nodes.
+//
+// Structure of the announcement:
+//
+//	LEN      TYPE      DESCRIPTION
+//	4        []byte    Magic, see magic.
+//	?        []byte    Nodes.NodeInfo message encoded using protobuf.
+//
+// The unspecified hosts in the announced addresses are replaced with the
+// source address of the announcement by the receiving nodes.
+package discovery
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/boreq/starlight/utils"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Group is the multicast group used for the announcements.
+const Group = "239.255.18.36:18360"
+
+// announceEvery specifies how often the local node is announced.
+const announceEvery = 30 * time.Second
+
+// announceDelay is the minimum time between two announcements. An
+// announcement is sent immediately after discovering a new node so that the
+// nodes which just started don't have to wait for the periodic announcements.
+const announceDelay = 1 * time.Second
+
+// nodeTTL specifies how long a node is remembered after its last
+// announcement.
+const nodeTTL = 3 * announceEvery
+
+// maxNodes limits the number of remembered nodes.
+const maxNodes = 64
+
+// maxAnnouncementSize limits the size of the received announcements.
+const maxAnnouncementSize = 4096
+
+// magic starts every announcement.
+var magic = []byte{'S', 'L', 'D', 1}
+
+var log = utils.GetLogger("discovery")
+
+// New creates a discovery service which announces the local node under the
+// addresses returned by the provided function.
+func New(self node.ID, addresses func() []address.Address) *Discovery {
+	return &Discovery{
+		self:      self,
+		addresses: addresses,
+		nodes:     make(map[string]discoveredNode),
+		announce:  make(chan struct{}, 1),
+	}
+}
+
+type Discovery struct {
+	self      node.ID
+	addresses func() []address.Address
+	nodes     map[string]discoveredNode
+	announce  chan struct{}
+	mutex     sync.Mutex
+}
+
+type discoveredNode struct {
+	info     node.NodeInfo
+	lastSeen time.Time
+}
+
+// Run joins the multicast group and starts announcing the local node, does
+// not block. The service stops when the context is closed.
+func (d *Discovery) Run(ctx context.Context) error {
+	group, err := net.ResolveUDPAddr("udp4", Group)
+	if err != nil {
+		return errors.Wrap(err, "could not resolve the group")
+	}
+	listenConn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return errors.Wrap(err, "could not join the group")
+	}
+	sendConn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		listenConn.Close()
+		return errors.Wrap(err, "could not create the socket")
+	}
+
+	go func() {
+		<-ctx.Done()
+		listenConn.Close()
+		sendConn.Close()
+	}()
+	go d.receive(listenConn)
+	go d.run(ctx, sendConn)
+	return nil
+}
+
+// Nodes returns the nodes which were recently discovered.
+func (d *Discovery) Nodes() []node.NodeInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.removeExpired()
+	var rv []node.NodeInfo
+	for _, n := range d.nodes {
+		rv = append(rv, n.info)
+	}
+	return rv
+}
+
+func (d *Discovery) run(ctx context.Context, conn net.Conn) {
+	ticker := time.NewTicker(announceEvery)
+	defer ticker.Stop()
+	for {
+		if data, err := d.encode(); err != nil {
+			log.Debugf("could not encode the announcement: %s", err)
+		} else if _, err := conn.Write(data); err != nil {
+			log.Debugf("could not send the announcement: %s", err)
+		}
+
+		select {
+		case <-time.After(announceDelay):
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.announce:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Discovery) receive(conn *net.UDPConn) {
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Debugf("stopping: %s", err)
+			return
+		}
+		d.handle(buf[:n], source.IP)
+	}
+}
+
+// handle processes an announcement received from the given IP address.
+func (d *Discovery) handle(data []byte, source net.IP) {
+	info, err := decode(data, source)
+	if err != nil {
+		log.Debugf("invalid announcement from %s: %s", source, err)
+		return
+	}
+	if node.CompareId(info.Id, d.self) {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := info.Id.String()
+	if _, ok := d.nodes[key]; !ok {
+		d.removeExpired()
+		if len(d.nodes) >= maxNodes {
+			return
+		}
+		log.Debugf("discovered %s on %s", info.Id, info.Addresses)
+		select {
+		case d.announce <- struct{}{}:
+		default:
+		}
+	}
+	d.nodes[key] = discoveredNode{info: info, lastSeen: time.Now()}
+}
+
+// removeExpired removes the nodes which haven't been announced recently. The
+// caller must hold the mutex.
+func (d *Discovery) removeExpired() {
+	for key, n := range d.nodes {
+		if time.Since(n.lastSeen) > nodeTTL {
+			delete(d.nodes, key)
+		}
+	}
+}
+
+// encode creates an announcement of the local node. The relay addresses are
+// skipped as the nodes on the local network can connect directly.
+func (d *Discovery) encode() ([]byte, error) {
+	info := node.NodeInfo{Id: d.self}
+	for _, a := range d.addresses() {
+		if !a.IsRelay() {
+			info.Addresses = append(info.Addresses, a)
+		}
+	}
+	data, err := proto.Marshal(info.Message())
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, magic...), data...), nil
+}
+
+// decode parses an announcement received from the given IP address.
+func decode(data []byte, source net.IP) (node.NodeInfo, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return node.NodeInfo{}, errors.New("invalid magic")
+	}
+	msg := &message.Nodes_NodeInfo{}
+	if err := proto.Unmarshal(data[len(magic):], msg); err != nil {
+		return node.NodeInfo{}, errors.Wrap(err, "could not unmarshal")
+	}
+	if !node.ValidateId(msg.GetId()) {
+		return node.NodeInfo{}, errors.New("invalid id")
+	}
+
+	info := node.NodeInfo{Id: msg.GetId()}
+	for _, s := range msg.GetAddresses() {
+		a, err := address.Parse(s)
+		if err != nil || a.IsRelay() {
+			continue
+		}
+		if a.IsUnspecified() {
+			// Sockets listening on the unspecified IPv4 address
+			// don't accept IPv6 connections.
+			if a.IP().To4() != nil && source.To4() == nil {
+				continue
+			}
+			a = a.WithHost(source.String())
+		}
+		if !address.Contains(info.Addresses, a) {
+			info.Addresses = append(info.Addresses, a)
+		}
+	}
+	if len(info.Addresses) == 0 {
+		return node.NodeInfo{}, errors.New("no valid addresses")
+	}
+	return info, nil
+}
@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+)
+
+func testId(b byte) node.ID {
+	id := make(node.ID, crypto.KeyDigestLength)
+	id[len(id)-1] = b
+	return id
+}
+
+func testDiscovery(t *testing.T, id node.ID, addresses ...string) *Discovery {
+	var parsed []address.Address
+	for _, s := range addresses {
+		a, err := address.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, a)
+	}
+	return New(id, func() []address.Address {
+		return parsed
+	})
+}
+
+func TestAnnouncement(t *testing.T) {
+	d := testDiscovery(t, testId(1),
+		"/ip6/::/tcp/1836",
+		"/ip4/0.0.0.0/udp/1836/quic",
+		"/ip4/203.0.113.1/tcp/1836",
+		"/ip4/203.0.113.2/tcp/1836/circuit/0a0b",
+	)
+	data, err := d.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := decode(data, net.ParseIP("192.168.1.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.CompareId(info.Id, testId(1)) {
+		t.Fatal("Invalid id", info.Id)
+	}
+	expected := []string{
+		"/ip4/192.168.1.2/tcp/1836",
+		"/ip4/192.168.1.2/udp/1836/quic",
+		"/ip4/203.0.113.1/tcp/1836",
+	}
+	if len(info.Addresses) != len(expected) {
+		t.Fatal("Invalid addresses", info.Addresses)
+	}
+	for i, s := range expected {
+		if info.Addresses[i].String() != s {
+			t.Fatal("Invalid addresses", info.Addresses)
+		}
+	}
+}
+
+func TestAnnouncementInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("data"),
+		append(append([]byte{}, magic...), 0xff, 0xff),
+	} {
+		if _, err := decode(data, net.ParseIP("192.168.1.2")); err == nil {
+			t.Fatal("Announcement should be invalid", data)
+		}
+	}
+
+	d := testDiscovery(t, node.ID{1}, "/ip4/192.168.1.1/tcp/1836")
+	data, err := d.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decode(data, net.ParseIP("192.168.1.2")); err == nil {
+		t.Fatal("Announcement with an invalid id should be rejected")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	local := testDiscovery(t, testId(1), "/ip4/0.0.0.0/tcp/1836")
+	remote := testDiscovery(t, testId(2), "/ip4/0.0.0.0/tcp/1836")
+
+	for _, d := range []*Discovery{local, remote} {
+		data, err := d.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.handle(data, net.ParseIP("192.168.1.2"))
+	}
+
+	nodes := local.Nodes()
+	if len(nodes) != 1 || !node.CompareId(nodes[0].Id, testId(2)) {
+		t.Fatal("Invalid nodes", nodes)
+	}
+	select {
+	case <-local.announce:
+	default:
+		t.Fatal("Discovering a new node should trigger an announcement")
+	}
+
+	local.nodes[testId(2).String()] = discoveredNode{
+		info:     nodes[0],
+		lastSeen: time.Now().Add(-2 * nodeTTL),
+	}
+	if len(local.Nodes()) != 0 {
+		t.Fatal("Node should expire")
+	}
+}
@@ -52,12 +52,17 @@ func (d *dispatcher) Subscribe() (chan IncomingMessage, CancelFunc) {
 }
 
 func (d *dispatcher) Dispatch(node node.NodeInfo, msg proto.Message) {
+	d.DispatchRequest(node, 0, msg)
+}
+
+func (d *dispatcher) DispatchRequest(node node.NodeInfo, requestId uint64, msg proto.Message) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	incMsg := IncomingMessage{
 		node,
 		msg,
+		requestId,
 	}
 
 	for _, sub := range d.subs {
@@ -20,6 +20,10 @@ type Dispatcher interface {
 	// Dispatch forwards a message to all channels retrieved using the
 	// subscribe method.
 	Dispatch(node.NodeInfo, proto.Message)
+
+	// DispatchRequest forwards a request to all channels retrieved using
+	// the subscribe method. The request id has to be used when responding.
+	DispatchRequest(node.NodeInfo, uint64, proto.Message)
 }
 
 // Since all incoming messages are passed on the same channel they must be
@@ -27,4 +31,8 @@ type Dispatcher interface {
 type IncomingMessage struct {
 	Sender  node.NodeInfo
 	Message proto.Message
+
+	// RequestId is set if the message is a request which expects
+	// a response. It is equal to zero otherwise.
+	RequestId uint64
 }
@@ -0,0 +1,333 @@
+package network
+
+import (
+	"net"
+	"time"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/network/transport"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// holePunchTimeout limits the time needed to coordinate a hole punch and
+// establish the connection.
+const holePunchTimeout = 20 * time.Second
+
+// punchAttempts is the number of times the addresses of the other node are
+// dialed. The first attempts are expected to fail until both nodes send their
+// packets and create the mappings in their NATs.
+const punchAttempts = 5
+
+// punchDialTimeout limits the time of a single attempt.
+const punchDialTimeout = 2 * time.Second
+
+// punchRetryDelay specifies how long to wait between the attempts.
+const punchRetryDelay = 250 * time.Millisecond
+
+// punchPeer is the subset of the peer methods used by the hole punching.
+type punchPeer interface {
+	Id() node.ID
+	Request(context.Context, proto.Message) (proto.Message, error)
+	Respond(ctx context.Context, requestId uint64, msg proto.Message) error
+}
+
+// holePuncher implements the hole punching which lets two nodes behind NATs
+// establish a direct connection. The initiator sends its external addresses
+// to a mutual peer to which both nodes are connected. The mutual peer
+// forwards them to the target which responds with its own addresses and
+// immediately starts dialing the initiator. The initiator starts dialing the
+// target as soon as it receives the response so that both nodes dial each
+// other at roughly the same time.
+type holePuncher struct {
+	ctx  context.Context
+	self node.ID
+
+	// findPeer returns a connected peer.
+	findPeer func(id node.ID) (punchPeer, error)
+
+	// addresses returns the external addresses of the local node which
+	// can be used for the hole punching.
+	addresses func() []address.Address
+
+	// dialFrom dials the address from the port the local node is
+	// listening on. It is nil if the hole punching is unavailable in which
+	// case the local node can only act as a mutual peer.
+	dialFrom func(ctx context.Context, a address.Address) (net.Conn, error)
+
+	// accept is called with the connections established with the nodes
+	// which initiated the hole punching.
+	accept func(conn net.Conn, initiator node.ID)
+}
+
+// connect establishes a direct connection with the target node. The hole
+// punching is coordinated by the mutual peer.
+func (h *holePuncher) connect(mutual punchPeer, target node.ID) (net.Conn, error) {
+	local := h.localAddresses()
+	if len(local) == 0 {
+		return nil, errors.New("no addresses which can be used for hole punching")
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, holePunchTimeout)
+	defer cancel()
+
+	request := &message.HolePunchConnect{
+		Target:    target,
+		Addresses: addressStrings(local),
+	}
+	response, err := mutual.Request(ctx, request)
+	if err != nil {
+		return nil, errors.Wrap(err, "coordination failed")
+	}
+	sync, ok := response.(*message.HolePunchSync)
+	if !ok {
+		return nil, errors.Errorf("unexpected response %T", response)
+	}
+	remote := punchAddresses(sync.GetAddresses())
+	if len(remote) == 0 {
+		return nil, errors.New("target can't be reached using hole punching")
+	}
+	return h.punch(ctx, remote)
+}
+
+// handleMessage handles the messages of the hole punching protocol. Returns
+// false if the message is not related to the hole punching.
+func (h *holePuncher) handleMessage(p punchPeer, env protocol.Envelope) bool {
+	msg, ok := env.Message.(*message.HolePunchConnect)
+	if !ok {
+		return false
+	}
+	if node.CompareId(msg.GetTarget(), h.self) {
+		go h.handleTarget(p, env.RequestId, msg)
+	} else {
+		go h.handleMutual(p, env.RequestId, msg)
+	}
+	return true
+}
+
+// handleMutual forwards the request to the target and its response back to
+// the initiator. The id of the initiator is always set by the mutual peer so
+// that it can't be forged.
+func (h *holePuncher) handleMutual(p punchPeer, requestId uint64, msg *message.HolePunchConnect) {
+	ctx, cancel := context.WithTimeout(h.ctx, holePunchTimeout)
+	defer cancel()
+
+	sync := &message.HolePunchSync{}
+	if target, err := h.findPeer(msg.GetTarget()); err != nil {
+		log.Debugf("holepunch: target %s for %s not found", node.ID(msg.GetTarget()), p.Id())
+	} else {
+		request := &message.HolePunchConnect{
+			Target:    msg.GetTarget(),
+			Initiator: p.Id(),
+			Addresses: msg.GetAddresses(),
+		}
+		response, err := target.Request(ctx, request)
+		if err != nil {
+			log.Debugf("holepunch: could not forward to %s: %s", target.Id(), err)
+		} else if targetSync, ok := response.(*message.HolePunchSync); ok {
+			sync = targetSync
+		}
+	}
+	if err := p.Respond(ctx, requestId, sync); err != nil {
+		log.Debugf("holepunch: could not respond to %s: %s", p.Id(), err)
+	}
+}
+
+// handleTarget responds with the addresses of the local node and starts
+// dialing the initiator.
+func (h *holePuncher) handleTarget(p punchPeer, requestId uint64, msg *message.HolePunchConnect) {
+	ctx, cancel := context.WithTimeout(h.ctx, holePunchTimeout)
+	defer cancel()
+
+	remote := punchAddresses(msg.GetAddresses())
+	var local []address.Address
+	if len(remote) > 0 {
+		local = h.localAddresses()
+	}
+	sync := &message.HolePunchSync{Addresses: addressStrings(local)}
+	if err := p.Respond(ctx, requestId, sync); err != nil {
+		log.Debugf("holepunch: could not respond to %s: %s", p.Id(), err)
+		return
+	}
+	if len(local) == 0 {
+		return
+	}
+
+	initiator := node.ID(msg.GetInitiator())
+	conn, err := h.punch(ctx, remote)
+	if err != nil {
+		log.Debugf("holepunch: could not connect to %s: %s", initiator, err)
+		return
+	}
+	h.accept(conn, initiator)
+}
+
+// punch repeatedly dials the addresses of the other node which is dialing the
+// local node at the same time.
+func (h *holePuncher) punch(ctx context.Context, remote []address.Address) (net.Conn, error) {
+	var err error
+	for i := 0; i < punchAttempts; i++ {
+		for _, a := range remote {
+			var conn net.Conn
+			dialCtx, cancel := context.WithTimeout(ctx, punchDialTimeout)
+			conn, err = h.dialFrom(dialCtx, a)
+			cancel()
+			if err == nil {
+				return conn, nil
+			}
+			log.Debugf("holepunch: dialing %s failed: %s", a, err)
+		}
+		select {
+		case <-time.After(punchRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+func (h *holePuncher) available() bool {
+	return h.dialFrom != nil
+}
+
+func (h *holePuncher) localAddresses() []address.Address {
+	if !h.available() {
+		return nil
+	}
+	return punchAddresses(addressStrings(h.addresses()))
+}
+
+// punchAddresses parses the addresses and returns those which can be used for
+// the hole punching.
+func punchAddresses(addresses []string) []address.Address {
+	var rv []address.Address
+	for _, s := range addresses {
+		a, err := address.Parse(s)
+		if err != nil {
+			continue
+		}
+		if a.Transport == address.TCP && !a.IsRelay() && a.Scope() == address.ScopeGlobal && a.IP() != nil {
+			rv = append(rv, a)
+		}
+	}
+	return rv
+}
+
+func addressStrings(addresses []address.Address) []string {
+	var rv []string
+	for _, a := range addresses {
+		rv = append(rv, a.String())
+	}
+	return rv
+}
+
+func newHolePuncher(n *network, available bool) *holePuncher {
+	h := &holePuncher{
+		ctx:       n.ctx,
+		self:      n.iden.Id,
+		findPeer:  n.findPunchPeer,
+		addresses: n.getPunchAddresses,
+		accept:    n.acceptPunched,
+	}
+	if available {
+		h.dialFrom = n.dialFrom
+	}
+	return h
+}
+
+// holePunch tries to establish a direct connection with a relayed node. The
+// relays act as the mutual peers since both nodes can connect to them.
+func (n *network) holePunch(ctx context.Context, id node.ID, relayed []address.Address) (net.Conn, error) {
+	if !n.holePuncher.available() {
+		return nil, errors.New("hole punching is unavailable")
+	}
+	err := errors.New("no relays")
+	for _, a := range relayed {
+		relayId, idErr := node.NewId(a.Relay)
+		if idErr != nil {
+			continue
+		}
+		relayInfo := node.NodeInfo{
+			Id:        relayId,
+			Addresses: []address.Address{a.RelayAddress()},
+		}
+		var mutual Peer
+		mutual, err = n.Dial(ctx, relayInfo)
+		if err != nil {
+			continue
+		}
+		var conn net.Conn
+		conn, err = n.holePuncher.connect(mutual, id)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (n *network) findPunchPeer(id node.ID) (punchPeer, error) {
+	p, err := n.FindActive(id)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// getPunchAddresses returns the external TCP addresses of the local node.
+func (n *network) getPunchAddresses() []address.Address {
+	n.listenersMutex.Lock()
+	defer n.listenersMutex.Unlock()
+
+	var addresses []address.Address
+	for _, a := range n.getObservedAddresses() {
+		if a.Transport == address.TCP {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses
+}
+
+// dialFrom dials the address from the port of the TCP listener which listens
+// on all interfaces as the observed addresses are created from such
+// listeners.
+func (n *network) dialFrom(ctx context.Context, a address.Address) (net.Conn, error) {
+	puncher, ok := n.transports[address.TCP].(transport.Puncher)
+	if !ok {
+		return nil, errors.New("transport can't be used for hole punching")
+	}
+
+	port := 0
+	n.listenersMutex.Lock()
+	for _, l := range n.listeners {
+		if l.address.Transport != address.TCP || !l.address.IsUnspecified() {
+			continue
+		}
+		if l.address.IP().To4() != nil && a.IP().To4() == nil {
+			continue
+		}
+		port = l.address.Port
+		break
+	}
+	n.listenersMutex.Unlock()
+
+	if port == 0 {
+		return nil, errors.New("no appropriate listener")
+	}
+	return puncher.DialFrom(ctx, port, a.HostPort())
+}
+
+// acceptPunched initiates a connection established by the hole punching
+// initiated by another node.
+func (n *network) acceptPunched(conn net.Conn, initiator node.ID) {
+	p, err := n.newConnection(n.ctx, conn, false)
+	if err != nil {
+		return
+	}
+	if !node.CompareId(p.Id(), initiator) {
+		log.Debugf("holepunch: expected %s, connected to %s", initiator, p.Id())
+	}
+}
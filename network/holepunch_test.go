@@ -0,0 +1,215 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testNat simulates the NATs of the nodes: a connection is established only
+// if both nodes dial each other at the same time.
+type testNat struct {
+	pending map[string]chan net.Conn
+	mutex   sync.Mutex
+}
+
+func newTestNat() *testNat {
+	return &testNat{pending: make(map[string]chan net.Conn)}
+}
+
+func (nat *testNat) dial(ctx context.Context, from, to address.Address) (net.Conn, error) {
+	nat.mutex.Lock()
+	if c, ok := nat.pending[to.String()+from.String()]; ok {
+		delete(nat.pending, to.String()+from.String())
+		nat.mutex.Unlock()
+		a, b := net.Pipe()
+		c <- b
+		return a, nil
+	}
+	c := make(chan net.Conn, 1)
+	key := from.String() + to.String()
+	nat.pending[key] = c
+	nat.mutex.Unlock()
+
+	select {
+	case conn := <-c:
+		return conn, nil
+	case <-ctx.Done():
+		nat.mutex.Lock()
+		delete(nat.pending, key)
+		nat.mutex.Unlock()
+		return nil, errors.New("packets dropped by the NAT")
+	}
+}
+
+type testNode struct {
+	h        *holePuncher
+	peers    map[string]*testPeer
+	accepted chan net.Conn
+}
+
+func newTestNode(id byte, host string, nat *testNat) *testNode {
+	tn := &testNode{
+		peers:    make(map[string]*testPeer),
+		accepted: make(chan net.Conn, 1),
+	}
+	external := address.Address{Transport: address.TCP, Host: host, Port: 1836}
+	tn.h = &holePuncher{
+		ctx:  context.Background(),
+		self: node.ID{id},
+		findPeer: func(id node.ID) (punchPeer, error) {
+			p, ok := tn.peers[id.String()]
+			if !ok {
+				return nil, errors.New("not found")
+			}
+			return p, nil
+		},
+		addresses: func() []address.Address {
+			if host == "" {
+				return nil
+			}
+			return []address.Address{external}
+		},
+		dialFrom: func(ctx context.Context, a address.Address) (net.Conn, error) {
+			return nat.dial(ctx, external, a)
+		},
+		accept: func(conn net.Conn, initiator node.ID) {
+			tn.accepted <- conn
+		},
+	}
+	return tn
+}
+
+// testPeer delivers the requests directly to the handler of the remote node.
+type testPeer struct {
+	remote    *testNode
+	reverse   *testPeer
+	responses map[uint64]chan proto.Message
+	requestId uint64
+	mutex     sync.Mutex
+}
+
+func connectTestNodes(a, b *testNode) {
+	ab := &testPeer{remote: b, responses: make(map[uint64]chan proto.Message)}
+	ba := &testPeer{remote: a, responses: make(map[uint64]chan proto.Message)}
+	ab.reverse = ba
+	ba.reverse = ab
+	a.peers[b.h.self.String()] = ab
+	b.peers[a.h.self.String()] = ba
+}
+
+func (p *testPeer) Id() node.ID {
+	return p.remote.h.self
+}
+
+func (p *testPeer) Request(ctx context.Context, msg proto.Message) (proto.Message, error) {
+	c := make(chan proto.Message, 1)
+	p.mutex.Lock()
+	p.requestId++
+	requestId := p.requestId
+	p.responses[requestId] = c
+	p.mutex.Unlock()
+
+	env := protocol.Envelope{RequestId: requestId, Message: msg}
+	if !p.remote.h.handleMessage(p.reverse, env) {
+		return nil, errors.New("message not handled")
+	}
+	select {
+	case response := <-c:
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *testPeer) Respond(ctx context.Context, requestId uint64, msg proto.Message) error {
+	p.reverse.mutex.Lock()
+	c, ok := p.reverse.responses[requestId]
+	delete(p.reverse.responses, requestId)
+	p.reverse.mutex.Unlock()
+	if !ok {
+		return errors.New("unknown request")
+	}
+	c <- msg
+	return nil
+}
+
+func TestHolePunch(t *testing.T) {
+	nat := newTestNat()
+	initiator := newTestNode(1, "203.0.113.1", nat)
+	target := newTestNode(2, "203.0.113.2", nat)
+	mutual := newTestNode(3, "203.0.113.3", nat)
+	connectTestNodes(initiator, mutual)
+	connectTestNodes(target, mutual)
+
+	conn, err := initiator.h.connect(initiator.peers[mutual.h.self.String()], target.h.self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var accepted net.Conn
+	select {
+	case accepted = <-target.accepted:
+		defer accepted.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Target didn't accept the connection")
+	}
+
+	go conn.Write([]byte("data"))
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Fatal("Invalid data", string(data))
+	}
+}
+
+func TestHolePunchTargetNotConnected(t *testing.T) {
+	nat := newTestNat()
+	initiator := newTestNode(1, "203.0.113.1", nat)
+	target := newTestNode(2, "203.0.113.2", nat)
+	mutual := newTestNode(3, "203.0.113.3", nat)
+	connectTestNodes(initiator, mutual)
+
+	if _, err := initiator.h.connect(initiator.peers[mutual.h.self.String()], target.h.self); err == nil {
+		t.Fatal("Hole punching should fail")
+	}
+}
+
+func TestHolePunchTargetWithoutAddresses(t *testing.T) {
+	nat := newTestNat()
+	initiator := newTestNode(1, "203.0.113.1", nat)
+	target := newTestNode(2, "", nat)
+	mutual := newTestNode(3, "203.0.113.3", nat)
+	connectTestNodes(initiator, mutual)
+	connectTestNodes(target, mutual)
+
+	if _, err := initiator.h.connect(initiator.peers[mutual.h.self.String()], target.h.self); err == nil {
+		t.Fatal("Hole punching should fail")
+	}
+}
+
+func TestPunchAddresses(t *testing.T) {
+	addresses := punchAddresses([]string{
+		"/ip4/203.0.113.1/tcp/1836",
+		"/ip4/192.168.1.1/tcp/1836",
+		"/ip4/203.0.113.1/udp/1836/quic",
+		"/ip4/203.0.113.1/tcp/1836/circuit/0a0b",
+		"/dns/example.com/tcp/1836",
+		"invalid",
+	})
+	if len(addresses) != 1 || addresses[0].Host != "203.0.113.1" {
+		t.Fatal("Invalid addresses", addresses)
+	}
+}
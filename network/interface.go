@@ -3,6 +3,7 @@ package network
 import (
 	"github.com/boreq/starlight/crypto"
 	"github.com/boreq/starlight/network/dispatcher"
+	"github.com/boreq/starlight/network/mux"
 	"github.com/boreq/starlight/network/node"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
@@ -15,8 +16,9 @@ type Network interface {
 	Listen() error
 
 	// Dial returns an already connected Peer or if the connection does not
-	// exist attempts to establish it.
-	Dial(node node.NodeInfo) (Peer, error)
+	// exist attempts to establish it. The context limits the time spent on
+	// establishing the connection.
+	Dial(ctx context.Context, node node.NodeInfo) (Peer, error)
 
 	// CheckOnline checks if the node is available under the specified
 	// address.
@@ -25,11 +27,28 @@ type Network interface {
 	// FindActive returns an already connected Peer.
 	FindActive(id node.ID) (Peer, error)
 
+	// LocalNodes returns the nodes discovered on the local network.
+	// Returns an error if the local discovery is disabled.
+	LocalNodes() ([]node.NodeInfo, error)
+
 	// Subscribe returns a channel on which it is possible to receive all
 	// incoming messages. CancelFunc must be called afterwards.
 	Subscribe() (chan dispatcher.IncomingMessage, dispatcher.CancelFunc)
+
+	// AcceptSubstream waits for a substream opened by another node. The
+	// substreams which aren't accepted quickly enough are rejected.
+	AcceptSubstream(ctx context.Context) (Peer, mux.Substream, error)
+
+	// Protect registers a protector. The connections with the nodes
+	// reported by any of the protectors are never closed by the
+	// connection manager unless they are dead.
+	Protect(Protector)
 }
 
+// Protector returns true if the connections with the node should be protected
+// from being closed by the connection manager.
+type Protector func(id node.ID) bool
+
 // Peer represents an external node.
 type Peer interface {
 	// Id returns the id of this peer.
@@ -38,9 +57,30 @@ type Peer interface {
 	// Returns the node's public key.
 	PubKey() crypto.PublicKey
 
+	// Version returns the version of the software reported by the node.
+	Version() string
+
 	// Sends a message to the node.
 	Send(proto.Message) error
 
 	// Sends a message to the node, returns an error if context is closed.
 	SendWithContext(context.Context, proto.Message) error
+
+	// Request sends a request to the node and waits for the response.
+	// Returns an error if the context is closed before the response is
+	// received. The responses sent by the nodes which don't support the
+	// request ids are recognized by their types, the requests which such
+	// nodes don't understand fail with protocol.ErrRequestsUnsupported.
+	Request(context.Context, proto.Message) (proto.Message, error)
+
+	// Respond sends a response to the request with the given id. If the id
+	// is zero a regular message is sent.
+	Respond(ctx context.Context, requestId uint64, msg proto.Message) error
+
+	// OpenSubstream opens a substream multiplexed over the connection
+	// with the node. Substreams should be used for bulk transfers so that
+	// they don't delay other messages. The protocol is reported to the
+	// node. Returns stream.ErrSubstreamsUnsupported if the node doesn't
+	// support the substreams.
+	OpenSubstream(ctx context.Context, protocol string) (mux.Substream, error)
 }
@@ -0,0 +1,84 @@
+package mux
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// frameType is the type of a frame.
+type frameType uint8
+
+const (
+	// frameMessage carries a message which isn't sent over a substream.
+	frameMessage frameType = 0
+
+	// frameOpen opens a substream. The payload contains the name of the
+	// protocol used over the substream.
+	frameOpen frameType = 1
+
+	// frameData carries the data sent over a substream.
+	frameData frameType = 2
+
+	// frameWindow increases the amount of data the other side can send
+	// over a substream. The payload contains the increment encoded as
+	// uint32.
+	frameWindow frameType = 3
+
+	// frameClose closes a substream.
+	frameClose frameType = 4
+)
+
+// headerSize is the size of the frame header.
+const headerSize = 5
+
+type frame struct {
+	typ     frameType
+	id      uint32
+	payload []byte
+
+	// written receives the result of sending the frame.
+	written chan error
+}
+
+func (f frame) encode() []byte {
+	buf := make([]byte, headerSize+len(f.payload))
+	buf[0] = byte(f.typ)
+	binary.BigEndian.PutUint32(buf[1:], f.id)
+	copy(buf[headerSize:], f.payload)
+	return buf
+}
+
+func decodeFrame(data []byte) (frame, error) {
+	if len(data) < headerSize {
+		return frame{}, errors.New("frame too short")
+	}
+	f := frame{
+		typ:     frameType(data[0]),
+		id:      binary.BigEndian.Uint32(data[1:]),
+		payload: data[headerSize:],
+	}
+	switch f.typ {
+	case frameMessage:
+		if f.id != 0 {
+			return frame{}, errors.New("message with a substream id")
+		}
+	case frameOpen, frameData, frameClose:
+		if f.id == 0 {
+			return frame{}, errors.New("missing substream id")
+		}
+	case frameWindow:
+		if f.id == 0 || len(f.payload) != 4 {
+			return frame{}, errors.New("invalid window update")
+		}
+	default:
+		return frame{}, errors.Errorf("unknown frame type %d", f.typ)
+	}
+	return f, nil
+}
+
+func windowFrame(id uint32, increment uint32) frame {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	return frame{typ: frameWindow, id: id, payload: payload}
+}
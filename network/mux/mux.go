@@ -0,0 +1,333 @@
+// Package mux multiplexes many logical substreams over a single secure
+// connection. Each substream has its own flow control window so that a bulk
+// transfer which isn't read quickly enough by the other side only blocks
+// itself. The messages which aren't sent over a substream, such as the DHT
+// RPCs, are not subject to the flow control and are always sent before the
+// data of the substreams so that they aren't delayed by the bulk transfers.
+//
+// Structure of a frame:
+//
+//	LEN      TYPE      DESCRIPTION
+//	1        uint8     Type, see frameType.
+//	4        uint32    Substream id, zero for messages.
+//	?        []byte    Payload.
+//
+// Each frame is sent as a single message over the underlying connection. The
+// substreams opened by the two sides use ids of different parity.
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/boreq/starlight/utils"
+	"github.com/boreq/starlight/utils/size"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxFrameData is the max amount of data sent in a single data frame. It
+// bounds the time for which a message waits for a data frame to be sent.
+const maxFrameData = 16 * size.Kilobyte
+
+// initialWindow is the amount of data which can be sent over a substream
+// before the other side reads it.
+const initialWindow = 256 * size.Kilobyte
+
+// maxSubstreams limits the number of substreams open at the same time.
+const maxSubstreams = 256
+
+// acceptBacklog is the number of the substreams opened by the other side
+// which await being accepted.
+const acceptBacklog = 16
+
+// messageBacklog is the number of the received messages which await being
+// received.
+const messageBacklog = 16
+
+// maxProtocolLength limits the length of the protocol names.
+const maxProtocolLength = 255
+
+var log = utils.GetLogger("mux")
+
+// ErrClosed is returned when the session or the substream is closed.
+var ErrClosed = errors.New("closed")
+
+// Conn is a connection over which the frames are exchanged.
+type Conn interface {
+	// Send sends a single frame.
+	Send([]byte) error
+
+	// Receive receives a single frame.
+	Receive() ([]byte, error)
+}
+
+// Substream is a logical stream of data sent over the session.
+type Substream interface {
+	io.ReadWriteCloser
+
+	// Protocol returns the name of the protocol specified by the side
+	// which opened the substream.
+	Protocol() string
+}
+
+// New creates a session which exchanges the frames over the connection. The
+// sides must use different values of odd.
+func New(conn Conn, odd bool) *Session {
+	rv := &Session{
+		conn:       conn,
+		odd:        odd,
+		substreams: make(map[uint32]*substream),
+		accept:     make(chan *substream, acceptBacklog),
+		messages:   make(chan []byte, messageBacklog),
+		control:    make(chan frame),
+		data:       make(chan frame),
+		done:       make(chan struct{}),
+	}
+	if odd {
+		rv.nextId = 1
+	} else {
+		rv.nextId = 2
+	}
+	go rv.readLoop()
+	go rv.writeLoop()
+	return rv
+}
+
+type Session struct {
+	conn       Conn
+	odd        bool
+	nextId     uint32
+	substreams map[uint32]*substream
+	accept     chan *substream
+	messages   chan []byte
+	control    chan frame
+	data       chan frame
+	done       chan struct{}
+	closeOnce  sync.Once
+	err        error
+	mutex      sync.Mutex
+}
+
+// SendMessage sends a message which isn't a part of any substream.
+func (s *Session) SendMessage(ctx context.Context, data []byte) error {
+	return s.send(ctx, s.control, frame{typ: frameMessage, payload: data})
+}
+
+// ReceiveMessage receives a message which isn't a part of any substream.
+func (s *Session) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-s.messages:
+		return data, nil
+	case <-s.done:
+		return nil, s.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Open opens a new substream. The protocol is reported to the other side.
+func (s *Session) Open(ctx context.Context, protocol string) (Substream, error) {
+	if len(protocol) > maxProtocolLength {
+		return nil, errors.New("protocol name too long")
+	}
+
+	s.mutex.Lock()
+	if len(s.substreams) >= maxSubstreams {
+		s.mutex.Unlock()
+		return nil, errors.New("too many substreams")
+	}
+	id := s.nextId
+	s.nextId += 2
+	st := newSubstream(s, id, protocol)
+	s.substreams[id] = st
+	s.mutex.Unlock()
+
+	if err := s.send(ctx, s.control, frame{typ: frameOpen, id: id, payload: []byte(protocol)}); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a substream opened by the other side.
+func (s *Session) Accept(ctx context.Context) (Substream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the session and all its substreams.
+func (s *Session) Close() {
+	s.closeWithError(ErrClosed)
+}
+
+// Done returns a channel which is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason for which the session was closed.
+func (s *Session) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		log.Debugf("closing: %s", err)
+		s.mutex.Lock()
+		s.err = err
+		substreams := s.substreams
+		s.substreams = make(map[uint32]*substream)
+		s.mutex.Unlock()
+
+		close(s.done)
+		for _, st := range substreams {
+			st.sessionClosed()
+		}
+	})
+}
+
+// send queues the frame and waits until it is sent. Frames queued using the
+// control channel are sent before the frames queued using the data channel.
+func (s *Session) send(ctx context.Context, queue chan frame, f frame) error {
+	f.written = make(chan error, 1)
+	select {
+	case queue <- f:
+	case <-s.done:
+		return s.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-f.written:
+		return err
+	case <-s.done:
+		return s.Err()
+	}
+}
+
+func (s *Session) writeLoop() {
+	for {
+		var f frame
+		select {
+		case f = <-s.control:
+		default:
+			select {
+			case f = <-s.control:
+			case f = <-s.data:
+			case <-s.done:
+				return
+			}
+		}
+		err := s.conn.Send(f.encode())
+		f.written <- err
+		if err != nil {
+			s.closeWithError(errors.Wrap(err, "send failed"))
+			return
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	for {
+		data, err := s.conn.Receive()
+		if err != nil {
+			s.closeWithError(errors.Wrap(err, "receive failed"))
+			return
+		}
+		f, err := decodeFrame(data)
+		if err != nil {
+			s.closeWithError(errors.Wrap(err, "invalid frame"))
+			return
+		}
+		if err := s.handleFrame(f); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(f frame) error {
+	switch f.typ {
+	case frameMessage:
+		select {
+		case s.messages <- f.payload:
+		case <-s.done:
+		}
+		return nil
+	case frameOpen:
+		return s.handleOpen(f)
+	}
+
+	s.mutex.Lock()
+	st, ok := s.substreams[f.id]
+	s.mutex.Unlock()
+	if !ok {
+		// The frames sent before the other side learned that the
+		// substream was closed.
+		return nil
+	}
+
+	switch f.typ {
+	case frameData:
+		return st.receive(f.payload)
+	case frameWindow:
+		st.increaseSendWindow(binary.BigEndian.Uint32(f.payload))
+	case frameClose:
+		s.remove(f.id)
+		st.remoteClosed()
+	}
+	return nil
+}
+
+func (s *Session) handleOpen(f frame) error {
+	if (f.id%2 == 1) == s.odd {
+		return errors.New("substream id has an invalid parity")
+	}
+	if len(f.payload) > maxProtocolLength {
+		return errors.New("protocol name too long")
+	}
+
+	s.mutex.Lock()
+	if _, ok := s.substreams[f.id]; ok {
+		s.mutex.Unlock()
+		return errors.New("substream already exists")
+	}
+	if len(s.substreams) >= maxSubstreams {
+		s.mutex.Unlock()
+		go s.reject(f.id)
+		return nil
+	}
+	st := newSubstream(s, f.id, string(f.payload))
+	s.substreams[f.id] = st
+	s.mutex.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.remove(f.id)
+		go s.reject(f.id)
+	}
+	return nil
+}
+
+// reject closes a substream opened by the other side which couldn't be
+// accepted.
+func (s *Session) reject(id uint32) {
+	s.send(context.Background(), s.control, frame{typ: frameClose, id: id})
+}
+
+func (s *Session) remove(id uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.substreams, id)
+}
@@ -0,0 +1,261 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// testConn delivers the frames over channels.
+type testConn struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+}
+
+func newTestConns() (*testConn, *testConn) {
+	a := make(chan []byte, 16)
+	b := make(chan []byte, 16)
+	closed := make(chan struct{})
+	return &testConn{a, b, closed}, &testConn{b, a, closed}
+}
+
+func (c *testConn) Send(data []byte) error {
+	select {
+	case c.out <- data:
+		return nil
+	case <-c.closed:
+		return errors.New("closed")
+	}
+}
+
+func (c *testConn) Receive() ([]byte, error) {
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func newTestSessions() (*Session, *Session, *testConn) {
+	a, b := newTestConns()
+	return New(a, true), New(b, false), a
+}
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func TestMessages(t *testing.T) {
+	a, b, _ := newTestSessions()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	if err := a.SendMessage(ctx, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := b.ReceiveMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Fatal("Invalid message", string(data))
+	}
+}
+
+func TestSubstream(t *testing.T) {
+	a, b, _ := newTestSessions()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	// Larger than the window so that the window has to be updated.
+	data := make([]byte, 3*int(initialWindow)+1)
+	rand.Read(data)
+
+	errC := make(chan error, 1)
+	go func() {
+		st, err := b.Accept(ctx)
+		if err != nil {
+			errC <- err
+			return
+		}
+		if st.Protocol() != "echo" {
+			errC <- errors.Errorf("invalid protocol %s", st.Protocol())
+			return
+		}
+		_, err = io.Copy(st, st)
+		st.Close()
+		errC <- err
+	}()
+
+	st, err := a.Open(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		st.Write(data)
+	}()
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(st, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Fatal("Invalid data")
+	}
+
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFlowControl makes sure that a substream which isn't read doesn't block
+// the messages and other substreams.
+func TestFlowControl(t *testing.T) {
+	a, b, _ := newTestSessions()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	bulk, err := a.Open(ctx, "bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bulkWritten := make(chan struct{})
+	go func() {
+		bulk.Write(make([]byte, 2*int(initialWindow)))
+		close(bulkWritten)
+	}()
+
+	if err := a.SendMessage(ctx, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ReceiveMessage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := a.Open(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-bulkWritten:
+		t.Fatal("Bulk write should block until the data is read")
+	default:
+	}
+
+	bulkRemote, err := b.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, bulkRemote, 2*int64(initialWindow)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bulkWritten:
+	case <-ctx.Done():
+		t.Fatal("Bulk write should finish")
+	}
+}
+
+func TestClose(t *testing.T) {
+	a, b, _ := newTestSessions()
+	defer b.Close()
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	st, err := a.Open(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := b.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	// The data sent before closing can still be read.
+	data, err := ioutil.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Fatal("Invalid data", string(data))
+	}
+	if _, err := remote.Write([]byte("data")); err == nil {
+		t.Fatal("Write should fail")
+	}
+
+	st, err = a.Open(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, err := st.Read(make([]byte, 1)); err != ErrClosed {
+		t.Fatal("Read should fail", err)
+	}
+	if _, err := a.Open(ctx, "test"); err == nil {
+		t.Fatal("Open should fail")
+	}
+}
+
+func TestWindowExceeded(t *testing.T) {
+	a, b := newTestConns()
+	session := New(a, true)
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	b.Send(frame{typ: frameOpen, id: 2}.encode())
+	if _, err := session.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, int(initialWindow)+1)
+	b.Send(frame{typ: frameData, id: 2, payload: data}.encode())
+
+	select {
+	case <-session.Done():
+	case <-ctx.Done():
+		t.Fatal("Session should be closed")
+	}
+}
+
+func TestInvalidParity(t *testing.T) {
+	a, b := newTestConns()
+	session := New(a, true)
+
+	ctx, cancel := testContext()
+	defer cancel()
+
+	b.Send(frame{typ: frameOpen, id: 1}.encode())
+	select {
+	case <-session.Done():
+	case <-ctx.Done():
+		t.Fatal("Session should be closed")
+	}
+}
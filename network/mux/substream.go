@@ -0,0 +1,185 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func newSubstream(s *Session, id uint32, protocol string) *substream {
+	rv := &substream{
+		session:    s,
+		id:         id,
+		protocol:   protocol,
+		recvWindow: uint32(initialWindow),
+		sendWindow: uint32(initialWindow),
+	}
+	rv.cond = sync.NewCond(&rv.mutex)
+	return rv
+}
+
+type substream struct {
+	session  *Session
+	id       uint32
+	protocol string
+
+	// buf contains the received data which wasn't read yet.
+	buf bytes.Buffer
+
+	// recvWindow is the amount of data the other side can send.
+	recvWindow uint32
+
+	// consumed is the amount of data which was read but the other side
+	// wasn't informed about it yet.
+	consumed uint32
+
+	// sendWindow is the amount of data the local side can send.
+	sendWindow uint32
+
+	closed         bool
+	closedByRemote bool
+	closedSession  bool
+	cond           *sync.Cond
+	mutex          sync.Mutex
+}
+
+func (st *substream) Protocol() string {
+	return st.protocol
+}
+
+// Read reads the received data. Once enough data is read the other side is
+// allowed to send more.
+func (st *substream) Read(b []byte) (int, error) {
+	st.mutex.Lock()
+	for st.buf.Len() == 0 {
+		if st.closed || st.closedSession {
+			st.mutex.Unlock()
+			return 0, ErrClosed
+		}
+		if st.closedByRemote {
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		st.cond.Wait()
+	}
+	n, _ := st.buf.Read(b)
+	st.consumed += uint32(n)
+	var increment uint32
+	if st.consumed >= uint32(initialWindow)/2 && !st.closedByRemote {
+		increment = st.consumed
+		st.recvWindow += increment
+		st.consumed = 0
+	}
+	st.mutex.Unlock()
+
+	if increment > 0 {
+		if err := st.session.send(context.Background(), st.session.control, windowFrame(st.id, increment)); err != nil {
+			return n, errors.Wrap(err, "could not update the window")
+		}
+	}
+	return n, nil
+}
+
+// Write splits the data into frames and sends them as long as the other side
+// allows it, otherwise it blocks until the other side reads the data.
+func (st *substream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mutex.Lock()
+		for st.sendWindow == 0 && !st.closed && !st.closedByRemote && !st.closedSession {
+			st.cond.Wait()
+		}
+		if st.closed || st.closedSession {
+			st.mutex.Unlock()
+			return written, ErrClosed
+		}
+		if st.closedByRemote {
+			st.mutex.Unlock()
+			return written, errors.New("closed by the other side")
+		}
+		n := len(b)
+		if n > int(maxFrameData) {
+			n = int(maxFrameData)
+		}
+		if n > int(st.sendWindow) {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mutex.Unlock()
+
+		payload := make([]byte, n)
+		copy(payload, b)
+		if err := st.session.send(context.Background(), st.session.data, frame{typ: frameData, id: st.id, payload: payload}); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the substream. The data which wasn't read is discarded.
+func (st *substream) Close() error {
+	st.mutex.Lock()
+	if st.closed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.closed = true
+	closedByRemote := st.closedByRemote
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+
+	st.session.remove(st.id)
+	if closedByRemote {
+		return nil
+	}
+	return st.session.send(context.Background(), st.session.control, frame{typ: frameClose, id: st.id})
+}
+
+// receive stores the data received from the other side. Returns an error if
+// the other side didn't respect the window.
+func (st *substream) receive(data []byte) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if uint32(len(data)) > st.recvWindow {
+		return errors.New("window exceeded")
+	}
+	st.recvWindow -= uint32(len(data))
+	if st.closed {
+		return nil
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *substream) increaseSendWindow(increment uint32) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if increment > math.MaxUint32-st.sendWindow {
+		st.sendWindow = math.MaxUint32
+	} else {
+		st.sendWindow += increment
+	}
+	st.cond.Broadcast()
+}
+
+func (st *substream) remoteClosed() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.closedByRemote = true
+	st.cond.Broadcast()
+}
+
+func (st *substream) sessionClosed() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.closedSession = true
+	st.cond.Broadcast()
+}
@@ -12,9 +12,12 @@ import (
 
 var log = utils.GetLogger("network/nat")
 
-func New(ctx context.Context, internalPort int) (*NAT, error) {
+// New creates a port mapping for the given protocol ("tcp" or "udp") and
+// internal port.
+func New(ctx context.Context, protocol string, internalPort int) (*NAT, error) {
 	rv := &NAT{
 		ctx:          ctx,
+		protocol:     protocol,
 		internalPort: internalPort,
 	}
 	go rv.run()
@@ -25,6 +28,7 @@ type NAT struct {
 	ctx          context.Context
 	nat          *libnat.NAT
 	mapping      libnat.Mapping
+	protocol     string
 	internalPort int
 	mutex        sync.Mutex
 }
@@ -58,7 +62,7 @@ func (n *NAT) refresh() error {
 
 	if n.nat != nil && n.mapping == nil {
 		log.Debug("running NewMapping")
-		mapping, err := n.nat.NewMapping("tcp", n.internalPort)
+		mapping, err := n.nat.NewMapping(n.protocol, n.internalPort)
 		if err != nil {
 			return errors.Wrap(err, "nat mapping failed")
 		}
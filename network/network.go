@@ -2,18 +2,26 @@ package network
 
 import (
 	"net"
-	"strconv"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/discovery"
 	"github.com/boreq/starlight/network/dispatcher"
+	"github.com/boreq/starlight/network/mux"
 	natlib "github.com/boreq/starlight/network/nat"
 	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/network/observed"
 	"github.com/boreq/starlight/network/peer"
+	"github.com/boreq/starlight/network/relay"
 	"github.com/boreq/starlight/network/stream"
+	"github.com/boreq/starlight/network/transport"
+	"github.com/boreq/starlight/protocol"
 	"github.com/boreq/starlight/utils"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
 )
 
 var log = utils.GetLogger("network")
@@ -21,24 +29,164 @@ var differentNodeIdError = errors.New("peer has a different id than requested")
 
 const cleanupPeersEvery = 1 * time.Minute
 
-func New(ctx context.Context, ident node.Identity, address string) Network {
-	net := &network{
-		ctx:     ctx,
-		iden:    ident,
-		disp:    dispatcher.New(ctx),
-		address: address,
+// Config specifies how the network should be set up. All addresses use the
+// format defined by the address package.
+type Config struct {
+	// ListenAddresses specify the transports and the addresses the local
+	// node should listen on. It is always possible to dial the nodes using
+	// any of the supported transports.
+	ListenAddresses []string
+
+	// AdvertisedAddresses are reported to other nodes instead of the
+	// automatically detected addresses if this list is not empty. This is
+	// useful if the node is for example reachable as a Tor hidden
+	// service, in that case the .onion address should be advertised.
+	AdvertisedAddresses []string
+
+	// ProxyAddress is a URL of a SOCKS5 proxy, for example
+	// "socks5://127.0.0.1:9050". If it is set all outgoing connections
+	// are established through that proxy and the transports which can't
+	// be proxied (QUIC) can't be used to dial other nodes. The addresses
+	// of the node are not detected and only the advertised addresses are
+	// reported to other nodes, the node can't be dialed if there are
+	// none.
+	ProxyAddress string
+
+	// LocalDiscovery enables the discovery of the nodes connected to the
+	// same local network using UDP multicast.
+	LocalDiscovery bool
+
+	// LowWatermark and HighWatermark limit the number of connected nodes.
+	// Once the number of connected nodes exceeds the high watermark the
+	// connections with the least recently active nodes are closed until
+	// the number falls to the low watermark. Zero high watermark disables
+	// the limit.
+	LowWatermark  int
+	HighWatermark int
+
+	// IdleTimeout specifies after how much time without receiving any
+	// messages the connection with a node is closed. Zero disables the
+	// timeout.
+	IdleTimeout time.Duration
+}
+
+func New(ctx context.Context, ident node.Identity, conf Config) (Network, error) {
+	listen, err := address.ParseList(conf.ListenAddresses)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid listen addresses")
+	}
+	advertised, err := address.ParseList(conf.AdvertisedAddresses)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid advertised addresses")
+	}
+	if conf.HighWatermark > 0 && (conf.LowWatermark < 0 || conf.LowWatermark > conf.HighWatermark) {
+		return nil, errors.New("low watermark must be between zero and the high watermark")
+	}
+
+	var dialer transport.Dialer = &net.Dialer{}
+	if conf.ProxyAddress != "" {
+		proxyDialer, err := newProxyDialer(conf.ProxyAddress)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy")
+		}
+		dialer = proxyDialer
+	}
+
+	rv := &network{
+		ctx:        ctx,
+		iden:       ident,
+		disp:       dispatcher.New(ctx),
+		listen:     listen,
+		advertised: advertised,
+		proxied:    conf.ProxyAddress != "",
+		substreams: make(chan incomingSubstream, substreamsBacklog),
+		transports: map[string]transport.Transport{
+			address.TCP: transport.NewTCP(dialer, conf.ProxyAddress == ""),
+		},
+	}
+	if conf.ProxyAddress != "" {
+		log.Printf("QUIC transport unavailable: can't be used with a proxy")
+	} else if quic, err := transport.NewQUIC(); err != nil {
+		log.Printf("QUIC transport unavailable: %s", err)
+	} else {
+		rv.transports[address.QUIC] = quic
+	}
+	if ws, err := transport.NewWebSocket(false, dialer); err != nil {
+		log.Printf("WebSocket transport unavailable: %s", err)
+	} else {
+		rv.transports[address.WS] = ws
 	}
-	return net
+	if wss, err := transport.NewWebSocket(true, dialer); err != nil {
+		log.Printf("secure WebSocket transport unavailable: %s", err)
+	} else {
+		rv.transports[address.WSS] = wss
+	}
+	rv.relays = newRelays(rv)
+	if conf.ProxyAddress != "" {
+		log.Printf("hole punching unavailable: can't be used with a proxy")
+	}
+	rv.holePuncher = newHolePuncher(rv, conf.ProxyAddress == "")
+	rv.observed = observed.New()
+	rv.connManager = newConnManager(rv, conf.LowWatermark, conf.HighWatermark, conf.IdleTimeout)
+	if conf.LocalDiscovery && conf.ProxyAddress != "" {
+		log.Printf("local discovery unavailable: can't be used with a proxy")
+	} else if conf.LocalDiscovery {
+		rv.discovery = discovery.New(ident.Id, rv.getListeningAddresses)
+	}
+	return rv, nil
+}
+
+// newProxyDialer creates a dialer which connects through a proxy specified by
+// the URL.
+func newProxyDialer(proxyAddress string) (transport.Dialer, error) {
+	u, err := url.Parse(proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, errors.Errorf("unsupported proxy type %s", u.Scheme)
+	}
+	dialer, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("proxy dialer doesn't support contexts")
+	}
+	return contextDialer, nil
 }
 
 type network struct {
-	ctx        context.Context
-	iden       node.Identity
-	peers      []peer.Peer
-	peersMutex sync.Mutex
-	disp       dispatcher.Dispatcher
-	nat        *natlib.NAT
-	address    string
+	ctx            context.Context
+	iden           node.Identity
+	peers          []peer.Peer
+	peersMutex     sync.Mutex
+	disp           dispatcher.Dispatcher
+	listeners      []*listener
+	listenersMutex sync.Mutex
+	listen         []address.Address
+	advertised     []address.Address
+	proxied        bool
+	transports     map[string]transport.Transport
+	relays         *relays
+	holePuncher    *holePuncher
+	observed       *observed.Tracker
+	discovery      *discovery.Discovery
+	substreams     chan incomingSubstream
+	connManager    *connManager
+}
+
+// incomingSubstream is a substream opened by another node.
+type incomingSubstream struct {
+	peer      Peer
+	substream mux.Substream
+}
+
+// listener is one of the addresses the local node is listening on.
+type listener struct {
+	address address.Address
+	nat     *natlib.NAT
 }
 
 func (n *network) Subscribe() (chan dispatcher.IncomingMessage, dispatcher.CancelFunc) {
@@ -46,25 +194,32 @@ func (n *network) Subscribe() (chan dispatcher.IncomingMessage, dispatcher.Cance
 }
 
 func (n *network) Listen() error {
-	log.Printf("Listening on %s", n.address)
 	log.Printf("Local id %s", n.iden.Id)
 
-	// Start listening
-	listener, err := net.Listen("tcp", n.address)
-	if err != nil {
-		return errors.Wrap(err, "could not listen")
+	if len(n.listen) == 0 {
+		return errors.New("no listen addresses")
 	}
 
-	// Initialize the NAT traversal
-	if err := n.initNatTraversal(); err != nil {
-		return errors.Wrap(err, "could not init the NAT traversal")
+	for _, a := range n.listen {
+		if err := n.startListener(a); err != nil {
+			return errors.Wrapf(err, "could not listen on %s", a)
+		}
 	}
 
-	// Make sure to close the listener after the context is closed
-	go func() {
-		<-n.ctx.Done()
-		listener.Close()
-	}()
+	// Reserve slots on the relays if this node can't accept incoming
+	// connections
+	go n.relays.run()
+
+	// Announce the local node to the nodes on the local network
+	if n.discovery != nil {
+		if err := n.discovery.Run(n.ctx); err != nil {
+			log.Printf("Local discovery unavailable: %s", err)
+		}
+	}
+
+	// Limit the number of connections, close idle connections and detect
+	// dead connections
+	go n.connManager.run()
 
 	// Periodically remove closed streams and peers that no longer have
 	// open streams
@@ -80,64 +235,183 @@ func (n *network) Listen() error {
 		}
 	}()
 
+	return nil
+}
+
+// startListener starts listening on the given address and accepting incoming
+// connections.
+func (n *network) startListener(a address.Address) error {
+	log.Printf("Listening on %s", a)
+
+	t, ok := n.transports[a.Transport]
+	if !ok {
+		return errors.Errorf("transport %s is not available", a.Transport)
+	}
+	netListener, err := t.Listen(a.HostPort())
+	if err != nil {
+		return err
+	}
+
+	l := &listener{address: a}
+
+	// Initialize the NAT traversal unless the addresses which should be
+	// advertised are specified explicitly or the node is hidden behind a
+	// proxy
+	if len(n.advertised) == 0 && !n.proxied {
+		nat, err := natlib.New(n.ctx, a.Network(), a.Port)
+		if err != nil {
+			netListener.Close()
+			return errors.Wrap(err, "could not init the NAT traversal")
+		}
+		l.nat = nat
+	}
+	n.listenersMutex.Lock()
+	n.listeners = append(n.listeners, l)
+	n.listenersMutex.Unlock()
+
+	// Make sure to close the listener after the context is closed
+	go func() {
+		<-n.ctx.Done()
+		netListener.Close()
+	}()
+
 	// Run the loop accepting connections
 	go func() {
 		for {
-			conn, err := listener.Accept()
+			conn, err := netListener.Accept()
 			if err != nil {
 				return
 			}
 			log.Debugf("New incoming connection from %s", conn.RemoteAddr().String())
-			go n.newConnection(n.ctx, conn)
+			go n.acceptConnection(conn)
 		}
 	}()
 
 	return nil
 }
 
+// acceptConnection handles an incoming connection which may be a regular
+// connection or a connection related to relaying.
+func (n *network) acceptConnection(conn net.Conn) {
+	bufferedConn, preamble, err := relay.ReadPreamble(conn)
+	if err != nil {
+		log.Debugf("acceptConnection: %s", err)
+		conn.Close()
+		return
+	}
+	if preamble != nil {
+		n.relays.handleConn(bufferedConn, preamble)
+		return
+	}
+	n.newConnection(n.ctx, bufferedConn, false)
+}
+
 // Initiates a new connection (incoming or outgoing).
-func (n *network) newConnection(ctx context.Context, conn net.Conn) (peer.Peer, error) {
+// newConnection initiates a stream over the connection. Outbound specifies if
+// the connection was established by the local node.
+func (n *network) newConnection(ctx context.Context, conn net.Conn, outbound bool) (peer.Peer, error) {
 	s, err := stream.New(ctx, n.iden, n.getListeningAddresses(), conn)
 	if err != nil {
 		log.Debugf("newConnection: failed to init a stream: %s", err)
 		return nil, errors.Wrap(err, "could not init a stream")
 	}
-	return n.newStream(s)
+	return n.newStream(s, outbound)
 }
 
 // Initiates a new peer.
-func (n *network) newStream(s stream.Stream) (peer.Peer, error) {
+func (n *network) newStream(s stream.Stream, outbound bool) (peer.Peer, error) {
 	n.peersMutex.Lock()
 	defer n.peersMutex.Unlock()
 
+	// Learn the external address of the local node
+	if outbound {
+		n.observed.Observe(s.RemoteAddress(), s.ObservedAddress())
+	}
+
 	// Add this stream to the appropriate peer (or create one)
 	p, err := n.getPeerForStream(s)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get peer for stream")
 	}
+	n.connManager.connected(p.Id())
+	go n.connManager.trim()
 
 	// Receive and dispatch messages received via this stream
 	go func() {
 		for {
-			msg, err := s.ReceiveWithContext(n.ctx)
-			log.Debugf("%s received %T", s.Info().Id, msg)
-			if err != nil && s.Closed() {
-				log.Debugf("%s error %s, stopping the dispatcher loop", s.Info().Id, err)
-				return
+			env, err := s.ReceiveEnvelope(n.ctx)
+			log.Debugf("%s received %T", s.Info().Id, env.Message)
+			if err != nil {
+				if s.Closed() {
+					log.Debugf("%s error %s, stopping the dispatcher loop", s.Info().Id, err)
+					return
+				}
+				continue
+			}
+			n.connManager.received(p.Id(), env.Message)
+			if env.Response {
+				if err := p.HandleResponse(env); err != nil {
+					log.Debugf("%s response error %s", s.Info().Id, err)
+				}
+				continue
 			}
-			n.disp.Dispatch(s.Info(), msg)
+			// The nodes which don't support the request ids send
+			// the responses as regular messages.
+			if s.ProtocolVersion() < protocol.VersionEnvelope && p.HandleLegacyResponse(env.Message) {
+				continue
+			}
+			if n.relays.handleMessage(p, env) || n.holePuncher.handleMessage(p, env) {
+				continue
+			}
+			n.disp.DispatchRequest(s.Info(), env.RequestId, env.Message)
 		}
 	}()
 
-	log.Debugf("newStream: accepted %s reporting listener on %s ", s.Info().Id, s.Info().Address)
+	go n.acceptSubstreams(p, s)
+
+	log.Debugf("newStream: accepted %s reporting listeners on %s ", s.Info().Id, s.Info().Addresses)
 
 	return p, nil
 }
 
+// substreamsBacklog is the number of substreams opened by other nodes which
+// await being accepted.
+const substreamsBacklog = 16
+
+// acceptSubstreams passes the substreams opened by the node to AcceptSubstream
+// until the stream is closed.
+func (n *network) acceptSubstreams(p peer.Peer, s stream.Stream) {
+	for {
+		sub, err := s.AcceptSubstream(n.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case n.substreams <- incomingSubstream{p, sub}:
+		default:
+			log.Debugf("rejecting substream %s from %s", sub.Protocol(), p.Id())
+			sub.Close()
+		}
+	}
+}
+
+func (n *network) Protect(p Protector) {
+	n.connManager.protect(p)
+}
+
+func (n *network) AcceptSubstream(ctx context.Context) (Peer, mux.Substream, error) {
+	select {
+	case in := <-n.substreams:
+		return in.peer, in.substream, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
 const dialTimeout = 10 * time.Second
 
-func (n *network) Dial(nd node.NodeInfo) (Peer, error) {
-	log.Debugf("Dial: %s on %s", nd.Id, nd.Address)
+func (n *network) Dial(ctx context.Context, nd node.NodeInfo) (Peer, error) {
+	log.Debugf("Dial: %s on %s", nd.Id, nd.Addresses)
 
 	if node.CompareId(nd.Id, n.iden.Id) {
 		return nil, errors.New("Tried calling a local id")
@@ -152,13 +426,13 @@ func (n *network) Dial(nd node.NodeInfo) (Peer, error) {
 	}
 
 	// Dial a peer if we are not already talking to it
-	conn, err := net.DialTimeout("tcp", nd.Address, dialTimeout)
+	conn, err := n.dial(ctx, nd)
 	if err != nil {
 		log.Debug("Dial: not responding", err)
 		return nil, err
 	}
 
-	p, err = n.newConnection(n.ctx, conn)
+	p, err = n.newConnection(n.ctx, conn, true)
 	if err != nil {
 		log.Debug("Dial: failed to init connection", err)
 		return nil, err
@@ -174,13 +448,13 @@ func (n *network) Dial(nd node.NodeInfo) (Peer, error) {
 }
 
 func (n *network) CheckOnline(ctx context.Context, nd node.NodeInfo) error {
-	log.Debugf("CheckOnline: %s on %s", nd.Id, nd.Address)
+	log.Debugf("CheckOnline: %s on %s", nd.Id, nd.Addresses)
 
 	if node.CompareId(nd.Id, n.iden.Id) {
 		return errors.New("tried checking a local id")
 	}
 
-	conn, err := net.DialTimeout("tcp", nd.Address, dialTimeout)
+	conn, err := n.dial(ctx, nd)
 	if err != nil {
 		return errors.Wrap(err, "could not dial")
 	}
@@ -194,10 +468,69 @@ func (n *network) CheckOnline(ctx context.Context, nd node.NodeInfo) error {
 		return differentNodeIdError
 	}
 
-	go n.newStream(s)
+	go n.newStream(s, true)
 	return nil
 }
 
+// dial tries to connect to the addresses of the node in order using the
+// appropriate transports and returns the first established connection. If the
+// node can't be reached directly and is relayed the hole punching coordinated
+// by its relays is attempted before falling back to the relays.
+func (n *network) dial(ctx context.Context, nd node.NodeInfo) (net.Conn, error) {
+	if len(nd.Addresses) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	var direct, relayed []address.Address
+	for _, a := range nd.Addresses {
+		if a.IsRelay() {
+			relayed = append(relayed, a)
+		} else {
+			direct = append(direct, a)
+		}
+	}
+
+	var err error
+	for _, a := range direct {
+		var conn net.Conn
+		if conn, err = n.dialAddress(ctx, a); err == nil {
+			return conn, nil
+		}
+		log.Debugf("dial: %s failed: %s", a, err)
+	}
+	if len(relayed) > 0 {
+		conn, err := n.holePunch(ctx, nd.Id, relayed)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("dial: hole punching %s failed: %s", nd.Id, err)
+	}
+	for _, a := range relayed {
+		var conn net.Conn
+		if conn, err = n.relays.dial(ctx, a, nd.Id); err == nil {
+			return conn, nil
+		}
+		log.Debugf("dial: %s failed: %s", a, err)
+	}
+	return nil, err
+}
+
+func (n *network) dialAddress(ctx context.Context, a address.Address) (net.Conn, error) {
+	t, ok := n.transports[a.Transport]
+	if !ok {
+		return nil, errors.Errorf("transport %s is not available", a.Transport)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	return t.Dial(ctx, a.HostPort())
+}
+
+func (n *network) LocalNodes() ([]node.NodeInfo, error) {
+	if n.discovery == nil {
+		return nil, errors.New("local discovery is disabled")
+	}
+	return n.discovery.Nodes(), nil
+}
+
 func (n *network) FindActive(id node.ID) (Peer, error) {
 	n.peersMutex.Lock()
 	defer n.peersMutex.Unlock()
@@ -218,39 +551,96 @@ func (n *network) findActive(id node.ID) (peer.Peer, error) {
 	return nil, errors.New("Peer not found")
 }
 
-func (n *network) initNatTraversal() error {
-	internalListeningPort, err := n.getInternalListeningPort()
-	if err != nil {
-		return errors.Wrap(err, "could not get the listening port")
+// getListeningAddresses returns the addresses which are reported to other
+// nodes: the addresses of all listeners followed by the external addresses
+// created by the NAT traversal and the external addresses confirmed by other
+// nodes. If the NAT traversal failed the addresses of the relays are appended.
+// Nodes which use a proxy report only the advertised addresses.
+func (n *network) getListeningAddresses() []address.Address {
+	if len(n.advertised) > 0 || n.proxied {
+		return n.advertised
 	}
 
-	nat, err := natlib.New(n.ctx, internalListeningPort)
-	if err != nil {
-		return errors.Wrap(err, "could not establish NAT piercing")
+	n.listenersMutex.Lock()
+	defer n.listenersMutex.Unlock()
+
+	var addresses []address.Address
+	for _, l := range n.listeners {
+		addresses = append(addresses, l.address)
 	}
-	n.nat = nat
-	return nil
+	natAddresses := n.getNatAddresses()
+	for _, a := range append(natAddresses, n.getObservedAddresses()...) {
+		if !address.Contains(addresses, a) {
+			addresses = append(addresses, a)
+		}
+	}
+	if len(natAddresses) == 0 {
+		addresses = append(addresses, n.relays.addresses()...)
+	}
+	return addresses
 }
 
-func (n *network) getInternalListeningPort() (int, error) {
-	_, port, err := net.SplitHostPort(n.address)
-	if err != nil {
-		return 0, errors.Wrap(err, "split host port failed")
+// getNatAddresses returns the external addresses created by the NAT
+// traversal. The caller must hold listenersMutex.
+func (n *network) getNatAddresses() []address.Address {
+	var addresses []address.Address
+	for _, l := range n.listeners {
+		if l.nat == nil {
+			continue
+		}
+		natAddress, err := l.nat.GetAddress()
+		if err != nil {
+			log.Debugf("failed getting NAT address for %s: %s", l.address, err)
+			continue
+		}
+		log.Debugf("NAT address for %s is: %s", l.address, natAddress)
+		natA, err := address.New(l.address.Transport, natAddress)
+		if err != nil {
+			continue
+		}
+		addresses = append(addresses, natA)
 	}
-	return strconv.Atoi(port)
+	return addresses
 }
 
-func (n *network) getListeningAddresses() []string {
-	addresses := []string{n.address}
-	if address, err := n.nat.GetAddress(); err != nil {
-		log.Debugf("failed getting NAT address: %s", err)
-	} else {
-		log.Debugf("NAT address is: %s", address)
-		addresses = append(addresses, address)
+// getObservedAddresses returns the addresses of the listeners which listen on
+// all interfaces combined with the external IP addresses reported by other
+// nodes. The ports are assumed to be preserved by the NAT or forwarded
+// manually. The caller must hold listenersMutex.
+func (n *network) getObservedAddresses() []address.Address {
+	var addresses []address.Address
+	for _, ip := range n.observed.Confirmed() {
+		for _, l := range n.listeners {
+			if !l.address.IsUnspecified() {
+				continue
+			}
+			// Sockets listening on the unspecified IPv4 address don't
+			// accept IPv6 connections.
+			if l.address.IP().To4() != nil && ip.To4() == nil {
+				continue
+			}
+			addresses = append(addresses, l.address.WithHost(ip.String()))
+		}
 	}
 	return addresses
 }
 
+// needsRelay returns true if the local node may be unable to accept incoming
+// connections: no addresses are advertised explicitly, no proxy is used and
+// the NAT traversal failed. Nodes which are publicly reachable without the NAT traversal also
+// use relays but since the relay addresses are advertised last they are only
+// used if the node can't be reached directly.
+func (n *network) needsRelay() bool {
+	if len(n.advertised) > 0 || n.proxied {
+		return false
+	}
+
+	n.listenersMutex.Lock()
+	defer n.listenersMutex.Unlock()
+
+	return len(n.getNatAddresses()) == 0
+}
+
 func (n *network) getPeerForStream(s stream.Stream) (peer.Peer, error) {
 	for _, p := range n.peers {
 		if node.CompareId(s.Info().Id, p.Id()) {
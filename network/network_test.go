@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"golang.org/x/net/context"
+)
+
+// TestProxyHidesAddresses makes sure that a node which uses a proxy doesn't
+// report the addresses of its listeners or the addresses observed by other
+// nodes, only the advertised addresses.
+func TestProxyHidesAddresses(t *testing.T) {
+	for _, advertised := range [][]string{nil, {"/ip4/203.0.113.1/tcp/1836"}} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		conf := Config{
+			ListenAddresses:     []string{"/ip4/0.0.0.0/tcp/0"},
+			AdvertisedAddresses: advertised,
+			ProxyAddress:        "socks5://127.0.0.1:9050",
+			LocalDiscovery:      true,
+		}
+		i, err := New(ctx, node.Identity{Id: node.ID{1}}, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := i.(*network)
+		if n.discovery != nil {
+			t.Fatal("Local discovery should be disabled")
+		}
+		if err := n.startListener(n.listen[0]); err != nil {
+			t.Fatal(err)
+		}
+		if n.listeners[0].nat != nil {
+			t.Fatal("NAT traversal should not be initialized")
+		}
+		for _, reporter := range []byte{1, 2, 3} {
+			n.observed.Observe(fmt.Sprintf("5.6.%d.7:1000", reporter), "1.2.3.4:1000")
+		}
+		if n.needsRelay() {
+			t.Fatal("Relays should not be used")
+		}
+
+		addresses := n.getListeningAddresses()
+		if len(addresses) != len(advertised) {
+			t.Fatal("Invalid addresses", addresses)
+		}
+		for j, a := range addresses {
+			expected, err := address.Parse(advertised[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a != expected {
+				t.Fatal("Invalid addresses", addresses)
+			}
+		}
+		cancel()
+	}
+}
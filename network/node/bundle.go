@@ -0,0 +1,171 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/pem"
+	"strings"
+
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// bundleVersion is the first byte of the text encoding of the bundles.
+const bundleVersion = 1
+
+// bundleChecksumSize is the size of the checksum appended to the text encoding
+// of the bundles which detects the typing mistakes.
+const bundleChecksumSize = 4
+
+// The text encoding of the bundles is split into groups of characters, the
+// groups are split into lines.
+const (
+	bundleGroupSize     = 4
+	bundleGroupsPerLine = 8
+)
+
+// bundleEncoding uses only the characters which can be efficiently stored in
+// QR codes using the alphanumeric mode.
+var bundleEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Bundle is a portable backup of an identity. The private key is always
+// encrypted with a passphrase.
+type Bundle struct {
+	key *encryptedKey
+}
+
+// NewBundle creates a bundle containing the identity encrypted with the
+// passphrase.
+func NewBundle(iden *Identity, passphrase []byte) (*Bundle, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase required")
+	}
+	k, err := encryptIdentity(iden, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encrypt the identity")
+	}
+	return &Bundle{k}, nil
+}
+
+// Id returns the id of the identity stored in the bundle. It is not confirmed
+// until the bundle is opened.
+func (b *Bundle) Id() ID {
+	return b.key.id
+}
+
+// Open decrypts the identity stored in the bundle.
+func (b *Bundle) Open(passphrase []byte) (*Identity, error) {
+	return b.key.decrypt(passphrase)
+}
+
+// PEM encodes the bundle as a PEM block which has the same format as an
+// encrypted identity file.
+func (b *Bundle) PEM() []byte {
+	return pem.EncodeToMemory(b.key.pemBlock())
+}
+
+// Text encodes the bundle using base32 so that it can be written down or
+// stored in a QR code.
+func (b *Bundle) Text() (string, error) {
+	msg := &message.IdentityBundle{
+		Id:         b.key.id,
+		Kdf:        proto.String(b.key.kdf),
+		ScryptN:    proto.Uint32(uint32(b.key.n)),
+		ScryptR:    proto.Uint32(uint32(b.key.r)),
+		ScryptP:    proto.Uint32(uint32(b.key.p)),
+		Salt:       b.key.salt,
+		Cipher:     proto.String(b.key.cipher),
+		Nonce:      b.key.nonce,
+		Ciphertext: b.key.ciphertext,
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal the bundle")
+	}
+	data = append([]byte{bundleVersion}, data...)
+	data = append(data, bundleChecksum(data)...)
+
+	encoded := bundleEncoding.EncodeToString(data)
+	var lines, groups []string
+	for len(encoded) > 0 {
+		n := bundleGroupSize
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		groups = append(groups, encoded[:n])
+		encoded = encoded[n:]
+		if len(groups) == bundleGroupsPerLine || len(encoded) == 0 {
+			lines = append(lines, strings.Join(groups, " "))
+			groups = nil
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// NewBundleFromBytes loads a bundle encoded using the PEM or Text method.
+func NewBundleFromBytes(data []byte) (*Bundle, error) {
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		return newBundleFromPEM(data)
+	}
+	return newBundleFromText(string(data))
+}
+
+func newBundleFromPEM(data []byte) (*Bundle, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	k, err := newEncryptedKeyFromPem(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Bundle{k}, nil
+}
+
+func newBundleFromText(text string) (*Bundle, error) {
+	text = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" \t\r\n-", r) {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(text))
+
+	data, err := bundleEncoding.DecodeString(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encoding")
+	}
+	if len(data) < 1+bundleChecksumSize {
+		return nil, errors.New("bundle is too short")
+	}
+	data, checksum := data[:len(data)-bundleChecksumSize], data[len(data)-bundleChecksumSize:]
+	if !bytes.Equal(checksum, bundleChecksum(data)) {
+		return nil, errors.New("invalid checksum, the bundle was mistyped")
+	}
+	if data[0] != bundleVersion {
+		return nil, errors.Errorf("unsupported bundle version %d", data[0])
+	}
+
+	msg := &message.IdentityBundle{}
+	if err := proto.Unmarshal(data[1:], msg); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal the bundle")
+	}
+	k := &encryptedKey{
+		id:         msg.GetId(),
+		kdf:        msg.GetKdf(),
+		n:          int(msg.GetScryptN()),
+		r:          int(msg.GetScryptR()),
+		p:          int(msg.GetScryptP()),
+		salt:       msg.GetSalt(),
+		cipher:     msg.GetCipher(),
+		nonce:      msg.GetNonce(),
+		ciphertext: msg.GetCiphertext(),
+	}
+	return &Bundle{k}, nil
+}
+
+func bundleChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:bundleChecksumSize]
+}
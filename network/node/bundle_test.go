@@ -0,0 +1,75 @@
+package node
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("passphrase")
+	bundle, err := NewBundle(iden, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := bundle.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{bundle.PEM(), []byte(text), []byte(strings.ToLower(text))} {
+		loaded, err := NewBundleFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !CompareId(loaded.Id(), iden.Id) {
+			t.Fatal("Invalid id")
+		}
+		if _, err := loaded.Open([]byte("invalid")); err != ErrInvalidPassphrase {
+			t.Fatalf("Invalid error %v", err)
+		}
+		opened, err := loaded.Open(passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !CompareId(opened.Id, iden.Id) {
+			t.Fatal("Invalid id of the opened identity")
+		}
+	}
+}
+
+func TestBundleMistyped(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := NewBundle(iden, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := bundle.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := "A"
+	if text[0] == 'A' {
+		replacement = "B"
+	}
+	if _, err := NewBundleFromBytes([]byte(replacement + text[1:])); err == nil {
+		t.Fatal("Mistyped bundle was accepted")
+	}
+}
+
+func TestBundleEmptyPassphrase(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBundle(iden, nil); err == nil {
+		t.Fatal("Bundle without a passphrase was created")
+	}
+}
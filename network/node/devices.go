@@ -0,0 +1,264 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"path"
+	"time"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// deviceListPrefix is prepended to the device lists signed with the master
+// identities, see statementSigningHash.
+const deviceListPrefix = "starlight-devices:"
+
+// maxDevices limits the size of the device lists which are attached to the
+// messages and stored in the DHT.
+const maxDevices = 32
+
+// DeviceList is a delegation certificate signed with a master identity which
+// lists the ids of the nodes belonging to the same person, for example the
+// nodes running on their laptop and desktop. Other users can address the
+// master id and the messages sent by the devices are displayed as sent by the
+// master id. The master key is only used to sign the lists and should be kept
+// offline. A newer list replaces the older lists.
+type DeviceList struct {
+	MasterKey lcrypto.PublicKey
+	Devices   []ID
+	Timestamp time.Time
+	Signature []byte
+}
+
+// NewDeviceList creates a device list signed with the master identity.
+func NewDeviceList(master *Identity, devices []ID) (*DeviceList, error) {
+	return newDeviceList(master, devices, time.Unix(time.Now().Unix(), 0))
+}
+
+// Update creates a new list signed with the master identity which replaces
+// this list.
+func (l *DeviceList) Update(master *Identity, devices []ID) (*DeviceList, error) {
+	masterId, err := l.MasterId()
+	if err != nil {
+		return nil, err
+	}
+	if !CompareId(masterId, master.Id) {
+		return nil, errors.New("list was signed with a different master identity")
+	}
+	// The timestamps have a resolution of one second, the new list must be
+	// newer even if it was created immediately after the previous one.
+	timestamp := time.Unix(time.Now().Unix(), 0)
+	if !timestamp.After(l.Timestamp) {
+		timestamp = l.Timestamp.Add(time.Second)
+	}
+	return newDeviceList(master, devices, timestamp)
+}
+
+func newDeviceList(master *Identity, devices []ID, timestamp time.Time) (*DeviceList, error) {
+	l := &DeviceList{
+		MasterKey: master.PubKey,
+		Devices:   devices,
+		Timestamp: timestamp,
+	}
+	if err := l.validateDevices(); err != nil {
+		return nil, err
+	}
+	data, err := l.signedData()
+	if err != nil {
+		return nil, err
+	}
+	l.Signature, err = master.PrivKey.Sign(data, statementSigningHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing failed")
+	}
+	return l, nil
+}
+
+// MasterId returns the id of the master identity.
+func (l *DeviceList) MasterId() (ID, error) {
+	return l.MasterKey.Hash()
+}
+
+// Contains returns true if the node with the given id is one of the devices.
+func (l *DeviceList) Contains(id ID) bool {
+	for _, device := range l.Devices {
+		if CompareId(device, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks if the list was signed with the master key.
+func (l *DeviceList) Validate() error {
+	if err := l.validateDevices(); err != nil {
+		return err
+	}
+	data, err := l.signedData()
+	if err != nil {
+		return err
+	}
+	if err := l.MasterKey.Validate(data, l.Signature, statementSigningHash); err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	return nil
+}
+
+func (l *DeviceList) validateDevices() error {
+	if len(l.Devices) > maxDevices {
+		return errors.Errorf("too many devices, the limit is %d", maxDevices)
+	}
+	masterId, err := l.MasterId()
+	if err != nil {
+		return err
+	}
+	for i, device := range l.Devices {
+		if !ValidateId(device) {
+			return errors.Errorf("invalid device id %s", device)
+		}
+		if CompareId(device, masterId) {
+			return errors.New("master identity can't be a device")
+		}
+		for _, other := range l.Devices[:i] {
+			if CompareId(device, other) {
+				return errors.Errorf("duplicate device id %s", device)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *DeviceList) signedData() ([]byte, error) {
+	key, err := l.MasterKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(deviceListPrefix)
+	binary.Write(buf, binary.BigEndian, uint32(len(key)))
+	buf.Write(key)
+	binary.Write(buf, binary.BigEndian, uint32(len(l.Devices)))
+	for _, device := range l.Devices {
+		binary.Write(buf, binary.BigEndian, uint32(len(device)))
+		buf.Write(device)
+	}
+	binary.Write(buf, binary.BigEndian, l.Timestamp.Unix())
+	return buf.Bytes(), nil
+}
+
+// Message converts the list to a message which can be sent to other nodes.
+func (l *DeviceList) Message() (*message.DeviceList, error) {
+	key, err := l.MasterKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := l.Timestamp.Unix()
+	msg := &message.DeviceList{
+		MasterKey: key,
+		Timestamp: &timestamp,
+		Signature: l.Signature,
+	}
+	for _, device := range l.Devices {
+		msg.DeviceIds = append(msg.DeviceIds, device)
+	}
+	return msg, nil
+}
+
+// NewDeviceListFromMessage loads a device list from a message and validates
+// it.
+func NewDeviceListFromMessage(msg *message.DeviceList) (*DeviceList, error) {
+	key, err := lcrypto.NewPublicKey(msg.GetMasterKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	l := &DeviceList{
+		MasterKey: key,
+		Timestamp: time.Unix(msg.GetTimestamp(), 0),
+		Signature: msg.GetSignature(),
+	}
+	for _, device := range msg.GetDeviceIds() {
+		l.Devices = append(l.Devices, device)
+	}
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Bytes serializes the device list.
+func (l *DeviceList) Bytes() ([]byte, error) {
+	msg, err := l.Message()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+// NewDeviceListFromBytes loads a device list from the output of the Bytes
+// method and validates it.
+func NewDeviceListFromBytes(data []byte) (*DeviceList, error) {
+	msg := &message.DeviceList{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal the device list")
+	}
+	return NewDeviceListFromMessage(msg)
+}
+
+const deviceListFilename = "devices.pem"
+
+const deviceListPemType = "STARLIGHT DEVICE LIST"
+
+// masterIdentityFilename is the name of the file in which the master identity
+// is stored. The file is needed only to change the device list and doesn't
+// have to be present on the devices.
+const masterIdentityFilename = "master.pem"
+
+// SaveLocalDeviceList saves the device list in the specified directory.
+func SaveLocalDeviceList(l *DeviceList, directory string) error {
+	data, err := l.Bytes()
+	if err != nil {
+		return err
+	}
+	pemData := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  deviceListPemType,
+			Bytes: data,
+		},
+	)
+	return ioutil.WriteFile(path.Join(directory, deviceListFilename), pemData, 0644)
+}
+
+// LoadLocalDeviceList loads the device list from the specified directory.
+func LoadLocalDeviceList(directory string) (*DeviceList, error) {
+	pemData, err := ioutil.ReadFile(path.Join(directory, deviceListFilename))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != deviceListPemType {
+		return nil, errors.New("invalid device list file")
+	}
+	return NewDeviceListFromBytes(block.Bytes)
+}
+
+// SaveLocalMasterIdentity saves the master identity in the specified
+// directory. The private key is encrypted with the passphrase unless the
+// passphrase is empty.
+func SaveLocalMasterIdentity(iden *Identity, directory string, passphrase []byte) error {
+	return saveIdentity(iden, path.Join(directory, masterIdentityFilename), passphrase)
+}
+
+// LoadLocalMasterIdentity loads the master identity from the specified
+// directory decrypting it with the passphrase if it is encrypted.
+func LoadLocalMasterIdentity(directory string, passphrase []byte) (*Identity, error) {
+	data, err := ioutil.ReadFile(path.Join(directory, masterIdentityFilename))
+	if err != nil {
+		return nil, err
+	}
+	return LoadIdentityWithPassphrase(data, passphrase)
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDeviceList(t *testing.T) {
+	master, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := generateIds(t, 3)
+
+	l, err := NewDeviceList(master, devices[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := l.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewDeviceListFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterId, err := loaded.MasterId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(masterId, master.Id) {
+		t.Fatal("Invalid master id")
+	}
+	if !loaded.Contains(devices[0]) || !loaded.Contains(devices[1]) {
+		t.Fatal("Device is missing")
+	}
+	if loaded.Contains(devices[2]) {
+		t.Fatal("List contains a device which wasn't added")
+	}
+
+	// The updated list is always newer.
+	updated, err := l.Update(master, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Timestamp.After(l.Timestamp) {
+		t.Fatal("Updated list is not newer")
+	}
+	if !updated.Contains(devices[2]) {
+		t.Fatal("Device is missing")
+	}
+}
+
+func TestDeviceListInvalid(t *testing.T) {
+	master, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := generateIds(t, 2)
+
+	if _, err := NewDeviceList(master, []ID{master.Id}); err == nil {
+		t.Fatal("Master identity was accepted as a device")
+	}
+	if _, err := NewDeviceList(master, []ID{devices[0], devices[0]}); err == nil {
+		t.Fatal("Duplicate device was accepted")
+	}
+	if _, err := NewDeviceList(master, generateIds(t, maxDevices+1)); err == nil {
+		t.Fatal("Too many devices were accepted")
+	}
+
+	l, err := NewDeviceList(master, devices[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Update(other, devices); err == nil {
+		t.Fatal("List was updated by a different identity")
+	}
+
+	// The devices are covered by the signature.
+	l.Devices = devices
+	if err := l.Validate(); err == nil {
+		t.Fatal("Modified list was accepted")
+	}
+}
+
+func TestLocalDeviceList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadLocalDeviceList(dir); !os.IsNotExist(err) {
+		t.Fatalf("Invalid error %v", err)
+	}
+
+	master, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewDeviceList(master, generateIds(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveLocalDeviceList(l, dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLocalDeviceList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Devices) != 2 {
+		t.Fatalf("Invalid number of devices %d", len(loaded.Devices))
+	}
+
+	passphrase := []byte("passphrase")
+	if err := SaveLocalMasterIdentity(master, dir, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLocalMasterIdentity(dir, nil); err != ErrPassphraseRequired {
+		t.Fatalf("Invalid error %v", err)
+	}
+	loadedMaster, err := LoadLocalMasterIdentity(dir, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(loadedMaster.Id, master.Id) {
+		t.Fatal("Invalid master id")
+	}
+}
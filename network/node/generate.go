@@ -0,0 +1,176 @@
+package node
+
+import (
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/utils"
+	"github.com/pkg/errors"
+)
+
+// progressInterval specifies how often the progress of the identity
+// generation is reported.
+const progressInterval = 1 * time.Second
+
+// GenerateOptions describes the identity generated by
+// GenerateIdentityWithOptions.
+type GenerateOptions struct {
+	// KeyType is the type of the generated key.
+	KeyType lcrypto.KeyType
+
+	// Bits is the size of the generated RSA keys, it must be bigger or
+	// equal to minKeyBits.
+	Bits int
+
+	// Difficulty is the number of zero bits at the beginning of the
+	// generated id. Defaults to MinIdDifficulty.
+	Difficulty int
+
+	// Match is an optional function which has to accept the generated id,
+	// for example to generate an id with a vanity prefix.
+	Match func(id ID) bool
+
+	// Workers is the number of keys generated in parallel. Defaults to the
+	// number of CPUs.
+	Workers int
+
+	// Progress is an optional function which is periodically called with
+	// the number of generated keys.
+	Progress func(attempts uint64)
+}
+
+// GenerateIdentityWithOptions generates a fresh identity for a local node
+// using multiple goroutines. Identities are generated until the id solves the
+// crypto puzzle with the requested difficulty and is accepted by the match
+// function.
+func GenerateIdentityWithOptions(options GenerateOptions) (*Identity, error) {
+	generate, err := options.keypairGenerator()
+	if err != nil {
+		return nil, err
+	}
+	difficulty := options.Difficulty
+	if difficulty == 0 {
+		difficulty = MinIdDifficulty
+	}
+	if difficulty < MinIdDifficulty || difficulty > maxIdDifficulty {
+		return nil, errors.Errorf("difficulty must be between %d and %d", MinIdDifficulty, maxIdDifficulty)
+	}
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	type result struct {
+		iden *Identity
+		err  error
+	}
+
+	var attempts uint64
+	done := make(chan struct{})
+	defer close(done)
+	// The channel is buffered so that the workers never block.
+	results := make(chan result, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				privKey, pubKey, err := generate()
+				if err != nil {
+					results <- result{nil, err}
+					return
+				}
+				atomic.AddUint64(&attempts, 1)
+
+				id, err := pubKey.Hash()
+				if err != nil {
+					results <- result{nil, err}
+					return
+				}
+
+				// Check if the puzzle has been solved.
+				if utils.ZerosLen(id) < difficulty {
+					continue
+				}
+				if options.Match != nil && !options.Match(id) {
+					continue
+				}
+				results <- result{&Identity{id, pubKey, privKey}, nil}
+				return
+			}
+		}()
+	}
+
+	var progress <-chan time.Time
+	if options.Progress != nil {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+	for {
+		select {
+		case r := <-results:
+			if options.Progress != nil {
+				options.Progress(atomic.LoadUint64(&attempts))
+			}
+			return r.iden, r.err
+		case <-progress:
+			options.Progress(atomic.LoadUint64(&attempts))
+		}
+	}
+}
+
+func (o GenerateOptions) keypairGenerator() (func() (lcrypto.PrivateKey, lcrypto.PublicKey, error), error) {
+	switch o.KeyType {
+	case lcrypto.RSA:
+		if o.Bits < minKeyBits {
+			return nil, errors.Errorf("use at least %d bits to generate a key", minKeyBits)
+		}
+		return func() (lcrypto.PrivateKey, lcrypto.PublicKey, error) {
+			return lcrypto.GenerateKeypair(o.Bits)
+		}, nil
+	case lcrypto.Ed25519:
+		return lcrypto.GenerateEd25519Keypair, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %s", o.KeyType)
+	}
+}
+
+// NewHexIdMatcher returns a match function for GenerateOptions which accepts
+// the ids whose hex representation starts with the prefix. An error is
+// returned if the ids solving the crypto puzzle with the given difficulty
+// can't start with the prefix.
+func NewHexIdMatcher(prefix string, difficulty int) (func(id ID) bool, error) {
+	for i, r := range prefix {
+		var digit int
+		switch {
+		case r >= '0' && r <= '9':
+			digit = int(r - '0')
+		case r >= 'a' && r <= 'f':
+			digit = int(r-'a') + 10
+		default:
+			return nil, errors.Errorf("invalid hex digit %q", r)
+		}
+		// Bits of the digit which have to be zero.
+		zeroBits := difficulty - i*4
+		if zeroBits > 4 {
+			zeroBits = 4
+		}
+		if zeroBits > 0 && digit>>uint(4-zeroBits) != 0 {
+			return nil, errors.Errorf("ids start with %d zero bits, the prefix can't be matched", difficulty)
+		}
+	}
+	if len(prefix) > lcrypto.KeyDigestLength*2 {
+		return nil, errors.New("prefix is too long")
+	}
+	return func(id ID) bool {
+		return strings.HasPrefix(id.String(), prefix)
+	}, nil
+}
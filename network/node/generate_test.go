@@ -0,0 +1,78 @@
+package node
+
+import (
+	"strings"
+	"testing"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+)
+
+func TestGenerateIdentityWithOptions(t *testing.T) {
+	var progressCalled bool
+	matcher, err := NewHexIdMatcher("003", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iden, err := GenerateIdentityWithOptions(GenerateOptions{
+		KeyType:    lcrypto.Ed25519,
+		Difficulty: 8,
+		Workers:    4,
+		Match:      matcher,
+		Progress: func(attempts uint64) {
+			progressCalled = true
+			if attempts == 0 {
+				t.Error("No attempts reported")
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidateId(iden.Id) {
+		t.Fatal("Invalid id")
+	}
+	if IdDifficulty(iden.Id) < 8 {
+		t.Fatalf("Invalid difficulty %d", IdDifficulty(iden.Id))
+	}
+	if !strings.HasPrefix(iden.Id.String(), "003") {
+		t.Fatalf("Invalid prefix %s", iden.Id)
+	}
+	if !progressCalled {
+		t.Fatal("Progress was not reported")
+	}
+}
+
+func TestGenerateIdentityWithOptionsInvalid(t *testing.T) {
+	for _, options := range []GenerateOptions{
+		{KeyType: lcrypto.Ed25519, Difficulty: MinIdDifficulty - 1},
+		{KeyType: lcrypto.Ed25519, Difficulty: maxIdDifficulty + 1},
+		{KeyType: lcrypto.RSA, Bits: minKeyBits - 1},
+	} {
+		if _, err := GenerateIdentityWithOptions(options); err == nil {
+			t.Errorf("Invalid options were accepted: %+v", options)
+		}
+	}
+}
+
+func TestNewHexIdMatcher(t *testing.T) {
+	for _, test := range []struct {
+		prefix     string
+		difficulty int
+		valid      bool
+	}{
+		{"", 5, true},
+		{"07", 5, true},
+		{"07bc", 5, true},
+		{"08", 5, false},
+		{"1", 5, false},
+		{"00f", 8, true},
+		{"01", 8, false},
+		{"0g", 5, false},
+		{"0A", 5, false},
+	} {
+		_, err := NewHexIdMatcher(test.prefix, test.difficulty)
+		if (err == nil) != test.valid {
+			t.Errorf("%q with difficulty %d: %v", test.prefix, test.difficulty, err)
+		}
+	}
+}
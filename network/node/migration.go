@@ -0,0 +1,203 @@
+package node
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"path"
+	"time"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// statementSigningHash is the hash used to sign the statements published by
+// the nodes, such as the migration statements. The signed data of each kind
+// of statement starts with a different prefix so that a signature created for
+// one kind of statement, or for any other purpose, can't be passed off as
+// a signature of a statement of a different kind.
+const statementSigningHash = crypto.SHA256
+
+// migrationPrefix is prepended to the signed migration statements, see
+// statementSigningHash.
+const migrationPrefix = "starlight-migration:"
+
+// Migration is a statement which links an old identity, usually an RSA
+// identity, to a new identity, usually an Ed25519 identity. The statement is
+// signed with both keys: the old key authorizes the new key to replace it and
+// the new key confirms that it replaces the old key so that nobody can claim
+// to be a successor of a node without owning its new key.
+type Migration struct {
+	OldKey       lcrypto.PublicKey
+	NewKey       lcrypto.PublicKey
+	Timestamp    time.Time
+	OldSignature []byte
+	NewSignature []byte
+}
+
+// NewMigration creates a migration statement signed with both identities.
+func NewMigration(oldIden, newIden *Identity) (*Migration, error) {
+	if CompareId(oldIden.Id, newIden.Id) {
+		return nil, errors.New("identities are the same")
+	}
+	m := &Migration{
+		OldKey:    oldIden.PubKey,
+		NewKey:    newIden.PubKey,
+		Timestamp: time.Unix(time.Now().Unix(), 0),
+	}
+	data, err := m.signedData()
+	if err != nil {
+		return nil, err
+	}
+	m.OldSignature, err = oldIden.PrivKey.Sign(data, statementSigningHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing with the old key failed")
+	}
+	m.NewSignature, err = newIden.PrivKey.Sign(data, statementSigningHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing with the new key failed")
+	}
+	return m, nil
+}
+
+// OldId returns the id of the old identity.
+func (m *Migration) OldId() (ID, error) {
+	return m.OldKey.Hash()
+}
+
+// NewId returns the id of the new identity.
+func (m *Migration) NewId() (ID, error) {
+	return m.NewKey.Hash()
+}
+
+// Validate checks if the statement was signed with both keys.
+func (m *Migration) Validate() error {
+	oldId, err := m.OldId()
+	if err != nil {
+		return err
+	}
+	newId, err := m.NewId()
+	if err != nil {
+		return err
+	}
+	if CompareId(oldId, newId) {
+		return errors.New("identities are the same")
+	}
+	data, err := m.signedData()
+	if err != nil {
+		return err
+	}
+	if err := m.OldKey.Validate(data, m.OldSignature, statementSigningHash); err != nil {
+		return errors.Wrap(err, "invalid signature of the old key")
+	}
+	if err := m.NewKey.Validate(data, m.NewSignature, statementSigningHash); err != nil {
+		return errors.Wrap(err, "invalid signature of the new key")
+	}
+	return nil
+}
+
+func (m *Migration) signedData() ([]byte, error) {
+	oldKey, err := m.OldKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := m.NewKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(migrationPrefix)
+	for _, key := range [][]byte{oldKey, newKey} {
+		binary.Write(buf, binary.BigEndian, uint32(len(key)))
+		buf.Write(key)
+	}
+	binary.Write(buf, binary.BigEndian, m.Timestamp.Unix())
+	return buf.Bytes(), nil
+}
+
+// Bytes serializes the statement.
+func (m *Migration) Bytes() ([]byte, error) {
+	oldKey, err := m.OldKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := m.NewKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := m.Timestamp.Unix()
+	msg := &message.Migration{
+		OldKey:       oldKey,
+		NewKey:       newKey,
+		Timestamp:    &timestamp,
+		OldSignature: m.OldSignature,
+		NewSignature: m.NewSignature,
+	}
+	return proto.Marshal(msg)
+}
+
+// NewMigrationFromBytes loads a statement from the output of the Bytes method
+// and validates it.
+func NewMigrationFromBytes(data []byte) (*Migration, error) {
+	msg := &message.Migration{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal the statement")
+	}
+	oldKey, err := lcrypto.NewPublicKey(msg.GetOldKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid old key")
+	}
+	newKey, err := lcrypto.NewPublicKey(msg.GetNewKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid new key")
+	}
+	m := &Migration{
+		OldKey:       oldKey,
+		NewKey:       newKey,
+		Timestamp:    time.Unix(msg.GetTimestamp(), 0),
+		OldSignature: msg.GetOldSignature(),
+		NewSignature: msg.GetNewSignature(),
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+const migrationFilename = "migration.pem"
+
+const migrationPemType = "STARLIGHT MIGRATION"
+
+// SaveLocalMigration saves the migration statement in the specified
+// directory.
+func SaveLocalMigration(m *Migration, directory string) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	pemData := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  migrationPemType,
+			Bytes: data,
+		},
+	)
+	return ioutil.WriteFile(path.Join(directory, migrationFilename), pemData, 0644)
+}
+
+// LoadLocalMigration loads the migration statement from the specified
+// directory.
+func LoadLocalMigration(directory string) (*Migration, error) {
+	pemData, err := ioutil.ReadFile(path.Join(directory, migrationFilename))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != migrationPemType {
+		return nil, errors.New("invalid migration statement file")
+	}
+	return NewMigrationFromBytes(block.Bytes)
+}
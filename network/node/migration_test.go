@@ -0,0 +1,149 @@
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMigration(t *testing.T) {
+	oldIden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newIden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMigration(oldIden, newIden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewMigrationFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldId, err := loaded.OldId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newId, err := loaded.NewId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(oldId, oldIden.Id) || !CompareId(newId, newIden.Id) {
+		t.Fatal("Invalid ids")
+	}
+}
+
+func TestMigrationInvalid(t *testing.T) {
+	oldIden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newIden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewMigration(oldIden, oldIden); err == nil {
+		t.Fatal("Migration to the same identity was created")
+	}
+
+	m, err := NewMigration(oldIden, newIden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.OldSignature, m.NewSignature = m.NewSignature, m.OldSignature
+	if err := m.Validate(); err == nil {
+		t.Fatal("Invalid signatures were accepted")
+	}
+}
+
+func TestSaveLoadEd25519Identity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidateId(iden.Id) {
+		t.Fatal("Invalid id")
+	}
+	if err := SaveLocalIdentity(iden, dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLocalIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(iden.Id, loaded.Id) {
+		t.Fatal("Invalid id of the loaded identity")
+	}
+}
+
+func TestMigrateLocalIdentity(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldIden, err := GenerateIdentity(minKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveLocalIdentity(oldIden, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := MigrateLocalIdentity(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newIden, err := LoadLocalIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newId, err := m.NewId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(newIden.Id, newId) {
+		t.Fatal("New identity was not saved")
+	}
+
+	loaded, err := LoadLocalMigration(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldId, err := loaded.OldId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(oldIden.Id, oldId) {
+		t.Fatal("Invalid old id")
+	}
+
+	if _, err := MigrateLocalIdentity(dir, nil); err == nil {
+		t.Fatal("Ed25519 identity was migrated")
+	}
+}
@@ -3,13 +3,18 @@ package node
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
-	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 
 	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/protocol/message"
 	"github.com/boreq/starlight/utils"
+	"github.com/pkg/errors"
 )
 
 type ID []byte
@@ -47,9 +52,68 @@ type Identity struct {
 	PrivKey lcrypto.PrivateKey
 }
 
+// NodeInfo describes a node and the addresses under which it can be reached.
+// The addresses are ordered by preference, the first one should be tried
+// first.
 type NodeInfo struct {
-	Id      ID
-	Address string
+	Id        ID
+	Addresses []address.Address
+}
+
+// UnmarshalJSON also accepts the legacy format in which a single address was
+// stored as a string in the Address field.
+func (nd *NodeInfo) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Id        ID
+		Addresses []address.Address
+		Address   string
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Address != "" {
+		a, err := address.Parse(v.Address)
+		if err != nil {
+			return err
+		}
+		v.Addresses = append(v.Addresses, a)
+	}
+	nd.Id = v.Id
+	nd.Addresses = v.Addresses
+	return nil
+}
+
+// Message converts the node info to the form in which it is sent to other
+// nodes. The first direct TCP address is also sent in the format understood by
+// the nodes which don't support the structured addresses.
+func (nd NodeInfo) Message() *message.Nodes_NodeInfo {
+	msg := &message.Nodes_NodeInfo{Id: nd.Id}
+	legacyAddress := ""
+	for _, a := range nd.Addresses {
+		if legacyAddress == "" && a.Transport == address.TCP && !a.IsRelay() {
+			legacyAddress = a.HostPort()
+		}
+		msg.Addresses = append(msg.Addresses, a.String())
+	}
+	msg.Address = &legacyAddress
+	return msg
+}
+
+// NewNodeInfoFromMessage converts the node info received from other nodes.
+// Invalid addresses are skipped. The address in the legacy format is used only
+// if the structured addresses weren't sent.
+func NewNodeInfoFromMessage(msg *message.Nodes_NodeInfo) NodeInfo {
+	nd := NodeInfo{Id: msg.GetId()}
+	addresses := msg.GetAddresses()
+	if len(addresses) == 0 && msg.GetAddress() != "" {
+		addresses = []string{msg.GetAddress()}
+	}
+	for _, s := range addresses {
+		if a, err := address.Parse(s); err == nil {
+			nd.Addresses = append(nd.Addresses, a)
+		}
+	}
+	return nd
 }
 
 // minKeyBits is the minimum bit size of a generated RSA keypair used as the
@@ -60,6 +124,16 @@ const minKeyBits = 2048
 // of a node ID which is simply a hash of a public key.
 const idCryptoPuzzleDifficulty = 5
 
+// MinIdDifficulty is the difficulty of the crypto puzzle which has to be
+// solved by the ids of all nodes. The nodes can generate the ids with a higher
+// difficulty to prove that more work was put into creating them.
+const MinIdDifficulty = idCryptoPuzzleDifficulty
+
+// maxIdDifficulty limits the difficulty of the crypto puzzle solved when
+// generating an identity as the ids with the higher difficulties would take
+// years to generate.
+const maxIdDifficulty = 40
+
 // CompareId returns true if two IDs are exactly the same.
 func CompareId(a, b ID) bool {
 	return bytes.Equal(a, b)
@@ -72,6 +146,12 @@ func Distance(a, b ID) ([]byte, error) {
 	return utils.XOR(a, b)
 }
 
+// IdDifficulty returns the difficulty of the crypto puzzle solved by the id,
+// the number of zero bits at its beginning.
+func IdDifficulty(id ID) int {
+	return utils.ZerosLen(id)
+}
+
 // ValidateId returns true if a node id is valid - has proper length and proper
 // structure (correct length of a prefix consisting of zero bits).
 func ValidateId(id ID) bool {
@@ -88,65 +168,192 @@ func ValidateId(id ID) bool {
 // parameter must be bigger or equal to minKeyBits constant or the function
 // will return an error.
 func GenerateIdentity(bits int) (*Identity, error) {
-	// Should this be placed here and not in the init command?
-	if bits < minKeyBits {
-		return nil, fmt.Errorf("use at least %d bits to generate a key", minKeyBits)
-	}
+	return GenerateIdentityWithOptions(GenerateOptions{
+		KeyType: lcrypto.RSA,
+		Bits:    bits,
+	})
+}
+
+// GenerateEd25519Identity generates a fresh Ed25519 identity for a local
+// node. Ed25519 keys are much faster to generate and use than RSA keys and
+// are significantly smaller.
+func GenerateEd25519Identity() (*Identity, error) {
+	return GenerateIdentityWithOptions(GenerateOptions{
+		KeyType: lcrypto.Ed25519,
+	})
+}
 
-	for {
-		privKey, pubKey, err := lcrypto.GenerateKeypair(bits)
+const identityFilename = "identity.pem"
+
+// oldIdentityFilename is the name of the file in which the identity replaced
+// during the migration is kept.
+const oldIdentityFilename = "identity-old.pem"
+
+// pemTypes maps the key types to the types of the PEM blocks in which the
+// private keys are stored.
+var pemTypes = map[lcrypto.KeyType]string{
+	lcrypto.RSA:     "RSA PRIVATE KEY",
+	lcrypto.Ed25519: "ED25519 PRIVATE KEY",
+}
+
+// SaveLocalIdentity saves the local identity in the specified directory.
+func SaveLocalIdentity(iden *Identity, directory string) error {
+	return SaveLocalIdentityWithPassphrase(iden, directory, nil)
+}
+
+// SaveLocalIdentityWithPassphrase saves the local identity in the specified
+// directory. The private key is encrypted with the passphrase unless the
+// passphrase is empty.
+func SaveLocalIdentityWithPassphrase(iden *Identity, directory string, passphrase []byte) error {
+	return saveIdentity(iden, path.Join(directory, identityFilename), passphrase)
+}
+
+func saveIdentity(iden *Identity, path string, passphrase []byte) error {
+	var block *pem.Block
+	if len(passphrase) > 0 {
+		k, err := encryptIdentity(iden, passphrase)
 		if err != nil {
-			return nil, err
+			return errors.Wrap(err, "could not encrypt the identity")
 		}
-
-		id, err := pubKey.Hash()
+		block = k.pemBlock()
+	} else {
+		keyBytes, err := iden.PrivKey.Bytes()
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		// Check if the puzzle has been solved.
-		if utils.ZerosLen(id) >= idCryptoPuzzleDifficulty {
-			return &Identity{id, pubKey, privKey}, nil
+		block = &pem.Block{
+			Type:  pemTypes[iden.PrivKey.Type()],
+			Bytes: keyBytes,
 		}
 	}
+	data := pem.EncodeToMemory(block)
+	return writeFileAtomic(path, data, 0600)
 }
 
-const identityFilename = "identity.pem"
-
-// SaveLocalIdentity saves the local identity in the specified directory.
-func SaveLocalIdentity(iden *Identity, directory string) error {
-	path := path.Join(directory, identityFilename)
-	keyBytes, err := iden.PrivKey.Bytes()
+// writeFileAtomic writes the data to a temporary file in the same directory
+// which then replaces the file so that the file is never partially written.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
 	if err != nil {
-		return err
+		return errors.Wrap(err, "could not create a temporary file")
 	}
-	data := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: keyBytes,
-		},
-	)
-	err = ioutil.WriteFile(path, data, 0600)
-	if err != nil {
+	tmpName := f.Name()
+	if err := writeAndSync(f, data, perm); err != nil {
+		os.Remove(tmpName)
 		return err
 	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return errors.Wrap(err, "could not replace the file")
+	}
 	return nil
 }
 
+// writeAndSync writes the data to the file, flushes it to the disk and closes
+// the file.
+func writeAndSync(f *os.File, data []byte, perm os.FileMode) error {
+	defer f.Close()
+	if err := f.Chmod(perm); err != nil {
+		return errors.Wrap(err, "chmod failed")
+	}
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrap(err, "write failed")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "sync failed")
+	}
+	return errors.Wrap(f.Close(), "close failed")
+}
+
 // LoadLocalIdentity loads the identity from the specified directory.
+// ErrPassphraseRequired is returned if the identity is encrypted.
 func LoadLocalIdentity(directory string) (*Identity, error) {
+	return LoadLocalIdentityWithPassphrase(directory, nil)
+}
+
+// LoadLocalIdentityWithPassphrase loads the identity from the specified
+// directory decrypting it with the passphrase if it is encrypted.
+func LoadLocalIdentityWithPassphrase(directory string, passphrase []byte) (*Identity, error) {
 	path := path.Join(directory, identityFilename)
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return LoadIdentity(data)
+	return LoadIdentityWithPassphrase(data, passphrase)
+}
+
+// IsLocalIdentityEncrypted returns true if the identity stored in the
+// specified directory is encrypted with a passphrase.
+func IsLocalIdentityEncrypted(directory string) (bool, error) {
+	block, err := loadLocalIdentityBlock(directory)
+	if err != nil {
+		return false, err
+	}
+	return block.Type == encryptedPemType, nil
+}
+
+// LoadLocalId loads the id of the identity stored in the specified directory.
+// The passphrase is not required to obtain the id of an encrypted identity.
+func LoadLocalId(directory string) (ID, error) {
+	block, err := loadLocalIdentityBlock(directory)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == encryptedPemType {
+		return encryptedId(block)
+	}
+	iden, err := loadIdentityBlock(block, nil)
+	if err != nil {
+		return nil, err
+	}
+	return iden.Id, nil
+}
+
+func loadLocalIdentityBlock(directory string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path.Join(directory, identityFilename))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid identity file")
+	}
+	return block, nil
 }
 
 // LoadIdentity loads the identity from the provided PEM data.
+// ErrPassphraseRequired is returned if the identity is encrypted.
 func LoadIdentity(pemData []byte) (*Identity, error) {
+	return LoadIdentityWithPassphrase(pemData, nil)
+}
+
+// LoadIdentityWithPassphrase loads the identity from the provided PEM data
+// decrypting it with the passphrase if it is encrypted.
+func LoadIdentityWithPassphrase(pemData []byte, passphrase []byte) (*Identity, error) {
 	block, _ := pem.Decode(pemData)
-	privKey, err := lcrypto.NewPrivateKey(block.Bytes)
+	if block == nil {
+		return nil, errors.New("invalid identity file")
+	}
+	return loadIdentityBlock(block, passphrase)
+}
+
+func loadIdentityBlock(block *pem.Block, passphrase []byte) (*Identity, error) {
+	if block.Type == encryptedPemType {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		k, err := newEncryptedKeyFromPem(block)
+		if err != nil {
+			return nil, err
+		}
+		return k.decrypt(passphrase)
+	}
+	return newIdentity(block.Bytes)
+}
+
+// newIdentity creates an identity from the private key bytes.
+func newIdentity(keyBytes []byte) (*Identity, error) {
+	privKey, err := lcrypto.NewPrivateKey(keyBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -164,3 +371,46 @@ func LoadIdentity(pemData []byte) (*Identity, error) {
 	}
 	return &iden, nil
 }
+
+// MigrateLocalIdentity replaces the identity stored in the specified directory
+// with a new Ed25519 identity. The old identity is kept in a separate file and
+// a migration statement linking both identities is saved. The passphrase is
+// used to decrypt the old identity and encrypt the new one, it should be empty
+// if the identity isn't encrypted.
+func MigrateLocalIdentity(directory string, passphrase []byte) (*Migration, error) {
+	oldIden, err := LoadLocalIdentityWithPassphrase(directory, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load the identity")
+	}
+	if oldIden.PrivKey.Type() == lcrypto.Ed25519 {
+		return nil, errors.New("identity is already an Ed25519 identity")
+	}
+
+	newIden, err := GenerateEd25519Identity()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate the identity")
+	}
+	m, err := NewMigration(oldIden, newIden)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the migration statement")
+	}
+
+	oldPath := path.Join(directory, oldIdentityFilename)
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		return nil, errors.Errorf("%s already exists", oldPath)
+	}
+	oldData, err := ioutil.ReadFile(path.Join(directory, identityFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the old identity")
+	}
+	if err := ioutil.WriteFile(oldPath, oldData, 0600); err != nil {
+		return nil, errors.Wrap(err, "could not copy the old identity")
+	}
+	if err := SaveLocalIdentityWithPassphrase(newIden, directory, passphrase); err != nil {
+		return nil, errors.Wrap(err, "could not save the new identity")
+	}
+	if err := SaveLocalMigration(m, directory); err != nil {
+		return nil, errors.Wrap(err, "could not save the migration statement")
+	}
+	return m, nil
+}
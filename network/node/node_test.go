@@ -1,11 +1,30 @@
 package node
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/protocol/message"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 )
 
+// generateIds returns the ids of n new identities.
+func generateIds(t *testing.T, n int) []ID {
+	var rv []ID
+	for i := 0; i < n; i++ {
+		iden, err := GenerateEd25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rv = append(rv, iden.Id)
+	}
+	return rv
+}
+
 func TestPublic(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping test in short mode.")
@@ -74,3 +93,96 @@ func BenchmarkGenerateIdentity4096(b *testing.B) {
 		}
 	}
 }
+
+func TestNodeInfoUnmarshalLegacy(t *testing.T) {
+	var nd NodeInfo
+	data := `{"Id": "0a0b", "Address": "1.2.3.4:1836"}`
+	if err := json.Unmarshal([]byte(data), &nd); err != nil {
+		t.Fatal(err)
+	}
+	if len(nd.Addresses) != 1 || nd.Addresses[0].String() != "/ip4/1.2.3.4/tcp/1836" {
+		t.Fatalf("Invalid addresses %v", nd.Addresses)
+	}
+	if !CompareId(nd.Id, []byte{0x0a, 0x0b}) {
+		t.Fatal("Invalid id", nd.Id)
+	}
+}
+
+func TestNodeInfoMessage(t *testing.T) {
+	var addresses []address.Address
+	for _, s := range []string{
+		"/ip4/1.2.3.4/udp/1836/quic",
+		"/ip4/5.6.7.8/tcp/1836/circuit/0a0b",
+		"/ip6/2001:db8::1/tcp/1836",
+		"/ip4/1.2.3.4/tcp/1836",
+	} {
+		a, err := address.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, a)
+	}
+	nd := NodeInfo{Id: ID{0x0a, 0x0b}, Addresses: addresses}
+
+	msg := nd.Message()
+	if msg.GetAddress() != "[2001:db8::1]:1836" {
+		t.Fatalf("Invalid legacy address %s", msg.GetAddress())
+	}
+	loaded := NewNodeInfoFromMessage(msg)
+	if !CompareId(loaded.Id, nd.Id) || len(loaded.Addresses) != len(addresses) {
+		t.Fatalf("Invalid node info %v", loaded)
+	}
+	for i, a := range addresses {
+		if loaded.Addresses[i] != a {
+			t.Fatalf("Invalid address %s", loaded.Addresses[i])
+		}
+	}
+
+	// The nodes which don't support the structured addresses send only
+	// the legacy address.
+	legacyAddress := "1.2.3.4:1836"
+	loaded = NewNodeInfoFromMessage(&message.Nodes_NodeInfo{Id: nd.Id, Address: &legacyAddress})
+	if len(loaded.Addresses) != 1 || loaded.Addresses[0].String() != "/ip4/1.2.3.4/tcp/1836" {
+		t.Fatalf("Invalid addresses %v", loaded.Addresses)
+	}
+}
+
+func TestSaveLocalIdentityReplaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 2; i++ {
+		iden, err := GenerateEd25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveLocalIdentity(iden, dir); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadLocalIdentity(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !CompareId(iden.Id, loaded.Id) {
+			t.Fatal("Identity was not replaced")
+		}
+	}
+
+	info, err := os.Stat(path.Join(dir, identityFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("Invalid mode", info.Mode())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("Temporary files were left", files)
+	}
+}
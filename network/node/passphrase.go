@@ -0,0 +1,210 @@
+package node
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"strconv"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedPemType is the type of the PEM blocks in which the private keys
+// encrypted with a passphrase are stored.
+const encryptedPemType = "STARLIGHT ENCRYPTED PRIVATE KEY"
+
+// The parameters of scrypt which is used to derive the key used to encrypt the
+// private key from the passphrase. They are stored together with the
+// encrypted key so that they can be changed without breaking the existing
+// files.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// The maximum values limit the cost of loading the files with modified
+	// parameters. The memory and the time required by scrypt are
+	// proportional to 128*N*r*p which is limited by scryptMaxCost.
+	scryptMaxN    = 1 << 20
+	scryptMaxR    = 32
+	scryptMaxP    = 16
+	scryptMaxCost = 128 * scryptMaxN * scryptR
+)
+
+// passphraseKdf is the name of the key derivation function.
+const passphraseKdf = "scrypt"
+
+// passphraseCipher is the AEAD cipher used to encrypt the private key.
+const passphraseCipher = "CHACHA20-POLY1305"
+
+const (
+	passphraseSaltSize = 32
+	passphraseKeySize  = 32
+)
+
+// The names of the PEM headers of the encrypted private keys.
+const (
+	headerId     = "Id"
+	headerKdf    = "Kdf"
+	headerN      = "Scrypt-N"
+	headerR      = "Scrypt-R"
+	headerP      = "Scrypt-P"
+	headerSalt   = "Salt"
+	headerCipher = "Cipher"
+	headerNonce  = "Nonce"
+)
+
+// ErrPassphraseRequired is returned when an encrypted identity is loaded
+// without a passphrase.
+var ErrPassphraseRequired = errors.New("identity is encrypted, passphrase required")
+
+// ErrInvalidPassphrase is returned when an encrypted identity can't be
+// decrypted using the provided passphrase.
+var ErrInvalidPassphrase = errors.New("invalid passphrase")
+
+// encryptedKey is a private key encrypted with a key derived from
+// a passphrase. The id is stored in plaintext so that it can be read without
+// the passphrase and is authenticated as the additional data.
+type encryptedKey struct {
+	id         ID
+	kdf        string
+	n, r, p    int
+	salt       []byte
+	cipher     string
+	nonce      []byte
+	ciphertext []byte
+}
+
+// encryptIdentity encrypts the private key of the identity with a key derived
+// from the passphrase.
+func encryptIdentity(iden *Identity, passphrase []byte) (*encryptedKey, error) {
+	keyBytes, err := iden.PrivKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	k := &encryptedKey{
+		id:     iden.Id,
+		kdf:    passphraseKdf,
+		n:      scryptN,
+		r:      scryptR,
+		p:      scryptP,
+		salt:   make([]byte, passphraseSaltSize),
+		cipher: passphraseCipher,
+	}
+	if _, err := rand.Read(k.salt); err != nil {
+		return nil, errors.Wrap(err, "could not generate the salt")
+	}
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	k.nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(k.nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate the nonce")
+	}
+	k.ciphertext = aead.Seal(nil, k.nonce, keyBytes, k.id)
+	return k, nil
+}
+
+// decrypt decrypts the private key and confirms that it matches the id.
+func (k *encryptedKey) decrypt(passphrase []byte) (*Identity, error) {
+	aead, err := k.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+	keyBytes, err := aead.Open(nil, k.nonce, k.ciphertext, k.id)
+	if err != nil {
+		return nil, ErrInvalidPassphrase
+	}
+	iden, err := newIdentity(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !CompareId(iden.Id, k.id) {
+		return nil, errors.New("key doesn't match the id")
+	}
+	return iden, nil
+}
+
+// aead derives the key from the passphrase and creates the cipher.
+func (k *encryptedKey) aead(passphrase []byte) (cipher.AEAD, error) {
+	if k.kdf != passphraseKdf {
+		return nil, errors.Errorf("unsupported key derivation function %s", k.kdf)
+	}
+	if k.n <= 0 || k.r <= 0 || k.p <= 0 {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+	if k.n > scryptMaxN || k.r > scryptMaxR || k.p > scryptMaxP || 128*uint64(k.n)*uint64(k.r)*uint64(k.p) > scryptMaxCost {
+		return nil, errors.New("key derivation parameters are too expensive")
+	}
+	key, err := scrypt.Key(passphrase, k.salt, k.n, k.r, k.p, passphraseKeySize)
+	if err != nil {
+		return nil, errors.Wrap(err, "key derivation failed")
+	}
+	return lcrypto.GetAEAD(k.cipher, key)
+}
+
+// pemBlock stores the key in a PEM block using the headers for everything
+// except the ciphertext.
+func (k *encryptedKey) pemBlock() *pem.Block {
+	return &pem.Block{
+		Type: encryptedPemType,
+		Headers: map[string]string{
+			headerId:     hex.EncodeToString(k.id),
+			headerKdf:    k.kdf,
+			headerN:      strconv.Itoa(k.n),
+			headerR:      strconv.Itoa(k.r),
+			headerP:      strconv.Itoa(k.p),
+			headerSalt:   hex.EncodeToString(k.salt),
+			headerCipher: k.cipher,
+			headerNonce:  hex.EncodeToString(k.nonce),
+		},
+		Bytes: k.ciphertext,
+	}
+}
+
+// newEncryptedKeyFromPem loads the key from a PEM block created by the
+// pemBlock method.
+func newEncryptedKeyFromPem(block *pem.Block) (*encryptedKey, error) {
+	if block.Type != encryptedPemType {
+		return nil, errors.New("key is not encrypted")
+	}
+	k := &encryptedKey{
+		kdf:        block.Headers[headerKdf],
+		cipher:     block.Headers[headerCipher],
+		ciphertext: block.Bytes,
+	}
+	var err error
+	if k.id, err = encryptedId(block); err != nil {
+		return nil, err
+	}
+	for name, param := range map[string]*int{headerN: &k.n, headerR: &k.r, headerP: &k.p} {
+		if *param, err = strconv.Atoi(block.Headers[name]); err != nil {
+			return nil, errors.Errorf("invalid %s header", name)
+		}
+	}
+	if k.salt, err = hex.DecodeString(block.Headers[headerSalt]); err != nil {
+		return nil, errors.Wrap(err, "invalid salt")
+	}
+	if k.nonce, err = hex.DecodeString(block.Headers[headerNonce]); err != nil {
+		return nil, errors.Wrap(err, "invalid nonce")
+	}
+	return k, nil
+}
+
+// encryptedId returns the id stored in the headers of the PEM block created by
+// the pemBlock method without decoding the remaining headers.
+func encryptedId(block *pem.Block) (ID, error) {
+	id, err := hex.DecodeString(block.Headers[headerId])
+	if err != nil || len(id) == 0 {
+		return nil, errors.New("invalid id header")
+	}
+	return id, nil
+}
@@ -0,0 +1,136 @@
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncryptedIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("passphrase")
+	if err := SaveLocalIdentityWithPassphrase(iden, dir, passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := IsLocalIdentityEncrypted(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted {
+		t.Fatal("Identity is not encrypted")
+	}
+
+	id, err := LoadLocalId(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(id, iden.Id) {
+		t.Fatal("Invalid id")
+	}
+
+	if _, err := LoadLocalIdentity(dir); err != ErrPassphraseRequired {
+		t.Fatalf("Invalid error %v", err)
+	}
+	if _, err := LoadLocalIdentityWithPassphrase(dir, []byte("invalid")); err != ErrInvalidPassphrase {
+		t.Fatalf("Invalid error %v", err)
+	}
+
+	loaded, err := LoadLocalIdentityWithPassphrase(dir, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(loaded.Id, iden.Id) {
+		t.Fatal("Invalid id of the loaded identity")
+	}
+}
+
+func TestUnencryptedIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveLocalIdentityWithPassphrase(iden, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := IsLocalIdentityEncrypted(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted {
+		t.Fatal("Identity is encrypted")
+	}
+
+	id, err := LoadLocalId(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(id, iden.Id) {
+		t.Fatal("Invalid id")
+	}
+
+	// The passphrase is ignored if the identity isn't encrypted.
+	if _, err := LoadLocalIdentityWithPassphrase(dir, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedIdentityModifiedId(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("passphrase")
+	k, err := encryptIdentity(iden, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.id = other.Id
+	if _, err := k.decrypt(passphrase); err == nil {
+		t.Fatal("Modified id was accepted")
+	}
+}
+
+func TestEncryptedIdentityExpensiveParameters(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("passphrase")
+	for _, params := range [][3]int{
+		{scryptMaxN * 2, scryptR, scryptP},
+		{scryptN, scryptMaxR * 2, scryptP},
+		{scryptN, scryptR, scryptMaxP * 2},
+		{scryptMaxN, scryptMaxR, scryptMaxP},
+		{scryptN, 0, scryptP},
+	} {
+		k, err := encryptIdentity(iden, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.n, k.r, k.p = params[0], params[1], params[2]
+		if _, err := k.decrypt(passphrase); err == nil {
+			t.Fatal("Parameters were accepted", params)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// revocationPrefix is prepended to the signed revocations, see
+// statementSigningHash.
+const revocationPrefix = "starlight-revocation:"
+
+// Revocation is a statement signed with a key which tells other nodes to stop
+// trusting that key, for example because it was compromised. A revocation can
+// name a successor, the id which should be used instead of the revoked id.
+// As the revocation is signed only with the revoked key, which may be known to
+// an attacker, the successor is merely a hint and shouldn't be trusted
+// automatically.
+type Revocation struct {
+	Key       lcrypto.PublicKey
+	Successor ID
+	Timestamp time.Time
+	Signature []byte
+}
+
+// NewRevocation creates a revocation of the identity. The successor is
+// optional.
+func NewRevocation(iden *Identity, successor ID) (*Revocation, error) {
+	if successor != nil {
+		if !ValidateId(successor) {
+			return nil, errors.New("invalid successor id")
+		}
+		if CompareId(successor, iden.Id) {
+			return nil, errors.New("identity can't succeed itself")
+		}
+	}
+	r := &Revocation{
+		Key:       iden.PubKey,
+		Successor: successor,
+		Timestamp: time.Unix(time.Now().Unix(), 0),
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return nil, err
+	}
+	r.Signature, err = iden.PrivKey.Sign(data, statementSigningHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing failed")
+	}
+	return r, nil
+}
+
+// Id returns the revoked id.
+func (r *Revocation) Id() (ID, error) {
+	return r.Key.Hash()
+}
+
+// Validate checks if the revocation was signed with the revoked key.
+func (r *Revocation) Validate() error {
+	if r.Successor != nil {
+		if !ValidateId(r.Successor) {
+			return errors.New("invalid successor id")
+		}
+		id, err := r.Id()
+		if err != nil {
+			return err
+		}
+		if CompareId(id, r.Successor) {
+			return errors.New("identity can't succeed itself")
+		}
+	}
+	data, err := r.signedData()
+	if err != nil {
+		return err
+	}
+	if err := r.Key.Validate(data, r.Signature, statementSigningHash); err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	return nil
+}
+
+func (r *Revocation) signedData() ([]byte, error) {
+	key, err := r.Key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(revocationPrefix)
+	for _, field := range [][]byte{key, r.Successor} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	binary.Write(buf, binary.BigEndian, r.Timestamp.Unix())
+	return buf.Bytes(), nil
+}
+
+// Message converts the revocation to a message which can be sent to other
+// nodes.
+func (r *Revocation) Message() (*message.Revocation, error) {
+	key, err := r.Key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := r.Timestamp.Unix()
+	return &message.Revocation{
+		Key:         key,
+		SuccessorId: r.Successor,
+		Timestamp:   &timestamp,
+		Signature:   r.Signature,
+	}, nil
+}
+
+// NewRevocationFromMessage loads a revocation from a message and validates
+// it.
+func NewRevocationFromMessage(msg *message.Revocation) (*Revocation, error) {
+	key, err := lcrypto.NewPublicKey(msg.GetKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	r := &Revocation{
+		Key:       key,
+		Successor: msg.GetSuccessorId(),
+		Timestamp: time.Unix(msg.GetTimestamp(), 0),
+		Signature: msg.GetSignature(),
+	}
+	if len(r.Successor) == 0 {
+		r.Successor = nil
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Bytes serializes the revocation.
+func (r *Revocation) Bytes() ([]byte, error) {
+	msg, err := r.Message()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+// NewRevocationFromBytes loads a revocation from the output of the Bytes
+// method and validates it.
+func NewRevocationFromBytes(data []byte) (*Revocation, error) {
+	msg := &message.Revocation{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal the revocation")
+	}
+	return NewRevocationFromMessage(msg)
+}
+
+const revocationsFilename = "revocations.pem"
+
+const revocationPemType = "STARLIGHT REVOCATION"
+
+// SaveLocalRevocation appends the revocation to the revocations stored in the
+// specified directory.
+func SaveLocalRevocation(r *Revocation, directory string) error {
+	data, err := r.Bytes()
+	if err != nil {
+		return err
+	}
+	pemData := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  revocationPemType,
+			Bytes: data,
+		},
+	)
+	f, err := os.OpenFile(path.Join(directory, revocationsFilename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(pemData)
+	return err
+}
+
+// LoadLocalRevocations loads the revocations stored in the specified
+// directory. No revocations and no error are returned if the file doesn't
+// exist.
+func LoadLocalRevocations(directory string) ([]*Revocation, error) {
+	pemData, err := ioutil.ReadFile(path.Join(directory, revocationsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rv []*Revocation
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			break
+		}
+		if block.Type != revocationPemType {
+			return nil, errors.New("invalid revocations file")
+		}
+		r, err := NewRevocationFromBytes(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, r)
+	}
+	return rv, nil
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRevocation(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	successor, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, successorId := range []ID{nil, successor.Id} {
+		r, err := NewRevocation(iden, successorId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := r.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := NewRevocationFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := loaded.Id()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !CompareId(id, iden.Id) {
+			t.Fatal("Invalid id")
+		}
+		if !CompareId(loaded.Successor, successorId) {
+			t.Fatal("Invalid successor")
+		}
+	}
+}
+
+func TestRevocationInvalid(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRevocation(iden, iden.Id); err == nil {
+		t.Fatal("Identity succeeded itself")
+	}
+
+	// The successor is covered by the signature.
+	r, err := NewRevocation(iden, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Successor = other.Id
+	if err := r.Validate(); err == nil {
+		t.Fatal("Modified revocation was accepted")
+	}
+}
+
+func TestLocalRevocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	revocations, err := LoadLocalRevocations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 0 {
+		t.Fatal("Revocations returned")
+	}
+
+	for i := 0; i < 2; i++ {
+		iden, err := GenerateEd25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewRevocation(iden, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveLocalRevocation(r, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revocations, err = LoadLocalRevocations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 2 {
+		t.Fatalf("Invalid number of revocations %d", len(revocations))
+	}
+}
@@ -0,0 +1,201 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	lcrypto "github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// trustListPrefix is prepended to the signed trust lists, see
+// statementSigningHash.
+const trustListPrefix = "starlight-trust:"
+
+// maxTrusted limits the size of the trust lists stored in the DHT.
+const maxTrusted = 256
+
+// TrustList is a statement signed with the key of a node which asserts that
+// the owner of the key verified the listed ids, for example by comparing
+// their fingerprints in person. A newer list replaces the older lists.
+type TrustList struct {
+	Key       lcrypto.PublicKey
+	Trusted   []ID
+	Timestamp time.Time
+	Signature []byte
+}
+
+// NewTrustList creates a trust list signed with the identity.
+func NewTrustList(iden *Identity, trusted []ID) (*TrustList, error) {
+	return newTrustList(iden, trusted, time.Unix(time.Now().Unix(), 0))
+}
+
+// Update creates a new list signed with the identity which replaces this list.
+func (l *TrustList) Update(iden *Identity, trusted []ID) (*TrustList, error) {
+	id, err := l.Id()
+	if err != nil {
+		return nil, err
+	}
+	if !CompareId(id, iden.Id) {
+		return nil, errors.New("list was signed with a different identity")
+	}
+	// The timestamps have a resolution of one second, the new list must be
+	// newer even if it was created immediately after the previous one.
+	timestamp := time.Unix(time.Now().Unix(), 0)
+	if !timestamp.After(l.Timestamp) {
+		timestamp = l.Timestamp.Add(time.Second)
+	}
+	return newTrustList(iden, trusted, timestamp)
+}
+
+func newTrustList(iden *Identity, trusted []ID, timestamp time.Time) (*TrustList, error) {
+	l := &TrustList{
+		Key:       iden.PubKey,
+		Trusted:   trusted,
+		Timestamp: timestamp,
+	}
+	if err := l.validateTrusted(); err != nil {
+		return nil, err
+	}
+	data, err := l.signedData()
+	if err != nil {
+		return nil, err
+	}
+	l.Signature, err = iden.PrivKey.Sign(data, statementSigningHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing failed")
+	}
+	return l, nil
+}
+
+// Id returns the id of the node which signed the list.
+func (l *TrustList) Id() (ID, error) {
+	return l.Key.Hash()
+}
+
+// Contains returns true if the node with the given id is trusted.
+func (l *TrustList) Contains(id ID) bool {
+	for _, trusted := range l.Trusted {
+		if CompareId(trusted, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks if the list was signed with the key.
+func (l *TrustList) Validate() error {
+	if err := l.validateTrusted(); err != nil {
+		return err
+	}
+	data, err := l.signedData()
+	if err != nil {
+		return err
+	}
+	if err := l.Key.Validate(data, l.Signature, statementSigningHash); err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+	return nil
+}
+
+func (l *TrustList) validateTrusted() error {
+	if len(l.Trusted) > maxTrusted {
+		return errors.Errorf("too many trusted ids, the limit is %d", maxTrusted)
+	}
+	id, err := l.Id()
+	if err != nil {
+		return err
+	}
+	for i, trusted := range l.Trusted {
+		if !ValidateId(trusted) {
+			return errors.Errorf("invalid trusted id %s", trusted)
+		}
+		if CompareId(trusted, id) {
+			return errors.New("node can't trust itself")
+		}
+		for _, other := range l.Trusted[:i] {
+			if CompareId(trusted, other) {
+				return errors.Errorf("duplicate trusted id %s", trusted)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *TrustList) signedData() ([]byte, error) {
+	key, err := l.Key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(trustListPrefix)
+	binary.Write(buf, binary.BigEndian, uint32(len(key)))
+	buf.Write(key)
+	binary.Write(buf, binary.BigEndian, uint32(len(l.Trusted)))
+	for _, trusted := range l.Trusted {
+		binary.Write(buf, binary.BigEndian, uint32(len(trusted)))
+		buf.Write(trusted)
+	}
+	binary.Write(buf, binary.BigEndian, l.Timestamp.Unix())
+	return buf.Bytes(), nil
+}
+
+// Message converts the list to a message which can be sent to other nodes.
+func (l *TrustList) Message() (*message.TrustList, error) {
+	key, err := l.Key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := l.Timestamp.Unix()
+	msg := &message.TrustList{
+		Key:       key,
+		Timestamp: &timestamp,
+		Signature: l.Signature,
+	}
+	for _, trusted := range l.Trusted {
+		msg.TrustedIds = append(msg.TrustedIds, trusted)
+	}
+	return msg, nil
+}
+
+// NewTrustListFromMessage loads a trust list from a message and validates it.
+func NewTrustListFromMessage(msg *message.TrustList) (*TrustList, error) {
+	key, err := lcrypto.NewPublicKey(msg.GetKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	l := &TrustList{
+		Key:       key,
+		Timestamp: time.Unix(msg.GetTimestamp(), 0),
+		Signature: msg.GetSignature(),
+	}
+	for _, trusted := range msg.GetTrustedIds() {
+		l.Trusted = append(l.Trusted, trusted)
+	}
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Bytes serializes the trust list.
+func (l *TrustList) Bytes() ([]byte, error) {
+	msg, err := l.Message()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+// NewTrustListFromBytes loads a trust list from the output of the Bytes
+// method and validates it.
+func NewTrustListFromBytes(data []byte) (*TrustList, error) {
+	msg := &message.TrustList{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal the trust list")
+	}
+	return NewTrustListFromMessage(msg)
+}
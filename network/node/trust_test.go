@@ -0,0 +1,83 @@
+package node
+
+import (
+	"testing"
+)
+
+func TestTrustList(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := generateIds(t, 3)
+
+	l, err := NewTrustList(iden, trusted[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := l.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewTrustListFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := loaded.Id()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CompareId(id, iden.Id) {
+		t.Fatal("Invalid id")
+	}
+	if !loaded.Contains(trusted[0]) || !loaded.Contains(trusted[1]) {
+		t.Fatal("Trusted id is missing")
+	}
+	if loaded.Contains(trusted[2]) {
+		t.Fatal("List contains an id which wasn't trusted")
+	}
+
+	// The updated list is always newer.
+	updated, err := l.Update(iden, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Timestamp.After(l.Timestamp) {
+		t.Fatal("Updated list is not newer")
+	}
+	if !updated.Contains(trusted[2]) {
+		t.Fatal("Trusted id is missing")
+	}
+}
+
+func TestTrustListInvalid(t *testing.T) {
+	iden, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := generateIds(t, 2)
+
+	if _, err := NewTrustList(iden, []ID{iden.Id}); err == nil {
+		t.Fatal("Node trusted itself")
+	}
+	if _, err := NewTrustList(iden, []ID{trusted[0], trusted[0]}); err == nil {
+		t.Fatal("Duplicate id was accepted")
+	}
+
+	// The trusted ids are covered by the signature.
+	l, err := NewTrustList(iden, trusted[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Update(other, trusted); err == nil {
+		t.Fatal("List was updated by a different identity")
+	}
+	l.Trusted = trusted
+	if err := l.Validate(); err == nil {
+		t.Fatal("Modified list was accepted")
+	}
+}
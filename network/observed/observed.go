@@ -0,0 +1,139 @@
+// Package observed discovers the external addresses of the local node using
+// the addresses reported by other nodes during the handshake. This is useful
+// when the NAT traversal fails as the nodes behind a NAT don't know their
+// external address.
+package observed
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/network/address"
+)
+
+// minConfirmations is the number of different networks from which the same
+// address has to be reported before it is considered to be confirmed.
+const minConfirmations = 3
+
+// observationTTL specifies after how much time the reports are forgotten.
+const observationTTL = 30 * time.Minute
+
+// maxObservations limits the number of stored reports. The oldest reports are
+// forgotten first.
+const maxObservations = 256
+
+// New creates an empty tracker.
+func New() *Tracker {
+	return &Tracker{
+		observations: make(map[string]observation),
+	}
+}
+
+// Tracker aggregates the addresses of the local node observed by other nodes.
+// The reports are grouped by the network of the reporting node, /24 for IPv4
+// and /48 for IPv6, so that a single host can't confirm an address by using
+// multiple node ids. Only the latest report from each network is taken into
+// account and an address is confirmed only if it was reported from the
+// majority of the networks.
+type Tracker struct {
+	observations map[string]observation
+	mutex        sync.Mutex
+}
+
+type observation struct {
+	ip   net.IP
+	time time.Time
+}
+
+// Observe records the address of the local node reported by a node. The
+// reporter address is the remote address of the connection with the reporting
+// node, both addresses are in the format used by the net package. Only the
+// reports received over the connections established by the local node should
+// be recorded as the nodes connecting to the local node can choose the
+// address they connect from. Addresses which aren't globally reachable IP
+// addresses are ignored.
+func (t *Tracker) Observe(reporterAddress string, connectionAddress string) {
+	reporter := parseIP(reporterAddress)
+	if reporter == nil {
+		return
+	}
+	ip := parseIP(connectionAddress)
+	if ip == nil || (address.Address{Host: ip.String()}).Scope() != address.ScopeGlobal {
+		return
+	}
+	key := reporterNetwork(reporter)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire()
+	if _, ok := t.observations[key]; !ok && len(t.observations) >= maxObservations {
+		t.dropOldest()
+	}
+	t.observations[key] = observation{ip: ip, time: time.Now()}
+}
+
+// parseIP returns nil if the address doesn't contain an IP address.
+func parseIP(hostPort string) net.IP {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// reporterNetwork returns the network of the reporting node.
+func reporterNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Confirmed returns the confirmed external IP addresses of the local node, at
+// most one IPv4 and one IPv6 address.
+func (t *Tracker) Confirmed() []net.IP {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.expire()
+
+	var rv []net.IP
+	for _, ip4 := range []bool{true, false} {
+		votes := make(map[string]int)
+		total := 0
+		for _, o := range t.observations {
+			if (o.ip.To4() != nil) == ip4 {
+				votes[o.ip.String()]++
+				total++
+			}
+		}
+		for ip, n := range votes {
+			if n >= minConfirmations && 2*n > total {
+				rv = append(rv, net.ParseIP(ip))
+			}
+		}
+	}
+	return rv
+}
+
+func (t *Tracker) expire() {
+	for key, o := range t.observations {
+		if time.Since(o.time) > observationTTL {
+			delete(t.observations, key)
+		}
+	}
+}
+
+func (t *Tracker) dropOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, o := range t.observations {
+		if oldestKey == "" || o.time.Before(oldest) {
+			oldestKey = key
+			oldest = o.time
+		}
+	}
+	delete(t.observations, oldestKey)
+}
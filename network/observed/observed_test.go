@@ -0,0 +1,84 @@
+package observed
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConfirmed(t *testing.T) {
+	tracker := New()
+
+	tracker.Observe("10.0.1.1:1000", "1.2.3.4:1000")
+	tracker.Observe("10.0.2.1:1000", "1.2.3.4:1001")
+	if len(tracker.Confirmed()) != 0 {
+		t.Fatal("Address should not be confirmed by two networks")
+	}
+
+	tracker.Observe("10.0.3.1:1000", "1.2.3.4:1002")
+	confirmed := tracker.Confirmed()
+	if len(confirmed) != 1 || confirmed[0].String() != "1.2.3.4" {
+		t.Fatal("Address should be confirmed", confirmed)
+	}
+
+	// Repeated reports from the same network count once.
+	tracker.Observe("10.0.4.1:1000", "5.6.7.8:1000")
+	tracker.Observe("10.0.4.2:1000", "5.6.7.8:1000")
+	tracker.Observe("10.0.4.3:1001", "5.6.7.8:1000")
+	if confirmed := tracker.Confirmed(); len(confirmed) != 1 || confirmed[0].String() != "1.2.3.4" {
+		t.Fatal("Address should still be confirmed", confirmed)
+	}
+
+	// The address is no longer confirmed without the majority.
+	tracker.Observe("10.0.5.1:1000", "5.6.7.8:1000")
+	tracker.Observe("10.0.6.1:1000", "5.6.7.8:1000")
+	if confirmed := tracker.Confirmed(); len(confirmed) != 0 {
+		t.Fatal("There is no majority", confirmed)
+	}
+
+	// Nodes change their reports.
+	tracker.Observe("10.0.1.1:1000", "5.6.7.8:1000")
+	if confirmed := tracker.Confirmed(); len(confirmed) != 1 || confirmed[0].String() != "5.6.7.8" {
+		t.Fatal("New address should be confirmed", confirmed)
+	}
+}
+
+func TestConfirmedIPv6Reporters(t *testing.T) {
+	tracker := New()
+	for i := 0; i < 3; i++ {
+		tracker.Observe(fmt.Sprintf("[2001:db8:0:%x::1]:1000", i), "1.2.3.4:1000")
+	}
+	if confirmed := tracker.Confirmed(); len(confirmed) != 0 {
+		t.Fatal("Reports from a single /48 should count once", confirmed)
+	}
+	for i := 1; i < 3; i++ {
+		tracker.Observe(fmt.Sprintf("[2001:db8:%x::1]:1000", i), "1.2.3.4:1000")
+	}
+	if confirmed := tracker.Confirmed(); len(confirmed) != 1 {
+		t.Fatal("Address should be confirmed", confirmed)
+	}
+}
+
+func TestConfirmedFamilies(t *testing.T) {
+	tracker := New()
+	for i := 0; i < 3; i++ {
+		tracker.Observe(fmt.Sprintf("10.0.%d.1:1000", i), "1.2.3.4:1000")
+		tracker.Observe(fmt.Sprintf("10.1.%d.1:1000", i), "[2001:db8::1]:1000")
+	}
+	if confirmed := tracker.Confirmed(); len(confirmed) != 2 {
+		t.Fatal("Both addresses should be confirmed", confirmed)
+	}
+}
+
+func TestObserveIgnored(t *testing.T) {
+	tracker := New()
+	for i := 0; i < 3; i++ {
+		reporter := fmt.Sprintf("10.0.%d.1:1000", i)
+		tracker.Observe(reporter, "127.0.0.1:1000")
+		tracker.Observe(reporter, "192.168.1.1:1000")
+		tracker.Observe(reporter, "invalid")
+		tracker.Observe(fmt.Sprintf("relay(10.0.%d.1:1000)", i), "1.2.3.4:1000")
+	}
+	if confirmed := tracker.Confirmed(); len(confirmed) != 0 {
+		t.Fatal("Addresses should be ignored", confirmed)
+	}
+}
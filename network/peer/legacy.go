@@ -0,0 +1,116 @@
+package peer
+
+import (
+	"bytes"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+)
+
+// legacyRequest is a request sent to a node which doesn't support the request
+// ids, see protocol.VersionEnvelope. Such nodes respond with regular messages
+// so the response is recognized by its type. FindChannel is answered with
+// a StoreChannel message for each member of the channel followed by a Nodes
+// message, those are combined into a ChannelMembers message.
+type legacyRequest struct {
+	request  proto.Message
+	members  []*message.StoreChannel
+	response chan proto.Message
+	done     bool
+}
+
+// newLegacyRequest returns protocol.ErrRequestsUnsupported if the nodes which
+// don't support the request ids don't understand the request.
+func newLegacyRequest(msg proto.Message) (*legacyRequest, error) {
+	switch msg.(type) {
+	case *message.Ping, *message.FindNode, *message.FindPubKey, *message.FindChannel:
+		return &legacyRequest{
+			request:  msg,
+			response: make(chan proto.Message, 1),
+		}, nil
+	default:
+		return nil, protocol.ErrRequestsUnsupported
+	}
+}
+
+// handle returns true if the message is a part of the response to the
+// request. The response is delivered once it is complete.
+func (r *legacyRequest) handle(msg proto.Message) bool {
+	if r.done {
+		return false
+	}
+	switch request := r.request.(type) {
+	case *message.Ping:
+		if pong, ok := msg.(*message.Pong); ok && pong.GetRandom() == request.GetRandom() {
+			r.respond(msg)
+			return true
+		}
+	case *message.FindNode:
+		if _, ok := msg.(*message.Nodes); ok {
+			r.respond(msg)
+			return true
+		}
+	case *message.FindPubKey:
+		switch pMsg := msg.(type) {
+		case *message.Nodes:
+			r.respond(msg)
+			return true
+		case *message.StorePubKey:
+			// The nodes also send their own keys to other nodes.
+			if isKeyOf(pMsg.GetKey(), request.GetId()) {
+				r.respond(msg)
+				return true
+			}
+		}
+	case *message.FindChannel:
+		switch pMsg := msg.(type) {
+		case *message.StoreChannel:
+			if bytes.Equal(pMsg.GetChannelId(), request.GetChannelId()) {
+				r.members = append(r.members, pMsg)
+				return true
+			}
+		case *message.Nodes:
+			r.respond(&message.ChannelMembers{
+				Members: r.members,
+				Nodes:   pMsg.GetNodes(),
+			})
+			return true
+		}
+	}
+	return false
+}
+
+func (r *legacyRequest) respond(msg proto.Message) {
+	r.done = true
+	r.response <- msg
+}
+
+// isKeyOf returns true if the key belongs to the node with the given id.
+func isKeyOf(key []byte, id node.ID) bool {
+	pubKey, err := crypto.NewPublicKey(key)
+	if err != nil {
+		return false
+	}
+	keyId, err := pubKey.Hash()
+	if err != nil {
+		return false
+	}
+	return node.CompareId(keyId, id)
+}
+
+// legacyResponse converts a response to the messages understood by the nodes
+// which don't support the request ids, see legacyRequest.
+func legacyResponse(msg proto.Message) []proto.Message {
+	members, ok := msg.(*message.ChannelMembers)
+	if !ok {
+		return []proto.Message{msg}
+	}
+	var rv []proto.Message
+	for _, member := range members.GetMembers() {
+		rv = append(rv, member)
+	}
+	return append(rv, &message.Nodes{Nodes: members.GetNodes()})
+}
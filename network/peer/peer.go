@@ -5,8 +5,10 @@ import (
 	"sync"
 
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/mux"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/network/stream"
+	"github.com/boreq/starlight/protocol"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 )
@@ -18,18 +20,55 @@ type Peer interface {
 	// Returns the node's public key.
 	PubKey() crypto.PublicKey
 
+	// Version returns the version of the software reported by the node.
+	Version() string
+
+	// Info returns the information about the node reported by one of the
+	// open streams.
+	Info() node.NodeInfo
+
 	// Sends a message to the node.
 	Send(proto.Message) error
 
 	// Sends a message to the node, returns an error if context is closed.
 	SendWithContext(context.Context, proto.Message) error
 
+	// Request sends a request to the node and waits for the response.
+	// Returns an error if the context is closed before the response is
+	// received. The responses sent by the nodes which don't support the
+	// request ids are recognized by their types, the requests which such
+	// nodes don't understand fail with protocol.ErrRequestsUnsupported.
+	Request(context.Context, proto.Message) (proto.Message, error)
+
+	// Respond sends a response to the request with the given id. If the id
+	// is zero a regular message is sent.
+	Respond(ctx context.Context, requestId uint64, msg proto.Message) error
+
+	// OpenSubstream opens a substream multiplexed over one of the open
+	// streams. The protocol is reported to the node. Returns
+	// stream.ErrSubstreamsUnsupported if none of the open streams supports
+	// the substreams.
+	OpenSubstream(ctx context.Context, protocol string) (mux.Substream, error)
+
+	// HandleResponse passes a received response to the caller waiting for
+	// it. Returns an error if nobody is waiting for this response.
+	HandleResponse(protocol.Envelope) error
+
+	// HandleLegacyResponse passes a message received over a stream which
+	// doesn't support the request ids to the caller waiting for a response
+	// to a request sent over such a stream. Returns false if the message
+	// isn't a response to any of the requests.
+	HandleLegacyResponse(proto.Message) bool
+
 	// Cleanup removes closed streams from this peer.
 	Cleanup()
 
 	// Closed returns true if all streams have been closed.
 	Closed() bool
 
+	// Close closes all streams.
+	Close()
+
 	// AddStream adds a stream used for sending data to this peer.
 	AddStream(stream stream.Stream) error
 }
@@ -39,15 +78,20 @@ func New(s stream.Stream) Peer {
 		id:      s.Info().Id,
 		pubKey:  s.PubKey(),
 		streams: []stream.Stream{s},
+		pending: make(map[uint64]chan proto.Message),
 	}
 	return rv
 }
 
 type peer struct {
-	id           node.ID
-	pubKey       crypto.PublicKey
-	streams      []stream.Stream
-	streamsMutex sync.Mutex
+	id            node.ID
+	pubKey        crypto.PublicKey
+	streams       []stream.Stream
+	streamsMutex  sync.Mutex
+	nextId        uint64
+	pending       map[uint64]chan proto.Message
+	legacyPending []*legacyRequest
+	pendingMutex  sync.Mutex
 }
 
 func (p *peer) AddStream(s stream.Stream) error {
@@ -69,6 +113,30 @@ func (p *peer) PubKey() crypto.PublicKey {
 	return p.pubKey
 }
 
+func (p *peer) Version() string {
+	p.streamsMutex.Lock()
+	defer p.streamsMutex.Unlock()
+
+	for _, s := range p.streams {
+		if !s.Closed() {
+			return s.Version()
+		}
+	}
+	return ""
+}
+
+func (p *peer) Info() node.NodeInfo {
+	p.streamsMutex.Lock()
+	defer p.streamsMutex.Unlock()
+
+	for _, s := range p.streams {
+		if !s.Closed() {
+			return s.Info()
+		}
+	}
+	return node.NodeInfo{Id: p.id}
+}
+
 func (p *peer) Send(msg proto.Message) error {
 	p.streamsMutex.Lock()
 	defer p.streamsMutex.Unlock()
@@ -93,6 +161,176 @@ func (p *peer) SendWithContext(ctx context.Context, msg proto.Message) error {
 	return errors.New("no open streams available")
 }
 
+func (p *peer) OpenSubstream(ctx context.Context, name string) (mux.Substream, error) {
+	p.streamsMutex.Lock()
+	defer p.streamsMutex.Unlock()
+
+	err := errors.New("no open streams available")
+	for _, s := range p.streams {
+		if s.Closed() {
+			continue
+		}
+		if s.ProtocolVersion() < protocol.VersionMux {
+			err = stream.ErrSubstreamsUnsupported
+			continue
+		}
+		return s.OpenSubstream(ctx, name)
+	}
+	return nil, err
+}
+
+func (p *peer) Request(ctx context.Context, msg proto.Message) (proto.Message, error) {
+	s, err := p.openStream()
+	if err != nil {
+		return nil, err
+	}
+	if s.ProtocolVersion() < protocol.VersionEnvelope {
+		return p.legacyRequest(ctx, s, msg)
+	}
+
+	id, c := p.registerRequest()
+	defer p.unregisterRequest(id)
+
+	env := protocol.Envelope{
+		RequestId: id,
+		Message:   msg,
+	}
+	if err := s.SendEnvelope(ctx, env); err != nil {
+		return nil, errors.Wrap(err, "send failed")
+	}
+
+	select {
+	case response := <-c:
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// legacyRequest sends a request over a stream which doesn't support the
+// request ids and waits for a message which looks like the response to it.
+func (p *peer) legacyRequest(ctx context.Context, s stream.Stream, msg proto.Message) (proto.Message, error) {
+	r, err := newLegacyRequest(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.pendingMutex.Lock()
+	p.legacyPending = append(p.legacyPending, r)
+	p.pendingMutex.Unlock()
+	defer p.unregisterLegacyRequest(r)
+
+	if err := s.SendWithContext(ctx, msg); err != nil {
+		return nil, errors.Wrap(err, "send failed")
+	}
+
+	select {
+	case response := <-r.response:
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Respond answers the requests received over the streams which don't support
+// the request ids with regular messages.
+func (p *peer) Respond(ctx context.Context, requestId uint64, msg proto.Message) error {
+	s, err := p.openStream()
+	if err != nil {
+		return err
+	}
+	if s.ProtocolVersion() < protocol.VersionEnvelope {
+		for _, m := range legacyResponse(msg) {
+			if err := s.SendWithContext(ctx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if requestId == 0 {
+		return s.SendWithContext(ctx, msg)
+	}
+
+	env := protocol.Envelope{
+		RequestId: requestId,
+		Response:  true,
+		Message:   msg,
+	}
+	return s.SendEnvelope(ctx, env)
+}
+
+func (p *peer) HandleResponse(env protocol.Envelope) error {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	c, ok := p.pending[env.RequestId]
+	if !ok {
+		return errors.Errorf("unexpected response with request id %d", env.RequestId)
+	}
+	delete(p.pending, env.RequestId)
+	c <- env.Message
+	return nil
+}
+
+func (p *peer) HandleLegacyResponse(msg proto.Message) bool {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	for _, r := range p.legacyPending {
+		if r.handle(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerRequest allocates a new request id and creates a channel over which
+// the response will be delivered. The channel is buffered so that
+// HandleResponse never blocks.
+func (p *peer) registerRequest() (uint64, chan proto.Message) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	// Zero is reserved for messages which aren't requests.
+	p.nextId++
+	if p.nextId == 0 {
+		p.nextId++
+	}
+	c := make(chan proto.Message, 1)
+	p.pending[p.nextId] = c
+	return p.nextId, c
+}
+
+func (p *peer) unregisterRequest(id uint64) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	delete(p.pending, id)
+}
+
+func (p *peer) unregisterLegacyRequest(r *legacyRequest) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	for i, pending := range p.legacyPending {
+		if pending == r {
+			p.legacyPending = append(p.legacyPending[:i], p.legacyPending[i+1:]...)
+			return
+		}
+	}
+}
+
+// openStream returns one of the open streams.
+func (p *peer) openStream() (stream.Stream, error) {
+	p.streamsMutex.Lock()
+	defer p.streamsMutex.Unlock()
+
+	for _, s := range p.streams {
+		if !s.Closed() {
+			return s, nil
+		}
+	}
+	return nil, errors.New("no open streams available")
+}
+
 func (p *peer) Closed() bool {
 	p.streamsMutex.Lock()
 	defer p.streamsMutex.Unlock()
@@ -105,6 +343,15 @@ func (p *peer) Closed() bool {
 	return true
 }
 
+func (p *peer) Close() {
+	p.streamsMutex.Lock()
+	defer p.streamsMutex.Unlock()
+
+	for _, s := range p.streams {
+		s.Close()
+	}
+}
+
 func (p *peer) Cleanup() {
 	p.streamsMutex.Lock()
 	defer p.streamsMutex.Unlock()
@@ -0,0 +1,143 @@
+package peer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/network/stream"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+)
+
+// testStream records the messages sent over it.
+type testStream struct {
+	stream.Stream
+	version uint32
+	sent    chan protocol.Envelope
+}
+
+func newTestStream(version uint32) *testStream {
+	return &testStream{
+		version: version,
+		sent:    make(chan protocol.Envelope, 10),
+	}
+}
+
+func (s *testStream) Info() node.NodeInfo {
+	return node.NodeInfo{Id: node.ID{1}}
+}
+
+func (s *testStream) PubKey() crypto.PublicKey {
+	return nil
+}
+
+func (s *testStream) ProtocolVersion() uint32 {
+	return s.version
+}
+
+func (s *testStream) Closed() bool {
+	return false
+}
+
+func (s *testStream) SendWithContext(ctx context.Context, msg proto.Message) error {
+	return s.SendEnvelope(ctx, protocol.Envelope{Message: msg})
+}
+
+func (s *testStream) SendEnvelope(ctx context.Context, env protocol.Envelope) error {
+	s.sent <- env
+	return nil
+}
+
+func TestRequestLegacy(t *testing.T) {
+	s := newTestStream(protocol.VersionLegacy)
+	p := New(s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	channelId := []byte("channel")
+	go func() {
+		env := <-s.sent
+		if env.RequestId != 0 {
+			t.Errorf("Request id %d sent to a legacy node", env.RequestId)
+		}
+		if p.HandleLegacyResponse(&message.Pong{}) {
+			t.Error("Unrelated message was accepted")
+		}
+		for _, msg := range []proto.Message{
+			&message.StoreChannel{ChannelId: channelId},
+			&message.Nodes{Nodes: []*message.Nodes_NodeInfo{{Id: []byte{2}}}},
+		} {
+			if !p.HandleLegacyResponse(msg) {
+				t.Errorf("Response %T was rejected", msg)
+			}
+		}
+	}()
+
+	response, err := p.Request(ctx, &message.FindChannel{ChannelId: channelId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, ok := response.(*message.ChannelMembers)
+	if !ok {
+		t.Fatalf("Invalid response %T", response)
+	}
+	if len(members.GetMembers()) != 1 || len(members.GetNodes()) != 1 {
+		t.Fatal("Invalid members")
+	}
+	if p.HandleLegacyResponse(&message.Nodes{}) {
+		t.Fatal("Response was accepted after the request completed")
+	}
+}
+
+func TestRequestLegacyUnsupported(t *testing.T) {
+	p := New(newTestStream(protocol.VersionLegacy))
+	if _, err := p.Request(context.Background(), &message.RelayReserve{}); err != protocol.ErrRequestsUnsupported {
+		t.Fatalf("Invalid error %v", err)
+	}
+}
+
+func TestRespondLegacy(t *testing.T) {
+	s := newTestStream(protocol.VersionLegacy)
+	p := New(s)
+
+	response := &message.ChannelMembers{
+		Members: []*message.StoreChannel{{}, {}},
+	}
+	if err := p.Respond(context.Background(), 0, response); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []proto.Message{&message.StoreChannel{}, &message.StoreChannel{}, &message.Nodes{}} {
+		env := <-s.sent
+		if env.Response || env.RequestId != 0 {
+			t.Fatal("Response sent as a response")
+		}
+		if proto.MessageName(env.Message) != proto.MessageName(expected) {
+			t.Fatalf("Sent %T instead of %T", env.Message, expected)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	s := newTestStream(protocol.VersionEnvelope)
+	p := New(s)
+
+	go func() {
+		env := <-s.sent
+		if err := p.HandleResponse(protocol.Envelope{RequestId: env.RequestId, Response: true, Message: &message.Pong{}}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	response, err := p.Request(context.Background(), &message.Ping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response.(*message.Pong); !ok {
+		t.Fatalf("Invalid response %T", response)
+	}
+}
@@ -0,0 +1,360 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/network/peer"
+	"github.com/boreq/starlight/network/relay"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// relayTimeout limits the time needed to establish a circuit through a relay.
+const relayTimeout = 10 * time.Second
+
+// refreshRelaysEvery specifies how often the node checks if it should reserve
+// slots on the relays.
+const refreshRelaysEvery = 1 * time.Minute
+
+// usedRelaysLimit is the number of relays the local node tries to reserve
+// a slot on if it can't accept incoming connections.
+const usedRelaysLimit = 3
+
+// reservationsLimit is the max number of nodes which can be relayed by the
+// local node.
+const reservationsLimit = 32
+
+// circuitsLimit is the max number of circuits which can be relayed by the
+// local node at the same time.
+const circuitsLimit = 64
+
+// tokenLength is the length of the tokens used to match the connections
+// established by the relayed nodes with the pending circuits.
+const tokenLength = 16
+
+func newRelays(n *network) *relays {
+	return &relays{
+		n:        n,
+		reserved: make(map[string]peer.Peer),
+		pending:  make(map[string]chan net.Conn),
+		used:     make(map[string]usedRelay),
+	}
+}
+
+// relays implements both sides of the relay protocol: it relays the
+// connections to the nodes which reserved a slot on the local node and
+// reserves slots on other nodes if the local node can't accept incoming
+// connections.
+type relays struct {
+	n *network
+
+	// reserved contains the nodes relayed by the local node.
+	reserved map[string]peer.Peer
+
+	// pending contains the circuits awaiting the connection from the
+	// relayed node.
+	pending map[string]chan net.Conn
+
+	// circuits is the number of open circuits.
+	circuits int
+
+	// used contains the relays which relay the connections to the local
+	// node.
+	used map[string]usedRelay
+
+	mutex sync.Mutex
+}
+
+type usedRelay struct {
+	peer      peer.Peer
+	addresses []address.Address
+}
+
+// run periodically reserves slots on the relays.
+func (r *relays) run() {
+	for {
+		select {
+		case <-time.After(refreshRelaysEvery):
+			r.refresh()
+		case <-r.n.ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh forgets the relays to which the connection was lost and reserves
+// slots on new relays if the local node needs them. Relays are selected from
+// the connected nodes which report globally reachable addresses.
+func (r *relays) refresh() {
+	r.mutex.Lock()
+	for key, u := range r.used {
+		if u.peer.Closed() {
+			log.Debugf("relays: lost relay %s", u.peer.Id())
+			delete(r.used, key)
+		}
+	}
+	missing := usedRelaysLimit - len(r.used)
+	r.mutex.Unlock()
+
+	if missing <= 0 || !r.n.needsRelay() {
+		return
+	}
+
+	r.n.peersMutex.Lock()
+	peers := make([]peer.Peer, len(r.n.peers))
+	copy(peers, r.n.peers)
+	r.n.peersMutex.Unlock()
+
+	for _, p := range peers {
+		if missing <= 0 {
+			return
+		}
+		if p.Closed() || r.isUsed(p.Id()) {
+			continue
+		}
+		addresses := relayAddresses(p.Info().Addresses)
+		if len(addresses) == 0 {
+			continue
+		}
+		if err := r.reserve(p); err != nil {
+			log.Debugf("relays: reservation on %s failed: %s", p.Id(), err)
+			continue
+		}
+		log.Printf("Using relay %s", p.Id())
+		r.mutex.Lock()
+		r.used[p.Id().String()] = usedRelay{peer: p, addresses: addresses}
+		r.mutex.Unlock()
+		missing--
+	}
+}
+
+// relayAddresses returns the addresses under which the relay should be
+// reachable by any node.
+func relayAddresses(addresses []address.Address) []address.Address {
+	var rv []address.Address
+	for _, a := range addresses {
+		if !a.IsRelay() && a.Scope() == address.ScopeGlobal {
+			rv = append(rv, a)
+		}
+	}
+	return rv
+}
+
+func (r *relays) reserve(p peer.Peer) error {
+	ctx, cancel := context.WithTimeout(r.n.ctx, relayTimeout)
+	defer cancel()
+
+	response, err := p.Request(ctx, &message.RelayReserve{})
+	if err != nil {
+		return err
+	}
+	reservation, ok := response.(*message.RelayReservation)
+	if !ok {
+		return errors.Errorf("unexpected response %T", response)
+	}
+	if !reservation.GetAccepted() {
+		return errors.New("reservation rejected")
+	}
+	return nil
+}
+
+func (r *relays) isUsed(id node.ID) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.used[id.String()]
+	return ok
+}
+
+// addresses returns the relay addresses of the local node.
+func (r *relays) addresses() []address.Address {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var rv []address.Address
+	for _, u := range r.used {
+		if u.peer.Closed() {
+			continue
+		}
+		for _, a := range u.addresses {
+			rv = append(rv, a.WithRelay(u.peer.Id().String()))
+		}
+	}
+	return rv
+}
+
+// handleMessage handles the messages of the relay protocol. Returns false if
+// the message is not related to relaying.
+func (r *relays) handleMessage(p peer.Peer, env protocol.Envelope) bool {
+	switch msg := env.Message.(type) {
+	case *message.RelayReserve:
+		accepted := r.addReservation(p)
+		response := &message.RelayReservation{Accepted: &accepted}
+		ctx, cancel := context.WithTimeout(r.n.ctx, relayTimeout)
+		defer cancel()
+		if err := p.Respond(ctx, env.RequestId, response); err != nil {
+			log.Debugf("relays: could not respond to %s: %s", p.Id(), err)
+		}
+		return true
+	case *message.RelayConnect:
+		r.mutex.Lock()
+		u, ok := r.used[p.Id().String()]
+		r.mutex.Unlock()
+		if !ok {
+			log.Debugf("relays: unexpected connect from %s", p.Id())
+			return true
+		}
+		go r.acceptCircuit(u, msg.GetToken())
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *relays) addReservation(p peer.Peer) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, reserved := range r.reserved {
+		if reserved.Closed() {
+			delete(r.reserved, key)
+		}
+	}
+	if _, ok := r.reserved[p.Id().String()]; !ok && len(r.reserved) >= reservationsLimit {
+		return false
+	}
+	r.reserved[p.Id().String()] = p
+	return true
+}
+
+// acceptCircuit dials the relay back in order to accept an incoming circuit.
+func (r *relays) acceptCircuit(u usedRelay, token []byte) {
+	for _, a := range u.addresses {
+		conn, err := r.n.dialAddress(r.n.ctx, a)
+		if err != nil {
+			log.Debugf("relays: could not dial relay %s on %s: %s", u.peer.Id(), a, err)
+			continue
+		}
+		if err := r.sendPreamble(conn, relay.Accept, token); err != nil {
+			log.Debugf("relays: could not accept a circuit from %s: %s", u.peer.Id(), err)
+			conn.Close()
+			return
+		}
+		r.n.newConnection(r.n.ctx, relay.NewConn(conn), false)
+		return
+	}
+}
+
+// dial establishes a connection with a node through a relay.
+func (r *relays) dial(ctx context.Context, a address.Address, id node.ID) (net.Conn, error) {
+	conn, err := r.n.dialAddress(ctx, a.RelayAddress())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not dial the relay")
+	}
+	if err := r.sendPreamble(conn, relay.Connect, id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return relay.NewConn(conn), nil
+}
+
+// sendPreamble sends the preamble to the relay and awaits the status.
+func (r *relays) sendPreamble(conn net.Conn, kind relay.Kind, payload []byte) error {
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := relay.WritePreamble(conn, relay.Preamble{Kind: kind, Payload: payload}); err != nil {
+		return errors.Wrap(err, "could not send the preamble")
+	}
+	return relay.ReadStatus(conn)
+}
+
+// handleConn handles an incoming connection which started with a preamble.
+func (r *relays) handleConn(conn net.Conn, p *relay.Preamble) {
+	switch p.Kind {
+	case relay.Connect:
+		if err := r.relay(conn, p.Payload); err != nil {
+			log.Debugf("relays: could not relay to %s: %s", node.ID(p.Payload), err)
+			relay.WriteStatus(conn, false)
+			conn.Close()
+		}
+	case relay.Accept:
+		r.mutex.Lock()
+		c, ok := r.pending[hex.EncodeToString(p.Payload)]
+		delete(r.pending, hex.EncodeToString(p.Payload))
+		r.mutex.Unlock()
+		if !ok {
+			relay.WriteStatus(conn, false)
+			conn.Close()
+			return
+		}
+		c <- conn
+	default:
+		conn.Close()
+	}
+}
+
+// relay asks the relayed node to dial the local node back and splices both
+// connections.
+func (r *relays) relay(conn net.Conn, id node.ID) error {
+	token := make([]byte, tokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return errors.Wrap(err, "could not generate a token")
+	}
+	key := hex.EncodeToString(token)
+	c := make(chan net.Conn, 1)
+
+	r.mutex.Lock()
+	p, ok := r.reserved[id.String()]
+	if !ok || p.Closed() {
+		r.mutex.Unlock()
+		return errors.New("node is not relayed")
+	}
+	if r.circuits >= circuitsLimit {
+		r.mutex.Unlock()
+		return errors.New("too many circuits")
+	}
+	r.circuits++
+	r.pending[key] = c
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		r.circuits--
+		delete(r.pending, key)
+		r.mutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(r.n.ctx, relayTimeout)
+	defer cancel()
+
+	if err := p.SendWithContext(ctx, &message.RelayConnect{Token: token}); err != nil {
+		return errors.Wrap(err, "could not contact the relayed node")
+	}
+
+	var relayedConn net.Conn
+	select {
+	case relayedConn = <-c:
+	case <-ctx.Done():
+		return errors.New("relayed node didn't connect")
+	}
+
+	if err := relay.WriteStatus(relayedConn, true); err != nil {
+		relayedConn.Close()
+		return errors.Wrap(err, "could not send the status to the relayed node")
+	}
+	if err := relay.WriteStatus(conn, true); err != nil {
+		relayedConn.Close()
+		return errors.Wrap(err, "could not send the status")
+	}
+	log.Debugf("relays: relaying to %s", id)
+	relay.Splice(conn, relayedConn)
+	return nil
+}
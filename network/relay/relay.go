@@ -0,0 +1,194 @@
+// Package relay implements the low level part of the relay protocol which
+// allows the nodes that can't accept incoming connections to be reached
+// through publicly reachable nodes.
+//
+// A node which wants to connect to a relayed node dials the relay and instead
+// of starting the handshake sends a preamble containing the id of the relayed
+// node. The relay asks the relayed node to dial it back and the relayed node
+// sends a preamble containing the token received from the relay. The relay
+// then splices both connections and the nodes perform the handshake over the
+// resulting circuit. The relay only forwards the data encrypted by the nodes
+// and can't read it.
+//
+// Structure of the preamble:
+//
+//	LEN      TYPE      DESCRIPTION
+//	4        []byte    Magic, see magic.
+//	1        uint8     Kind, see Kind.
+//	1        uint8     Length of the payload.
+//	?        []byte    Payload, the id of the relayed node or the token.
+//
+// After receiving the preamble the relay responds with a single status byte.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// magic starts every preamble. The first byte ensures that the preamble can't
+// be confused with the beginning of a regular connection as the messages
+// exchanged during the handshake are prefixed with their length which can't
+// be that large.
+var magic = []byte{0xff, 'S', 'L', 'R'}
+
+// Kind is the type of the preamble.
+type Kind uint8
+
+const (
+	// Connect is sent by a node which wants to connect to a relayed node.
+	// The payload contains the id of the relayed node.
+	Connect Kind = 1
+
+	// Accept is sent by a relayed node which dials the relay back. The
+	// payload contains the token received from the relay.
+	Accept Kind = 2
+)
+
+const (
+	statusOk     byte = 0
+	statusFailed byte = 1
+)
+
+// preambleTimeout specifies how much time the dialing node has to send the
+// beginning of the preamble or the handshake.
+const preambleTimeout = 10 * time.Second
+
+// Preamble is sent at the beginning of the connections used by the relay
+// protocol.
+type Preamble struct {
+	Kind    Kind
+	Payload []byte
+}
+
+// WritePreamble sends the preamble.
+func WritePreamble(w io.Writer, p Preamble) error {
+	if len(p.Payload) > 255 {
+		return errors.New("payload too long")
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(magic)
+	buf.WriteByte(byte(p.Kind))
+	buf.WriteByte(byte(len(p.Payload)))
+	buf.Write(p.Payload)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadPreamble checks if the incoming connection starts with a preamble. The
+// returned preamble is nil if this is a regular connection. The returned
+// connection must be used instead of the original one since a part of its
+// data may have been already consumed.
+func ReadPreamble(conn net.Conn) (net.Conn, *Preamble, error) {
+	r := bufio.NewReader(conn)
+	rv := &bufferedConn{conn, r}
+
+	conn.SetReadDeadline(time.Now().Add(preambleTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	start, err := r.Peek(len(magic))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not read the beginning of the connection")
+	}
+	if !bytes.Equal(start, magic) {
+		return rv, nil, nil
+	}
+	r.Discard(len(magic))
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, errors.Wrap(err, "could not read the preamble header")
+	}
+	p := &Preamble{
+		Kind:    Kind(header[0]),
+		Payload: make([]byte, header[1]),
+	}
+	if _, err := io.ReadFull(r, p.Payload); err != nil {
+		return nil, nil, errors.Wrap(err, "could not read the preamble payload")
+	}
+	return rv, p, nil
+}
+
+// WriteStatus informs the other side if the relay succeeded.
+func WriteStatus(w io.Writer, ok bool) error {
+	status := statusFailed
+	if ok {
+		status = statusOk
+	}
+	_, err := w.Write([]byte{status})
+	return err
+}
+
+// ReadStatus returns an error if the relay failed.
+func ReadStatus(r io.Reader) error {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return errors.Wrap(err, "could not read the status")
+	}
+	if status[0] != statusOk {
+		return errors.New("relay failed")
+	}
+	return nil
+}
+
+// Splice forwards the data between the connections until one of them is
+// closed. Both connections are closed when this function returns.
+func Splice(a, b net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	forward := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		a.Close()
+		b.Close()
+	}
+	go forward(a, b)
+	go forward(b, a)
+	wg.Wait()
+}
+
+// NewConn wraps a connection established through a relay. The remote address
+// of the returned connection indicates that the connection is relayed so that
+// the address of the relay isn't confused with the address of the node.
+func NewConn(conn net.Conn) net.Conn {
+	return &relayedConn{conn}
+}
+
+// Addr is the remote address of the relayed connections.
+type Addr struct {
+	// Relay is the address of the relay.
+	Relay net.Addr
+}
+
+func (a Addr) Network() string {
+	return "relay"
+}
+
+func (a Addr) String() string {
+	return "relay(" + a.Relay.String() + ")"
+}
+
+type relayedConn struct {
+	net.Conn
+}
+
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return Addr{c.Conn.RemoteAddr()}
+}
+
+// bufferedConn reads the data using a buffered reader which may already
+// contain a part of the data received by the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
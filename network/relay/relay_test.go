@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadPreamble(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		WritePreamble(a, Preamble{Kind: Connect, Payload: []byte{1, 2, 3}})
+		a.Write([]byte("data"))
+	}()
+
+	conn, p, err := ReadPreamble(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Kind != Connect || !bytes.Equal(p.Payload, []byte{1, 2, 3}) {
+		t.Fatalf("Invalid preamble %#v", p)
+	}
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Fatal("Invalid data", string(data))
+	}
+}
+
+func TestReadPreambleRegular(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go a.Write([]byte{0, 0, 0, 4, 'd', 'a', 't', 'a'})
+
+	conn, p, err := ReadPreamble(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != nil {
+		t.Fatalf("Unexpected preamble %#v", p)
+	}
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data[4:]) != "data" {
+		t.Fatal("Data was consumed", data)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	buf := &bytes.Buffer{}
+	WriteStatus(buf, true)
+	WriteStatus(buf, false)
+	if err := ReadStatus(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadStatus(buf); err == nil {
+		t.Fatal("Status should indicate a failure")
+	}
+}
+
+func TestSplice(t *testing.T) {
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	go Splice(a2, b1)
+
+	go a1.Write([]byte("ping"))
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(b2, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ping" {
+		t.Fatal("Invalid data", string(data))
+	}
+
+	go b2.Write([]byte("pong"))
+	if _, err := io.ReadFull(a1, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "pong" {
+		t.Fatal("Invalid data", string(data))
+	}
+
+	// Closing one side should close the circuit.
+	a1.Close()
+	if _, err := b2.Read(data); err == nil {
+		t.Fatal("Circuit should be closed")
+	}
+}
@@ -0,0 +1,371 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/boreq/starlight/transport"
+	"github.com/boreq/starlight/transport/basic"
+	"github.com/boreq/starlight/transport/secure"
+	"github.com/boreq/starlight/utils"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The parameters supported by the nodes which predate the protocol versions.
+const (
+	baselineCurves  = "P224,P256,P384,P521"
+	baselineHashes  = "SHA256,SHA512"
+	baselineCiphers = "AES-256,AES-128"
+)
+
+// baselinePeer speaks the wire format of the nodes which predate the protocol
+// versions: the Init messages don't list the handshakes or the protocol
+// version, the handshake uses the Handshake and ConfirmHandshake messages,
+// the Identity message contains the host:port addresses and the messages are
+// sent without the envelopes directly over the secure layer.
+type baselinePeer struct {
+	conn    net.Conn
+	wrapper transport.Wrapper
+	id      node.ID
+}
+
+func newBaselinePeer(conn net.Conn) *baselinePeer {
+	b := &baselinePeer{
+		conn:    conn,
+		wrapper: transport.NewWrapper(conn, conn),
+	}
+	b.wrapper.AddLayer(basic.New(uint32(maxMessageSize)))
+	return b
+}
+
+func (b *baselinePeer) send(msg proto.Message) error {
+	data, err := protocol.Encode(protocol.VersionLegacy, protocol.Envelope{Message: msg})
+	if err != nil {
+		return err
+	}
+	return b.wrapper.Send(data)
+}
+
+func (b *baselinePeer) receive() (proto.Message, error) {
+	data, err := b.wrapper.Receive()
+	if err != nil {
+		return nil, err
+	}
+	env, err := protocol.Decode(protocol.VersionLegacy, data)
+	if err != nil {
+		return nil, err
+	}
+	return env.Message, nil
+}
+
+func (b *baselinePeer) exchange(msg proto.Message) (proto.Message, error) {
+	errC := make(chan error, 1)
+	go func() {
+		errC <- b.send(msg)
+	}()
+	received, err := b.receive()
+	if err != nil {
+		return nil, errors.Wrap(err, "receive failed")
+	}
+	if err := <-errC; err != nil {
+		return nil, errors.Wrap(err, "send failed")
+	}
+	return received, nil
+}
+
+func (b *baselinePeer) handshake(iden node.Identity) error {
+	pubKeyBytes, err := iden.PubKey.Bytes()
+	if err != nil {
+		return err
+	}
+	localNonce := make([]byte, nonceSize)
+	if err := crypto.GenerateNonce(localNonce); err != nil {
+		return err
+	}
+	curves, hashes, ciphers := baselineCurves, baselineHashes, baselineCiphers
+	localInit := &message.Init{
+		PubKey:           pubKeyBytes,
+		Nonce:            localNonce,
+		SupportedCurves:  &curves,
+		SupportedHashes:  &hashes,
+		SupportedCiphers: &ciphers,
+	}
+	msg, err := b.exchange(localInit)
+	if err != nil {
+		return err
+	}
+	remoteInit, ok := msg.(*message.Init)
+	if !ok {
+		return errors.Errorf("received %T instead of Init", msg)
+	}
+
+	remotePub, err := crypto.NewPublicKey(remoteInit.GetPubKey())
+	if err != nil {
+		return err
+	}
+	remoteId, err := remotePub.Hash()
+	if err != nil {
+		return err
+	}
+	order, err := utils.Compare(iden.Id, remoteId)
+	if err != nil {
+		return err
+	}
+	var selectedCurve, selectedHash, selectedCipher string
+	if order > 0 {
+		selectedCurve = selectParam(curves, remoteInit.GetSupportedCurves())
+		selectedHash = selectParam(hashes, remoteInit.GetSupportedHashes())
+		selectedCipher = selectParam(ciphers, remoteInit.GetSupportedCiphers())
+	} else {
+		selectedCurve = selectParam(remoteInit.GetSupportedCurves(), curves)
+		selectedHash = selectParam(remoteInit.GetSupportedHashes(), hashes)
+		selectedCipher = selectParam(remoteInit.GetSupportedCiphers(), ciphers)
+	}
+	if selectedCurve == "" || selectedHash == "" || selectedCipher == "" {
+		return errors.New("selection error")
+	}
+
+	curve, err := crypto.GetCurve(selectedCurve)
+	if err != nil {
+		return err
+	}
+	ephemeralKey, err := crypto.GenerateEphemeralKeypair(curve)
+	if err != nil {
+		return err
+	}
+	ephemeralKeyBytes, err := ephemeralKey.Bytes()
+	if err != nil {
+		return err
+	}
+	msg, err = b.exchange(&message.Handshake{EphemeralPubKey: ephemeralKeyBytes})
+	if err != nil {
+		return err
+	}
+	remoteHandshake, ok := msg.(*message.Handshake)
+	if !ok {
+		return errors.Errorf("received %T instead of Handshake", msg)
+	}
+
+	sharedSecret, err := ephemeralKey.GenerateSharedSecret(remoteHandshake.GetEphemeralPubKey())
+	if err != nil {
+		return err
+	}
+	var salt []byte
+	if order > 0 {
+		salt = append(localNonce, remoteInit.GetNonce()...)
+	} else {
+		salt = append(remoteInit.GetNonce(), localNonce...)
+	}
+	k1, k2, err := crypto.StretchKey(sharedSecret, salt, selectedHash, selectedCipher)
+	if err != nil {
+		return err
+	}
+	if order < 0 {
+		k2, k1 = k1, k2
+	}
+	localIntNonce := binary.BigEndian.Uint32(localNonce)
+	remoteIntNonce := binary.BigEndian.Uint32(remoteInit.GetNonce())
+	layer, err := baselineSecure(k1, k2, localIntNonce, remoteIntNonce, selectedHash, selectedCipher)
+	if err != nil {
+		return err
+	}
+	b.wrapper.AddLayer(layer)
+
+	hash, err := crypto.GetCryptoHash(selectedHash)
+	if err != nil {
+		return err
+	}
+	valueToSign := bytes.Buffer{}
+	first, second := localInit, remoteInit
+	if order < 0 {
+		first, second = second, first
+	}
+	for _, init := range []*message.Init{first, second} {
+		valueToSign.Write(init.GetNonce())
+		valueToSign.Write(init.GetPubKey())
+	}
+	valueToSign.WriteString(selectedCurve)
+	valueToSign.WriteString(selectedHash)
+	valueToSign.WriteString(selectedCipher)
+	sig, err := iden.PrivKey.Sign(valueToSign.Bytes(), hash)
+	if err != nil {
+		return err
+	}
+	msg, err = b.exchange(&message.ConfirmHandshake{Nonce: remoteInit.GetNonce(), Signature: sig})
+	if err != nil {
+		return err
+	}
+	remoteConfirm, ok := msg.(*message.ConfirmHandshake)
+	if !ok {
+		return errors.Errorf("received %T instead of ConfirmHandshake", msg)
+	}
+	if err := remotePub.Validate(valueToSign.Bytes(), remoteConfirm.GetSignature(), hash); err != nil {
+		return err
+	}
+	if !bytes.Equal(remoteConfirm.GetNonce(), localNonce) {
+		return errors.New("received an invalid nonce")
+	}
+	b.id = remoteId
+	return nil
+}
+
+// baselineSecure creates the secure layer which uses the CBC ciphers.
+func baselineSecure(localKeys, remoteKeys crypto.StretchedKeys, localNonce, remoteNonce uint32, hashName string, cipherName string) (transport.Layer, error) {
+	hash, err := crypto.GetCryptoHash(hashName)
+	if err != nil {
+		return nil, err
+	}
+	localCipher, err := crypto.GetCipher(cipherName, localKeys.CipherKey)
+	if err != nil {
+		return nil, err
+	}
+	remoteCipher, err := crypto.GetCipher(cipherName, remoteKeys.CipherKey)
+	if err != nil {
+		return nil, err
+	}
+	encHmac := hmac.New(hash.New, localKeys.MacKey)
+	decHmac := hmac.New(hash.New, remoteKeys.MacKey)
+	encCipher := cipher.NewCBCEncrypter(localCipher, localKeys.IV)
+	decCipher := cipher.NewCBCDecrypter(remoteCipher, remoteKeys.IV)
+	return secure.New(decHmac, encHmac, decCipher, encCipher, remoteNonce, localNonce), nil
+}
+
+// identify exchanges the Identity messages and returns the message sent by
+// the other node.
+func (b *baselinePeer) identify(listenAddresses []string) (*message.Identity, error) {
+	remoteAddr := b.conn.RemoteAddr().String()
+	msg, err := b.exchange(&message.Identity{
+		ListenAddresses:   listenAddresses,
+		ConnectionAddress: &remoteAddr,
+	})
+	if err != nil {
+		return nil, err
+	}
+	identity, ok := msg.(*message.Identity)
+	if !ok {
+		return nil, errors.Errorf("received %T instead of Identity", msg)
+	}
+	return identity, nil
+}
+
+// newBaselineStream creates a stream using New with the other side of the
+// connection handled by a baseline peer. The Identity message received by
+// the baseline peer is returned.
+func newBaselineStream(ctx context.Context, t *testing.T, iden, baselineIden node.Identity, listenAddresses []address.Address) (*stream, *baselinePeer, *message.Identity) {
+	conn, baselineConn := net.Pipe()
+	b := newBaselinePeer(baselineConn)
+
+	identityC := make(chan *message.Identity, 1)
+	errC := make(chan error, 1)
+	go func() {
+		if err := b.handshake(baselineIden); err != nil {
+			errC <- errors.Wrap(err, "handshake failed")
+			return
+		}
+		identity, err := b.identify([]string{"10.0.0.1:1000"})
+		if err != nil {
+			errC <- errors.Wrap(err, "identify failed")
+			return
+		}
+		identityC <- identity
+	}()
+
+	s, err := New(ctx, iden, listenAddresses, conn)
+	if err != nil {
+		baselineConn.Close()
+		t.Fatal(err)
+	}
+	select {
+	case identity := <-identityC:
+		return s.(*stream), b, identity
+	case err := <-errC:
+		s.Close()
+		t.Fatal(err)
+	}
+	return nil, nil, nil
+}
+
+// exchangeBaseline exchanges the messages with a baseline peer.
+func exchangeBaseline(ctx context.Context, s *stream, b *baselinePeer) error {
+	random := uint32(10)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.SendWithContext(ctx, &message.Ping{Random: &random})
+	}()
+	msg, err := b.receive()
+	if err != nil {
+		return errors.Wrap(err, "baseline receive failed")
+	}
+	if ping, ok := msg.(*message.Ping); !ok || ping.GetRandom() != random {
+		return errors.Errorf("invalid message %v", msg)
+	}
+	if err := <-errC; err != nil {
+		return errors.Wrap(err, "send failed")
+	}
+
+	go func() {
+		errC <- b.send(&message.Pong{Random: &random})
+	}()
+	msg, err = s.ReceiveWithContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "receive failed")
+	}
+	if pong, ok := msg.(*message.Pong); !ok || pong.GetRandom() != random {
+		return errors.Errorf("invalid message %v", msg)
+	}
+	return errors.Wrap(<-errC, "baseline send failed")
+}
+
+// TestNewBaseline checks if the nodes can communicate with the nodes which
+// predate the protocol versions and don't multiplex the messages.
+func TestNewBaseline(t *testing.T) {
+	idenA, idenB := getTestIdentities(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tcp, err := address.New(address.TCP, "10.0.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quic, err := address.New(address.QUIC, "10.0.0.2:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, b, identity := newBaselineStream(ctx, t, idenA, idenB, []address.Address{tcp, quic})
+	defer s.Close()
+
+	if s.protocolVersion != protocol.VersionLegacy {
+		t.Fatal("Invalid protocol version", s.protocolVersion)
+	}
+	if s.session != nil {
+		t.Fatal("Session created with a baseline node")
+	}
+	if s.rekeyer != nil {
+		t.Fatal("Keys are replaced with a baseline node")
+	}
+	if _, err := s.OpenSubstream(ctx, "test"); err != ErrSubstreamsUnsupported {
+		t.Fatal("Invalid error", err)
+	}
+	if addresses := identity.GetListenAddresses(); len(addresses) != 1 || addresses[0] != "10.0.0.2:1000" {
+		t.Fatal("Invalid listen addresses", addresses)
+	}
+	if addresses := s.Info().Addresses; len(addresses) != 1 || addresses[0].HostPort() != "10.0.0.1:1000" {
+		t.Fatal("Invalid addresses", addresses)
+	}
+	if err := exchangeBaseline(ctx, s, b); err != nil {
+		t.Fatal(err)
+	}
+}
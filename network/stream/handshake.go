@@ -8,11 +8,15 @@ import (
 	"strings"
 
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
 	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol"
 	"github.com/boreq/starlight/protocol/message"
 	"github.com/boreq/starlight/transport"
+	"github.com/boreq/starlight/transport/aead"
 	"github.com/boreq/starlight/transport/secure"
 	"github.com/boreq/starlight/utils"
+	"github.com/boreq/starlight/utils/version"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -34,7 +38,14 @@ func selectParam(a, b string) string {
 	return ""
 }
 
+// newSecure creates a layer which encrypts the data using the selected
+// cipher. The AEAD ciphers don't use the nonces as the message counters are
+// derived from the IVs instead.
 func newSecure(localKeys, remoteKeys crypto.StretchedKeys, localNonce, remoteNonce uint32, hashName string, cipherName string) (transport.Layer, error) {
+	if crypto.IsAEAD(cipherName) {
+		return newAEAD(localKeys, remoteKeys, cipherName)
+	}
+
 	hash, err := crypto.GetCryptoHash(hashName)
 	if err != nil {
 		return nil, err
@@ -58,6 +69,20 @@ func newSecure(localKeys, remoteKeys crypto.StretchedKeys, localNonce, remoteNon
 	return layer, nil
 }
 
+func newAEAD(localKeys, remoteKeys crypto.StretchedKeys, cipherName string) (transport.Layer, error) {
+	encCipher, err := crypto.GetAEAD(cipherName, localKeys.CipherKey)
+	if err != nil {
+		return nil, err
+	}
+
+	decCipher, err := crypto.GetAEAD(cipherName, remoteKeys.CipherKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.New(decCipher, encCipher, remoteKeys.IV, localKeys.IV)
+}
+
 // nonceSize is the size of the nonce used to calculate the shared secret. As
 // the same nonce is converted to the uint32 nonce used by the secure encoder
 // to prevent replay attacks, this value must be equal or higher than 32/8=4.
@@ -70,12 +95,9 @@ const nonceSize = 20
 // incomming message. As the messages are small this could work due to OS
 // buffering and the way the network stack works but it is a dangerous gamble.
 func (p *stream) sendAsyncWithContext(ctx context.Context, msg proto.Message) <-chan error {
-	errC := make(chan error)
+	errC := make(chan error, 1)
 	go func() {
-		err := p.SendWithContext(ctx, msg)
-		if err != nil {
-			errC <- errors.Wrap(err, "could not send with context")
-		}
+		errC <- errors.Wrap(p.SendWithContext(ctx, msg), "could not send with context")
 	}()
 	return errC
 }
@@ -100,19 +122,27 @@ func (p *stream) receiveAsyncWithContext(ctx context.Context) (<-chan proto.Mess
 func (p *stream) exchangeMessages(ctx context.Context, msg proto.Message) (proto.Message, error) {
 	sendErrC := p.sendAsyncWithContext(ctx, msg)
 	msgC, recErrC := p.receiveAsyncWithContext(ctx)
-	select {
-	case err := <-sendErrC:
-		return nil, errors.Wrap(err, "async send failed")
-	case err := <-recErrC:
-		return nil, errors.Wrap(err, "async receive failed")
-	case msg := <-msgC:
-		return msg, nil
+	var received proto.Message
+	for sent := false; !sent || received == nil; {
+		select {
+		case err := <-sendErrC:
+			if err != nil {
+				return nil, errors.Wrap(err, "async send failed")
+			}
+			sent = true
+		case err := <-recErrC:
+			return nil, errors.Wrap(err, "async receive failed")
+		case msg := <-msgC:
+			received = msg
+		}
 	}
+	return received, nil
 }
 
 // The ride never ends. Performs a handshake, sets up a secure encoder and peer
-// id.
-func (p *stream) handshake(ctx context.Context, iden node.Identity) error {
+// id. The handshakes parameter lists the supported handshakes, see
+// supportedHandshakes.
+func (p *stream) handshake(ctx context.Context, iden node.Identity, handshakes string) error {
 
 	//
 	// === EXCHANGE INIT MESSAGES ===
@@ -137,6 +167,11 @@ func (p *stream) handshake(ctx context.Context, iden node.Identity) error {
 		SupportedHashes:  &crypto.SupportedHashes,
 		SupportedCiphers: &crypto.SupportedCiphers,
 	}
+	if handshakes != "" {
+		localInit.SupportedHandshakes = &handshakes
+	}
+	protocolVersion := protocol.Version
+	localInit.ProtocolVersion = &protocolVersion
 
 	// Exchange Init messages
 	msg, err := p.exchangeMessages(ctx, localInit)
@@ -148,6 +183,10 @@ func (p *stream) handshake(ctx context.Context, iden node.Identity) error {
 		return errors.New("the received message is not Init")
 	}
 
+	// The Init messages are always encoded using the legacy version as
+	// the version of the remote node is not known yet.
+	p.protocolVersion = protocol.SelectVersion(remoteInit.GetProtocolVersion())
+
 	//
 	// === PROCESS INIT MESSAGES ===
 	//
@@ -172,13 +211,29 @@ func (p *stream) handshake(ctx context.Context, iden node.Identity) error {
 		return errors.New("peer claims to have the same id as the local node")
 	}
 
-	// Choose encryption params
-	var selectedCurve, selectedHash, selectedCipher string
 	// We need everything to be perfomed the same way on both sides.
 	order, err := utils.Compare(iden.Id, remoteId)
 	if err != nil {
 		return err
 	}
+
+	// Choose the handshake
+	switch selectHandshake(order, handshakes, remoteInit.GetSupportedHandshakes()) {
+	case handshakeNoise:
+		prologue := noisePrologue(order, localInit, remoteInit)
+		if err := p.noiseHandshake(ctx, iden, order, prologue, remotePub); err != nil {
+			return errors.Wrap(err, "noise handshake failed")
+		}
+		p.id = remoteId
+		p.pubKey = remotePub
+		return nil
+	case handshakeLegacy:
+	default:
+		return errors.New("could not select a handshake")
+	}
+
+	// Choose encryption params
+	var selectedCurve, selectedHash, selectedCipher string
 	if order > 0 {
 		selectedCurve = selectParam(crypto.SupportedCurves, remoteInit.GetSupportedCurves())
 		selectedHash = selectParam(crypto.SupportedHashes, remoteInit.GetSupportedHashes())
@@ -269,7 +324,7 @@ func (p *stream) handshake(ctx context.Context, iden node.Identity) error {
 	if err != nil {
 		return errors.Wrap(err, "could not create a secure encoder")
 	}
-	p.wrapper.AddLayer(layer)
+	p.addSecureLayer(order, layer, selectedCurve, selectedHash, selectedCipher, sharedSecret)
 
 	//
 	// === EXCHANGE CONFIRMHANDSHAKE MESSAGES ===
@@ -340,13 +395,27 @@ func (p *stream) handshake(ctx context.Context, iden node.Identity) error {
 	return nil
 }
 
-func (p *stream) identify(ctx context.Context, listenAddresses []string) error {
+func (p *stream) identify(ctx context.Context, listenAddresses []address.Address) error {
 	// Form Identity message.
 	remoteAddr := p.conn.RemoteAddr().String()
+	localVersion := version.Version
+	var localAddresses []string
+	for _, a := range listenAddresses {
+		// The nodes which don't report the protocol version expect
+		// the TCP addresses in the host:port format.
+		if p.protocolVersion == protocol.VersionLegacy {
+			if a.Transport == address.TCP && !a.IsRelay() {
+				localAddresses = append(localAddresses, a.HostPort())
+			}
+			continue
+		}
+		localAddresses = append(localAddresses, a.String())
+	}
 
 	localIdentify := &message.Identity{
-		ListenAddresses:   listenAddresses,
+		ListenAddresses:   localAddresses,
 		ConnectionAddress: &remoteAddr,
+		Version:           &localVersion,
 	}
 
 	// Exchange Identity messages.
@@ -360,6 +429,15 @@ func (p *stream) identify(ctx context.Context, listenAddresses []string) error {
 	}
 
 	// Process Identity message.
-	p.listenAddr = remoteIdentify.GetListenAddresses()
+	p.listenAddr = nil
+	for _, listenAddr := range remoteIdentify.GetListenAddresses() {
+		if a, err := address.Parse(listenAddr); err == nil {
+			p.listenAddr = append(p.listenAddr, a)
+		} else {
+			log.Debugf("identify: invalid listen address %s: %s", listenAddr, err)
+		}
+	}
+	p.version = remoteIdentify.GetVersion()
+	p.observedAddr = remoteIdentify.GetConnectionAddress()
 	return nil
 }
@@ -1,7 +1,22 @@
 package stream
 
 import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/mux"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 )
 
 func TestSelectParam(t *testing.T) {
@@ -32,3 +47,311 @@ func TestSelectParam(t *testing.T) {
 		t.Error("Invalid result", rv)
 	}
 }
+
+func TestNewSecure(t *testing.T) {
+	for _, cipherName := range strings.Split(crypto.SupportedCiphers, ",") {
+		k1, k2, err := crypto.StretchKey([]byte("secret"), []byte("salt"), "SHA256", cipherName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := newSecure(k1, k2, 1, 2, "SHA256", cipherName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := newSecure(k2, k1, 2, 1, "SHA256", cipherName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := &bytes.Buffer{}
+		if err := a.Encode(bytes.NewBufferString("data"), encoded); err != nil {
+			t.Fatal(err)
+		}
+		decoded := &bytes.Buffer{}
+		if err := b.Decode(encoded, decoded); err != nil {
+			t.Fatalf("%s: %s", cipherName, err)
+		}
+		if decoded.String() != "data" {
+			t.Fatalf("%s: invalid data", cipherName)
+		}
+	}
+}
+
+func TestSelectHandshake(t *testing.T) {
+	for _, order := range []int{1, -1} {
+		if rv := selectHandshake(order, supportedHandshakes, supportedHandshakes); rv != handshakeNoise {
+			t.Error("Invalid result", rv)
+		}
+		if rv := selectHandshake(order, supportedHandshakes, ""); rv != handshakeLegacy {
+			t.Error("Invalid result", rv)
+		}
+		if rv := selectHandshake(order, "", supportedHandshakes); rv != handshakeLegacy {
+			t.Error("Invalid result", rv)
+		}
+		if rv := selectHandshake(order, handshakeNoise, ""); rv != "" {
+			t.Error("Invalid result", rv)
+		}
+	}
+}
+
+var testIdentities []node.Identity
+var testIdentitiesOnce sync.Once
+
+func getTestIdentities(t *testing.T) (node.Identity, node.Identity) {
+	testIdentitiesOnce.Do(func() {
+		for i := 0; i < 2; i++ {
+			iden, err := node.GenerateIdentity(2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testIdentities = append(testIdentities, *iden)
+		}
+	})
+	if len(testIdentities) != 2 {
+		t.Fatal("Identities not generated")
+	}
+	return testIdentities[0], testIdentities[1]
+}
+
+// newTestStreams establishes the streams between the nodes which support the
+// given handshakes in the same way as New.
+func newTestStreams(ctx context.Context, t *testing.T, handshakesA, handshakesB string) (*stream, *stream, error) {
+	idenA, idenB := getTestIdentities(t)
+
+	connA, connB := net.Pipe()
+
+	bC := make(chan *stream, 1)
+	errC := make(chan error, 1)
+	go func() {
+		b, err := newStream(ctx, idenB, nil, connB, handshakesB)
+		if err != nil {
+			errC <- err
+			return
+		}
+		bC <- b
+	}()
+	a, err := newStream(ctx, idenA, nil, connA, handshakesA)
+	if err != nil {
+		connB.Close()
+		<-errC
+		return nil, nil, err
+	}
+	var b *stream
+	select {
+	case b = <-bC:
+	case err := <-errC:
+		a.Close()
+		return nil, nil, err
+	}
+
+	if !node.CompareId(a.id, idenB.Id) || !node.CompareId(b.id, idenA.Id) {
+		t.Fatal("Invalid ids")
+	}
+	return a, b, nil
+}
+
+// testHandshake performs a handshake between the nodes which support the
+// given handshakes and exchanges a message over the established streams.
+func testHandshake(t *testing.T, handshakesA, handshakesB string) error {
+	getTestIdentities(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, b, err := newTestStreams(ctx, t, handshakesA, handshakesB)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	defer b.Close()
+
+	random := uint32(10)
+	go a.SendWithContext(ctx, &message.Ping{Random: &random})
+	msg, err := b.ReceiveWithContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "receive failed")
+	}
+	if ping, ok := msg.(*message.Ping); !ok || ping.GetRandom() != random {
+		t.Fatal("Invalid message", msg)
+	}
+	return nil
+}
+
+func TestHandshakeNoise(t *testing.T) {
+	if err := testHandshake(t, supportedHandshakes, supportedHandshakes); err != nil {
+		t.Fatal(err)
+	}
+	if err := testHandshake(t, handshakeNoise, handshakeNoise); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHandshakeLegacy checks if the nodes can communicate with the nodes
+// which predate the Noise handshake and the protocol versions.
+func TestHandshakeLegacy(t *testing.T) {
+	idenA, idenB := getTestIdentities(t)
+	for _, idens := range [][]node.Identity{{idenA, idenB}, {idenB, idenA}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s, b, _ := newBaselineStream(ctx, t, idens[0], idens[1], nil)
+		if !node.CompareId(s.id, idens[1].Id) || !node.CompareId(b.id, idens[0].Id) {
+			t.Fatal("Invalid ids")
+		}
+		if err := exchangeBaseline(ctx, s, b); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		cancel()
+	}
+}
+
+// TestHandshakeLegacySelected checks if the nodes use the legacy handshake if
+// one of them doesn't support the Noise handshake.
+func TestHandshakeLegacySelected(t *testing.T) {
+	if err := testHandshake(t, supportedHandshakes, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := testHandshake(t, "", supportedHandshakes); err != nil {
+		t.Fatal(err)
+	}
+	if err := testHandshake(t, "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHandshakeProtocolVersion checks if the nodes negotiate the newest
+// protocol version.
+func TestHandshakeProtocolVersion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, handshakes := range []string{supportedHandshakes, ""} {
+		a, b, err := newTestStreams(ctx, t, handshakes, handshakes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+		b.Close()
+		if a.protocolVersion != protocol.Version || b.protocolVersion != protocol.Version {
+			t.Fatalf("%q: invalid protocol version %d %d", handshakes, a.protocolVersion, b.protocolVersion)
+		}
+	}
+}
+
+func TestHandshakeLegacyDisabled(t *testing.T) {
+	if err := testHandshake(t, handshakeNoise, ""); err == nil {
+		t.Fatal("Handshake should fail")
+	}
+}
+
+// TestNew checks if the streams created by New multiplex the messages and the
+// substreams.
+func TestNew(t *testing.T) {
+	idenA, idenB := getTestIdentities(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listenA, err := address.New(address.TCP, "10.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenB, err := address.New(address.QUIC, "10.0.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connA, connB := net.Pipe()
+	bC := make(chan Stream, 1)
+	errC := make(chan error, 1)
+	go func() {
+		b, err := New(ctx, idenB, []address.Address{listenB}, connB)
+		if err != nil {
+			errC <- err
+			return
+		}
+		bC <- b
+	}()
+	a, err := New(ctx, idenA, []address.Address{listenA}, connA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var b Stream
+	select {
+	case b = <-bC:
+	case err := <-errC:
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, s := range []Stream{a, b} {
+		if s.ProtocolVersion() != protocol.Version {
+			t.Fatal("Invalid protocol version", s.ProtocolVersion())
+		}
+		if s.(*stream).session == nil || s.(*stream).rekeyer == nil {
+			t.Fatal("Session not established")
+		}
+	}
+	if !node.CompareId(a.Info().Id, idenB.Id) || !node.CompareId(b.Info().Id, idenA.Id) {
+		t.Fatal("Invalid ids")
+	}
+	if addresses := a.Info().Addresses; len(addresses) != 1 || addresses[0] != listenB {
+		t.Fatal("Invalid addresses", addresses)
+	}
+	if addresses := b.Info().Addresses; len(addresses) != 1 || addresses[0] != listenA {
+		t.Fatal("Invalid addresses", addresses)
+	}
+
+	subC := make(chan mux.Substream, 1)
+	go func() {
+		sub, err := b.AcceptSubstream(ctx)
+		if err != nil {
+			errC <- err
+			return
+		}
+		subC <- sub
+	}()
+	sub, err := a.OpenSubstream(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	var accepted mux.Substream
+	select {
+	case accepted = <-subC:
+	case err := <-errC:
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if accepted.Protocol() != "test" {
+		t.Fatal("Invalid protocol", accepted.Protocol())
+	}
+
+	go func() {
+		_, err := sub.Write([]byte("data"))
+		errC <- err
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "data" {
+		t.Fatal("Invalid data", buf)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+
+	random := uint32(10)
+	go func() {
+		errC <- b.SendWithContext(ctx, &message.Ping{Random: &random})
+	}()
+	msg, err := a.ReceiveWithContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping, ok := msg.(*message.Ping); !ok || ping.GetRandom() != random {
+		t.Fatal("Invalid message", msg)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+}
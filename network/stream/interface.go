@@ -2,7 +2,9 @@ package stream
 
 import (
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/mux"
 	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 )
@@ -14,6 +16,25 @@ type Stream interface {
 	// PubKey returns the node's public key.
 	PubKey() crypto.PublicKey
 
+	// Version returns the version of the software reported by the node
+	// during the handshake. Returns an empty string if the node didn't
+	// report its version.
+	Version() string
+
+	// ObservedAddress returns the address of the local node as seen by
+	// the remote node, in the format used by the net package. It is
+	// reported by the remote node during the handshake and can't be
+	// trusted.
+	ObservedAddress() string
+
+	// RemoteAddress returns the address of the remote end of the
+	// underlying connection, in the format used by the net package.
+	RemoteAddress() string
+
+	// ProtocolVersion returns the protocol version negotiated during the
+	// handshake, see protocol.Version.
+	ProtocolVersion() uint32
+
 	// Send sends a message to the node.
 	Send(proto.Message) error
 
@@ -21,6 +42,11 @@ type Stream interface {
 	// the context is closed.
 	SendWithContext(context.Context, proto.Message) error
 
+	// SendEnvelope sends a message wrapped in an envelope to the node and
+	// returns an error if the context is closed. It is used to send
+	// requests and responses.
+	SendEnvelope(context.Context, protocol.Envelope) error
+
 	// Receive receives a message from the node.
 	Receive() (proto.Message, error)
 
@@ -28,6 +54,20 @@ type Stream interface {
 	// error if the context is closed.
 	ReceiveWithContext(context.Context) (proto.Message, error)
 
+	// ReceiveEnvelope receives a message from the node together with
+	// the envelope it was wrapped in and returns an error if the context is
+	// closed.
+	ReceiveEnvelope(context.Context) (protocol.Envelope, error)
+
+	// OpenSubstream opens a substream multiplexed over the same
+	// connection. The protocol is reported to the node. Returns
+	// ErrSubstreamsUnsupported if the node doesn't support the substreams.
+	OpenSubstream(ctx context.Context, protocol string) (mux.Substream, error)
+
+	// AcceptSubstream waits for a substream opened by the node. Returns
+	// ErrSubstreamsUnsupported if the node doesn't support the substreams.
+	AcceptSubstream(ctx context.Context) (mux.Substream, error)
+
 	// Close ends communication with the node, closes the underlying
 	// connection.
 	Close()
@@ -0,0 +1,214 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/node"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/boreq/starlight/transport/noise"
+	flynn "github.com/flynn/noise"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The names of the handshakes negotiated using the Init messages.
+const (
+	// handshakeNoise is the Noise XX handshake. The identity keys of the
+	// nodes are bound to the static Noise keys with signatures sent in
+	// the handshake payloads.
+	handshakeNoise = "NOISE-XX"
+
+	// handshakeLegacy is the original handshake which uses the Handshake
+	// and ConfirmHandshake messages.
+	handshakeLegacy = "LEGACY"
+)
+
+// supportedHandshakes lists the handshakes in the order of preference. The
+// nodes which don't report the supported handshakes in their Init messages
+// support only the legacy handshake. As a node can be tricked into using the
+// legacy handshake by removing the supported handshakes from the Init
+// messages, the legacy handshake should be removed from this list once the
+// nodes which don't support the Noise handshake are no longer in use.
+var supportedHandshakes = handshakeNoise + "," + handshakeLegacy
+
+// noiseCipherSuite is the cipher suite used by the Noise handshake.
+var noiseCipherSuite = flynn.NewCipherSuite(flynn.DH25519, flynn.CipherChaChaPoly, flynn.HashSHA256)
+
+// The parameters used to replace the keys of the streams established using the
+// Noise handshake.
+const (
+	noiseRekeyCurve  = "P256"
+	noiseRekeyHash   = "SHA256"
+	noiseRekeyCipher = "CHACHA20-POLY1305"
+)
+
+// noiseSignaturePrefix is prepended to the static Noise key before it is
+// signed with the identity key.
+const noiseSignaturePrefix = "starlight-noise-static-key:"
+
+// selectHandshake selects the handshake in the same way on both sides using
+// the lists of the supported handshakes. An empty list is equivalent to
+// supporting only the legacy handshake.
+func selectHandshake(order int, local, remote string) string {
+	if local == "" {
+		local = handshakeLegacy
+	}
+	if remote == "" {
+		remote = handshakeLegacy
+	}
+	if order > 0 {
+		return selectParam(local, remote)
+	}
+	return selectParam(remote, local)
+}
+
+// noisePrologue binds the contents of the Init messages to the Noise
+// handshake which fails if they were modified.
+func noisePrologue(order int, localInit, remoteInit *message.Init) []byte {
+	first, second := localInit, remoteInit
+	if order < 0 {
+		first, second = second, first
+	}
+
+	buf := &bytes.Buffer{}
+	for _, init := range []*message.Init{first, second} {
+		fields := [][]byte{
+			init.GetPubKey(),
+			init.GetNonce(),
+			[]byte(init.GetSupportedCurves()),
+			[]byte(init.GetSupportedHashes()),
+			[]byte(init.GetSupportedCiphers()),
+			[]byte(init.GetSupportedHandshakes()),
+		}
+		for _, field := range fields {
+			binary.Write(buf, binary.BigEndian, uint32(len(field)))
+			buf.Write(field)
+		}
+		binary.Write(buf, binary.BigEndian, init.GetProtocolVersion())
+	}
+	return buf.Bytes()
+}
+
+// noiseHandshake performs the Noise XX handshake and sets up the encoder. The
+// node with the higher id initiates the handshake. Each node proves that it
+// owns the identity key sent in its Init message by signing its static Noise
+// key and sending the signature in the handshake payload.
+func (p *stream) noiseHandshake(ctx context.Context, iden node.Identity, order int, prologue []byte, remotePub crypto.PublicKey) error {
+	staticKey, err := noiseCipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "could not generate a static key")
+	}
+
+	hs, err := flynn.NewHandshakeState(flynn.Config{
+		CipherSuite:   noiseCipherSuite,
+		Pattern:       flynn.HandshakeXX,
+		Initiator:     order > 0,
+		Prologue:      prologue,
+		StaticKeypair: staticKey,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not create the handshake state")
+	}
+
+	hash, err := crypto.GetCryptoHash("SHA256")
+	if err != nil {
+		return err
+	}
+	sig, err := iden.PrivKey.Sign(append([]byte(noiseSignaturePrefix), staticKey.Public...), hash)
+	if err != nil {
+		return errors.Wrap(err, "signing with the private key failed")
+	}
+
+	var local, remote *flynn.CipherState
+	if order > 0 {
+		// -> e
+		if _, _, err := p.writeNoise(ctx, hs, nil); err != nil {
+			return err
+		}
+		// <- e, ee, s, es
+		remoteSig, _, _, err := p.readNoise(ctx, hs)
+		if err != nil {
+			return err
+		}
+		if err := validateNoiseStatic(remotePub, hs.PeerStatic(), remoteSig); err != nil {
+			return err
+		}
+		// -> s, se
+		local, remote, err = p.writeNoise(ctx, hs, sig)
+		if err != nil {
+			return err
+		}
+	} else {
+		// -> e
+		if _, _, _, err := p.readNoise(ctx, hs); err != nil {
+			return err
+		}
+		// <- e, ee, s, es
+		if _, _, err := p.writeNoise(ctx, hs, sig); err != nil {
+			return err
+		}
+		// -> s, se
+		remoteSig, cs1, cs2, err := p.readNoise(ctx, hs)
+		if err != nil {
+			return err
+		}
+		if err := validateNoiseStatic(remotePub, hs.PeerStatic(), remoteSig); err != nil {
+			return err
+		}
+		local, remote = cs2, cs1
+	}
+
+	if local == nil || remote == nil {
+		return errors.New("handshake not completed")
+	}
+	layer := noise.New(remote, local)
+	p.addSecureLayer(order, layer, noiseRekeyCurve, noiseRekeyHash, noiseRekeyCipher, hs.ChannelBinding())
+	return nil
+}
+
+// validateNoiseStatic confirms that the static Noise key of the remote node
+// was signed with its identity key.
+func validateNoiseStatic(remotePub crypto.PublicKey, static, sig []byte) error {
+	hash, err := crypto.GetCryptoHash("SHA256")
+	if err != nil {
+		return err
+	}
+	if err := remotePub.Validate(append([]byte(noiseSignaturePrefix), static...), sig, hash); err != nil {
+		return errors.Wrap(err, "remote identity confirmation failed")
+	}
+	return nil
+}
+
+// writeNoise sends the next handshake message. The cipher states are returned
+// once the handshake is completed.
+func (p *stream) writeNoise(ctx context.Context, hs *flynn.HandshakeState, payload []byte) (*flynn.CipherState, *flynn.CipherState, error) {
+	data, cs1, cs2, err := hs.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create a handshake message")
+	}
+	if err := p.SendWithContext(ctx, &message.NoiseHandshake{Data: data}); err != nil {
+		return nil, nil, errors.Wrap(err, "could not send a handshake message")
+	}
+	return cs1, cs2, nil
+}
+
+// readNoise receives the next handshake message and returns its payload. The
+// cipher states are returned once the handshake is completed.
+func (p *stream) readNoise(ctx context.Context, hs *flynn.HandshakeState) ([]byte, *flynn.CipherState, *flynn.CipherState, error) {
+	msg, err := p.ReceiveWithContext(ctx)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "could not receive a handshake message")
+	}
+	noiseMsg, ok := msg.(*message.NoiseHandshake)
+	if !ok {
+		return nil, nil, nil, errors.New("received message is not NoiseHandshake")
+	}
+	payload, cs1, cs2, err := hs.ReadMessage(nil, noiseMsg.GetData())
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "invalid handshake message")
+	}
+	return payload, cs1, cs2, nil
+}
@@ -0,0 +1,351 @@
+package stream
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/boreq/starlight/transport"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// rekeyMessages specifies after sending how many messages using the same keys
+// the keys are replaced. It must be significantly lower than 2^32 as the
+// nonces used by the secure encoder would otherwise wrap.
+const rekeyMessages = 1 << 24
+
+// rekeyInterval specifies after how much time the keys are replaced if any
+// messages were sent using them.
+const rekeyInterval = 1 * time.Hour
+
+// After the handshake each raw message starts with a byte which specifies its
+// kind if both nodes support protocol.VersionMux.
+const (
+	rawMux byte = iota
+	rawRekey
+)
+
+// addSecureLayer adds the layer which encrypts the data after the handshake.
+// The keys are periodically replaced only if both nodes support it, see
+// protocol.VersionMux, otherwise the layer is used directly.
+func (p *stream) addSecureLayer(order int, layer transport.Layer, curve, hash, cipher string, chainingKey []byte) {
+	if p.protocolVersion < protocol.VersionMux {
+		p.wrapper.AddLayer(layer)
+		return
+	}
+	p.rekeyer = newRekeyer(p, order, layer, curve, hash, cipher, chainingKey)
+	p.wrapper.AddLayer(p.rekeyer)
+}
+
+func newRekeyer(p *stream, order int, layer transport.Layer, curve, hash, cipher string, chainingKey []byte) *rekeyer {
+	return &rekeyer{
+		p:           p,
+		order:       order,
+		curve:       curve,
+		hash:        hash,
+		cipher:      cipher,
+		chainingKey: chainingKey,
+		maxMessages: rekeyMessages,
+		interval:    rekeyInterval,
+		encoder:     layer,
+		decoder:     layer,
+		lastRekey:   time.Now(),
+	}
+}
+
+// rekeyer is a transport layer which encrypts the data using the keys which
+// are periodically replaced with the keys derived from a fresh ephemeral ECDH.
+//
+// Replacing the keys:
+//
+//	A -> B    RekeyRequest     A's ephemeral key.
+//	B -> A    RekeyResponse    B's ephemeral key, B switches its encoder.
+//	A -> B    RekeyConfirm     A switches its encoder.
+//
+// Each rekey message is the last message encrypted with the old keys in its
+// direction, the side which receives it switches its decoder. If both sides
+// send a request at the same time the request of the node with the higher id
+// is answered.
+type rekeyer struct {
+	p           *stream
+	order       int
+	curve       string
+	hash        string
+	cipher      string
+	chainingKey []byte
+	maxMessages uint64
+	interval    time.Duration
+
+	encoder transport.Layer
+	decoder transport.Layer
+
+	// nextEncoder is the encoder which will be used after the next
+	// message is encoded.
+	nextEncoder transport.Layer
+
+	// local is the ephemeral key sent in the request which awaits the
+	// response.
+	local crypto.EphemeralKey
+
+	// nextDecoder is the decoder which will be used after the
+	// confirmation is received.
+	nextDecoder transport.Layer
+
+	// switches is the number of the layers which still have to be
+	// switched before the current rekey is completed.
+	switches int
+
+	// starting is set when a rekey was started automatically and the
+	// request wasn't sent yet.
+	starting bool
+
+	sent      uint64
+	lastRekey time.Time
+	rekeys    int
+	mutex     sync.Mutex
+}
+
+// Encode encodes the data using the current encoder. The encoder is switched
+// right after the last message which uses it is encoded, before that message
+// is sent, so that the other side can't react to it earlier.
+func (r *rekeyer) Encode(reader io.Reader, w io.Writer) error {
+	r.mutex.Lock()
+	encoder, next := r.encoder, r.nextEncoder
+	r.mutex.Unlock()
+
+	if err := encoder.Encode(reader, w); err != nil {
+		return err
+	}
+
+	if next != nil {
+		r.mutex.Lock()
+		r.encoder = next
+		r.nextEncoder = nil
+		r.switched()
+		r.mutex.Unlock()
+	}
+	return nil
+}
+
+func (r *rekeyer) Decode(reader io.Reader, w io.Writer) error {
+	r.mutex.Lock()
+	decoder := r.decoder
+	r.mutex.Unlock()
+	return decoder.Decode(reader, w)
+}
+
+// rekey sends a request to replace the keys unless the keys are already being
+// replaced. The request is considered to be pending only once it is being
+// sent so that the other side always receives it before any response which
+// was sent after it was abandoned.
+func (r *rekeyer) rekey() error {
+	r.mutex.Lock()
+	inProgress := r.switches > 0
+	r.mutex.Unlock()
+	if inProgress {
+		return nil
+	}
+
+	key, pub, err := r.generate()
+	if err != nil {
+		return err
+	}
+	data, err := protocol.Encode(r.p.protocolVersion, protocol.Envelope{Message: &message.RekeyRequest{EphemeralPubKey: pub}})
+	if err != nil {
+		return errors.Wrap(err, "protocol encoding failed")
+	}
+	return r.p.sendRaw(rawRekey, data, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.switches > 0 {
+			return false
+		}
+		log.Debugf("%s rekey: sending a request", r.p.id)
+		r.local = key
+		r.switches = 2
+		return true
+	})
+}
+
+// messageSent is called after a message is sent using the current keys and
+// starts replacing them if they were used for too long.
+func (r *rekeyer) messageSent() {
+	r.mutex.Lock()
+	r.sent++
+	due := !r.starting && r.switches == 0 && (r.sent >= r.maxMessages || time.Since(r.lastRekey) >= r.interval)
+	if due {
+		r.starting = true
+	}
+	r.mutex.Unlock()
+
+	if due {
+		go func() {
+			if err := r.rekey(); err != nil {
+				log.Debugf("%s rekey: request failed: %s", r.p.id, err)
+			}
+			r.mutex.Lock()
+			r.starting = false
+			r.mutex.Unlock()
+		}()
+	}
+}
+
+// handle processes a received rekey message. The message is processed
+// before the next message is received so that the decoder is switched at the
+// message boundary. The messages are sent asynchronously as the receive loop
+// must not wait for the send operations.
+func (r *rekeyer) handle(data []byte) error {
+	env, err := protocol.Decode(r.p.protocolVersion, data)
+	if err != nil {
+		return errors.Wrap(err, "could not decode the message")
+	}
+
+	switch msg := env.Message.(type) {
+	case *message.RekeyRequest:
+		return r.handleRequest(msg)
+	case *message.RekeyResponse:
+		return r.handleResponse(msg)
+	case *message.RekeyConfirm:
+		return r.handleConfirm()
+	default:
+		return errors.Errorf("unexpected message %T", env.Message)
+	}
+}
+
+func (r *rekeyer) handleRequest(msg *message.RekeyRequest) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.local != nil {
+		if r.order > 0 {
+			// The other side will answer our request.
+			return nil
+		}
+		r.local = nil
+	} else if r.switches > 0 {
+		return errors.New("received a request during a rekey")
+	}
+
+	key, pub, err := r.generate()
+	if err != nil {
+		return err
+	}
+	layer, err := r.derive(key, msg.GetEphemeralPubKey())
+	if err != nil {
+		return err
+	}
+	r.nextDecoder = layer
+	r.switches = 2
+
+	go r.send(&message.RekeyResponse{EphemeralPubKey: pub}, layer)
+	return nil
+}
+
+func (r *rekeyer) handleResponse(msg *message.RekeyResponse) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.local == nil {
+		return errors.New("received an unexpected response")
+	}
+
+	layer, err := r.derive(r.local, msg.GetEphemeralPubKey())
+	if err != nil {
+		return err
+	}
+	r.local = nil
+	r.decoder = layer
+	r.switched()
+
+	go r.send(&message.RekeyConfirm{}, layer)
+	return nil
+}
+
+func (r *rekeyer) handleConfirm() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.nextDecoder == nil {
+		return errors.New("received an unexpected confirmation")
+	}
+	r.decoder = r.nextDecoder
+	r.nextDecoder = nil
+	r.switched()
+	return nil
+}
+
+// switched must be called after a layer is switched. Mutex must be locked
+// when calling this function.
+func (r *rekeyer) switched() {
+	r.switches--
+	if r.switches == 0 {
+		r.sent = 0
+		r.lastRekey = time.Now()
+		r.rekeys++
+		log.Debugf("%s rekey: completed", r.p.id)
+	}
+}
+
+// send sends a rekey message after which the messages are encoded using the
+// provided encoder.
+func (r *rekeyer) send(msg proto.Message, encoder transport.Layer) error {
+	data, err := protocol.Encode(r.p.protocolVersion, protocol.Envelope{Message: msg})
+	if err != nil {
+		return errors.Wrap(err, "protocol encoding failed")
+	}
+	return r.p.sendRaw(rawRekey, data, func() bool {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.nextEncoder = encoder
+		return true
+	})
+}
+
+// generate creates a new ephemeral key.
+func (r *rekeyer) generate() (crypto.EphemeralKey, []byte, error) {
+	curve, err := crypto.GetCurve(r.curve)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := crypto.GenerateEphemeralKeypair(curve)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate an ephemeral keypair")
+	}
+	pub, err := key.Bytes()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get the ephemeral key bytes")
+	}
+	return key, pub, nil
+}
+
+// derive creates a new layer using the shared secret and the chaining key
+// which is then replaced so that the new keys depend on all previous shared
+// secrets. Mutex must be locked when calling this function.
+func (r *rekeyer) derive(key crypto.EphemeralKey, remotePub []byte) (transport.Layer, error) {
+	secret, err := key.GenerateSharedSecret(remotePub)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate the shared secret")
+	}
+	k1, k2, err := crypto.StretchKey(secret, r.chainingKey, r.hash, r.cipher)
+	if err != nil {
+		return nil, errors.Wrap(err, "key stretching failed")
+	}
+	if r.order < 0 {
+		k2, k1 = k1, k2
+	}
+	layer, err := newSecure(k1, k2, 0, 0, r.hash, r.cipher)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create a secure encoder")
+	}
+
+	hash, err := crypto.GetHash(r.hash)
+	if err != nil {
+		return nil, err
+	}
+	r.chainingKey = crypto.Digest(hash, append(append([]byte{}, r.chainingKey...), secret...))
+	return layer, nil
+}
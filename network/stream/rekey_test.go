@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/boreq/starlight/protocol"
+	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// exchange sends the numbered messages and checks if the messages received
+// from the other side are numbered correctly.
+func exchange(ctx context.Context, p *stream, n int) error {
+	errC := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			data := make([]byte, 4)
+			binary.BigEndian.PutUint32(data, uint32(i))
+			if err := p.session.SendMessage(ctx, data); err != nil {
+				errC <- errors.Wrap(err, "send failed")
+				return
+			}
+		}
+		errC <- nil
+	}()
+
+	for i := 0; i < n; i++ {
+		data, err := p.session.ReceiveMessage(ctx)
+		if err != nil {
+			return errors.Wrap(err, "receive failed")
+		}
+		if len(data) != 4 || binary.BigEndian.Uint32(data) != uint32(i) {
+			return errors.Errorf("invalid message %d", i)
+		}
+	}
+	return <-errC
+}
+
+func rekeys(p *stream) int {
+	p.rekeyer.mutex.Lock()
+	defer p.rekeyer.mutex.Unlock()
+	return p.rekeyer.rekeys
+}
+
+// TestRekeyConcurrent replaces the keys while both sides are sending and
+// receiving messages. The rekeys are started by both sides, both
+// automatically and at the same time.
+func TestRekeyConcurrent(t *testing.T) {
+	const messages = 1000
+
+	getTestIdentities(t)
+	for _, handshakes := range []string{handshakeNoise, handshakeLegacy} {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		a, b, err := newTestStreams(ctx, t, handshakes, handshakes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []*stream{a, b} {
+			p.rekeyer.mutex.Lock()
+			p.rekeyer.maxMessages = 100
+			p.rekeyer.mutex.Unlock()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(5 * time.Millisecond):
+					go a.rekeyer.rekey()
+					go b.rekeyer.rekey()
+				}
+			}
+		}()
+
+		errC := make(chan error, 2)
+		go func() {
+			errC <- exchange(ctx, a, messages)
+		}()
+		go func() {
+			errC <- exchange(ctx, b, messages)
+		}()
+		for i := 0; i < 2; i++ {
+			if err := <-errC; err != nil {
+				t.Fatalf("%s: %s", handshakes, err)
+			}
+		}
+		close(done)
+
+		if rekeys(a) == 0 || rekeys(b) == 0 {
+			t.Fatalf("%s: keys were not replaced", handshakes)
+		}
+		if a.Closed() || b.Closed() {
+			t.Fatalf("%s: streams were closed", handshakes)
+		}
+
+		a.Close()
+		b.Close()
+		cancel()
+	}
+}
+
+func TestRekeyUnexpected(t *testing.T) {
+	for _, msg := range []proto.Message{&message.RekeyResponse{}, &message.RekeyConfirm{}} {
+		r := newRekeyer(&stream{protocolVersion: protocol.Version}, 1, nil, "P256", "SHA256", "AES-256-GCM", nil)
+		data, err := protocol.Encode(protocol.Version, protocol.Envelope{Message: msg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.handle(data); err == nil {
+			t.Fatalf("%T should be rejected", msg)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/network/address"
+	"github.com/boreq/starlight/network/mux"
 	"github.com/boreq/starlight/network/node"
 	"github.com/boreq/starlight/protocol"
 	"github.com/boreq/starlight/transport"
@@ -30,12 +32,25 @@ const maxMessageSize = 100 * size.Kilobyte
 
 var log = utils.GetLogger("stream")
 
+// ErrSubstreamsUnsupported is returned when the substreams are used with
+// a node which doesn't support them, see protocol.VersionMux.
+var ErrSubstreamsUnsupported = errors.New("substreams are not supported by the remote node")
+
 // New attempts to create a new stream using the provided connection. During that
 // process the handshake and other initialization will be performed. The
-// function accepts the identity of the local node and the listen address of
-// the local node (which is used to extract the port which the local node is
-// listening on).
-func New(ctx context.Context, iden node.Identity, listenAddresses []string, conn net.Conn) (Stream, error) {
+// function accepts the identity of the local node and the listen addresses of
+// the local node which are reported to the remote node.
+func New(ctx context.Context, iden node.Identity, listenAddresses []address.Address, conn net.Conn) (Stream, error) {
+	p, err := newStream(ctx, iden, listenAddresses, conn, supportedHandshakes)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newStream creates a new stream using one of the handshakes listed in the
+// handshakes parameter, see supportedHandshakes.
+func newStream(ctx context.Context, iden node.Identity, listenAddresses []address.Address, conn net.Conn, handshakes string) (*stream, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	p := &stream{
 		ctx:    ctx,
@@ -48,7 +63,7 @@ func New(ctx context.Context, iden node.Identity, listenAddresses []string, conn
 	hCtx, cancel := context.WithTimeout(p.ctx, handshakeTimeout)
 	defer cancel()
 
-	if err := p.handshake(hCtx, iden); err != nil {
+	if err := p.handshake(hCtx, iden, handshakes); err != nil {
 		p.Close()
 		log.Debugf("handshake error: %s", err)
 		return nil, errors.Wrap(err, "handshake error")
@@ -60,6 +75,22 @@ func New(ctx context.Context, iden node.Identity, listenAddresses []string, conn
 		return nil, errors.Wrap(err, "identify error")
 	}
 
+	// From now on the messages and the substreams are multiplexed over
+	// the connection if both nodes support it.
+	if p.protocolVersion < protocol.VersionMux {
+		return p, nil
+	}
+	order, err := utils.Compare(iden.Id, p.id)
+	if err != nil {
+		p.Close()
+		return nil, errors.Wrap(err, "could not compare the ids")
+	}
+	p.session = mux.New(&muxConn{p}, order > 0)
+	go func() {
+		<-p.session.Done()
+		p.Close()
+	}()
+
 	return p, nil
 }
 
@@ -69,48 +100,77 @@ type stream struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	conn         net.Conn
-	listenAddr   []string
+	listenAddr   []address.Address
+	version      string
+	observedAddr string
+
+	// protocolVersion is negotiated during the handshake, see
+	// protocol.Version.
+	protocolVersion uint32
+
 	wrapper      transport.Wrapper
+	session      *mux.Session
+	rekeyer      *rekeyer
 	sendMutex    sync.Mutex
 	receiveMutex sync.Mutex
 }
 
+// Info returns the addresses reported by the remote node. Unspecified and
+// loopback hosts are replaced with the host of the underlying connection,
+// other addresses such as DNS names or the external addresses created by the
+// NAT traversal are returned verbatim. Addresses using the same network as the
+// underlying connection are placed first since the node is known to be
+// reachable over it.
 func (p *stream) Info() node.NodeInfo {
 	rHost, _, _ := net.SplitHostPort(p.conn.RemoteAddr().String())
-	_, rPort, _ := net.SplitHostPort(p.getAppropriateListenAddr())
-	address := net.JoinHostPort(rHost, rPort)
-
-	return node.NodeInfo{
-		Id:      p.id,
-		Address: address,
-	}
-}
-
-func (p *stream) getAppropriateListenAddr() string {
-	remoteLocal, err := addrIsLocal(p.conn.RemoteAddr().String())
-	if err == nil {
-		for _, listenAddr := range p.listenAddr {
-			reportedLocal, err := addrIsLocal(listenAddr)
-			if err != nil {
+	network := p.conn.RemoteAddr().Network()
+
+	var same, other []address.Address
+	for _, a := range p.listenAddr {
+		if scope := a.Scope(); scope == address.ScopeUnspecified || scope == address.ScopeLoopback {
+			// The host of relayed connections is not an IP address
+			// of the node.
+			if net.ParseIP(rHost) == nil {
 				continue
 			}
-
-			if remoteLocal == reportedLocal {
-				return listenAddr
-			}
+			a = a.WithHost(rHost)
+		}
+		if address.Contains(same, a) || address.Contains(other, a) {
+			continue
+		}
+		if a.Network() == network {
+			same = append(same, a)
+		} else {
+			other = append(other, a)
 		}
 	}
 
-	if len(p.listenAddr) > 0 {
-		return p.listenAddr[0]
+	return node.NodeInfo{
+		Id:        p.id,
+		Addresses: append(same, other...),
 	}
-	return ""
 }
 
 func (p *stream) PubKey() crypto.PublicKey {
 	return p.pubKey
 }
 
+func (p *stream) Version() string {
+	return p.version
+}
+
+func (p *stream) ObservedAddress() string {
+	return p.observedAddr
+}
+
+func (p *stream) RemoteAddress() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *stream) ProtocolVersion() uint32 {
+	return p.protocolVersion
+}
+
 func (p *stream) Closed() bool {
 	select {
 	case <-p.ctx.Done():
@@ -123,18 +183,38 @@ func (p *stream) Closed() bool {
 func (p *stream) Close() {
 	p.cancel()
 	p.conn.Close()
+	if p.session != nil {
+		p.session.Close()
+	}
+}
+
+func (p *stream) OpenSubstream(ctx context.Context, protocol string) (mux.Substream, error) {
+	if p.session == nil {
+		return nil, ErrSubstreamsUnsupported
+	}
+	return p.session.Open(ctx, protocol)
+}
+
+func (p *stream) AcceptSubstream(ctx context.Context) (mux.Substream, error) {
+	if p.session == nil {
+		return nil, ErrSubstreamsUnsupported
+	}
+	return p.session.Accept(ctx)
 }
 
 func (p *stream) Send(msg proto.Message) error {
-	data, err := protocol.Encode(msg)
+	data, err := protocol.Encode(p.protocolVersion, protocol.Envelope{Message: msg})
 	if err != nil {
 		return errors.Wrap(err, "protocol encoding failed")
 	}
 	log.Debugf("%s sending %T (%d bytes)", p.id, msg, len(data))
+	if p.session != nil {
+		return p.session.SendMessage(context.Background(), data)
+	}
 	return p.send(data)
 }
 
-// send sends a raw message to the stream.
+// send sends a raw message to the stream bypassing the session.
 func (p *stream) send(data []byte) error {
 	p.sendMutex.Lock()
 	defer p.sendMutex.Unlock()
@@ -147,11 +227,15 @@ func (p *stream) send(data []byte) error {
 }
 
 func (p *stream) SendWithContext(ctx context.Context, msg proto.Message) error {
-	data, err := protocol.Encode(msg)
+	return p.SendEnvelope(ctx, protocol.Envelope{Message: msg})
+}
+
+func (p *stream) SendEnvelope(ctx context.Context, env protocol.Envelope) error {
+	data, err := protocol.Encode(p.protocolVersion, env)
 	if err != nil {
 		return errors.Wrap(err, "protocol encoding failed")
 	}
-	log.Debugf("%s sending with context %T (%d bytes)", p.id, msg, len(data))
+	log.Debugf("%s sending with context %T, request id %d (%d bytes)", p.id, env.Message, env.RequestId, len(data))
 	return p.sendWithContext(ctx, data)
 }
 
@@ -161,6 +245,10 @@ func (p *stream) SendWithContext(ctx context.Context, msg proto.Message) error {
 // the message is sent, so the function basically returns without confirming
 // that the data has been sent instead of aborting completely.
 func (p *stream) sendWithContext(ctx context.Context, data []byte) error {
+	if p.session != nil {
+		return p.session.SendMessage(ctx, data)
+	}
+
 	result := make(chan error)
 
 	go func() {
@@ -180,14 +268,18 @@ func (p *stream) sendWithContext(ctx context.Context, data []byte) error {
 }
 
 func (p *stream) Receive() (proto.Message, error) {
-	data, err := p.receive()
+	data, err := p.receiveWithContext(context.Background())
 	if err != nil {
 		return nil, errors.Wrap(err, "receive failed")
 	}
-	return protocol.Decode(data)
+	env, err := protocol.Decode(p.protocolVersion, data)
+	if err != nil {
+		return nil, err
+	}
+	return env.Message, nil
 }
 
-// receive receives a raw message from the peer.
+// receive receives a raw message from the peer bypassing the session.
 func (p *stream) receive() ([]byte, error) {
 	p.receiveMutex.Lock()
 	defer p.receiveMutex.Unlock()
@@ -200,11 +292,19 @@ func (p *stream) receive() ([]byte, error) {
 }
 
 func (p *stream) ReceiveWithContext(ctx context.Context) (proto.Message, error) {
+	env, err := p.ReceiveEnvelope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return env.Message, nil
+}
+
+func (p *stream) ReceiveEnvelope(ctx context.Context) (protocol.Envelope, error) {
 	data, err := p.receiveWithContext(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "receive with context failed")
+		return protocol.Envelope{}, errors.Wrap(err, "receive with context failed")
 	}
-	return protocol.Decode(data)
+	return protocol.Decode(p.protocolVersion, data)
 }
 
 // receiveWithContext attempts to receive a raw message from the peer.
@@ -216,6 +316,10 @@ func (p *stream) ReceiveWithContext(ctx context.Context) (proto.Message, error)
 // because it will either be during the handshake or because of the serious
 // protocol error which disconnects the the peer.
 func (p *stream) receiveWithContext(ctx context.Context) (data []byte, err error) {
+	if p.session != nil {
+		return p.session.ReceiveMessage(ctx)
+	}
+
 	result := make(chan []byte)
 	resultErr := make(chan error)
 
@@ -244,22 +348,55 @@ func (p *stream) receiveWithContext(ctx context.Context) (data []byte, err error
 	}
 }
 
-var localHosts = []string{
-	"",
-	"127.0.0.1",
-	"localhost",
-}
-
-func addrIsLocal(addr string) (bool, error) {
-	host, _, err := net.SplitHostPort(addr)
+// sendRaw sends a raw message of the given kind after the handshake. The
+// prepare function is called right before the message is sent, the message is
+// not sent if it returns false.
+func (p *stream) sendRaw(kind byte, data []byte, prepare func() bool) error {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	if prepare != nil && !prepare() {
+		return nil
+	}
+	err := p.wrapper.Send(append([]byte{kind}, data...))
 	if err != nil {
-		return false, err
+		log.Debugf("error on send %s, closing %s", err, p.id)
+		p.Close()
+		return errors.Wrap(err, "wrapper send failed")
+	}
+	if p.rekeyer != nil {
+		p.rekeyer.messageSent()
 	}
+	return nil
+}
+
+// muxConn sends and receives the frames of the session as raw messages. The
+// rekey messages are processed when they are received.
+type muxConn struct {
+	p *stream
+}
+
+func (c *muxConn) Send(data []byte) error {
+	return c.p.sendRaw(rawMux, data, nil)
+}
 
-	for _, localHost := range localHosts {
-		if host == localHost {
-			return true, nil
+func (c *muxConn) Receive() ([]byte, error) {
+	for {
+		data, err := c.p.receive()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, errors.New("empty message")
+		}
+		switch data[0] {
+		case rawMux:
+			return data[1:], nil
+		case rawRekey:
+			if err := c.p.rekeyer.handle(data[1:]); err != nil {
+				return nil, errors.Wrap(err, "rekey failed")
+			}
+		default:
+			return nil, errors.Errorf("unknown message kind %d", data[0])
 		}
 	}
-	return false, nil
 }
@@ -0,0 +1,198 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/context"
+)
+
+// quicProtocol is used during the TLS protocol negotiation.
+const quicProtocol = "starlight"
+
+// quicIdleTimeout specifies after how much time a connection is closed if
+// no packets were received. Keepalive packets are sent to prevent the
+// connections and the NAT mappings from timing out.
+const quicIdleTimeout = 60 * time.Second
+
+// NewQUIC creates a transport which uses QUIC. Each connection uses a single
+// QUIC stream. TLS is required by QUIC but the certificates are not verified,
+// the nodes are authenticated by the handshake performed by the streams
+// anyway.
+func NewQUIC() (Transport, error) {
+	cert, err := generateCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate a certificate")
+	}
+	rv := &quicTransport{
+		tlsConfig: &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			NextProtos:         []string{quicProtocol},
+			InsecureSkipVerify: true,
+		},
+		config: &quic.Config{
+			MaxIdleTimeout:  quicIdleTimeout,
+			KeepAlivePeriod: quicIdleTimeout / 2,
+		},
+	}
+	return rv, nil
+}
+
+type quicTransport struct {
+	tlsConfig *tls.Config
+	config    *quic.Config
+}
+
+func (t *quicTransport) Listen(hostPort string) (net.Listener, error) {
+	listener, err := quic.ListenAddr(hostPort, t.tlsConfig, t.config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rv := &quicListener{
+		listener: listener,
+		ctx:      ctx,
+		cancel:   cancel,
+		conns:    make(chan net.Conn),
+	}
+	go rv.run()
+	return rv, nil
+}
+
+func (t *quicTransport) Dial(ctx context.Context, hostPort string) (net.Conn, error) {
+	conn, err := quic.DialAddr(ctx, hostPort, t.tlsConfig, t.config)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, errors.Wrap(err, "could not open a stream")
+	}
+	return &quicConn{conn, stream}, nil
+}
+
+type quicListener struct {
+	listener *quic.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conns    chan net.Conn
+}
+
+// run accepts incoming connections and waits for the first stream in
+// a separate goroutine so that a single slow connection doesn't block the
+// others.
+func (l *quicListener) run() {
+	for {
+		conn, err := l.listener.Accept(l.ctx)
+		if err != nil {
+			l.cancel()
+			return
+		}
+		go func() {
+			stream, err := conn.AcceptStream(l.ctx)
+			if err != nil {
+				conn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case l.conns <- &quicConn{conn, stream}:
+			case <-l.ctx.Done():
+				conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.cancel()
+	return l.listener.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// quicConn implements net.Conn using a single stream of a QUIC connection.
+type quicConn struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	return c.stream.Read(b)
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	return c.stream.Write(b)
+}
+
+func (c *quicConn) Close() error {
+	c.stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+// generateCertificate generates a self-signed certificate.
+func generateCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: quicProtocol},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return cert, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package transport
+
+import (
+	"syscall"
+)
+
+const reuseSupported = false
+
+func reuseControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// NewTCP creates a transport which uses plain TCP connections. Outgoing
+// connections are established using the provided dialer. If punching is true
+// the listeners which listen on all interfaces allow the connections to be
+// dialed from their ports, see Puncher. Other listeners never share their
+// ports.
+func NewTCP(dialer Dialer, punching bool) Transport {
+	return &tcp{dialer, punching}
+}
+
+type tcp struct {
+	dialer   Dialer
+	punching bool
+}
+
+func (t *tcp) Listen(hostPort string) (net.Listener, error) {
+	lc := &net.ListenConfig{}
+	if t.punching && isUnspecified(hostPort) {
+		lc.Control = reuseControl
+	}
+	return lc.Listen(context.Background(), "tcp", hostPort)
+}
+
+func (t *tcp) Dial(ctx context.Context, hostPort string) (net.Conn, error) {
+	return t.dialer.DialContext(ctx, "tcp", hostPort)
+}
+
+// DialFrom implements Puncher. The dialer is bypassed since the connections
+// established through a proxy can't be used to punch holes.
+func (t *tcp) DialFrom(ctx context.Context, localPort int, hostPort string) (net.Conn, error) {
+	if !t.punching {
+		return nil, errors.New("hole punching is disabled")
+	}
+	if !reuseSupported {
+		return nil, errors.New("port reuse is not supported on this platform")
+	}
+	if _, ok := t.dialer.(*net.Dialer); !ok {
+		return nil, errors.New("can't be used with a proxy")
+	}
+	d := &net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: localPort},
+		Control:   reuseControl,
+	}
+	return d.DialContext(ctx, "tcp", hostPort)
+}
+
+// isUnspecified returns true if the address doesn't specify the host or
+// specifies an unspecified IP address.
+func isUnspecified(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
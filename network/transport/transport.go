@@ -0,0 +1,39 @@
+// Package transport implements the transports over which the network
+// establishes connections with other nodes. Each transport provides reliable
+// connections on top of which streams are created. It should not be confused
+// with the top level transport package which implements layers used by the
+// streams to send the messages over those connections.
+package transport
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+type Transport interface {
+	// Listen starts listening on the given address in the format used by
+	// the net package.
+	Listen(hostPort string) (net.Listener, error)
+
+	// Dial connects to the given address in the format used by the net
+	// package.
+	Dial(ctx context.Context, hostPort string) (net.Conn, error)
+}
+
+// Dialer establishes TCP connections. It is used by the transports so that
+// the outgoing connections can be routed through a proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Puncher is implemented by the transports which can be used for the hole
+// punching. Two nodes behind NATs can establish a direct connection if both of
+// them dial each other at the same time from the ports they are listening on,
+// which creates the mappings in both NATs.
+type Puncher interface {
+	// DialFrom connects to the given address in the format used by the
+	// net package from the given local port even if it is already used
+	// by a listener.
+	DialFrom(ctx context.Context, localPort int, hostPort string) (net.Conn, error)
+}
@@ -0,0 +1,179 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func testTransport(t *testing.T, transport Transport) {
+	listener, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	data := []byte("data")
+	errC := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errC <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			errC <- err
+			return
+		}
+		_, err = conn.Write(buf)
+		errC <- err
+
+		// Wait for the other side to close the connection so that
+		// the data isn't discarded.
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := transport.Dial(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Invalid data received")
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	testTransport(t, NewTCP(&net.Dialer{}, false))
+}
+
+func TestQUIC(t *testing.T) {
+	transport, err := NewQUIC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, transport)
+}
+
+func TestWebSocket(t *testing.T) {
+	transport, err := NewWebSocket(false, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, transport)
+}
+
+func TestWebSocketSecure(t *testing.T) {
+	transport, err := NewWebSocket(true, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, transport)
+}
+
+func TestTCPDialFrom(t *testing.T) {
+	if !reuseSupported {
+		t.Skip("port reuse is not supported")
+	}
+
+	transport := NewTCP(&net.Dialer{}, true)
+	local, err := transport.Listen(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go func() {
+		if conn, err := remote.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	localPort := local.Addr().(*net.TCPAddr).Port
+	conn, err := transport.(Puncher).DialFrom(ctx, localPort, remote.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().(*net.TCPAddr).Port != localPort {
+		t.Fatal("Connection was not dialed from the port of the listener", conn.LocalAddr())
+	}
+}
+
+func TestTCPDialFromProxy(t *testing.T) {
+	transport := NewTCP(proxyDialer{}, true)
+	if _, err := transport.(Puncher).DialFrom(context.Background(), 1836, "127.0.0.1:1836"); err == nil {
+		t.Fatal("Proxied transport should not punch holes")
+	}
+}
+
+func TestTCPDialFromDisabled(t *testing.T) {
+	transport := NewTCP(&net.Dialer{}, false)
+	if _, err := transport.(Puncher).DialFrom(context.Background(), 1836, "127.0.0.1:1836"); err == nil {
+		t.Fatal("Transport should not punch holes if hole punching is disabled")
+	}
+}
+
+func TestTCPListenReuse(t *testing.T) {
+	if !reuseSupported {
+		t.Skip("port reuse is not supported")
+	}
+
+	for _, punching := range []bool{true, false} {
+		transport := NewTCP(&net.Dialer{}, punching)
+		for _, hostPort := range []string{":0", "127.0.0.1:0"} {
+			listener, err := transport.Listen(hostPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			second, err := transport.Listen(net.JoinHostPort(listener.Addr().(*net.TCPAddr).IP.String(), strconv.Itoa(port)))
+			if err == nil {
+				second.Close()
+			}
+			listener.Close()
+
+			shared := punching && hostPort == ":0"
+			if shared != (err == nil) {
+				t.Fatalf("Punching %t, listening on %s: shared %t, error %v", punching, hostPort, shared, err)
+			}
+		}
+	}
+}
+
+type proxyDialer struct{}
+
+func (d proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.New("not implemented")
+}
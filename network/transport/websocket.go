@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// websocketPath is the path under which the nodes accept WebSocket
+// connections.
+const websocketPath = "/"
+
+// NewWebSocket creates a transport which uses WebSocket connections. This
+// transport is useful if only HTTP(S) traffic is permitted. If secure is true
+// TLS is used. Listening nodes use a self-signed certificate and certificates
+// are not verified when dialing, the nodes are authenticated by the handshake
+// performed by the streams anyway. Outgoing connections are established using
+// the provided dialer and respect the HTTP_PROXY and HTTPS_PROXY environment
+// variables.
+func NewWebSocket(secure bool, dialer Dialer) (Transport, error) {
+	rv := &websocketTransport{
+		secure: secure,
+		dialer: dialer,
+	}
+	if secure {
+		cert, err := generateCertificate()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not generate a certificate")
+		}
+		rv.tlsConfig = &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		}
+	}
+	return rv, nil
+}
+
+type websocketTransport struct {
+	secure    bool
+	dialer    Dialer
+	tlsConfig *tls.Config
+}
+
+func (t *websocketTransport) Listen(hostPort string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if t.secure {
+		listener = tls.NewListener(listener, t.tlsConfig)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rv := &websocketListener{
+		listener: listener,
+		ctx:      ctx,
+		cancel:   cancel,
+		conns:    make(chan net.Conn),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(websocketPath, websocket.Server{
+		Handler: rv.handle,
+		// Accept connections with any origin.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	})
+	rv.server = &http.Server{Handler: mux}
+	go func() {
+		rv.server.Serve(listener)
+		cancel()
+	}()
+	return rv, nil
+}
+
+func (t *websocketTransport) Dial(ctx context.Context, hostPort string) (net.Conn, error) {
+	scheme := "ws"
+	if t.secure {
+		scheme = "wss"
+	}
+	location := &url.URL{Scheme: scheme, Host: hostPort, Path: websocketPath}
+
+	conn, err := dialWithHTTPProxy(ctx, t.dialer, location)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abort the handshake if the context is closed.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if t.secure {
+		host, _, _ := net.SplitHostPort(hostPort)
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "TLS handshake failed")
+		}
+		conn = tlsConn
+	}
+
+	origin := &url.URL{Scheme: "http", Host: hostPort}
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not create a config")
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "WebSocket handshake failed")
+	}
+	conn.SetDeadline(time.Time{})
+	return newWebsocketConn(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// dialWithHTTPProxy establishes a TCP connection with the host specified in
+// the URL. If a proxy should be used for that URL according to the
+// environment variables the connection is established using the HTTP CONNECT
+// method.
+func dialWithHTTPProxy(ctx context.Context, dialer Dialer, location *url.URL) (net.Conn, error) {
+	req := &http.Request{URL: &url.URL{Scheme: "http", Host: location.Host}}
+	if location.Scheme == "wss" {
+		req.URL.Scheme = "https"
+	}
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy")
+	}
+
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", location.Host)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not dial the proxy")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: location.Host},
+		Host:   location.Host,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		connectReq.SetBasicAuth(proxyURL.User.Username(), password)
+		connectReq.Header.Set("Proxy-Authorization", connectReq.Header.Get("Authorization"))
+		connectReq.Header.Del("Authorization")
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not send the CONNECT request")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "could not read the CONNECT response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("proxy returned %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type websocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conns    chan net.Conn
+}
+
+// handle passes an incoming connection to Accept. The connection is closed by
+// the server when this function returns so it has to block until the
+// connection is closed.
+func (l *websocketListener) handle(ws *websocket.Conn) {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		return
+	}
+	conn := newWebsocketConn(ws, l.listener.Addr(), remoteAddr)
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		return
+	}
+	select {
+	case <-conn.closed:
+	case <-l.ctx.Done():
+	}
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *websocketListener) Close() error {
+	l.cancel()
+	return l.server.Close()
+}
+
+func (l *websocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// websocketConn sends the data in binary frames. The addresses returned by the
+// websocket.Conn are replaced with the addresses of the underlying connection.
+type websocketConn struct {
+	*websocket.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func newWebsocketConn(ws *websocket.Conn, localAddr, remoteAddr net.Addr) *websocketConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &websocketConn{
+		Conn:       ws,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		closed:     make(chan struct{}),
+	}
+}
+
+func (c *websocketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *websocketConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
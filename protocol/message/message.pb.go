@@ -23,6 +23,21 @@ It has these top-level messages:
 	FindPubKey
 	StoreChannel
 	FindChannel
+	ChannelMembers
+	RelayReserve
+	RelayReservation
+	RelayConnect
+	HolePunchConnect
+	HolePunchSync
+	NoiseHandshake
+	RekeyRequest
+	RekeyResponse
+	RekeyConfirm
+	Migration
+	IdentityBundle
+	Revocation
+	DeviceList
+	TrustList
 */
 package message
 
@@ -34,12 +49,14 @@ var _ = proto.Marshal
 var _ = math.Inf
 
 type Init struct {
-	PubKey           []byte  `protobuf:"bytes,1,req" json:"PubKey,omitempty"`
-	Nonce            []byte  `protobuf:"bytes,2,req" json:"Nonce,omitempty"`
-	SupportedCurves  *string `protobuf:"bytes,3,req" json:"SupportedCurves,omitempty"`
-	SupportedHashes  *string `protobuf:"bytes,4,req" json:"SupportedHashes,omitempty"`
-	SupportedCiphers *string `protobuf:"bytes,5,req" json:"SupportedCiphers,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	PubKey              []byte  `protobuf:"bytes,1,req" json:"PubKey,omitempty"`
+	Nonce               []byte  `protobuf:"bytes,2,req" json:"Nonce,omitempty"`
+	SupportedCurves     *string `protobuf:"bytes,3,req" json:"SupportedCurves,omitempty"`
+	SupportedHashes     *string `protobuf:"bytes,4,req" json:"SupportedHashes,omitempty"`
+	SupportedCiphers    *string `protobuf:"bytes,5,req" json:"SupportedCiphers,omitempty"`
+	SupportedHandshakes *string `protobuf:"bytes,6,opt" json:"SupportedHandshakes,omitempty"`
+	ProtocolVersion     *uint32 `protobuf:"varint,7,opt" json:"ProtocolVersion,omitempty"`
+	XXX_unrecognized    []byte  `json:"-"`
 }
 
 func (m *Init) Reset()         { *m = Init{} }
@@ -81,6 +98,20 @@ func (m *Init) GetSupportedCiphers() string {
 	return ""
 }
 
+func (m *Init) GetSupportedHandshakes() string {
+	if m != nil && m.SupportedHandshakes != nil {
+		return *m.SupportedHandshakes
+	}
+	return ""
+}
+
+func (m *Init) GetProtocolVersion() uint32 {
+	if m != nil && m.ProtocolVersion != nil {
+		return *m.ProtocolVersion
+	}
+	return 0
+}
+
 type Handshake struct {
 	EphemeralPubKey  []byte `protobuf:"bytes,1,req" json:"EphemeralPubKey,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -126,7 +157,9 @@ type Identity struct {
 	ListenAddresses []string `protobuf:"bytes,1,rep" json:"ListenAddresses,omitempty"`
 	// Apparent address of the other side of the connection.
 	ConnectionAddress *string `protobuf:"bytes,2,req" json:"ConnectionAddress,omitempty"`
-	XXX_unrecognized  []byte  `json:"-"`
+	// Version of the software run by the node.
+	Version          *string `protobuf:"bytes,3,opt" json:"Version,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *Identity) Reset()         { *m = Identity{} }
@@ -147,6 +180,13 @@ func (m *Identity) GetConnectionAddress() string {
 	return ""
 }
 
+func (m *Identity) GetVersion() string {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return ""
+}
+
 type Ping struct {
 	Random           *uint32 `protobuf:"varint,1,req" json:"Random,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -212,9 +252,12 @@ func (m *Nodes) GetNodes() []*Nodes_NodeInfo {
 }
 
 type Nodes_NodeInfo struct {
-	Id               []byte  `protobuf:"bytes,1,req" json:"Id,omitempty"`
-	Address          *string `protobuf:"bytes,2,req" json:"Address,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Id []byte `protobuf:"bytes,1,req" json:"Id,omitempty"`
+	// TCP address in the host:port format used by the nodes which
+	// don't support the Addresses field, empty if there is none.
+	Address          *string  `protobuf:"bytes,2,req" json:"Address,omitempty"`
+	Addresses        []string `protobuf:"bytes,3,rep" json:"Addresses,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *Nodes_NodeInfo) Reset()         { *m = Nodes_NodeInfo{} }
@@ -235,12 +278,21 @@ func (m *Nodes_NodeInfo) GetAddress() string {
 	return ""
 }
 
+func (m *Nodes_NodeInfo) GetAddresses() []string {
+	if m != nil {
+		return m.Addresses
+	}
+	return nil
+}
+
 type PrivateMessage struct {
-	TargetId         []byte  `protobuf:"bytes,1,req" json:"TargetId,omitempty"`
-	NodeId           []byte  `protobuf:"bytes,2,req" json:"NodeId,omitempty"`
-	Text             *string `protobuf:"bytes,3,req" json:"Text,omitempty"`
-	Nonce            *uint64 `protobuf:"fixed64,4,req" json:"Nonce,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	TargetId []byte  `protobuf:"bytes,1,req" json:"TargetId,omitempty"`
+	NodeId   []byte  `protobuf:"bytes,2,req" json:"NodeId,omitempty"`
+	Text     *string `protobuf:"bytes,3,req" json:"Text,omitempty"`
+	Nonce    *uint64 `protobuf:"fixed64,4,req" json:"Nonce,omitempty"`
+	// Device list proving that the sender is a device of a master identity.
+	DeviceList       *DeviceList `protobuf:"bytes,5,opt" json:"DeviceList,omitempty"`
+	XXX_unrecognized []byte      `json:"-"`
 }
 
 func (m *PrivateMessage) Reset()         { *m = PrivateMessage{} }
@@ -275,14 +327,23 @@ func (m *PrivateMessage) GetNonce() uint64 {
 	return 0
 }
 
+func (m *PrivateMessage) GetDeviceList() *DeviceList {
+	if m != nil {
+		return m.DeviceList
+	}
+	return nil
+}
+
 type ChannelMessage struct {
-	ChannelId        []byte  `protobuf:"bytes,1,req" json:"ChannelId,omitempty"`
-	NodeId           []byte  `protobuf:"bytes,2,req" json:"NodeId,omitempty"`
-	Timestamp        *int64  `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
-	Text             *string `protobuf:"bytes,4,req" json:"Text,omitempty"`
-	Nonce            *uint64 `protobuf:"fixed64,5,req" json:"Nonce,omitempty"`
-	Signature        []byte  `protobuf:"bytes,6,req" json:"Signature,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	ChannelId []byte  `protobuf:"bytes,1,req" json:"ChannelId,omitempty"`
+	NodeId    []byte  `protobuf:"bytes,2,req" json:"NodeId,omitempty"`
+	Timestamp *int64  `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
+	Text      *string `protobuf:"bytes,4,req" json:"Text,omitempty"`
+	Nonce     *uint64 `protobuf:"fixed64,5,req" json:"Nonce,omitempty"`
+	Signature []byte  `protobuf:"bytes,6,req" json:"Signature,omitempty"`
+	// Device list proving that the sender is a device of a master identity.
+	DeviceList       *DeviceList `protobuf:"bytes,7,opt" json:"DeviceList,omitempty"`
+	XXX_unrecognized []byte      `json:"-"`
 }
 
 func (m *ChannelMessage) Reset()         { *m = ChannelMessage{} }
@@ -331,9 +392,22 @@ func (m *ChannelMessage) GetSignature() []byte {
 	return nil
 }
 
+func (m *ChannelMessage) GetDeviceList() *DeviceList {
+	if m != nil {
+		return m.DeviceList
+	}
+	return nil
+}
+
 type StorePubKey struct {
-	Key              []byte `protobuf:"bytes,1,req" json:"Key,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	Key []byte `protobuf:"bytes,1,req" json:"Key,omitempty"`
+	// Revocation of the key which can be stored by any node.
+	Revocation *Revocation `protobuf:"bytes,2,opt" json:"Revocation,omitempty"`
+	// Device list signed with the key which can be stored by any node.
+	DeviceList *DeviceList `protobuf:"bytes,3,opt" json:"DeviceList,omitempty"`
+	// Trust list signed with the key which can be stored by any node.
+	TrustList        *TrustList `protobuf:"bytes,4,opt" json:"TrustList,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
 }
 
 func (m *StorePubKey) Reset()         { *m = StorePubKey{} }
@@ -347,6 +421,27 @@ func (m *StorePubKey) GetKey() []byte {
 	return nil
 }
 
+func (m *StorePubKey) GetRevocation() *Revocation {
+	if m != nil {
+		return m.Revocation
+	}
+	return nil
+}
+
+func (m *StorePubKey) GetDeviceList() *DeviceList {
+	if m != nil {
+		return m.DeviceList
+	}
+	return nil
+}
+
+func (m *StorePubKey) GetTrustList() *TrustList {
+	if m != nil {
+		return m.TrustList
+	}
+	return nil
+}
+
 type FindPubKey struct {
 	Id               []byte `protobuf:"bytes,1,req" json:"Id,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -418,3 +513,419 @@ func (m *FindChannel) GetChannelId() []byte {
 	}
 	return nil
 }
+
+type ChannelMembers struct {
+	Members          []*StoreChannel   `protobuf:"bytes,1,rep" json:"Members,omitempty"`
+	Nodes            []*Nodes_NodeInfo `protobuf:"bytes,2,rep" json:"Nodes,omitempty"`
+	XXX_unrecognized []byte            `json:"-"`
+}
+
+func (m *ChannelMembers) Reset()         { *m = ChannelMembers{} }
+func (m *ChannelMembers) String() string { return proto.CompactTextString(m) }
+func (*ChannelMembers) ProtoMessage()    {}
+
+func (m *ChannelMembers) GetMembers() []*StoreChannel {
+	if m != nil {
+		return m.Members
+	}
+	return nil
+}
+
+func (m *ChannelMembers) GetNodes() []*Nodes_NodeInfo {
+	if m != nil {
+		return m.Nodes
+	}
+	return nil
+}
+
+type RelayReserve struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RelayReserve) Reset()         { *m = RelayReserve{} }
+func (m *RelayReserve) String() string { return proto.CompactTextString(m) }
+func (*RelayReserve) ProtoMessage()    {}
+
+type RelayReservation struct {
+	Accepted         *bool  `protobuf:"varint,1,req" json:"Accepted,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RelayReservation) Reset()         { *m = RelayReservation{} }
+func (m *RelayReservation) String() string { return proto.CompactTextString(m) }
+func (*RelayReservation) ProtoMessage()    {}
+
+func (m *RelayReservation) GetAccepted() bool {
+	if m != nil && m.Accepted != nil {
+		return *m.Accepted
+	}
+	return false
+}
+
+type RelayConnect struct {
+	Token            []byte `protobuf:"bytes,1,req" json:"Token,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RelayConnect) Reset()         { *m = RelayConnect{} }
+func (m *RelayConnect) String() string { return proto.CompactTextString(m) }
+func (*RelayConnect) ProtoMessage()    {}
+
+func (m *RelayConnect) GetToken() []byte {
+	if m != nil {
+		return m.Token
+	}
+	return nil
+}
+
+type HolePunchConnect struct {
+	Target           []byte   `protobuf:"bytes,1,req" json:"Target,omitempty"`
+	Initiator        []byte   `protobuf:"bytes,2,opt" json:"Initiator,omitempty"`
+	Addresses        []string `protobuf:"bytes,3,rep" json:"Addresses,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *HolePunchConnect) Reset()         { *m = HolePunchConnect{} }
+func (m *HolePunchConnect) String() string { return proto.CompactTextString(m) }
+func (*HolePunchConnect) ProtoMessage()    {}
+
+func (m *HolePunchConnect) GetTarget() []byte {
+	if m != nil {
+		return m.Target
+	}
+	return nil
+}
+
+func (m *HolePunchConnect) GetInitiator() []byte {
+	if m != nil {
+		return m.Initiator
+	}
+	return nil
+}
+
+func (m *HolePunchConnect) GetAddresses() []string {
+	if m != nil {
+		return m.Addresses
+	}
+	return nil
+}
+
+type HolePunchSync struct {
+	Addresses        []string `protobuf:"bytes,1,rep" json:"Addresses,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *HolePunchSync) Reset()         { *m = HolePunchSync{} }
+func (m *HolePunchSync) String() string { return proto.CompactTextString(m) }
+func (*HolePunchSync) ProtoMessage()    {}
+
+func (m *HolePunchSync) GetAddresses() []string {
+	if m != nil {
+		return m.Addresses
+	}
+	return nil
+}
+
+type NoiseHandshake struct {
+	Data             []byte `protobuf:"bytes,1,req" json:"Data,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *NoiseHandshake) Reset()         { *m = NoiseHandshake{} }
+func (m *NoiseHandshake) String() string { return proto.CompactTextString(m) }
+func (*NoiseHandshake) ProtoMessage()    {}
+
+func (m *NoiseHandshake) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type RekeyRequest struct {
+	EphemeralPubKey  []byte `protobuf:"bytes,1,req" json:"EphemeralPubKey,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RekeyRequest) Reset()         { *m = RekeyRequest{} }
+func (m *RekeyRequest) String() string { return proto.CompactTextString(m) }
+func (*RekeyRequest) ProtoMessage()    {}
+
+func (m *RekeyRequest) GetEphemeralPubKey() []byte {
+	if m != nil {
+		return m.EphemeralPubKey
+	}
+	return nil
+}
+
+type RekeyResponse struct {
+	EphemeralPubKey  []byte `protobuf:"bytes,1,req" json:"EphemeralPubKey,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RekeyResponse) Reset()         { *m = RekeyResponse{} }
+func (m *RekeyResponse) String() string { return proto.CompactTextString(m) }
+func (*RekeyResponse) ProtoMessage()    {}
+
+func (m *RekeyResponse) GetEphemeralPubKey() []byte {
+	if m != nil {
+		return m.EphemeralPubKey
+	}
+	return nil
+}
+
+type RekeyConfirm struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *RekeyConfirm) Reset()         { *m = RekeyConfirm{} }
+func (m *RekeyConfirm) String() string { return proto.CompactTextString(m) }
+func (*RekeyConfirm) ProtoMessage()    {}
+
+type Migration struct {
+	OldKey           []byte `protobuf:"bytes,1,req" json:"OldKey,omitempty"`
+	NewKey           []byte `protobuf:"bytes,2,req" json:"NewKey,omitempty"`
+	Timestamp        *int64 `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
+	OldSignature     []byte `protobuf:"bytes,4,req" json:"OldSignature,omitempty"`
+	NewSignature     []byte `protobuf:"bytes,5,req" json:"NewSignature,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Migration) Reset()         { *m = Migration{} }
+func (m *Migration) String() string { return proto.CompactTextString(m) }
+func (*Migration) ProtoMessage()    {}
+
+func (m *Migration) GetOldKey() []byte {
+	if m != nil {
+		return m.OldKey
+	}
+	return nil
+}
+
+func (m *Migration) GetNewKey() []byte {
+	if m != nil {
+		return m.NewKey
+	}
+	return nil
+}
+
+func (m *Migration) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *Migration) GetOldSignature() []byte {
+	if m != nil {
+		return m.OldSignature
+	}
+	return nil
+}
+
+func (m *Migration) GetNewSignature() []byte {
+	if m != nil {
+		return m.NewSignature
+	}
+	return nil
+}
+
+type IdentityBundle struct {
+	Id               []byte  `protobuf:"bytes,1,req" json:"Id,omitempty"`
+	Kdf              *string `protobuf:"bytes,2,req" json:"Kdf,omitempty"`
+	ScryptN          *uint32 `protobuf:"varint,3,req" json:"ScryptN,omitempty"`
+	ScryptR          *uint32 `protobuf:"varint,4,req" json:"ScryptR,omitempty"`
+	ScryptP          *uint32 `protobuf:"varint,5,req" json:"ScryptP,omitempty"`
+	Salt             []byte  `protobuf:"bytes,6,req" json:"Salt,omitempty"`
+	Cipher           *string `protobuf:"bytes,7,req" json:"Cipher,omitempty"`
+	Nonce            []byte  `protobuf:"bytes,8,req" json:"Nonce,omitempty"`
+	Ciphertext       []byte  `protobuf:"bytes,9,req" json:"Ciphertext,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *IdentityBundle) Reset()         { *m = IdentityBundle{} }
+func (m *IdentityBundle) String() string { return proto.CompactTextString(m) }
+func (*IdentityBundle) ProtoMessage()    {}
+
+func (m *IdentityBundle) GetId() []byte {
+	if m != nil {
+		return m.Id
+	}
+	return nil
+}
+
+func (m *IdentityBundle) GetKdf() string {
+	if m != nil && m.Kdf != nil {
+		return *m.Kdf
+	}
+	return ""
+}
+
+func (m *IdentityBundle) GetScryptN() uint32 {
+	if m != nil && m.ScryptN != nil {
+		return *m.ScryptN
+	}
+	return 0
+}
+
+func (m *IdentityBundle) GetScryptR() uint32 {
+	if m != nil && m.ScryptR != nil {
+		return *m.ScryptR
+	}
+	return 0
+}
+
+func (m *IdentityBundle) GetScryptP() uint32 {
+	if m != nil && m.ScryptP != nil {
+		return *m.ScryptP
+	}
+	return 0
+}
+
+func (m *IdentityBundle) GetSalt() []byte {
+	if m != nil {
+		return m.Salt
+	}
+	return nil
+}
+
+func (m *IdentityBundle) GetCipher() string {
+	if m != nil && m.Cipher != nil {
+		return *m.Cipher
+	}
+	return ""
+}
+
+func (m *IdentityBundle) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *IdentityBundle) GetCiphertext() []byte {
+	if m != nil {
+		return m.Ciphertext
+	}
+	return nil
+}
+
+type Revocation struct {
+	Key              []byte `protobuf:"bytes,1,req" json:"Key,omitempty"`
+	SuccessorId      []byte `protobuf:"bytes,2,opt" json:"SuccessorId,omitempty"`
+	Timestamp        *int64 `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
+	Signature        []byte `protobuf:"bytes,4,req" json:"Signature,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Revocation) Reset()         { *m = Revocation{} }
+func (m *Revocation) String() string { return proto.CompactTextString(m) }
+func (*Revocation) ProtoMessage()    {}
+
+func (m *Revocation) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *Revocation) GetSuccessorId() []byte {
+	if m != nil {
+		return m.SuccessorId
+	}
+	return nil
+}
+
+func (m *Revocation) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *Revocation) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+type DeviceList struct {
+	MasterKey        []byte   `protobuf:"bytes,1,req" json:"MasterKey,omitempty"`
+	DeviceIds        [][]byte `protobuf:"bytes,2,rep" json:"DeviceIds,omitempty"`
+	Timestamp        *int64   `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
+	Signature        []byte   `protobuf:"bytes,4,req" json:"Signature,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *DeviceList) Reset()         { *m = DeviceList{} }
+func (m *DeviceList) String() string { return proto.CompactTextString(m) }
+func (*DeviceList) ProtoMessage()    {}
+
+func (m *DeviceList) GetMasterKey() []byte {
+	if m != nil {
+		return m.MasterKey
+	}
+	return nil
+}
+
+func (m *DeviceList) GetDeviceIds() [][]byte {
+	if m != nil {
+		return m.DeviceIds
+	}
+	return nil
+}
+
+func (m *DeviceList) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *DeviceList) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+type TrustList struct {
+	Key              []byte   `protobuf:"bytes,1,req" json:"Key,omitempty"`
+	TrustedIds       [][]byte `protobuf:"bytes,2,rep" json:"TrustedIds,omitempty"`
+	Timestamp        *int64   `protobuf:"varint,3,req" json:"Timestamp,omitempty"`
+	Signature        []byte   `protobuf:"bytes,4,req" json:"Signature,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *TrustList) Reset()         { *m = TrustList{} }
+func (m *TrustList) String() string { return proto.CompactTextString(m) }
+func (*TrustList) ProtoMessage()    {}
+
+func (m *TrustList) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *TrustList) GetTrustedIds() [][]byte {
+	if m != nil {
+		return m.TrustedIds
+	}
+	return nil
+}
+
+func (m *TrustList) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *TrustList) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
@@ -21,6 +21,16 @@ var cmdMap = map[reflect.Type]uint32{
 	reflect.TypeOf(message.FindPubKey{}):       12,
 	reflect.TypeOf(message.StoreChannel{}):     13,
 	reflect.TypeOf(message.FindChannel{}):      14,
+	reflect.TypeOf(message.ChannelMembers{}):   15,
+	reflect.TypeOf(message.RelayReserve{}):     16,
+	reflect.TypeOf(message.RelayReservation{}): 17,
+	reflect.TypeOf(message.RelayConnect{}):     18,
+	reflect.TypeOf(message.HolePunchConnect{}): 19,
+	reflect.TypeOf(message.HolePunchSync{}):    20,
+	reflect.TypeOf(message.NoiseHandshake{}):   21,
+	reflect.TypeOf(message.RekeyRequest{}):     22,
+	reflect.TypeOf(message.RekeyResponse{}):    23,
+	reflect.TypeOf(message.RekeyConfirm{}):     24,
 }
 
 // cmdEncode returns a value used in the protocol to indicate the type of a
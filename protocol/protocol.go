@@ -1,4 +1,14 @@
 // Package protocol handles encoding and decoding of protobuf messages.
+//
+// Structure of the encoded data:
+//     LEN      TYPE      DESCRIPTION
+//     4        uint32    Type of the message.
+//     1        uint8     Flags, see flagResponse. Since VersionEnvelope.
+//     8        uint64    Request id, zero if the message is not a request or a response. Since VersionEnvelope.
+//     ?        []byte    Protobuf encoded message.
+//
+// The version is negotiated during the handshake, the messages exchanged
+// before that are encoded using VersionLegacy.
 package protocol
 
 import (
@@ -13,12 +23,70 @@ import (
 var log = utils.GetLogger("protocol")
 var ErrUnknownMessageType = errors.New("unknown message type")
 
-// Encode converts a protobuf message into its wire format.
-func Encode(msg proto.Message) ([]byte, error) {
+// ErrRequestsUnsupported is returned when a request is encoded using a version
+// which doesn't support the request ids.
+var ErrRequestsUnsupported = errors.New("requests are not supported by this protocol version")
+
+const (
+	// VersionLegacy is the version used by the nodes which don't report
+	// the protocol version. The messages don't have the flags and the
+	// request ids.
+	VersionLegacy uint32 = 0
+
+	// VersionEnvelope introduced the flags and the request ids.
+	VersionEnvelope uint32 = 1
+
+	// VersionMux introduced the multiplexing of the messages and the
+	// substreams over a single connection and the periodic replacement of
+	// the session keys. The encoding of the messages is the same as in
+	// VersionEnvelope.
+	VersionMux uint32 = 2
+)
+
+// Version is the newest supported protocol version.
+const Version = VersionMux
+
+// SelectVersion returns the newest version supported by both nodes given the
+// version reported by the remote node.
+func SelectVersion(remote uint32) uint32 {
+	if remote < Version {
+		return remote
+	}
+	return Version
+}
+
+// flagResponse is set if the message is a response to a request.
+const flagResponse uint8 = 1 << 0
+
+// Envelope bundles a message with the data used to match responses with the
+// requests which caused them.
+type Envelope struct {
+	// RequestId identifies a request. It is equal to zero if the message
+	// is neither a request nor a response.
+	RequestId uint64
+
+	// Response is set if the message is a response to the request
+	// identified by RequestId.
+	Response bool
+
+	// Message is the actual message.
+	Message proto.Message
+}
+
+// Encode converts a protobuf message wrapped in an envelope into its wire
+// format using the given protocol version.
+func Encode(version uint32, env Envelope) ([]byte, error) {
+	if version > Version {
+		return nil, errors.New("unsupported protocol version")
+	}
+	if version < VersionEnvelope && env.RequestId != 0 {
+		return nil, ErrRequestsUnsupported
+	}
+
 	buf := &bytes.Buffer{}
 
 	// Command.
-	cmd, err := cmdEncode(msg)
+	cmd, err := cmdEncode(env.Message)
 	if err != nil {
 		return nil, err
 	}
@@ -26,8 +94,24 @@ func Encode(msg proto.Message) ([]byte, error) {
 		return nil, err
 	}
 
+	if version >= VersionEnvelope {
+		// Flags.
+		var flags uint8
+		if env.Response {
+			flags |= flagResponse
+		}
+		if err := binary.Write(buf, binary.BigEndian, flags); err != nil {
+			return nil, err
+		}
+
+		// Request id.
+		if err := binary.Write(buf, binary.BigEndian, env.RequestId); err != nil {
+			return nil, err
+		}
+	}
+
 	// Payload.
-	data, err := proto.Marshal(msg)
+	data, err := proto.Marshal(env.Message)
 	if err != nil {
 		return nil, err
 	}
@@ -36,14 +120,33 @@ func Encode(msg proto.Message) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Decode decodes a slice of bytes back into a protobuf message.
-func Decode(data []byte) (proto.Message, error) {
+// Decode decodes a slice of bytes encoded using the given protocol version back
+// into a protobuf message wrapped in an envelope.
+func Decode(version uint32, data []byte) (Envelope, error) {
+	if version > Version {
+		return Envelope{}, errors.New("unsupported protocol version")
+	}
+
 	buf := bytes.NewBuffer(data)
 
 	// Decode command type.
 	var cmd uint32
 	if err := binary.Read(buf, binary.BigEndian, &cmd); err != nil {
-		return nil, err
+		return Envelope{}, err
+	}
+
+	var flags uint8
+	var requestId uint64
+	if version >= VersionEnvelope {
+		// Decode flags.
+		if err := binary.Read(buf, binary.BigEndian, &flags); err != nil {
+			return Envelope{}, err
+		}
+
+		// Decode request id.
+		if err := binary.Read(buf, binary.BigEndian, &requestId); err != nil {
+			return Envelope{}, err
+		}
 	}
 
 	// Payload. Unfortunately the switch has to be hardcoded.
@@ -77,10 +180,38 @@ func Decode(data []byte) (proto.Message, error) {
 		msg = &message.StoreChannel{}
 	case 14:
 		msg = &message.FindChannel{}
+	case 15:
+		msg = &message.ChannelMembers{}
+	case 16:
+		msg = &message.RelayReserve{}
+	case 17:
+		msg = &message.RelayReservation{}
+	case 18:
+		msg = &message.RelayConnect{}
+	case 19:
+		msg = &message.HolePunchConnect{}
+	case 20:
+		msg = &message.HolePunchSync{}
+	case 21:
+		msg = &message.NoiseHandshake{}
+	case 22:
+		msg = &message.RekeyRequest{}
+	case 23:
+		msg = &message.RekeyResponse{}
+	case 24:
+		msg = &message.RekeyConfirm{}
 	default:
 		log.Debugf("Decode: unknown message type %d", cmd)
-		return nil, ErrUnknownMessageType
+		return Envelope{}, ErrUnknownMessageType
+	}
+	if err := proto.Unmarshal(buf.Bytes(), msg); err != nil {
+		return Envelope{}, err
+	}
+
+	env := Envelope{
+		RequestId: requestId,
+		Response:  flags&flagResponse != 0,
+		Message:   msg,
 	}
-	err := proto.Unmarshal(buf.Bytes(), msg)
-	return msg, err
+	return env, nil
 }
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"github.com/boreq/starlight/protocol/message"
+	"github.com/golang/protobuf/proto"
 	"testing"
 )
 
@@ -13,17 +14,84 @@ func TestEncode(t *testing.T) {
 	}
 
 	// Encode.
-	b, err := Encode(msg)
+	b, err := Encode(Version, Envelope{Message: msg})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Decode.
-	dMsg, err := Decode(b)
+	env, err := Decode(Version, b)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if pMsg, ok := dMsg.(*message.Ping); !ok || *pMsg.Random != pingRandom {
+	if pMsg, ok := env.Message.(*message.Ping); !ok || *pMsg.Random != pingRandom {
 		t.Fatal("Invalid message decoded")
 	}
+	if env.RequestId != 0 || env.Response {
+		t.Fatal("Invalid envelope decoded")
+	}
+}
+
+func TestEncodeRequestId(t *testing.T) {
+	var pongRandom uint32 = 10
+
+	msg := &message.Pong{
+		Random: &pongRandom,
+	}
+
+	b, err := Encode(Version, Envelope{RequestId: 123, Response: true, Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := Decode(Version, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pMsg, ok := env.Message.(*message.Pong); !ok || *pMsg.Random != pongRandom {
+		t.Fatal("Invalid message decoded")
+	}
+	if env.RequestId != 123 || !env.Response {
+		t.Fatal("Invalid envelope decoded", env.RequestId, env.Response)
+	}
+}
+
+func TestEncodeLegacy(t *testing.T) {
+	var pingRandom uint32 = 10
+
+	msg := &message.Ping{
+		Random: &pingRandom,
+	}
+
+	b, err := Encode(VersionLegacy, Envelope{Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 4+proto.Size(msg) {
+		t.Fatal("Legacy messages should contain only the type and the payload", len(b))
+	}
+
+	env, err := Decode(VersionLegacy, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pMsg, ok := env.Message.(*message.Ping); !ok || *pMsg.Random != pingRandom {
+		t.Fatal("Invalid message decoded")
+	}
+
+	if _, err := Encode(VersionLegacy, Envelope{RequestId: 123, Message: msg}); err != ErrRequestsUnsupported {
+		t.Fatal("Requests should be rejected", err)
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+	if v := SelectVersion(VersionLegacy); v != VersionLegacy {
+		t.Fatal("Invalid version", v)
+	}
+	if v := SelectVersion(Version); v != Version {
+		t.Fatal("Invalid version", v)
+	}
+	if v := SelectVersion(Version + 1); v != Version {
+		t.Fatal("Invalid version", v)
+	}
 }
@@ -0,0 +1,141 @@
+// Package aead implements a transport layer which provides encryption and
+// integrity checks using an authenticated encryption cipher. The nonces are
+// not sent, instead each side derives them from the IV and the number of
+// messages which were already sent in the given direction. As a result the
+// messages which were replayed, reordered or dropped fail authentication.
+//
+// Structure of the sent data:
+//
+//	size-?   []byte    Encrypted payload.
+//	?        []byte    Authentication tag, length depends on the cipher.
+package aead
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+
+	"github.com/boreq/starlight/transport"
+	"github.com/boreq/starlight/utils"
+	"github.com/pkg/errors"
+)
+
+var log = utils.GetLogger("transport/aead")
+
+// ErrAuthentication is returned when a received message can't be decrypted.
+// The reason of the failure is deliberately not reported.
+var ErrAuthentication = errors.New("message authentication failed")
+
+// New creates a layer which encrypts the data using the encoder cipher and
+// decrypts the data using the decoder cipher. The length of the IVs must be
+// equal to the nonce size of the ciphers.
+func New(decoderCipher, encoderCipher cipher.AEAD, decoderIV, encoderIV []byte) (transport.Layer, error) {
+	dec, err := newNonces(decoderCipher, decoderIV)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid decoder IV")
+	}
+	enc, err := newNonces(encoderCipher, encoderIV)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encoder IV")
+	}
+	rv := &aead{
+		encoder:   encoderCipher,
+		decoder:   decoderCipher,
+		encNonces: enc,
+		decNonces: dec,
+	}
+	return rv, nil
+}
+
+type aead struct {
+	encoder   cipher.AEAD
+	decoder   cipher.AEAD
+	encNonces *nonces
+	decNonces *nonces
+}
+
+func (a *aead) Encode(r io.Reader, w io.Writer) error {
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+
+	nonce, err := a.encNonces.current()
+	if err != nil {
+		return err
+	}
+	a.encNonces.next()
+
+	data := a.encoder.Seal(buf.Bytes()[:0], nonce, buf.Bytes(), nil)
+	n, err := w.Write(data)
+	if err != nil {
+		return err
+	}
+	log.Debugf("written %d bytes", n)
+	return nil
+}
+
+func (a *aead) Decode(r io.Reader, w io.Writer) error {
+	buf := &bytes.Buffer{}
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return err
+	}
+	log.Debugf("received %d bytes", n)
+
+	nonce, err := a.decNonces.current()
+	if err != nil {
+		return err
+	}
+	data, err := a.decoder.Open(buf.Bytes()[:0], nonce, buf.Bytes(), nil)
+	if err != nil {
+		return ErrAuthentication
+	}
+	a.decNonces.next()
+
+	_, err = w.Write(data)
+	return err
+}
+
+func newNonces(c cipher.AEAD, iv []byte) (*nonces, error) {
+	if len(iv) != c.NonceSize() || len(iv) < 8 {
+		return nil, errors.Errorf("IV must be %d bytes long", c.NonceSize())
+	}
+	rv := &nonces{
+		iv: make([]byte, len(iv)),
+	}
+	copy(rv.iv, iv)
+	return rv, nil
+}
+
+// nonces generates the nonces by XORing the IV with a message counter.
+type nonces struct {
+	iv        []byte
+	counter   uint64
+	exhausted bool
+}
+
+// current returns the nonce which should be used for the next message.
+func (n *nonces) current() ([]byte, error) {
+	if n.exhausted {
+		return nil, errors.New("nonces exhausted")
+	}
+	nonce := make([]byte, len(n.iv))
+	copy(nonce, n.iv)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, n.counter)
+	offset := len(nonce) - len(counter)
+	for i := range counter {
+		nonce[offset+i] ^= counter[i]
+	}
+	return nonce, nil
+}
+
+// next advances the counter after a message was processed.
+func (n *nonces) next() {
+	n.counter++
+	if n.counter == 0 {
+		n.exhausted = true
+	}
+}
@@ -0,0 +1,119 @@
+package aead
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/boreq/starlight/crypto"
+	"github.com/boreq/starlight/transport"
+)
+
+var ciphers = []string{"CHACHA20-POLY1305", "AES-256-GCM", "AES-128-GCM"}
+
+// get returns two layers which communicate with each other.
+func get(t *testing.T, cipherName string) (a, b transport.Layer) {
+	k1, k2, err := crypto.StretchKey([]byte("a"), []byte("a"), "SHA256", cipherName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCipher := func(key []byte) cipher.AEAD {
+		c, err := crypto.GetAEAD(cipherName, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	a, err = New(newCipher(k2.CipherKey), newCipher(k1.CipherKey), k2.IV, k1.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = New(newCipher(k1.CipherKey), newCipher(k2.CipherKey), k1.IV, k2.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func encode(t *testing.T, l transport.Layer, data []byte) []byte {
+	out := &bytes.Buffer{}
+	if err := l.Encode(bytes.NewBuffer(data), out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decode(l transport.Layer, data []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	err := l.Decode(bytes.NewBuffer(data), out)
+	return out.Bytes(), err
+}
+
+func TestAEAD(t *testing.T) {
+	for _, cipherName := range ciphers {
+		a, b := get(t, cipherName)
+		for _, data := range [][]byte{[]byte("data"), []byte{}, []byte("more data")} {
+			encoded := encode(t, a, data)
+			if bytes.Contains(encoded, data) && len(data) > 0 {
+				t.Fatalf("%s: data was not encrypted", cipherName)
+			}
+			decoded, err := decode(b, encoded)
+			if err != nil {
+				t.Fatalf("%s: %s", cipherName, err)
+			}
+			if !bytes.Equal(data, decoded) {
+				t.Fatalf("%s: decoded data is different", cipherName)
+			}
+		}
+	}
+}
+
+// TestAEADDirection checks if a side can't decode its own messages.
+func TestAEADDirection(t *testing.T) {
+	a, _ := get(t, ciphers[0])
+	if _, err := decode(a, encode(t, a, []byte("data"))); err != ErrAuthentication {
+		t.Fatal("Decoding should fail", err)
+	}
+}
+
+func TestAEADTampered(t *testing.T) {
+	a, b := get(t, ciphers[0])
+	encoded := encode(t, a, []byte("data"))
+	encoded[0] ^= 1
+	if _, err := decode(b, encoded); err != ErrAuthentication {
+		t.Fatal("Decoding should fail", err)
+	}
+}
+
+func TestAEADReplay(t *testing.T) {
+	a, b := get(t, ciphers[0])
+	first := encode(t, a, []byte("first"))
+	second := encode(t, a, []byte("second"))
+
+	// Reordered.
+	if _, err := decode(b, second); err != ErrAuthentication {
+		t.Fatal("Decoding should fail", err)
+	}
+
+	// A failed message doesn't advance the counter.
+	if _, err := decode(b, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replayed.
+	if _, err := decode(b, first); err != ErrAuthentication {
+		t.Fatal("Decoding should fail", err)
+	}
+}
+
+func TestAEADInvalidIV(t *testing.T) {
+	c, err := crypto.GetAEAD(ciphers[0], make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(c, c, make([]byte, 12), make([]byte, 16)); err == nil {
+		t.Fatal("Creating the layer should fail")
+	}
+}
@@ -0,0 +1,79 @@
+// Package noise implements a transport layer which provides encryption and
+// integrity checks using the cipher states established by a Noise handshake.
+// The nonces are kept by the cipher states and are not sent so the messages
+// must be decrypted in the order in which they were sent.
+//
+// Unlike the transport messages defined by the Noise specification the
+// messages are not limited to 65535 bytes, their size is limited by the layer
+// which frames them instead.
+//
+// Structure of the sent data:
+//
+//	size-16  []byte    Encrypted payload.
+//	16       []byte    Authentication tag.
+package noise
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/boreq/starlight/transport"
+	"github.com/boreq/starlight/utils"
+	flynn "github.com/flynn/noise"
+	"github.com/pkg/errors"
+)
+
+var log = utils.GetLogger("transport/noise")
+
+// ErrAuthentication is returned when a received message can't be decrypted.
+// The reason of the failure is deliberately not reported.
+var ErrAuthentication = errors.New("message authentication failed")
+
+// New creates a layer which encrypts the data using the encoder cipher state
+// and decrypts the data using the decoder cipher state.
+func New(decoder, encoder *flynn.CipherState) transport.Layer {
+	rv := &noise{
+		encoder: encoder,
+		decoder: decoder,
+	}
+	return rv
+}
+
+type noise struct {
+	encoder *flynn.CipherState
+	decoder *flynn.CipherState
+}
+
+func (n *noise) Encode(r io.Reader, w io.Writer) error {
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+
+	data, err := n.encoder.Encrypt(nil, nil, buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "encryption failed")
+	}
+	written, err := w.Write(data)
+	if err != nil {
+		return err
+	}
+	log.Debugf("written %d bytes", written)
+	return nil
+}
+
+func (n *noise) Decode(r io.Reader, w io.Writer) error {
+	buf := &bytes.Buffer{}
+	received, err := buf.ReadFrom(r)
+	if err != nil {
+		return err
+	}
+	log.Debugf("received %d bytes", received)
+
+	data, err := n.decoder.Decrypt(nil, nil, buf.Bytes())
+	if err != nil {
+		return ErrAuthentication
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -1,6 +1,7 @@
 // Package secure implements a transport layer which provides encryption and
 // integrity checks. Data is sent encrypted, with a nonce and an HMAC confirming
-// its integrity added.
+// its integrity added. This layer is used only with the nodes which don't
+// support the AEAD ciphers, see the aead package.
 //
 // Structure of the sent data:
 //      ?        []byte    Payload HMAC, length depends on the hash type.
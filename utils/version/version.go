@@ -0,0 +1,6 @@
+// Package version holds the version of the program.
+package version
+
+// Version is reported to other nodes during the handshake. It can be
+// overridden during the build using the -ldflags "-X" flag.
+var Version = "0.1.0-dev"